@@ -6,18 +6,505 @@ load_pubkey() {
   (jq -r '.source.private_key // empty' < $1) > $private_key_path
 
   if [ -s $private_key_path ]; then
-    chmod 0600 $private_key_path
+    add_private_key $private_key_path $1
+  fi
+}
+
+add_private_key() {
+  local private_key_path=$1
+  local payload=$2
 
+  chmod 0600 $private_key_path
+
+  if [ -z "$ssh_agent_started" ]; then
     eval $(ssh-agent) >/dev/null 2>&1
     trap "kill $SSH_AGENT_PID" 0
+    ssh_agent_started=true
+  fi
 
-    ssh-add $private_key_path >/dev/null 2>&1
+  ssh-add $private_key_path >/dev/null 2>&1
 
-    mkdir -p ~/.ssh
+  mkdir -p ~/.ssh
+
+  # ssh takes the first value it finds for each setting, so appending keeps
+  # whatever the image's own config says
+  if [ "$(jq -r '.source.inherit_git_config // false' < $payload)" = "true" ] && [ -f ~/.ssh/config ]; then
+    cat >> ~/.ssh/config <<EOF
+
+Host *
+  StrictHostKeyChecking no
+  LogLevel quiet
+EOF
+  else
     cat > ~/.ssh/config <<EOF
 StrictHostKeyChecking no
 LogLevel quiet
 EOF
-    chmod 0600 ~/.ssh/config
+  fi
+  chmod 0600 ~/.ssh/config
+}
+
+# reaches SSH remotes on source.port, for scp-like uris such as
+# git@host:org/repo.git that have no way to give one, and verifies their host
+# keys against source.known_hosts rather than whichever the image knows;
+# mirrors sshEnv in the out resource
+load_ssh_options() {
+  local payload=$1
+  local known_hosts_path=$TMPDIR/git-resource-known-hosts
+  local options=""
+
+  if [ -n "$(jq -r '.source.known_hosts // empty' < $payload)" ]; then
+    jq -r '.source.known_hosts' < $payload > $known_hosts_path
+    options="$options -o UserKnownHostsFile=$known_hosts_path"
+  fi
+
+  local checking=$(jq -r '
+    .source.strict_host_key_checking // "" as $checking |
+    if $checking == "" and (.source.known_hosts // "") != "" then "yes" else $checking end
+  ' < $payload)
+
+  # a rejected host key is otherwise failed silently
+  if [ -n "$checking" ]; then
+    options="$options -o StrictHostKeyChecking=$checking -o LogLevel=ERROR"
+  fi
+
+  local port=$(jq -r '.source.port // empty' < $payload)
+  if [ -n "$port" ]; then
+    options="$options -p $port"
+  fi
+
+  if [ -n "$options" ]; then
+    export GIT_SSH_COMMAND="${GIT_SSH_COMMAND:-ssh}$options"
+  fi
+}
+
+# verifies HTTPS remotes against source.ca_cert, for servers with a private
+# certificate authority; GIT_SSL_CAINFO is git's environment equivalent of
+# http.sslCAInfo, which takes precedence over a bundle the image sets up.
+# Mirrors caCertEnv in the out resource
+load_ca_cert() {
+  local ca_cert_path=$TMPDIR/git-resource-ca-cert
+
+  if [ -z "$(jq -r '.source.ca_cert // empty' < $1)" ]; then
+    return 0
+  fi
+
+  jq -r '.source.ca_cert' < $1 > $ca_cert_path
+  export GIT_SSL_CAINFO=$ca_cert_path
+}
+
+# lets git defer to a credential helper or askpass program that is already
+# available in the image instead of static credentials in the source
+load_credentials() {
+  local credential_helper=$(jq -r '.source.credential_helper // empty' < $1)
+  local askpass=$(jq -r '.source.askpass // empty' < $1)
+
+  if [ -n "$credential_helper" ]; then
+    # scoped to this process rather than written to the global config, so a
+    # helper removed from the source stops being used
+    local index=${GIT_CONFIG_COUNT:-0}
+    export GIT_CONFIG_KEY_$index=credential.helper
+    export GIT_CONFIG_VALUE_$index="$credential_helper"
+    export GIT_CONFIG_COUNT=$((index + 1))
+  fi
+
+  if [ -n "$askpass" ]; then
+    if [ ! -x "$askpass" ]; then
+      echo "invalid payload: source.askpass \"$askpass\" is not an executable file"
+      exit 1
+    fi
+
+    export GIT_ASKPASS="$askpass"
+  fi
+}
+
+# asks the remote for git protocol version 2 unless the source says otherwise,
+# which only advertises the refs that are asked for
+load_protocol_version() {
+  local version=$(jq -r '.source.protocol_version // 0 | if . == 0 then 2 else . end' < $1)
+
+  local index=${GIT_CONFIG_COUNT:-0}
+  export GIT_CONFIG_KEY_$index=protocol.version
+  export GIT_CONFIG_VALUE_$index="$version"
+  export GIT_CONFIG_COUNT=$((index + 1))
+}
+
+# sets clone_since to the date source.clone_since reaches back to, in the form
+# git's --shallow-since takes, or to nothing if it isn't set. It is given as
+# a duration such as 720h or 1h30m, or as a number of nanoseconds
+load_clone_since() {
+  local since=$(jq -r '.source.clone_since // empty | tostring' < $1)
+  local seconds=0
+
+  case "$since" in
+    "") ;;
+    *[!0-9]*)
+      # anything else is reported by validate_source
+      if echo "$since" | grep -Eq '^([0-9]+[hms])+$'; then
+        seconds=$(($(echo "$since" | sed -E 's/([0-9]+)h/\1*3600+/g; s/([0-9]+)m/\1*60+/g; s/([0-9]+)s/\1+/g; s/\+$//')))
+      fi
+      ;;
+    *)
+      seconds=$((since / 1000000000))
+      ;;
+  esac
+
+  clone_since=""
+  if [ "$seconds" -gt 0 ]; then
+    clone_since="@$(($(date +%s) - seconds))"
+  fi
+}
+
+# runs a git clone or fetch bounded by source.clone_since. A branch that
+# hasn't changed since has no commits that new, which git refuses to take,
+# so just its last commit is taken instead. Mirrors runSince in the out
+# resource
+git_since() {
+  local subcommand=$1
+  shift
+
+  if [ -z "$clone_since" ]; then
+    git $subcommand "$@"
+    return
+  fi
+
+  local errors=$(mktemp $TMPDIR/git-errors.XXXXXX)
+
+  if git $subcommand --shallow-since=$clone_since "$@" 2>$errors; then
+    cat $errors >&2
+    rm -f $errors
+    return 0
+  fi
+
+  if ! grep -q 'no commits selected for shallow requests' $errors; then
+    cat $errors >&2
+    rm -f $errors
+    return 1
+  fi
+
+  rm -f $errors
+  git $subcommand --depth 1 "$@"
+}
+
+# fetches the private key or HTTPS credentials from Vault when the pool is
+# used, so that pipelines only configure where they are kept. The secret may
+# hold a private_key, a username and password, or a token.
+load_vault_credentials() {
+  local payload=$1
+
+  local address=$(jq -r '.source.vault.address // empty' < $payload)
+  if [ -z "$address" ]; then
+    return 0
+  fi
+
+  local path=$(jq -r '.source.vault.path // empty' < $payload)
+  local role=$(jq -r '.source.vault.role // empty' < $payload)
+  local auth_mount=$(jq -r '.source.vault.auth_mount // "kubernetes"' < $payload)
+
+  if [ -z "$path" ]; then
+    return 0
+  fi
+
+  address=${address%/}
+
+  local token=$VAULT_TOKEN
+  if [ -n "$role" ]; then
+    local jwt_path=${VAULT_JWT_PATH:-/var/run/secrets/kubernetes.io/serviceaccount/token}
+    if [ ! -r "$jwt_path" ]; then
+      echo "error: cannot log in to Vault as role $role without a service account token at $jwt_path"
+      exit 1
+    fi
+
+    local login=$(jq -nc --arg role "$role" --arg jwt "$(cat $jwt_path)" '{role: $role, jwt: $jwt}')
+    token=$(wget -q -O - --post-data "$login" "$address/v1/auth/$auth_mount/login" | jq -r '.auth.client_token // empty')
+
+    if [ -z "$token" ]; then
+      echo "error: failed to log in to Vault at $address as role $role"
+      exit 1
+    fi
+  fi
+
+  if [ -z "$token" ]; then
+    echo "error: source.vault.role or a VAULT_TOKEN is required to read from Vault"
+    exit 1
+  fi
+
+  # KV version 2 engines nest the secret under data.data
+  local secret=$(wget -q -O - --header "X-Vault-Token: $token" "$address/v1/$path" | jq -c '
+    .data // empty | if has("data") and has("metadata") then .data else . end
+  ')
+
+  if [ -z "$secret" ]; then
+    echo "error: failed to read $path from Vault at $address"
+    exit 1
+  fi
+
+  local private_key_path=$TMPDIR/vault-private-key
+  echo "$secret" | jq -r '.private_key // empty' > $private_key_path
+
+  if [ -s $private_key_path ]; then
+    add_private_key $private_key_path $payload
+  fi
+
+  local username=$(echo "$secret" | jq -r 'if .password then .username // "git" else .username // "x-access-token" end')
+  local password=$(echo "$secret" | jq -r '.password // .token // empty')
+
+  if [ -n "$password" ]; then
+    use_https_credentials $payload $TMPDIR/vault-git-credentials "$username" "$password"
+  fi
+}
+
+# authenticates as an installation of a GitHub App, with a token minted for
+# this run; out mints its own as it needs them
+load_github_app_credentials() {
+  local payload=$1
+
+  if [ -z "$(jq -r '.source.github_app.app_id // empty' < $payload)" ]; then
+    return 0
+  fi
+
+  local token=$(/opt/go/github-app-token < $payload)
+  if [ -z "$token" ]; then
+    exit 1
+  fi
+
+  use_https_credentials $payload $TMPDIR/github-app-git-credentials x-access-token "$token"
+}
+
+# answers git's requests for HTTPS credentials for the pool's host with the
+# given username and password, kept in a file that only we can read; mirrors,
+# submodules and LFS servers on other hosts are never given them
+use_https_credentials() {
+  local payload=$1
+  local credentials_path=$2
+
+  local host=$(jq -r '.source.uri // empty' < $payload | sed -nE 's#^(https?://)([^@/]*@)?([^/]+).*#\1\3#p')
+  if [ -z "$host" ]; then
+    return 0
+  fi
+
+  printf 'username=%s\npassword=%s\n' "$3" "$4" > $credentials_path
+  chmod 0600 $credentials_path
+
+  local index=${GIT_CONFIG_COUNT:-0}
+  export GIT_CONFIG_KEY_$index=credential.$host.helper
+  export GIT_CONFIG_VALUE_$index="!f() { test \"\$1\" = get && cat $credentials_path; }; f"
+  export GIT_CONFIG_COUNT=$((index + 1))
+}
+
+# prints, as a JSON array of metadata pairs, the parts of a lock's metadata
+# file that the source asks to show; mirrors ShownMetadata in the out resource
+shown_metadata() {
+  local payload=$1
+  local metadata_file=$2
+
+  local keys=$(jq -c '.source.show_metadata_keys // []' < $payload)
+  local show_all=$(jq -r '.source.show_metadata // false' < $payload)
+
+  if [ ! -r "$metadata_file" ]; then
+    echo '[]'
+  elif [ "$keys" != "[]" ]; then
+    jq -c --argjson keys "$keys" '
+      . as $fields
+      | if type == "object" then
+          [$keys[] | select(. as $key | $fields | has($key))
+            | {name: ., value: ($fields[.] | if type == "string" then . else tojson end)}]
+        else [] end
+    ' < $metadata_file 2>/dev/null || echo '[]'
+  elif [ "$show_all" = "true" ] && [ $(wc -c < $metadata_file) -le 1024 ]; then
+    jq -Rs '[{name: "metadata", value: rtrimstr("\n")}]' < $metadata_file
+  else
+    echo '[]'
+  fi
+}
+
+# prints the digest of a lock's contents as committed in the given commit,
+# which versions carry with source.content_digest, or nothing if the commit
+# doesn't hold the lock; mirrors ContentDigest in the out resource
+lock_digest() {
+  local commit=$1
+  local pool_name=$2
+  local lock=$3
+
+  # hidden files, like fencing tokens, are named after their lock too
+  local path=$(git ls-tree -r --name-only $commit -- $pool_name | awk -F/ -v lock="$lock" '$NF == lock && $0 !~ /\/\./' | head -1)
+
+  if [ -n "$path" ]; then
+    echo "sha256:$(git cat-file blob "$commit:$path" | sha256sum | cut -d' ' -f1)"
+  fi
+}
+
+# decrypts a lock's metadata file in place if it is encrypted and the source
+# gives a key for it; mirrors Encryption.Readable in the out resource
+decrypt_metadata() {
+  local payload=$1
+  local metadata_file=$2
+
+  local type=$(jq -r 'if (.source.encryption.private_key // "") == "" then empty else .source.encryption.type // empty end' < $payload)
+
+  if [ -z "$type" ] || [ ! -r "$metadata_file" ]; then
+    return 0
+  fi
+
+  if ! grep -q -e '-----BEGIN AGE ENCRYPTED FILE-----' -e '-----BEGIN PGP MESSAGE-----' $metadata_file; then
+    return 0
+  fi
+
+  local decrypted=$(mktemp $TMPDIR/pool-resource-metadata.XXXXXX)
+
+  case "$type" in
+    age)
+      local identity=$(mktemp $TMPDIR/pool-resource-age-identity.XXXXXX)
+      jq -r '.source.encryption.private_key' < $payload > $identity
+      age --decrypt --identity $identity < $metadata_file > $decrypted
+      rm -f $identity
+      ;;
+    gpg)
+      # not named pool-resource-*, which the out resource sweeps up once
+      # stale unless they are locked, as they can't be locked from here
+      local home=$(mktemp -d $TMPDIR/pool-gnupg.XXXXXX)
+      jq -r '.source.encryption.private_key' < $payload | gpg --homedir $home --batch --import 2>/dev/null
+      gpg --homedir $home --batch --yes --pinentry-mode loopback --decrypt < $metadata_file > $decrypted
+      rm -rf $home
+      ;;
+  esac
+
+  mv $decrypted $metadata_file
+}
+
+# checks that the branch can be read from the repository before cloning it,
+# so that a failure says why; the causes are told apart the same way as
+# ClassifyGitOutput in the out resource
+probe_repository() {
+  local uri=$1
+  local branch=$2
+
+  local status=0
+  local output
+  output=$(git ls-remote --exit-code --heads "$uri" "$branch" 2>&1) || status=$?
+
+  if [ $status -eq 0 ]; then
+    return 0
+  fi
+
+  # ls-remote exits with 2 when the remote is reachable but has no such ref
+  if [ $status -eq 2 ]; then
+    echo "error: branch $branch does not exist in $uri"
+    exit 1
+  fi
+
+  local reason
+  case "$(echo "$output" | tr 'A-Z' 'a-z')" in
+    *"could not resolve host"*|*"name or service not known"*|*"temporary failure in name resolution"*|*"nodename nor servname"*)
+      reason="the host of $uri could not be found; check source.uri"
+      ;;
+    *"permission denied"*|*"authentication failed"*|*"could not read username"*|*"could not read password"*|*"host key verification failed"*|*"access denied"*|*"invalid username or password"*|*"returned error: 401"*|*"returned error: 403"*)
+      reason="access to $uri was denied; check that the credentials given can read it"
+      ;;
+    *"repository not found"*|*"does not appear to be a git repository"*|*"returned error: 404"*)
+      reason="repository $uri does not exist, or the credentials given cannot see it"
+      ;;
+    *)
+      reason="could not reach $uri"
+      ;;
+  esac
+
+  echo "error: $reason"
+  echo "$output" | sed -e 's/^/  /'
+  exit 1
+}
+
+# mirrors Source.Validate in the out resource
+validate_source() {
+  local payload=$1
+  local errors=""
+
+  local uri=$(jq -r '.source.uri // ""' < $payload)
+  local branch=$(jq -r '.source.branch // ""' < $payload)
+  local pool=$(jq -r '.source.pool // ""' < $payload)
+
+  if [ -z "$uri" ]; then
+    errors="${errors}invalid payload: source.uri is required\n"
+  fi
+
+  if [ -z "$branch" ]; then
+    errors="${errors}invalid payload: source.branch is required\n"
+  elif ! git check-ref-format --branch "$branch" >/dev/null 2>&1; then
+    errors="${errors}invalid payload: source.branch \"$branch\" is not a valid branch name\n"
+  fi
+
+  local pools=$(jq -r '.source.pools // [] | .[]' < $payload)
+
+  if [ -z "$pool" ] && [ -z "$pools" ]; then
+    errors="${errors}invalid payload: source.pool is required\n"
+  elif [ -n "$pool" ]; then
+    case "/$pool/" in
+      //*|*/../*)
+        errors="${errors}invalid payload: source.pool \"$pool\" must be a path within the repository\n"
+        ;;
+    esac
+  fi
+
+  for listed in $pools; do
+    case "/$listed/" in
+      //*|*/../*)
+        errors="${errors}invalid payload: source.pools \"$listed\" must be a path within the repository\n"
+        ;;
+    esac
+  done
+
+  if ! jq -e '(.source.retry_delay // 0) >= 0' < $payload >/dev/null; then
+    errors="${errors}invalid payload: source.retry_delay must not be negative\n"
+  fi
+
+  if ! jq -e '(.source.retry_jitter // 0) | . >= 0 and . <= 1' < $payload >/dev/null; then
+    errors="${errors}invalid payload: source.retry_jitter must be between 0 and 1\n"
+  fi
+
+  if ! jq -e '(.source.port // 0) | . >= 0 and . <= 65535' < $payload >/dev/null; then
+    errors="${errors}invalid payload: source.port must be between 1 and 65535\n"
+  fi
+
+  case "$(jq -r '.source.strict_host_key_checking // ""' < $payload)" in
+    ""|yes|no|accept-new) ;;
+    *)
+      errors="${errors}invalid payload: source.strict_host_key_checking \"$(jq -r '.source.strict_host_key_checking' < $payload)\" must be yes, no, or accept-new\n"
+      ;;
+  esac
+
+  local since=$(jq -r '.source.clone_since // "" | tostring' < $payload)
+  if [ -n "$since" ] && ! echo "$since" | grep -Eq '^([0-9]+|([0-9]+[hms])+)$'; then
+    errors="${errors}invalid payload: source.clone_since \"$since\" must be a duration such as 720h\n"
+  fi
+
+  if ! jq -e '(.source.protocol_version // 0) | . == 0 or . == 1 or . == 2' < $payload >/dev/null; then
+    errors="${errors}invalid payload: source.protocol_version must be 1 or 2\n"
+  fi
+
+  for state in $(jq -r '.source.states // [] | .[]' < $payload); do
+    case "$state" in
+      unclaimed|claimed|maintenance|broken) ;;
+      *)
+        errors="${errors}invalid payload: source.states may only contain unclaimed, claimed, maintenance, and broken, not \"$state\"\n"
+        ;;
+    esac
+  done
+
+  local lock_name=$(jq -r '.source.lock_name // ""' < $payload)
+  if [ -n "$lock_name" ] && ! echo "$lock_name" | grep -Eq '^[A-Za-z0-9][A-Za-z0-9._-]*$'; then
+    errors="${errors}invalid payload: source.lock_name \"$lock_name\" is not a valid lock name\n"
+  fi
+
+  errors="${errors}$(jq -r '
+    .source.vault // {} | [.address // "", .path // ""] |
+    if .[0] != "" and .[1] == "" then "path"
+    elif .[0] == "" and .[1] != "" then "address"
+    else empty end |
+    "invalid payload: source.vault.\(.) is required to read credentials from Vault\\n"
+  ' < $payload)"
+
+  if [ -n "$errors" ]; then
+    printf "$errors"
+    exit 1
   fi
 }
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/cfmobile/pool-resource/out"
+)
+
+// prints an installation token for the GitHub App in the request's source,
+// for check and in, which authenticate their clones in the shell
+func main() {
+	var request struct {
+		Source out.Source `json:"source"`
+	}
+
+	err := json.NewDecoder(os.Stdin).Decode(&request)
+	if err != nil {
+		fatal("reading request", err)
+	}
+
+	token, err := out.NewGitHubAppTokenSource(request.Source.GitHubApp).Token()
+	if err != nil {
+		fatal("authenticating as GitHub App", err)
+	}
+
+	fmt.Println(token)
+}
+
+func fatal(doing string, err error) {
+	println("error " + doing + ": " + err.Error())
+	os.Exit(1)
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"encoding/json"
+	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/cfmobile/pool-resource/out"
@@ -22,18 +24,48 @@ func main() {
 	sourceDir := os.Args[1]
 
 	var request out.OutRequest
-	err := json.NewDecoder(os.Stdin).Decode(&request)
+	payload, err := ioutil.ReadAll(os.Stdin)
+	if err == nil {
+		err = json.Unmarshal(payload, &request)
+	}
 	if err != nil {
-		fatal("reading request", err)
+		println("error reading request: " + err.Error())
+		failWith(out.ErrorResponse{Error: out.ErrorDetail{
+			Category: out.ErrorCategoryInvalidRequest,
+			Message:  err.Error(),
+			Doing:    "reading request",
+		}})
 	}
 
-	validateRequest(request)
+	request.Source = request.Source.WithDefaults()
+
+	validateRequest(request, payload)
+
+	if request.Params.Branch != "" {
+		request.Source.Branch = request.Params.Branch
+	}
 
-	if request.Source.RetryDelay == 0 {
-		request.Source.RetryDelay = 10 * time.Second
+	if request.Params.Pool != "" {
+		request.Source.Pool = request.Params.Pool
+	}
+
+	if request.Params.BypassReserveMinimum {
+		request.Source.ReserveMinimum = 0
+	}
+
+	request.Source.Hooks = request.Source.Hooks.RelativeTo(sourceDir)
+
+	if request.Source.StaleTempDirAge == 0 {
+		request.Source.StaleTempDirAge = out.DefaultStaleTempDirAge
+	}
+
+	_, err = out.SweepStaleTempDirs(os.TempDir(), request.Source.StaleTempDirAge)
+	if err != nil {
+		println("warning: failed to clean up stale clones: " + err.Error())
 	}
 
 	lockPool := out.NewLockPool(request.Source, os.Stderr)
+	tracer = lockPool.Tracer
 
 	var (
 		lock    string
@@ -41,23 +73,134 @@ func main() {
 	)
 
 	if request.Params.Acquire {
-		lock, version, err = lockPool.AcquireLock()
+		if len(request.Params.ClaimAnyOf) > 0 {
+			lock, version, err = lockPool.AcquireAnyOf(request.Params.ClaimAnyOf)
+		} else if len(request.Params.MetadataQuery) > 0 {
+			lock, version, err = lockPool.AcquireMatching(request.Params.MetadataQuery)
+		} else {
+			lock, version, err = lockPool.AcquireLock()
+		}
 		if err != nil {
 			fatal("acquiring lock", err)
 		}
 	}
 
+	if request.Params.Reserve {
+		reserveFor := request.Params.ReserveFor
+		if reserveFor == 0 {
+			reserveFor = out.DefaultReserveFor
+		}
+
+		lock, version, err = lockPool.ReserveLock(reserveFor)
+		if err != nil {
+			fatal("reserving lock", err)
+		}
+	}
+
+	if request.Params.Confirm != "" {
+		confirmPath := filepath.Join(sourceDir, request.Params.Confirm)
+		lock, version, err = lockPool.ConfirmLock(confirmPath)
+		if err != nil {
+			fatal("confirming lock", err)
+		}
+	}
+
+	if request.Params.Heartbeat != "" {
+		heartbeatPath := filepath.Join(sourceDir, request.Params.Heartbeat)
+		lock, version, err = lockPool.RenewLease(heartbeatPath)
+		if err != nil {
+			fatal("renewing lease", err)
+		}
+	}
+
+	if request.Params.Rename != nil {
+		lock, version, err = lockPool.RenameLock(request.Params.Rename.From, request.Params.Rename.To)
+		if err != nil {
+			fatal("renaming lock", err)
+		}
+	}
+
+	if request.Params.PausePool {
+		lock, version, err = lockPool.PausePool(request.Params.Reason)
+		if err != nil {
+			fatal("pausing pool", err)
+		}
+	}
+
+	if request.Params.UnpausePool {
+		lock, version, err = lockPool.UnpausePool()
+		if err != nil {
+			fatal("unpausing pool", err)
+		}
+	}
+
+	if request.Params.Revert != "" {
+		lock, version, err = lockPool.RevertCommit(request.Params.Revert)
+		if err != nil {
+			fatal("reverting commit", err)
+		}
+	}
+
+	if request.Params.DestroyPool {
+		lock, version, err = lockPool.DestroyPool(request.Params.ConfirmDestroy)
+		if err != nil {
+			fatal("destroying pool", err)
+		}
+	}
+
+	if request.Params.SquashHistory {
+		days := request.Params.SquashOlderThanDays
+		if days == 0 {
+			days = out.DefaultSquashOlderThanDays
+		}
+
+		lock, version, err = lockPool.SquashHistory(time.Duration(days) * 24 * time.Hour)
+		if err != nil {
+			fatal("squashing history", err)
+		}
+	}
+
+	if request.Params.Transfer != "" {
+		transferPath := filepath.Join(sourceDir, request.Params.Transfer)
+		lock, version, err = lockPool.TransferLock(transferPath)
+		if err != nil {
+			fatal("transferring lock", err)
+		}
+	}
+
 	if request.Params.Release != "" {
 		poolName := filepath.Join(sourceDir, request.Params.Release)
-		lock, version, err = lockPool.ReleaseLock(poolName)
+		if request.Params.AllowMissing {
+			lock, version, err = lockPool.ReleaseLockIfClaimed(poolName)
+		} else {
+			lock, version, err = lockPool.ReleaseLock(poolName)
+		}
 		if err != nil {
 			fatal("releasing lock", err)
 		}
 	}
 
+	if request.Params.ReleaseMatching != "" {
+		lock, version, err = lockPool.ReleaseMatching(request.Params.ReleaseMatching)
+		if err != nil {
+			fatal("releasing locks", err)
+		}
+	}
+
+	if request.Params.ReleaseAllMine {
+		lock, version, err = lockPool.ReleaseAllMine()
+		if err != nil {
+			fatal("releasing locks", err)
+		}
+	}
+
 	if request.Params.Add != "" {
 		lockPath := filepath.Join(sourceDir, request.Params.Add)
-		lock, version, err = lockPool.AddLock(lockPath)
+		if request.Params.Overwrite {
+			lock, version, err = lockPool.ReplaceLock(lockPath, request.Params.MetadataTemplate)
+		} else {
+			lock, version, err = lockPool.AddTemplatedLock(lockPath, request.Params.MetadataTemplate)
+		}
 		if err != nil {
 			fatal("adding lock", err)
 		}
@@ -71,47 +214,127 @@ func main() {
 		}
 	}
 
+	if request.Params.RemoveMatching != "" {
+		lock, version, err = lockPool.RemoveMatching(request.Params.RemoveMatching)
+		if err != nil {
+			fatal("removing locks", err)
+		}
+	}
+
+	if len(request.Params.RemoveList) > 0 {
+		lock, version, err = lockPool.RemoveList(request.Params.RemoveList)
+		if err != nil {
+			fatal("removing locks", err)
+		}
+	}
+
+	if request.Params.Disable != "" {
+		disablePath := filepath.Join(sourceDir, request.Params.Disable)
+		lock, version, err = lockPool.DisableLock(disablePath)
+		if err != nil {
+			fatal("disabling lock", err)
+		}
+	}
+
+	if request.Params.Enable != "" {
+		enablePath := filepath.Join(sourceDir, request.Params.Enable)
+		lock, version, err = lockPool.EnableLock(enablePath)
+		if err != nil {
+			fatal("enabling lock", err)
+		}
+	}
+
+	if request.Params.Quarantine != "" {
+		quarantinePath := filepath.Join(sourceDir, request.Params.Quarantine)
+		lock, version, err = lockPool.QuarantineLock(quarantinePath, request.Params.Reason)
+		if err != nil {
+			fatal("quarantining lock", err)
+		}
+	}
+
+	// a source watching several pools versions each by the pool it changed
+	if len(request.Source.Pools) > 0 {
+		version.Pool = request.Source.Pool
+	}
+
+	if claim := lockPool.Claim(); claim != nil {
+		err = out.WriteClaim(sourceDir, *claim)
+		if err != nil {
+			println("warning: failed to write " + out.ClaimFile + ": " + err.Error())
+		}
+	}
+
 	err = json.NewEncoder(os.Stdout).Encode(out.OutResponse{
 		Version: version,
-		Metadata: []out.MetadataPair{
+		Metadata: append([]out.MetadataPair{
 			{Name: "lock_name", Value: lock},
 			{Name: "pool_name", Value: request.Source.Pool},
-		},
+		}, lockPool.Metadata()...),
 	})
 
 	if err != nil {
 		fatal("encoding output", err)
 	}
+
+	flushTraces()
+}
+
+var tracer *out.Tracer
+
+func flushTraces() {
+	err := tracer.Flush()
+	if err != nil {
+		println("warning: failed to export traces: " + err.Error())
+	}
 }
 
 func fatal(doing string, err error) {
 	println("error " + doing + ": " + err.Error())
+	failWith(out.NewErrorResponse(doing, err))
+}
+
+// failWith ends the log with a structured account of the failure and exits.
+func failWith(response out.ErrorResponse) {
+	json.NewEncoder(os.Stderr).Encode(response)
+	flushTraces()
 	os.Exit(1)
 }
 
-func validateRequest(request out.OutRequest) {
+func validateRequest(request out.OutRequest, payload []byte) {
 	var errorMessages []string
 
-	if request.Source.URI == "" {
-		errorMessages = append(errorMessages, "invalid payload (missing uri)")
-	}
+	problems := out.UnknownFields("", payload, request)
+	problems = append(problems, request.Source.Validate()...)
+	problems = append(problems, request.Params.Validate()...)
 
-	if request.Source.Pool == "" {
-		errorMessages = append(errorMessages, "invalid payload (missing pool)")
+	// with only source.pools, out needs to be told which of them to change
+	if request.Source.Pool == "" && len(request.Source.Pools) > 0 && request.Params.Pool == "" {
+		problems = append(problems, "params.pool is required to change one of source.pools, as source.pool is not given")
 	}
 
-	if request.Source.Branch == "" {
-		errorMessages = append(errorMessages, "invalid payload (missing branch)")
+	for _, problem := range problems {
+		errorMessages = append(errorMessages, "invalid payload: "+problem)
 	}
 
-	if request.Params.Acquire == false && request.Params.Release == "" && request.Params.Add == "" && request.Params.Remove == "" {
-		errorMessages = append(errorMessages, "invalid payload (missing acquire, release, remove, or add)")
+	if request.Params.Acquire == false && request.Params.Release == "" && request.Params.ReleaseMatching == "" && !request.Params.ReleaseAllMine && request.Params.Add == "" && request.Params.Remove == "" &&
+		request.Params.RemoveMatching == "" && len(request.Params.RemoveList) == 0 &&
+		request.Params.Disable == "" && request.Params.Enable == "" && request.Params.Quarantine == "" &&
+		request.Params.Reserve == false && request.Params.Confirm == "" && request.Params.Heartbeat == "" &&
+		request.Params.Transfer == "" && request.Params.PausePool == false && request.Params.UnpausePool == false &&
+		request.Params.SquashHistory == false && request.Params.Rename == nil && request.Params.DestroyPool == false &&
+		request.Params.Revert == "" {
+		errorMessages = append(errorMessages, "invalid payload: params must include one of acquire, reserve, confirm, heartbeat, transfer, release, release_matching, release_all_mine, remove, remove_matching, remove_list, add, disable, enable, quarantine, rename, pause_pool, unpause_pool, squash_history, revert, or destroy_pool")
 	}
 
 	if len(errorMessages) > 0 {
 		for _, errorMessage := range errorMessages {
 			println(errorMessage)
 		}
-		os.Exit(1)
+
+		failWith(out.ErrorResponse{Error: out.ErrorDetail{
+			Category: out.ErrorCategoryInvalidRequest,
+			Message:  strings.Join(errorMessages, "; "),
+			Doing:    "validating request",
+		}})
 	}
 }
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cfmobile/pool-resource/out"
+)
+
+const usage = `usage: poolctl [flags] <command> [arguments]
+
+Changes a pool the same way the resource does, retrying conflicting changes
+made by builds at the same time.
+
+commands:
+  list                    list the locks in each state, and, for a pool with a
+                          lock_index, since when and who claimed them
+  stats                   count the locks in each state
+  audit [name]            list the claims and releases recorded in the pool's
+                          audit notes, of the named lock or of every lock
+  add <name> [metadata]   add an unclaimed lock, with metadata read from the
+                          file given, or empty
+  remove <name>           remove a claimed lock
+  unclaim <name>          release a claimed lock, running any pre_release hook
+  force-unclaim <name>    return a lock to unclaimed from whichever state it is
+                          in, without running hooks
+  heartbeat [-every <duration>] <name>
+                          renew the lease of a claimed lock, once or, with
+                          -every, repeatedly until interrupted
+  migrate [migrate flags] copy every lock, in its state, to another pool, which
+                          is the same as this one apart from the migrate flags
+                          given:
+      -to-source <file>     read the destination from this JSON file
+      -to-uri <uri>         the repository to copy to
+      -to-branch <branch>   the branch to copy to
+      -to-pool <pool>       the pool to copy to
+      -history              replay the commits that changed the pool, rather
+                            than only copying its locks
+  export [file]           write every lock, with its state, metadata and claim,
+                          as a JSON snapshot to the file given, or stdout
+  import <file>           restore every lock of a JSON snapshot into the pool,
+                          which must not already hold any of them
+
+flags:
+`
+
+func main() {
+	flags := flag.NewFlagSet("poolctl", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flags.PrintDefaults()
+	}
+
+	sourceFile := flags.String("source", "", "read the source from this JSON file, as configured in a pipeline")
+	uri := flags.String("uri", "", "the location of the pool repository")
+	branch := flags.String("branch", "", "the branch to use")
+	pool := flags.String("pool", "", "the pool to manage")
+
+	flags.Parse(os.Args[1:])
+
+	source := loadSource(out.Source{}, *sourceFile, *uri, *branch, *pool)
+	validate(source)
+
+	args := flags.Args()
+	if len(args) == 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	command, args := args[0], args[1:]
+
+	switch command {
+	case "list":
+		expectArgs(args, 0, 0)
+		list(source)
+
+	case "stats":
+		expectArgs(args, 0, 0)
+		stats(source)
+
+	case "audit":
+		expectArgs(args, 0, 1)
+
+		lock := ""
+		if len(args) == 1 {
+			lock = args[0]
+		}
+
+		audit(source, lock)
+
+	case "add":
+		expectArgs(args, 1, 2)
+
+		var metadata []byte
+		if len(args) == 2 {
+			var err error
+			metadata, err = ioutil.ReadFile(args[1])
+			if err != nil {
+				fatal("reading metadata", err)
+			}
+		}
+
+		change(source, args[0], metadata, func(lockPool out.LockPool, lockDir string) (out.Version, error) {
+			_, version, err := lockPool.AddLock(lockDir)
+			return version, err
+		})
+
+	case "remove":
+		expectArgs(args, 1, 1)
+		change(source, args[0], nil, func(lockPool out.LockPool, lockDir string) (out.Version, error) {
+			_, version, err := lockPool.RemoveLock(lockDir)
+			return version, err
+		})
+
+	case "unclaim":
+		expectArgs(args, 1, 1)
+		change(source, args[0], nil, func(lockPool out.LockPool, lockDir string) (out.Version, error) {
+			_, version, err := lockPool.ReleaseLock(lockDir)
+			return version, err
+		})
+
+	case "force-unclaim":
+		expectArgs(args, 1, 1)
+		change(source, args[0], nil, func(lockPool out.LockPool, lockDir string) (out.Version, error) {
+			_, version, err := lockPool.ForceUnclaimLock(lockDir)
+			return version, err
+		})
+
+	case "heartbeat":
+		heartbeatFlags := flag.NewFlagSet("heartbeat", flag.ExitOnError)
+		heartbeatFlags.Usage = flags.Usage
+
+		every := heartbeatFlags.Duration("every", 0, "")
+
+		heartbeatFlags.Parse(args)
+		args = heartbeatFlags.Args()
+		expectArgs(args, 1, 1)
+
+		for {
+			change(source, args[0], nil, func(lockPool out.LockPool, lockDir string) (out.Version, error) {
+				_, version, err := lockPool.RenewLease(lockDir)
+				return version, err
+			})
+
+			if *every <= 0 {
+				break
+			}
+
+			time.Sleep(*every)
+		}
+
+	case "migrate":
+		migrateFlags := flag.NewFlagSet("migrate", flag.ExitOnError)
+		migrateFlags.Usage = flags.Usage
+
+		toSourceFile := migrateFlags.String("to-source", "", "")
+		toURI := migrateFlags.String("to-uri", "", "")
+		toBranch := migrateFlags.String("to-branch", "", "")
+		toPool := migrateFlags.String("to-pool", "", "")
+		history := migrateFlags.Bool("history", false, "")
+
+		migrateFlags.Parse(args)
+		expectArgs(migrateFlags.Args(), 0, 0)
+
+		base := source
+		if *toSourceFile != "" {
+			base = out.Source{}
+		}
+
+		toSource := loadSource(base, *toSourceFile, *toURI, *toBranch, *toPool)
+		validate(toSource)
+
+		if toSource.URI == source.URI && toSource.Branch == source.Branch && toSource.Pool == source.Pool {
+			fatal("migrating", fmt.Errorf("the pool to copy to is the pool being copied"))
+		}
+
+		migrate(source, toSource, *history)
+
+	case "export":
+		expectArgs(args, 0, 1)
+
+		snapshot, err := out.ExportSnapshot(out.NewGitLockHandler(source), source)
+		if err != nil {
+			fatal("exporting pool", err)
+		}
+
+		contents, err := json.MarshalIndent(snapshot, "", "  ")
+		if err != nil {
+			fatal("exporting pool", err)
+		}
+
+		contents = append(contents, '\n')
+
+		if len(args) == 1 {
+			err = ioutil.WriteFile(args[0], contents, 0644)
+		} else {
+			_, err = os.Stdout.Write(contents)
+		}
+
+		if err != nil {
+			fatal("writing snapshot", err)
+		}
+
+	case "import":
+		expectArgs(args, 1, 1)
+
+		contents, err := ioutil.ReadFile(args[0])
+		if err != nil {
+			fatal("reading snapshot", err)
+		}
+
+		var snapshot out.Snapshot
+		err = json.Unmarshal(contents, &snapshot)
+		if err != nil {
+			fatal("reading snapshot", err)
+		}
+
+		err = out.ImportSnapshot(out.NewGitLockHandler(source), source, snapshot, os.Stderr)
+		if err != nil {
+			fatal("importing pool", err)
+		}
+
+		fmt.Printf("imported %d locks\n", len(snapshot.Locks))
+
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n\n", command)
+		flags.Usage()
+		os.Exit(1)
+	}
+}
+
+// loadSource reads the source from file, if given, on top of base, and then
+// applies any of the other settings given.
+func loadSource(base out.Source, file string, uri string, branch string, pool string) out.Source {
+	source := base
+
+	if file != "" {
+		contents, err := ioutil.ReadFile(file)
+		if err != nil {
+			fatal("reading source", err)
+		}
+
+		err = json.Unmarshal(contents, &source)
+		if err != nil {
+			fatal("reading source", err)
+		}
+
+		unknown := out.UnknownFields("source", contents, source)
+		if len(unknown) > 0 {
+			for _, problem := range unknown {
+				fmt.Fprintln(os.Stderr, "invalid source: "+problem)
+			}
+			os.Exit(1)
+		}
+	}
+
+	if uri != "" {
+		source.URI = uri
+	}
+
+	if branch != "" {
+		source.Branch = branch
+	}
+
+	if pool != "" {
+		source.Pool = pool
+	}
+
+	return source.WithDefaults()
+}
+
+func validate(source out.Source) {
+	problems := source.Validate()
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			fmt.Fprintln(os.Stderr, "invalid source: "+problem)
+		}
+		os.Exit(1)
+	}
+}
+
+func states(source out.Source) []string {
+	return []string{source.Paths.Unclaimed, source.Paths.Claimed, source.Paths.Reserved, source.Paths.Maintenance, source.Paths.Broken}
+}
+
+// listLocks reads the locks in each state from a fresh clone of the pool,
+// from its index if it keeps one. The index is returned too, if it was read.
+func listLocks(source out.Source) (map[string][]string, *out.LockIndex) {
+	handler := out.NewGitLockHandler(source)
+
+	err := handler.Setup()
+	if err != nil {
+		fatal("cloning pool", err)
+	}
+
+	defer handler.Cleanup()
+
+	index, indexed, err := handler.ReadLockIndex()
+	if err != nil {
+		handler.Cleanup()
+		fatal("reading lock index", err)
+	}
+
+	locks := map[string][]string{}
+
+	if indexed {
+		paths := map[string]string{}
+		for i, state := range out.SnapshotStates {
+			paths[state] = states(source)[i]
+		}
+
+		for name, entry := range index.Locks {
+			locks[paths[entry.State]] = append(locks[paths[entry.State]], name)
+		}
+
+		for _, names := range locks {
+			sort.Strings(names)
+		}
+
+		return locks, &index
+	}
+
+	for _, state := range states(source) {
+		locks[state], err = handler.ListLocks(state)
+		if err != nil {
+			handler.Cleanup()
+			fatal("listing locks", err)
+		}
+	}
+
+	return locks, nil
+}
+
+func list(source out.Source) {
+	locks, index := listLocks(source)
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+
+	if index == nil {
+		fmt.Fprintln(writer, "LOCK\tSTATE")
+	} else {
+		fmt.Fprintln(writer, "LOCK\tSTATE\tSINCE\tCLAIMER")
+	}
+
+	for _, state := range states(source) {
+		for _, lock := range locks[state] {
+			if index == nil {
+				fmt.Fprintf(writer, "%s\t%s\n", lock, state)
+				continue
+			}
+
+			entry := index.Locks[lock]
+
+			since := "-"
+			if entry.Since != nil {
+				since = entry.Since.Format(time.RFC3339)
+			}
+
+			claimer := entry.Claimer
+			if claimer == "" {
+				claimer = "-"
+			}
+
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%s\n", lock, state, since, claimer)
+		}
+	}
+
+	writer.Flush()
+}
+
+func stats(source out.Source) {
+	locks, _ := listLocks(source)
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+
+	total := 0
+	for _, state := range states(source) {
+		fmt.Fprintf(writer, "%s:\t%d\n", state, len(locks[state]))
+		total += len(locks[state])
+	}
+
+	fmt.Fprintf(writer, "total:\t%d\n", total)
+
+	writer.Flush()
+}
+
+// audit lists the audit notes of the lock, or of every lock if lock is "",
+// oldest first. They are read whether or not the source records them now.
+func audit(source out.Source, lock string) {
+	source.AuditNotes = true
+
+	var handler out.LockHandler = out.NewGitLockHandler(source)
+
+	err := handler.Setup()
+	if err != nil {
+		fatal("cloning pool", err)
+	}
+
+	defer handler.Cleanup()
+
+	notes, err := handler.AuditLog(lock)
+	if err != nil {
+		handler.Cleanup()
+		fatal("reading audit notes", err)
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintln(writer, "AT\tACTION\tLOCK\tBY\tHELD\tBUILD")
+
+	for _, note := range notes {
+		held := "-"
+		if note.HeldSeconds > 0 {
+			held = (time.Duration(note.HeldSeconds) * time.Second).String()
+		}
+
+		build := note.BuildURL
+		if build == "" {
+			build = "-"
+		}
+
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\n", note.At.Format(time.RFC3339), note.Action, note.Lock, note.By, held, build)
+	}
+
+	writer.Flush()
+}
+
+// change runs an operation of the lock pool on the named lock, which it
+// passes in a directory laid out as a step's input would be.
+func change(source out.Source, lock string, metadata []byte, operation func(out.LockPool, string) (out.Version, error)) {
+	err := out.ValidateLockName(lock)
+	if err != nil {
+		fatal("reading lock name", err)
+	}
+
+	lockDir, err := ioutil.TempDir("", out.TempDirPrefix+"-poolctl")
+	if err != nil {
+		fatal("creating lock directory", err)
+	}
+
+	defer os.RemoveAll(lockDir)
+
+	// held, as the operation can wait a long time on a contended pool
+	release, err := out.HoldTempDir(lockDir)
+	if err != nil {
+		fatal("creating lock directory", err)
+	}
+
+	defer release()
+
+	err = ioutil.WriteFile(filepath.Join(lockDir, "name"), []byte(lock), 0644)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(lockDir, "metadata"), metadata, 0644)
+	}
+
+	if err != nil {
+		os.RemoveAll(lockDir)
+		fatal("creating lock directory", err)
+	}
+
+	version, err := operation(out.NewLockPool(source, os.Stderr), lockDir)
+	if err != nil {
+		os.RemoveAll(lockDir)
+		fatal("changing pool", err)
+	}
+
+	fmt.Println(version.Ref)
+}
+
+func migrate(from out.Source, to out.Source, history bool) {
+	var (
+		report out.MigrationReport
+		err    error
+	)
+
+	if history {
+		report, err = out.NewHistoryMigration(from, to, os.Stderr).Run()
+	} else {
+		report, err = out.Migration{
+			From:       out.NewGitLockHandler(from),
+			FromSource: from,
+			To:         out.NewGitLockHandler(to),
+			ToSource:   to,
+			Output:     os.Stderr,
+		}.Run()
+	}
+
+	if err != nil {
+		fatal("migrating", err)
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(writer, "STATE\t%s\t%s\n", from.Pool, to.Pool)
+
+	for _, count := range report.Counts {
+		fmt.Fprintf(writer, "%s\t%d\t%d\n", count.State, count.Source, count.Destination)
+	}
+
+	writer.Flush()
+
+	if history {
+		fmt.Printf("\nreplayed %d commits\n", report.Commits)
+	}
+
+	if !report.Verified() {
+		fmt.Fprintln(os.Stderr, "error migrating: the pools hold different numbers of locks")
+		os.Exit(1)
+	}
+}
+
+func expectArgs(args []string, min int, max int) {
+	if len(args) < min || len(args) > max {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(1)
+	}
+}
+
+func fatal(doing string, err error) {
+	fmt.Fprintln(os.Stderr, "error "+doing+": "+err.Error())
+	os.Exit(1)
+}
@@ -0,0 +1,230 @@
+package integration_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/concourse/pool-resource/out"
+)
+
+// The benchmarks below measure how long claiming a lock takes, from resetting
+// the clone to pushing the claim, as the pool grows and as more builds claim
+// from it at once. Run them on their own with
+//
+//	go test -run '^$' -bench . ./integration/
+//
+// Each claim is released again, outside of the time measured, so that the
+// pool never runs dry.
+
+func BenchmarkClaim(b *testing.B) {
+	for _, size := range []int{10, 100, 1000, 10000} {
+		for _, bare := range []bool{false, true} {
+			mode := "checkout"
+			if bare {
+				mode = "bare"
+			}
+
+			b.Run(fmt.Sprintf("locks=%d/%s", size, mode), func(b *testing.B) {
+				origin := setupBenchmarkPool(b, size)
+				defer os.RemoveAll(origin)
+
+				benchmarkClaims(b, out.Source{
+					URI:    origin,
+					Branch: "master",
+					Pool:   "lock-pool",
+					Bare:   bare,
+				}, 1)
+			})
+		}
+	}
+}
+
+func BenchmarkClaimContended(b *testing.B) {
+	for _, claimers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("claimers=%d", claimers), func(b *testing.B) {
+			origin := setupBenchmarkPool(b, 100)
+			defer os.RemoveAll(origin)
+
+			benchmarkClaims(b, out.Source{
+				URI:    origin,
+				Branch: "master",
+				Pool:   "lock-pool",
+			}, claimers)
+		})
+	}
+}
+
+// benchmarkClaims claims and releases b.N locks between claimers claiming at
+// the same time, each with a clone of its own, and reports the time each
+// claim took and how often it had to be retried.
+func benchmarkClaims(b *testing.B, source out.Source, claimers int) {
+	source = source.WithDefaults()
+
+	handlers := make([]*out.GitLockHandler, claimers)
+	for i := range handlers {
+		handlers[i] = out.NewGitLockHandler(source)
+
+		err := handlers[i].Setup()
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		defer handlers[i].Cleanup()
+	}
+
+	var mutex sync.Mutex
+	var claiming time.Duration
+	var conflicts int
+	var failure error
+
+	claims := make(chan struct{}, b.N)
+	for i := 0; i < b.N; i++ {
+		claims <- struct{}{}
+	}
+	close(claims)
+
+	b.ResetTimer()
+
+	var wg sync.WaitGroup
+	for _, handler := range handlers {
+		wg.Add(1)
+
+		go func(handler *out.GitLockHandler) {
+			defer wg.Done()
+
+			for range claims {
+				startedAt := time.Now()
+
+				lock, retries, err := claimLock(handler)
+				took := time.Since(startedAt)
+
+				if err == nil {
+					err = releaseLock(handler, lock)
+				}
+
+				mutex.Lock()
+				claiming += took
+				conflicts += retries
+				if err != nil && failure == nil {
+					failure = err
+				}
+				mutex.Unlock()
+
+				if err != nil {
+					return
+				}
+			}
+		}(handler)
+	}
+
+	wg.Wait()
+
+	b.StopTimer()
+
+	if failure != nil {
+		b.Fatal(failure)
+	}
+
+	b.ReportMetric(float64(claiming.Nanoseconds())/float64(b.N), "ns/claim")
+	b.ReportMetric(float64(conflicts)/float64(b.N), "retries/claim")
+}
+
+// claimRetryDelay is how long claimLock waits for a lock to be released when
+// the other claimers hold them all.
+const claimRetryDelay = 10 * time.Millisecond
+
+// claimLock claims an available lock as out's acquire does, retrying for as
+// long as other claimers get there first.
+func claimLock(handler *out.GitLockHandler) (string, int, error) {
+	for retries := 0; ; retries++ {
+		err := handler.ResetLock()
+		if err != nil {
+			return "", retries, err
+		}
+
+		lock, _, err := handler.LeaseLock(func(string) time.Time { return time.Time{} })
+		if err == out.ErrNoLocksAvailable {
+			time.Sleep(claimRetryDelay)
+			continue
+		}
+		if err != nil {
+			return "", retries, err
+		}
+
+		err = handler.BroadcastLockPool()
+		if err == out.ErrLockConflict {
+			continue
+		}
+
+		return lock, retries, err
+	}
+}
+
+// releaseLock releases a claimed lock, retrying around conflicting changes.
+func releaseLock(handler *out.GitLockHandler, lock string) error {
+	for {
+		err := handler.ResetLock()
+		if err != nil {
+			return err
+		}
+
+		_, err = handler.UnclaimLock(lock)
+		if err != nil {
+			return err
+		}
+
+		err = handler.BroadcastLockPool()
+		if err != out.ErrLockConflict {
+			return err
+		}
+	}
+}
+
+// setupBenchmarkPool makes a bare repository holding a pool of size unclaimed
+// locks, returning where it is.
+func setupBenchmarkPool(b *testing.B, size int) string {
+	work, err := ioutil.TempDir("", "benchmark-pool")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	defer os.RemoveAll(work)
+
+	origin, err := ioutil.TempDir("", "benchmark-origin")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	setup := exec.Command("bash", "-e", "-c", `
+		git init -q
+		git config user.email "ginkgo@localhost"
+		git config user.name "Ginkgo Local"
+
+		mkdir -p lock-pool/unclaimed lock-pool/claimed
+		touch lock-pool/unclaimed/.gitkeep lock-pool/claimed/.gitkeep
+
+		for i in $(seq 1 $SIZE); do
+			echo '{"some":"json"}' > lock-pool/unclaimed/lock-$i
+		done
+
+		git add .
+		git commit -q -m 'benchmark-setup'
+		git branch -M master
+		git clone -q --bare . "$ORIGIN"
+	`)
+	setup.Dir = work
+	setup.Env = append(os.Environ(), fmt.Sprintf("SIZE=%d", size), "ORIGIN="+origin)
+
+	output, err := setup.CombinedOutput()
+	if err != nil {
+		os.RemoveAll(origin)
+		b.Fatalf("setting up pool: %s\n%s", err, output)
+	}
+
+	return origin
+}
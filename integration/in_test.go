@@ -8,6 +8,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -46,9 +47,9 @@ var _ = Describe("In", func() {
 		It("returns all config errors", func() {
 			errorMessages := string(session.Err.Contents())
 
-			Ω(errorMessages).Should(ContainSubstring("invalid payload (missing uri)"))
-			Ω(errorMessages).Should(ContainSubstring("invalid payload (missing branch)"))
-			Ω(errorMessages).Should(ContainSubstring("invalid payload (missing pool)"))
+			Ω(errorMessages).Should(ContainSubstring("invalid payload: source.uri is required"))
+			Ω(errorMessages).Should(ContainSubstring("invalid payload: source.branch is required"))
+			Ω(errorMessages).Should(ContainSubstring("invalid payload: source.pool is required"))
 		})
 	})
 
@@ -105,6 +106,103 @@ var _ = Describe("In", func() {
 		})
 	})
 
+	Context("when the given version's commit is no longer in the repository", func() {
+		BeforeEach(func() {
+			setupGitRepo(gitRepo)
+		})
+
+		It("fails saying so instead of fetching newer state", func() {
+			jsonIn := fmt.Sprintf(`
+				{
+					"source": {
+						"uri": "%s",
+						"branch": "master",
+						"pool": "lock-pool"
+					},
+					"version": {
+						"ref": "0123456789abcdef0123456789abcdef01234567"
+					}
+				}`, gitRepo)
+
+			session := runIn(jsonIn, inDestination, 1)
+
+			Ω(session.Err).Should(gbytes.Say("error: version 0123456789abcdef0123456789abcdef01234567 is no longer in %s", gitRepo))
+			Ω(session.Err).Should(gbytes.Say("branch master was probably force-pushed"))
+			Ω(session.Out.Contents()).Should(BeEmpty())
+		})
+	})
+
+	Context("when fetching shallowly without tags", func() {
+		var sha string
+
+		BeforeEach(func() {
+			setupGitRepo(gitRepo)
+
+			history := exec.Command("bash", "-e", "-c", `
+				git tag some-tag
+				for i in 1 2 3; do
+					git commit -q --allow-empty -m "padding $i"
+				done
+
+				git mv lock-pool/unclaimed/some-lock lock-pool/claimed/some-lock
+				git commit -q -m 'claiming some-lock'
+
+				git commit -q --allow-empty -m 'later change'
+			`)
+			history.Dir = gitRepo
+			Ω(history.Run()).Should(Succeed())
+
+			gitVersion := exec.Command("git", "rev-parse", "HEAD~1")
+			gitVersion.Dir = gitRepo
+			output, err := gitVersion.Output()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			sha = strings.TrimSpace(string(output))
+		})
+
+		inJSON := func(depth int) string {
+			return fmt.Sprintf(`
+				{
+					"source": {
+						"uri": "file://%s",
+						"branch": "master",
+						"pool": "lock-pool"
+					},
+					"version": {
+						"ref": "%s"
+					},
+					"params": {
+						"depth": %d,
+						"fetch_tags": false
+					}
+				}`, gitRepo, sha, depth)
+		}
+
+		It("clones only the most recent commits, without tags", func() {
+			session := runIn(inJSON(3), inDestination, 0)
+
+			err := json.Unmarshal(session.Out.Contents(), &output)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(output.Version.Ref).Should(Equal(sha))
+			Ω(output.Metadata).Should(ContainElement(metadataPair{Name: "lock_name", Value: "some-lock"}))
+
+			Ω(filepath.Join(inDestination, ".git", "shallow")).Should(BeARegularFile())
+
+			tags := exec.Command("git", "tag")
+			tags.Dir = inDestination
+			Ω(tags.Output()).Should(BeEmpty())
+		})
+
+		It("still finds the version's lock when the version is at the edge of the clone", func() {
+			session := runIn(inJSON(1), inDestination, 0)
+
+			err := json.Unmarshal(session.Out.Contents(), &output)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(output.Version.Ref).Should(Equal(sha))
+			Ω(output.Metadata).Should(ContainElement(metadataPair{Name: "lock_name", Value: "some-lock"}))
+		})
+	})
+
 	Context("when a previous version is given", func() {
 		BeforeEach(func() {
 			var err error
@@ -171,6 +269,270 @@ var _ = Describe("In", func() {
 			}))
 		})
 
+		It("outputs when and by whom the lock was claimed", func() {
+			gitVersion := exec.Command("git", "rev-parse", "HEAD")
+			gitVersion.Dir = gitRepo
+			sha, err := gitVersion.Output()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			jsonIn := fmt.Sprintf(`
+				{
+					"source": {
+						"uri": "%s",
+						"branch": "master",
+						"pool": "lock-pool"
+					},
+					"version": {
+						"ref": "%s"
+					}
+				}`, gitRepo, strings.TrimSpace(string(sha)))
+
+			runIn(jsonIn, inDestination, 0)
+
+			claimedAtFile := filepath.Join(inDestination, "claimed_at")
+			Ω(claimedAtFile).Should(BeARegularFile())
+
+			fileContents, err := ioutil.ReadFile(claimedAtFile)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			claimedAt, err := time.Parse(time.RFC3339, strings.TrimSpace(string(fileContents)))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(claimedAt).Should(BeTemporally("~", time.Now(), time.Minute))
+
+			claimerFile := filepath.Join(inDestination, "claimer")
+			Ω(claimerFile).Should(BeARegularFile())
+
+			fileContents, err = ioutil.ReadFile(claimerFile)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(strings.TrimSpace(string(fileContents))).Should(Equal("Ginkgo Local <ginkgo@localhost>"))
+		})
+
+		It("outputs when and by whom the lock was claimed, rather than who changed the pool since", func() {
+			renew := exec.Command("bash", "-e", "-c", `
+				echo '2030-01-01T00:00:00Z' > lock-pool/claimed/.some-lock.expires
+				git add lock-pool/claimed/.some-lock.expires
+				GIT_COMMITTER_DATE='2030-01-01T00:00:00Z' git -c user.name='Someone Else' -c user.email='else@localhost' commit -m 'renewing lease: some-lock'
+			`)
+			renew.Dir = gitRepo
+
+			err := renew.Run()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			gitVersion := exec.Command("git", "rev-parse", "HEAD")
+			gitVersion.Dir = gitRepo
+			sha, err := gitVersion.Output()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			jsonIn := fmt.Sprintf(`
+				{
+					"source": {
+						"uri": "%s",
+						"branch": "master",
+						"pool": "lock-pool"
+					},
+					"version": {
+						"ref": "%s",
+						"lock": "some-lock"
+					}
+				}`, gitRepo, strings.TrimSpace(string(sha)))
+
+			runIn(jsonIn, inDestination, 0)
+
+			fileContents, err := ioutil.ReadFile(filepath.Join(inDestination, "claimed_at"))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			claimedAt, err := time.Parse(time.RFC3339, strings.TrimSpace(string(fileContents)))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(claimedAt).Should(BeTemporally("~", time.Now(), time.Minute))
+
+			fileContents, err = ioutil.ReadFile(filepath.Join(inDestination, "claimer"))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(strings.TrimSpace(string(fileContents))).Should(Equal("Ginkgo Local <ginkgo@localhost>"))
+		})
+
+		It("names the build recorded next to the lock as its claimer", func() {
+			record := exec.Command("bash", "-e", "-c", `
+				echo 'https://ci.example.com/teams/main/pipelines/deploy/jobs/test/builds/7' > lock-pool/claimed/.some-lock.build_url
+				git add lock-pool/claimed/.some-lock.build_url
+				git commit --amend --no-edit
+			`)
+			record.Dir = gitRepo
+			Ω(record.Run()).Should(Succeed())
+
+			gitVersion := exec.Command("git", "rev-parse", "HEAD")
+			gitVersion.Dir = gitRepo
+			sha, err := gitVersion.Output()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			jsonIn := fmt.Sprintf(`
+				{
+					"source": {
+						"uri": "%s",
+						"branch": "master",
+						"pool": "lock-pool"
+					},
+					"version": {
+						"ref": "%s",
+						"lock": "some-lock"
+					}
+				}`, gitRepo, strings.TrimSpace(string(sha)))
+
+			runIn(jsonIn, inDestination, 0)
+
+			fileContents, err := ioutil.ReadFile(filepath.Join(inDestination, "claimer"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(strings.TrimSpace(string(fileContents))).Should(Equal("https://ci.example.com/teams/main/pipelines/deploy/jobs/test/builds/7"))
+
+			fileContents, err = ioutil.ReadFile(filepath.Join(inDestination, "claim.json"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(fileContents)).Should(ContainSubstring(`"claimer": "https://ci.example.com/teams/main/pipelines/deploy/jobs/test/builds/7"`))
+		})
+
+		It("says nothing of a claim once the lock has been released", func() {
+			release := exec.Command("bash", "-e", "-c", `
+				git mv lock-pool/claimed/some-lock lock-pool/unclaimed/some-lock
+				git commit -m 'unclaiming: some-lock'
+			`)
+			release.Dir = gitRepo
+			Ω(release.Run()).Should(Succeed())
+
+			gitVersion := exec.Command("git", "rev-parse", "HEAD")
+			gitVersion.Dir = gitRepo
+			sha, err := gitVersion.Output()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			jsonIn := fmt.Sprintf(`
+				{
+					"source": {
+						"uri": "%s",
+						"branch": "master",
+						"pool": "lock-pool"
+					},
+					"version": {
+						"ref": "%s",
+						"lock": "some-lock"
+					}
+				}`, gitRepo, strings.TrimSpace(string(sha)))
+
+			runIn(jsonIn, inDestination, 0)
+
+			Ω(filepath.Join(inDestination, "claimed_at")).ShouldNot(BeAnExistingFile())
+			Ω(filepath.Join(inDestination, "claimer")).ShouldNot(BeAnExistingFile())
+
+			fileContents, err := ioutil.ReadFile(filepath.Join(inDestination, "claim.json"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(fileContents)).Should(ContainSubstring(`"state": "unclaimed"`))
+			Ω(string(fileContents)).ShouldNot(ContainSubstring("claimer"))
+		})
+
+		It("passes along the fencing token of the claim", func() {
+			fence := exec.Command("bash", "-e", "-c", `
+				mkdir -p lock-pool/.fencing
+				echo 3 > lock-pool/.fencing/some-lock
+				git add lock-pool/.fencing/some-lock
+				git commit --amend --no-edit
+			`)
+			fence.Dir = gitRepo
+			Ω(fence.Run()).Should(Succeed())
+
+			gitVersion := exec.Command("git", "rev-parse", "HEAD")
+			gitVersion.Dir = gitRepo
+			sha, err := gitVersion.Output()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			jsonIn := fmt.Sprintf(`
+				{
+					"source": {
+						"uri": "%s",
+						"branch": "master",
+						"pool": "lock-pool"
+					},
+					"version": {
+						"ref": "%s",
+						"lock": "some-lock"
+					}
+				}`, gitRepo, strings.TrimSpace(string(sha)))
+
+			runIn(jsonIn, inDestination, 0)
+
+			fileContents, err := ioutil.ReadFile(filepath.Join(inDestination, "fencing_token"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(strings.TrimSpace(string(fileContents))).Should(Equal("3"))
+
+			fileContents, err = ioutil.ReadFile(filepath.Join(inDestination, "name"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(strings.TrimSpace(string(fileContents))).Should(Equal("some-lock"))
+		})
+
+		It("writes a report of the pool's use when asked to", func() {
+			cycle := exec.Command("bash", "-e", "-c", `
+				git mv lock-pool/unclaimed/some-other-lock lock-pool/claimed/some-other-lock
+				git commit -m 'claiming some-other-lock'
+				git mv lock-pool/claimed/some-other-lock lock-pool/unclaimed/some-other-lock
+				git commit -m 'unclaiming some-other-lock'
+			`)
+			cycle.Dir = gitRepo
+			Ω(cycle.Run()).Should(Succeed())
+
+			gitVersion := exec.Command("git", "rev-parse", "HEAD")
+			gitVersion.Dir = gitRepo
+			sha, err := gitVersion.Output()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			jsonIn := fmt.Sprintf(`
+				{
+					"source": {
+						"uri": "%s",
+						"branch": "master",
+						"pool": "lock-pool"
+					},
+					"version": {
+						"ref": "%s",
+						"lock": "some-lock"
+					},
+					"params": {
+						"report": true,
+						"report_window": "1 week"
+					}
+				}`, gitRepo, strings.TrimSpace(string(sha)))
+
+			runIn(jsonIn, inDestination, 0)
+
+			contents, err := ioutil.ReadFile(filepath.Join(inDestination, "report.json"))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			var report struct {
+				Window string         `json:"window"`
+				Counts map[string]int `json:"counts"`
+				Locks  []struct {
+					Name    string `json:"name"`
+					Claims  int    `json:"claims"`
+					Claimed bool   `json:"claimed"`
+				} `json:"locks"`
+				TopClaimers []struct {
+					Claimer string `json:"claimer"`
+					Claims  int    `json:"claims"`
+				} `json:"top_claimers"`
+			}
+			Ω(json.Unmarshal(contents, &report)).Should(Succeed())
+
+			Ω(report.Window).Should(Equal("1 week"))
+			Ω(report.Counts).Should(Equal(map[string]int{"claimed": 1, "unclaimed": 1}))
+
+			Ω(report.Locks).Should(HaveLen(2))
+			Ω(report.Locks[0].Name).Should(Equal("some-lock"))
+			Ω(report.Locks[0].Claims).Should(Equal(1))
+			Ω(report.Locks[0].Claimed).Should(BeTrue())
+			Ω(report.Locks[1].Name).Should(Equal("some-other-lock"))
+			Ω(report.Locks[1].Claimed).Should(BeFalse())
+
+			Ω(report.TopClaimers).Should(HaveLen(1))
+			Ω(report.TopClaimers[0].Claimer).Should(Equal("Ginkgo Local <ginkgo@localhost>"))
+			Ω(report.TopClaimers[0].Claims).Should(Equal(2))
+		})
+
 		Context("when the lock from the previous version has been released and we are trying to run it again", func() {
 			var sha []byte
 
@@ -241,4 +603,103 @@ var _ = Describe("In", func() {
 			})
 		})
 	})
+
+	Context("when fetching a lock by name", func() {
+		BeforeEach(func() {
+			setupGitRepo(gitRepo)
+		})
+
+		It("outputs the lock's current metadata and state without claiming it", func() {
+			jsonIn := fmt.Sprintf(`
+				{
+					"source": {
+						"uri": "%s",
+						"branch": "master",
+						"pool": "lock-pool"
+					},
+					"params": {
+						"lock_name": "some-other-lock"
+					}
+				}`, gitRepo)
+
+			session := runIn(jsonIn, inDestination, 0)
+
+			err := json.Unmarshal(session.Out.Contents(), &output)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(output.Metadata).Should(Equal([]metadataPair{
+				{Name: "lock_name", Value: "some-other-lock"},
+				{Name: "pool_name", Value: "lock-pool"},
+				{Name: "lock_state", Value: "unclaimed"},
+			}))
+
+			fileContents, err := ioutil.ReadFile(filepath.Join(inDestination, "metadata"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(fileContents).Should(MatchJSON(`{"some":"wrong-json"}`))
+
+			fileContents, err = ioutil.ReadFile(filepath.Join(inDestination, "state"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(strings.TrimSpace(string(fileContents))).Should(Equal("unclaimed"))
+		})
+
+		It("shows the selected keys of the lock's metadata", func() {
+			jsonIn := fmt.Sprintf(`
+				{
+					"source": {
+						"uri": "%s",
+						"branch": "master",
+						"pool": "lock-pool",
+						"show_metadata_keys": ["some", "missing"]
+					},
+					"params": {
+						"lock_name": "some-lock"
+					}
+				}`, gitRepo)
+
+			session := runIn(jsonIn, inDestination, 0)
+
+			err := json.Unmarshal(session.Out.Contents(), &output)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(output.Metadata).Should(ContainElement(metadataPair{Name: "some", Value: "json"}))
+			Ω(output.Metadata).Should(HaveLen(4))
+		})
+
+		It("shows small metadata whole", func() {
+			jsonIn := fmt.Sprintf(`
+				{
+					"source": {
+						"uri": "%s",
+						"branch": "master",
+						"pool": "lock-pool",
+						"show_metadata": true
+					},
+					"params": {
+						"lock_name": "some-lock"
+					}
+				}`, gitRepo)
+
+			session := runIn(jsonIn, inDestination, 0)
+
+			err := json.Unmarshal(session.Out.Contents(), &output)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(output.Metadata).Should(ContainElement(metadataPair{Name: "metadata", Value: `{"some":"json"}`}))
+		})
+
+		It("fails when the pool has no such lock", func() {
+			jsonIn := fmt.Sprintf(`
+				{
+					"source": {
+						"uri": "%s",
+						"branch": "master",
+						"pool": "lock-pool"
+					},
+					"params": {
+						"lock_name": "no-such-lock"
+					}
+				}`, gitRepo)
+
+			session := runIn(jsonIn, inDestination, 1)
+
+			Ω(session.Err).Should(gbytes.Say("error: lock no-such-lock does not exist in pool lock-pool"))
+		})
+	})
 })
@@ -7,6 +7,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/concourse/pool-resource/out"
 	. "github.com/onsi/ginkgo"
@@ -23,6 +24,7 @@ func TestIntegration(t *testing.T) {
 
 var outPath string
 var inPath string
+var poolctlPath string
 
 var _ = BeforeSuite(func() {
 	var err error
@@ -30,6 +32,9 @@ var _ = BeforeSuite(func() {
 	outPath, err = gexec.Build("github.com/concourse/pool-resource/cmd/out")
 	Ω(err).ShouldNot(HaveOccurred())
 
+	poolctlPath, err = gexec.Build("github.com/concourse/pool-resource/cmd/poolctl")
+	Ω(err).ShouldNot(HaveOccurred())
+
 	pwd, err := os.Getwd()
 	Ω(err).ShouldNot(HaveOccurred())
 	inPath = filepath.Join(pwd, "../assets/in")
@@ -63,7 +68,7 @@ func runIn(inJson string, destination string, expectedExitCode int) *gexec.Sessi
 
 	Ω(err).ShouldNot(HaveOccurred())
 
-	Eventually(session).Should(gexec.Exit(expectedExitCode))
+	Eventually(session, 10*time.Second).Should(gexec.Exit(expectedExitCode))
 
 	return session
 }
@@ -83,6 +88,17 @@ func runOut(request out.OutRequest, sourceDir string) *gexec.Session {
 	return session
 }
 
+// errorResponse reads the structured error that ends the log of a failed out.
+func errorResponse(session *gexec.Session) out.ErrorResponse {
+	lines := strings.Split(strings.TrimSpace(string(session.Err.Contents())), "\n")
+
+	var response out.ErrorResponse
+	err := json.Unmarshal([]byte(lines[len(lines)-1]), &response)
+	Ω(err).ShouldNot(HaveOccurred())
+
+	return response
+}
+
 func setupGitRepo(dir string) {
 	gitSetup := exec.Command("bash", "-e", "-c", `
 	  git init
@@ -117,6 +133,42 @@ func setupGitRepo(dir string) {
 	Ω(err).ShouldNot(HaveOccurred())
 }
 
+// setupAgedGitRepo sets up a pool that has been in use for years: four locks
+// added in early 2020, the first of them claimed ever since and the second
+// claimed and released again.
+func setupAgedGitRepo(dir string) {
+	gitSetup := exec.Command("bash", "-e", "-c", `
+		git init -q
+		git config user.email "ginkgo@localhost"
+		git config user.name "Ginkgo Local"
+
+		mkdir -p lock-pool/unclaimed lock-pool/claimed
+		touch lock-pool/unclaimed/.gitkeep lock-pool/claimed/.gitkeep
+
+		for day in 1 2 3 4; do
+			echo "{}" > lock-pool/unclaimed/lock-$day
+			git add .
+			GIT_AUTHOR_DATE=2020-01-0${day}T00:00:00Z GIT_COMMITTER_DATE=2020-01-0${day}T00:00:00Z git commit -q -m "adding: lock-$day"
+		done
+
+		git mv lock-pool/unclaimed/lock-1 lock-pool/claimed/lock-1
+		GIT_AUTHOR_DATE=2020-01-05T00:00:00Z GIT_COMMITTER_DATE=2020-01-05T00:00:00Z git commit -q -m "claiming: lock-1"
+
+		git mv lock-pool/unclaimed/lock-2 lock-pool/claimed/lock-2
+		GIT_AUTHOR_DATE=2020-01-06T00:00:00Z GIT_COMMITTER_DATE=2020-01-06T00:00:00Z git commit -q -m "claiming: lock-2"
+
+		git mv lock-pool/claimed/lock-2 lock-pool/unclaimed/lock-2
+		GIT_AUTHOR_DATE=2020-01-07T00:00:00Z GIT_COMMITTER_DATE=2020-01-07T00:00:00Z git commit -q -m "unclaiming: lock-2"
+	`)
+	gitSetup.Dir = dir
+
+	gitSetup.Stderr = GinkgoWriter
+	gitSetup.Stdout = GinkgoWriter
+
+	err := gitSetup.Run()
+	Ω(err).ShouldNot(HaveOccurred())
+}
+
 func getVersion(gitURI string, ref string) out.Version {
 	gitVersionRepo, err := ioutil.TempDir("", "git-version-repo")
 	Ω(err).ShouldNot(HaveOccurred())
@@ -133,7 +185,13 @@ func getVersion(gitURI string, ref string) out.Version {
 	sha, err := gitVersion.Output()
 	Ω(err).ShouldNot(HaveOccurred())
 
+	changedPaths := exec.Command("git", "diff-tree", "--no-commit-id", "--name-only", "-r", ref)
+	changedPaths.Dir = gitVersionRepo
+	paths, err := changedPaths.Output()
+	Ω(err).ShouldNot(HaveOccurred())
+
 	return out.Version{
-		Ref: strings.TrimSpace(string(sha)),
+		Ref:  strings.TrimSpace(string(sha)),
+		Lock: filepath.Base(strings.Split(strings.TrimSpace(string(paths)), "\n")[0]),
 	}
 }
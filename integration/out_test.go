@@ -2,12 +2,16 @@ package integration_test
 
 import (
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
+	"net/http/cgi"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -98,7 +102,7 @@ func itWorksWithBranch(branchName string) {
 				It("complains about it", func() {
 					errorMessages := string(session.Err.Contents())
 
-					Ω(errorMessages).Should(ContainSubstring("invalid payload (missing uri)"))
+					Ω(errorMessages).Should(ContainSubstring("invalid payload: source.uri is required"))
 				})
 			})
 
@@ -110,7 +114,15 @@ func itWorksWithBranch(branchName string) {
 				It("complains about it", func() {
 					errorMessages := string(session.Err.Contents())
 
-					Ω(errorMessages).Should(ContainSubstring("invalid payload (missing pool)"))
+					Ω(errorMessages).Should(ContainSubstring("invalid payload: source.pool is required"))
+				})
+
+				It("ends the log with a structured error", func() {
+					Ω(errorResponse(session)).Should(Equal(out.ErrorResponse{Error: out.ErrorDetail{
+						Category: "invalid_request",
+						Message:  "invalid payload: source.pool is required",
+						Doing:    "validating request",
+					}}))
 				})
 			})
 
@@ -122,7 +134,7 @@ func itWorksWithBranch(branchName string) {
 				It("complains about it", func() {
 					errorMessages := string(session.Err.Contents())
 
-					Ω(errorMessages).Should(ContainSubstring("invalid payload (missing branch)"))
+					Ω(errorMessages).Should(ContainSubstring("invalid payload: source.branch is required"))
 				})
 			})
 
@@ -134,12 +146,14 @@ func itWorksWithBranch(branchName string) {
 				It("complains about it", func() {
 					errorMessages := string(session.Err.Contents())
 
-					Ω(errorMessages).Should(ContainSubstring("invalid payload (missing acquire, release, remove, or add)"))
+					Ω(errorMessages).Should(ContainSubstring("invalid payload: params must include one of acquire, reserve, confirm, heartbeat, transfer, release, release_matching, release_all_mine, remove, remove_matching, remove_list, add, disable, enable, quarantine, rename, pause_pool, unpause_pool, squash_history, revert, or destroy_pool"))
 				})
 			})
 		})
 
 		Context("When acquiring a lock", func() {
+			var session *gexec.Session
+
 			BeforeEach(func() {
 				outRequest = out.OutRequest{
 					Source: out.Source{
@@ -153,13 +167,17 @@ func itWorksWithBranch(branchName string) {
 					},
 				}
 
-				session := runOut(outRequest, sourceDir)
+				session = runOut(outRequest, sourceDir)
 				Eventually(session).Should(gexec.Exit(0))
 
 				err := json.Unmarshal(session.Out.Contents(), &outResponse)
 				Ω(err).ShouldNot(HaveOccurred())
 			})
 
+			It("speaks git protocol version 2 to a remote that supports it", func() {
+				Ω(session.Err.Contents()).ShouldNot(ContainSubstring("git protocol"))
+			})
+
 			It("moves a lock to claimed", func() {
 				version := getVersion(bareGitRepo, "origin/"+branchName)
 
@@ -186,13 +204,22 @@ func itWorksWithBranch(branchName string) {
 					}
 				}
 
-				Ω(outResponse).Should(Equal(out.OutResponse{
-					Version: version,
-					Metadata: []out.MetadataPair{
-						{Name: "lock_name", Value: lockFile},
-						{Name: "pool_name", Value: "lock-pool"},
-					},
+				Ω(outResponse.Version).Should(Equal(version))
+				Ω(outResponse.Metadata).Should(HaveLen(6))
+				Ω(outResponse.Metadata[:2]).Should(Equal([]out.MetadataPair{
+					{Name: "lock_name", Value: lockFile},
+					{Name: "pool_name", Value: "lock-pool"},
 				}))
+				Ω(outResponse.Metadata[3:]).Should(Equal([]out.MetadataPair{
+					{Name: "fencing_token", Value: "1"},
+					{Name: "claimed_count", Value: "1"},
+					{Name: "unclaimed_count", Value: "1"},
+				}))
+
+				token, err := ioutil.ReadFile(filepath.Join(reCloneRepo, "lock-pool", ".fencing", lockFile))
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(string(token)).Should(Equal("1\n"))
+				Ω(outResponse.Metadata[2].Name).Should(Equal("wait_duration"))
 			})
 		})
 
@@ -263,15 +290,20 @@ func itWorksWithBranch(branchName string) {
 				err = json.Unmarshal(session.Out.Contents(), &outResponse)
 				Ω(err).ShouldNot(HaveOccurred())
 
-				Ω(outResponse).Should(Equal(out.OutResponse{
-					Version: out.Version{
-						Ref: outResponse.Version.Ref,
-					},
-					Metadata: []out.MetadataPair{
-						{Name: "lock_name", Value: "some-lock"},
-						{Name: "pool_name", Value: "lock-pool"},
-					},
+				Ω(outResponse.Metadata).Should(HaveLen(6))
+				Ω(outResponse.Metadata[:2]).Should(Equal([]out.MetadataPair{
+					{Name: "lock_name", Value: "some-lock"},
+					{Name: "pool_name", Value: "lock-pool"},
+				}))
+				Ω(outResponse.Metadata[4:]).Should(Equal([]out.MetadataPair{
+					{Name: "claimed_count", Value: "2"},
+					{Name: "unclaimed_count", Value: "0"},
 				}))
+
+				Ω(outResponse.Metadata[2].Name).Should(Equal("wait_duration"))
+				waited, err := time.ParseDuration(outResponse.Metadata[2].Value)
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(waited).Should(BeNumerically(">=", 2*time.Second))
 			})
 		})
 
@@ -377,6 +409,8 @@ func itWorksWithBranch(branchName string) {
 					Metadata: []out.MetadataPair{
 						{Name: "lock_name", Value: removedLockName},
 						{Name: "pool_name", Value: "lock-pool"},
+						{Name: "claimed_count", Value: "0"},
+						{Name: "unclaimed_count", Value: "1"},
 					},
 				}))
 			})
@@ -484,9 +518,30 @@ func itWorksWithBranch(branchName string) {
 					Metadata: []out.MetadataPair{
 						{Name: "lock_name", Value: releasedLockName},
 						{Name: "pool_name", Value: "lock-pool"},
+						{Name: "claimed_count", Value: "0"},
+						{Name: "unclaimed_count", Value: "2"},
 					},
 				}))
 			})
+
+			It("fails to release it again unless a missing claim is allowed", func() {
+				session := runOut(outReleaseRequest, myLocksGetDir)
+				Eventually(session).Should(gexec.Exit(1))
+				Ω(session.Err).Should(gbytes.Say("is not claimed in pool lock-pool"))
+
+				outReleaseRequest.Params.AllowMissing = true
+
+				session = runOut(outReleaseRequest, myLocksGetDir)
+				Eventually(session).Should(gexec.Exit(0))
+				Ω(session.Err).Should(gbytes.Say("is not claimed, so there is nothing to release"))
+
+				var response out.OutResponse
+				err := json.Unmarshal(session.Out.Contents(), &response)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(response.Version).Should(Equal(outReleaseResponse.Version))
+				Ω(response.Metadata).Should(ContainElement(out.MetadataPair{Name: "already_released", Value: "true"}))
+			})
 		})
 
 		Context("when adding a lock to the pool", func() {
@@ -552,6 +607,73 @@ func itWorksWithBranch(branchName string) {
 			})
 		})
 
+		Context("when adding several locks from a directory", func() {
+			var lockToAddDir string
+
+			BeforeEach(func() {
+				var err error
+				lockToAddDir, err = ioutil.TempDir("", "locks-to-add")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				locksDir := filepath.Join(lockToAddDir, "environments")
+				err = os.Mkdir(locksDir, 0755)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				err = ioutil.WriteFile(filepath.Join(locksDir, "env-1"), []byte("one"), 0555)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				err = ioutil.WriteFile(filepath.Join(locksDir, "env-2"), []byte("two"), 0555)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				outRequest = out.OutRequest{
+					Source: out.Source{
+						URI:        bareGitRepo,
+						Branch:     branchName,
+						Pool:       "lock-pool",
+						RetryDelay: 100 * time.Millisecond,
+					},
+					Params: out.OutParams{
+						Add: "environments",
+					},
+				}
+
+				session := runOut(outRequest, lockToAddDir)
+				Eventually(session).Should(gexec.Exit(0))
+
+				err = json.Unmarshal(session.Out.Contents(), &outResponse)
+				Ω(err).ShouldNot(HaveOccurred())
+			})
+
+			AfterEach(func() {
+				err := os.RemoveAll(lockToAddDir)
+				Ω(err).ShouldNot(HaveOccurred())
+			})
+
+			It("adds every lock in a single commit", func() {
+				lsTree := exec.Command("git", "ls-tree", "--name-only", branchName, "lock-pool/unclaimed/")
+				lsTree.Dir = bareGitRepo
+				files, err := lsTree.Output()
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(string(files)).Should(ContainSubstring("lock-pool/unclaimed/env-1\n"))
+				Ω(string(files)).Should(ContainSubstring("lock-pool/unclaimed/env-2\n"))
+
+				show := exec.Command("git", "show", branchName+":lock-pool/unclaimed/env-2")
+				show.Dir = bareGitRepo
+				contents, err := show.Output()
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(string(contents)).Should(Equal("two"))
+
+				log := exec.Command("git", "log", "-1", "--format=%s", branchName)
+				log.Dir = bareGitRepo
+				subject, err := log.Output()
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(string(subject)).Should(Equal("adding: env-1, env-2\n"))
+
+				Ω(outResponse.Metadata).Should(ContainElement(out.MetadataPair{Name: "added_locks", Value: "env-1, env-2"}))
+			})
+		})
+
 		Context("when 2 processes are acquiring a lock at the same time", func() {
 			var sessionOne *gexec.Session
 			var sessionTwo *gexec.Session
@@ -714,3 +836,3512 @@ func itWorksWithBranch(branchName string) {
 		})
 	})
 }
+
+var _ = Describe("Out with a pool in a submodule", func() {
+	var locksRepo string
+	var bareLocksRepo string
+	var superRepo string
+	var bareSuperRepo string
+	var sourceDir string
+
+	BeforeEach(func() {
+		var err error
+		locksRepo, err = ioutil.TempDir("", "locks-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		bareLocksRepo, err = ioutil.TempDir("", "bare-locks-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		superRepo, err = ioutil.TempDir("", "super-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		bareSuperRepo, err = ioutil.TempDir("", "bare-super-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		sourceDir, err = ioutil.TempDir("", "source-dir")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		// local submodule URIs are refused by default since git 2.38.1
+		os.Setenv("GIT_CONFIG_COUNT", "1")
+		os.Setenv("GIT_CONFIG_KEY_0", "protocol.file.allow")
+		os.Setenv("GIT_CONFIG_VALUE_0", "always")
+
+		setupGitRepo(locksRepo)
+
+		superSetup := exec.Command("bash", "-e", "-c", fmt.Sprintf(`
+			git clone --bare %s %s
+
+			git init
+			git checkout -b master
+
+			git config user.email "ginkgo@localhost"
+			git config user.name "Ginkgo Local"
+
+			git submodule add %s locks
+			git commit -m 'adding locks submodule'
+
+			git clone --bare . %s
+		`, locksRepo, bareLocksRepo, bareLocksRepo, bareSuperRepo))
+		superSetup.Dir = superRepo
+		superSetup.Stdout = GinkgoWriter
+		superSetup.Stderr = GinkgoWriter
+
+		err = superSetup.Run()
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.Unsetenv("GIT_CONFIG_COUNT")
+		os.Unsetenv("GIT_CONFIG_KEY_0")
+		os.Unsetenv("GIT_CONFIG_VALUE_0")
+
+		for _, dir := range []string{locksRepo, bareLocksRepo, superRepo, bareSuperRepo, sourceDir} {
+			err := os.RemoveAll(dir)
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+	})
+
+	It("claims the lock by pushing to the submodule", func() {
+		session := runOut(out.OutRequest{
+			Source: out.Source{
+				URI:        bareSuperRepo,
+				Branch:     "master",
+				Pool:       "locks/lock-pool",
+				RetryDelay: 100 * time.Millisecond,
+				Submodules: out.Submodules{All: true},
+			},
+			Params: out.OutParams{
+				Acquire: true,
+			},
+		}, sourceDir)
+		Eventually(session).Should(gexec.Exit(0))
+
+		var outResponse out.OutResponse
+		err := json.Unmarshal(session.Out.Contents(), &outResponse)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(outResponse.Version.Ref).Should(Equal(getVersion(bareLocksRepo, "origin/master").Ref))
+	})
+})
+
+var _ = Describe("Out with a branch that doesn't exist yet", func() {
+	var gitRepo string
+	var bareGitRepo string
+	var sourceDir string
+
+	var outRequest out.OutRequest
+
+	BeforeEach(func() {
+		var err error
+		gitRepo, err = ioutil.TempDir("", "git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		bareGitRepo, err = ioutil.TempDir("", "bare-git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		sourceDir, err = ioutil.TempDir("", "source-dir")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		setupGitRepo(gitRepo)
+
+		bareGitSetup := exec.Command("git", "clone", "--bare", gitRepo, ".")
+		bareGitSetup.Dir = bareGitRepo
+
+		err = bareGitSetup.Run()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		outRequest = out.OutRequest{
+			Source: out.Source{
+				URI:        bareGitRepo,
+				Branch:     "brand-new-branch",
+				Pool:       "lock-pool",
+				RetryDelay: 100 * time.Millisecond,
+			},
+			Params: out.OutParams{
+				Acquire: true,
+			},
+		}
+	})
+
+	AfterEach(func() {
+		for _, dir := range []string{gitRepo, bareGitRepo, sourceDir} {
+			err := os.RemoveAll(dir)
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+	})
+
+	It("fails without create_branch", func() {
+		session := runOut(outRequest, sourceDir)
+		Eventually(session).Should(gexec.Exit(1))
+	})
+
+	Context("with create_branch", func() {
+		BeforeEach(func() {
+			outRequest.Source.CreateBranch = true
+		})
+
+		It("creates the branch from the default branch and claims a lock on it", func() {
+			session := runOut(outRequest, sourceDir)
+			Eventually(session).Should(gexec.Exit(0))
+
+			var outResponse out.OutResponse
+			err := json.Unmarshal(session.Out.Contents(), &outResponse)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(outResponse.Version).Should(Equal(getVersion(bareGitRepo, "origin/brand-new-branch")))
+			Ω(outResponse.Version).ShouldNot(Equal(getVersion(bareGitRepo, "origin/master")))
+		})
+	})
+})
+
+var _ = Describe("Out with custom state directories", func() {
+	var gitRepo string
+	var bareGitRepo string
+	var sourceDir string
+
+	BeforeEach(func() {
+		var err error
+		gitRepo, err = ioutil.TempDir("", "git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		bareGitRepo, err = ioutil.TempDir("", "bare-git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		sourceDir, err = ioutil.TempDir("", "source-dir")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		setupGitRepo(gitRepo)
+
+		relayout := exec.Command("bash", "-e", "-c", fmt.Sprintf(`
+			git mv lock-pool/unclaimed lock-pool/available
+			git mv lock-pool/claimed lock-pool/in-use
+			git commit -m 'switching layout'
+
+			git clone --bare . %s
+		`, bareGitRepo))
+		relayout.Dir = gitRepo
+
+		err = relayout.Run()
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		for _, dir := range []string{gitRepo, bareGitRepo, sourceDir} {
+			err := os.RemoveAll(dir)
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+	})
+
+	It("moves a lock between the configured directories", func() {
+		session := runOut(out.OutRequest{
+			Source: out.Source{
+				URI:        bareGitRepo,
+				Branch:     "master",
+				Pool:       "lock-pool",
+				RetryDelay: 100 * time.Millisecond,
+				Paths: out.Paths{
+					Unclaimed: "available",
+					Claimed:   "in-use",
+				},
+			},
+			Params: out.OutParams{
+				Acquire: true,
+			},
+		}, sourceDir)
+		Eventually(session).Should(gexec.Exit(0))
+
+		reCloneRepo, err := ioutil.TempDir("", "git-version-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		defer os.RemoveAll(reCloneRepo)
+
+		reClone := exec.Command("git", "clone", bareGitRepo, ".")
+		reClone.Dir = reCloneRepo
+		err = reClone.Run()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		claimedFiles, err := ioutil.ReadDir(filepath.Join(reCloneRepo, "lock-pool", "in-use"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(claimedFiles).Should(HaveLen(2))
+
+		unclaimedFiles, err := ioutil.ReadDir(filepath.Join(reCloneRepo, "lock-pool", "available"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(unclaimedFiles).Should(HaveLen(2))
+	})
+})
+
+var _ = Describe("Out changing the state of a claimed lock", func() {
+	var gitRepo string
+	var bareGitRepo string
+	var sourceDir string
+
+	var source out.Source
+
+	BeforeEach(func() {
+		var err error
+		gitRepo, err = ioutil.TempDir("", "git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		bareGitRepo, err = ioutil.TempDir("", "bare-git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		sourceDir, err = ioutil.TempDir("", "source-dir")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		setupGitRepo(gitRepo)
+
+		claimLock := exec.Command("bash", "-e", "-c", fmt.Sprintf(`
+			git mv lock-pool/unclaimed/some-lock lock-pool/claimed/some-lock
+			git commit -m 'claiming some-lock'
+
+			git clone --bare . %s
+		`, bareGitRepo))
+		claimLock.Dir = gitRepo
+
+		err = claimLock.Run()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		err = os.Mkdir(filepath.Join(sourceDir, "some-lock"), 0755)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		err = ioutil.WriteFile(filepath.Join(sourceDir, "some-lock", "name"), []byte("some-lock"), 0644)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		source = out.Source{
+			URI:        bareGitRepo,
+			Branch:     "master",
+			Pool:       "lock-pool",
+			RetryDelay: 100 * time.Millisecond,
+		}
+	})
+
+	AfterEach(func() {
+		for _, dir := range []string{gitRepo, bareGitRepo, sourceDir} {
+			err := os.RemoveAll(dir)
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+	})
+
+	lockStateAfter := func(params out.OutParams) string {
+		session := runOut(out.OutRequest{Source: source, Params: params}, sourceDir)
+		Eventually(session).Should(gexec.Exit(0))
+
+		reCloneRepo, err := ioutil.TempDir("", "git-version-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		defer os.RemoveAll(reCloneRepo)
+
+		reClone := exec.Command("git", "clone", bareGitRepo, ".")
+		reClone.Dir = reCloneRepo
+		err = reClone.Run()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		matches, err := filepath.Glob(filepath.Join(reCloneRepo, "lock-pool", "*", "some-lock"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(matches).Should(HaveLen(1))
+
+		return filepath.Base(filepath.Dir(matches[0]))
+	}
+
+	It("moves the lock into maintenance and back into circulation", func() {
+		Ω(lockStateAfter(out.OutParams{Disable: "some-lock"})).Should(Equal("maintenance"))
+		Ω(lockStateAfter(out.OutParams{Enable: "some-lock"})).Should(Equal("unclaimed"))
+	})
+
+	It("moves a broken lock into quarantine", func() {
+		Ω(lockStateAfter(out.OutParams{Quarantine: "some-lock", Reason: "disk full"})).Should(Equal("broken"))
+
+		log := exec.Command("git", "log", "-1", "--format=%B")
+		log.Dir = bareGitRepo
+		message, err := log.Output()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(string(message)).Should(ContainSubstring("quarantining: some-lock"))
+		Ω(string(message)).Should(ContainSubstring("disk full"))
+	})
+
+	It("releases every claimed lock matching a pattern in one commit", func() {
+		session := runOut(out.OutRequest{Source: source, Params: out.OutParams{Acquire: true}}, sourceDir)
+		Eventually(session).Should(gexec.Exit(0))
+
+		session = runOut(out.OutRequest{Source: source, Params: out.OutParams{ReleaseMatching: "some-*"}}, sourceDir)
+		Eventually(session).Should(gexec.Exit(0))
+
+		var response out.OutResponse
+		err := json.Unmarshal(session.Out.Contents(), &response)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(response.Metadata).Should(ContainElement(out.MetadataPair{Name: "released_locks", Value: "some-lock, some-other-lock"}))
+
+		lsTree := exec.Command("git", "ls-tree", "--name-only", "master", "lock-pool/unclaimed/")
+		lsTree.Dir = bareGitRepo
+		unclaimed, err := lsTree.Output()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(strings.Fields(string(unclaimed))).Should(ContainElement("lock-pool/unclaimed/some-lock"))
+		Ω(strings.Fields(string(unclaimed))).Should(ContainElement("lock-pool/unclaimed/some-other-lock"))
+
+		log := exec.Command("git", "log", "-1", "--format=%s")
+		log.Dir = bareGitRepo
+		message, err := log.Output()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(message)).Should(Equal("unclaiming: some-lock, some-other-lock\n"))
+	})
+
+	It("removes claimed and unclaimed locks matching a pattern in one commit", func() {
+		session := runOut(out.OutRequest{Source: source, Params: out.OutParams{RemoveMatching: "some-*"}}, sourceDir)
+		Eventually(session).Should(gexec.Exit(0))
+
+		var response out.OutResponse
+		err := json.Unmarshal(session.Out.Contents(), &response)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(response.Metadata).Should(ContainElement(out.MetadataPair{Name: "removed_locks", Value: "some-lock, some-other-lock"}))
+
+		lsTree := exec.Command("git", "ls-tree", "-r", "--name-only", "master", "lock-pool/")
+		lsTree.Dir = bareGitRepo
+		files, err := lsTree.Output()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(files)).ShouldNot(ContainSubstring("some-lock"))
+		Ω(string(files)).ShouldNot(ContainSubstring("some-other-lock"))
+
+		log := exec.Command("git", "log", "-1", "--format=%s")
+		log.Dir = bareGitRepo
+		message, err := log.Output()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(message)).Should(Equal("removing: some-lock, some-other-lock\n"))
+	})
+
+	It("ends the log of a failed change with a structured error", func() {
+		err := os.MkdirAll(filepath.Join(sourceDir, "some-other-lock"), 0755)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		err = ioutil.WriteFile(filepath.Join(sourceDir, "some-other-lock", "name"), []byte("some-other-lock"), 0644)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		session := runOut(out.OutRequest{Source: source, Params: out.OutParams{Release: "some-other-lock"}}, sourceDir)
+		Eventually(session).Should(gexec.Exit(1))
+
+		response := errorResponse(session)
+		Ω(response.Error.Category).Should(Equal("operation"))
+		Ω(response.Error.Message).Should(ContainSubstring("lock some-other-lock is not claimed"))
+		Ω(response.Error.Retryable).Should(BeFalse())
+		Ω(response.Error.Doing).Should(Equal("releasing lock"))
+	})
+
+	It("writes added locks with the source's lock_file_mode", func() {
+		err := os.MkdirAll(filepath.Join(sourceDir, "new-locks"), 0755)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		err = ioutil.WriteFile(filepath.Join(sourceDir, "new-locks", "plain-lock"), []byte("contents"), 0644)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		mode := func(lock string) string {
+			lsTree := exec.Command("git", "ls-tree", "master", "lock-pool/unclaimed/"+lock)
+			lsTree.Dir = bareGitRepo
+			output, err := lsTree.Output()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			return strings.Fields(string(output))[0]
+		}
+
+		session := runOut(out.OutRequest{Source: source, Params: out.OutParams{Add: "new-locks"}}, sourceDir)
+		Eventually(session).Should(gexec.Exit(0))
+		Ω(mode("plain-lock")).Should(Equal("100755"))
+
+		source.LockFileMode = "0644"
+
+		session = runOut(out.OutRequest{Source: source, Params: out.OutParams{Add: "new-locks", Overwrite: true}}, sourceDir)
+		Eventually(session).Should(gexec.Exit(0))
+		Ω(mode("plain-lock")).Should(Equal("100644"))
+	})
+
+	It("refuses to add a lock that is already in the pool unless told to overwrite it", func() {
+		err := os.MkdirAll(filepath.Join(sourceDir, "existing-lock"), 0755)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		err = ioutil.WriteFile(filepath.Join(sourceDir, "existing-lock", "name"), []byte("some-lock"), 0644)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		err = ioutil.WriteFile(filepath.Join(sourceDir, "existing-lock", "metadata"), []byte(`{"replaced":true}`), 0644)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		session := runOut(out.OutRequest{Source: source, Params: out.OutParams{Add: "existing-lock"}}, sourceDir)
+		Eventually(session).Should(gexec.Exit(1))
+		Ω(session.Err).Should(gbytes.Say("lock some-lock is already in pool lock-pool, in claimed, and can't be overwritten"))
+
+		session = runOut(out.OutRequest{Source: source, Params: out.OutParams{Add: "existing-lock", Overwrite: true}}, sourceDir)
+		Eventually(session).Should(gexec.Exit(1))
+		Ω(session.Err).Should(gbytes.Say("lock some-lock is already in pool lock-pool, in claimed, and can't be overwritten"))
+
+		session = runOut(out.OutRequest{Source: source, Params: out.OutParams{Release: "existing-lock"}}, sourceDir)
+		Eventually(session).Should(gexec.Exit(0))
+
+		session = runOut(out.OutRequest{Source: source, Params: out.OutParams{Add: "existing-lock"}}, sourceDir)
+		Eventually(session).Should(gexec.Exit(1))
+		Ω(session.Err).Should(gbytes.Say("lock some-lock is already in pool lock-pool; set params.overwrite to replace its metadata"))
+
+		session = runOut(out.OutRequest{Source: source, Params: out.OutParams{Add: "existing-lock", Overwrite: true}}, sourceDir)
+		Eventually(session).Should(gexec.Exit(0))
+
+		show := exec.Command("git", "show", "master:lock-pool/unclaimed/some-lock")
+		show.Dir = bareGitRepo
+		contents, err := show.Output()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(contents)).Should(Equal(`{"replaced":true}`))
+	})
+
+	Context("when the image's git config gives an identity", func() {
+		BeforeEach(func() {
+			gitConfig := filepath.Join(sourceDir, "gitconfig")
+			err := ioutil.WriteFile(gitConfig, []byte("[user]\n\tname = Image Builder\n\temail = builder@example.com\n"), 0644)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			os.Setenv("GIT_CONFIG_GLOBAL", gitConfig)
+		})
+
+		AfterEach(func() {
+			os.Unsetenv("GIT_CONFIG_GLOBAL")
+		})
+
+		author := func() string {
+			session := runOut(out.OutRequest{Source: source, Params: out.OutParams{Release: "some-lock"}}, sourceDir)
+			Eventually(session).Should(gexec.Exit(0))
+
+			log := exec.Command("git", "log", "-1", "--format=%an <%ae>")
+			log.Dir = bareGitRepo
+			output, err := log.Output()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			return strings.TrimSpace(string(output))
+		}
+
+		It("commits as the resource by default", func() {
+			Ω(author()).Should(Equal("CI Pool Resource <ci-pool@localhost>"))
+		})
+
+		It("keeps that identity with inherit_git_config", func() {
+			source.InheritGitConfig = true
+
+			Ω(author()).Should(Equal("Image Builder <builder@example.com>"))
+		})
+	})
+})
+
+var _ = Describe("Out with a pool given in params", func() {
+	var gitRepo string
+	var bareGitRepo string
+	var sourceDir string
+
+	BeforeEach(func() {
+		var err error
+		gitRepo, err = ioutil.TempDir("", "git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		bareGitRepo, err = ioutil.TempDir("", "bare-git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		sourceDir, err = ioutil.TempDir("", "source-dir")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		setupGitRepo(gitRepo)
+
+		addPool := exec.Command("bash", "-e", "-c", fmt.Sprintf(`
+			git mv lock-pool/unclaimed/some-lock lock-pool/claimed/some-lock
+			git commit -m 'claiming some-lock'
+
+			mkdir -p prod-pool/unclaimed prod-pool/claimed
+			touch prod-pool/unclaimed/.gitkeep prod-pool/claimed/.gitkeep
+			git add prod-pool
+			git commit -m 'adding prod-pool'
+
+			git clone --bare . %s
+		`, bareGitRepo))
+		addPool.Dir = gitRepo
+
+		err = addPool.Run()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		err = os.Mkdir(filepath.Join(sourceDir, "some-lock"), 0755)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		err = ioutil.WriteFile(filepath.Join(sourceDir, "some-lock", "name"), []byte("some-lock"), 0644)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		err = ioutil.WriteFile(filepath.Join(sourceDir, "some-lock", "metadata"), []byte(`{"some":"json"}`), 0644)
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		for _, dir := range []string{gitRepo, bareGitRepo, sourceDir} {
+			err := os.RemoveAll(dir)
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+	})
+
+	It("promotes a lock from one pool to another", func() {
+		source := out.Source{
+			URI:        bareGitRepo,
+			Branch:     "master",
+			Pool:       "lock-pool",
+			RetryDelay: 100 * time.Millisecond,
+		}
+
+		session := runOut(out.OutRequest{Source: source, Params: out.OutParams{Remove: "some-lock"}}, sourceDir)
+		Eventually(session).Should(gexec.Exit(0))
+
+		session = runOut(out.OutRequest{Source: source, Params: out.OutParams{Add: "some-lock", Pool: "prod-pool"}}, sourceDir)
+		Eventually(session).Should(gexec.Exit(0))
+
+		var outResponse out.OutResponse
+		err := json.Unmarshal(session.Out.Contents(), &outResponse)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(outResponse.Metadata[1]).Should(Equal(out.MetadataPair{Name: "pool_name", Value: "prod-pool"}))
+
+		reCloneRepo, err := ioutil.TempDir("", "git-version-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		defer os.RemoveAll(reCloneRepo)
+
+		reClone := exec.Command("git", "clone", bareGitRepo, ".")
+		reClone.Dir = reCloneRepo
+		err = reClone.Run()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(filepath.Join(reCloneRepo, "lock-pool", "claimed", "some-lock")).ShouldNot(BeAnExistingFile())
+		Ω(filepath.Join(reCloneRepo, "prod-pool", "unclaimed", "some-lock")).Should(BeARegularFile())
+	})
+
+	It("rejects a pool outside the repository", func() {
+		session := runOut(out.OutRequest{
+			Source: out.Source{
+				URI:    bareGitRepo,
+				Branch: "master",
+				Pool:   "lock-pool",
+			},
+			Params: out.OutParams{Add: "some-lock", Pool: "../elsewhere"},
+		}, sourceDir)
+		Eventually(session).Should(gexec.Exit(1))
+
+		Ω(session.Err).Should(gbytes.Say(`invalid payload: params.pool "../elsewhere" must be a path within the repository`))
+	})
+
+	Context("when the source watches several pools", func() {
+		var source out.Source
+
+		BeforeEach(func() {
+			source = out.Source{
+				URI:        bareGitRepo,
+				Branch:     "master",
+				Pools:      []string{"lock-pool", "prod-pool"},
+				RetryDelay: 100 * time.Millisecond,
+			}
+		})
+
+		It("versions the lock by the pool it changed", func() {
+			session := runOut(out.OutRequest{Source: source, Params: out.OutParams{Add: "some-lock", Pool: "prod-pool"}}, sourceDir)
+			Eventually(session).Should(gexec.Exit(0))
+
+			var outResponse out.OutResponse
+			err := json.Unmarshal(session.Out.Contents(), &outResponse)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(outResponse.Version.Lock).Should(Equal("some-lock"))
+			Ω(outResponse.Version.Pool).Should(Equal("prod-pool"))
+		})
+
+		It("requires params.pool to say which pool to change", func() {
+			session := runOut(out.OutRequest{Source: source, Params: out.OutParams{Add: "some-lock"}}, sourceDir)
+			Eventually(session).Should(gexec.Exit(1))
+
+			Ω(session.Err).Should(gbytes.Say(`invalid payload: params.pool is required to change one of source.pools, as source.pool is not given`))
+		})
+	})
+})
+
+var _ = Describe("Out with a branch given in params", func() {
+	var (
+		gitRepo     string
+		bareGitRepo string
+		sourceDir   string
+	)
+
+	BeforeEach(func() {
+		var err error
+
+		gitRepo, err = ioutil.TempDir("", "git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		bareGitRepo, err = ioutil.TempDir("", "bare-git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		sourceDir, err = ioutil.TempDir("", "source-dir")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		setupGitRepo(gitRepo)
+
+		addBranch := exec.Command("bash", "-e", "-c", fmt.Sprintf(`
+			git mv lock-pool/unclaimed/some-lock lock-pool/claimed/some-lock
+			git commit -m 'claiming some-lock'
+
+			git checkout -b prod
+			git rm -q lock-pool/claimed/some-lock lock-pool/unclaimed/some-other-lock
+			git commit -m 'emptying the prod pool'
+			git checkout master
+
+			git clone --bare . %s
+		`, bareGitRepo))
+		addBranch.Dir = gitRepo
+
+		err = addBranch.Run()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		err = os.Mkdir(filepath.Join(sourceDir, "some-lock"), 0755)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		err = ioutil.WriteFile(filepath.Join(sourceDir, "some-lock", "name"), []byte("some-lock"), 0644)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		err = ioutil.WriteFile(filepath.Join(sourceDir, "some-lock", "metadata"), []byte(`{"some":"json"}`), 0644)
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		for _, dir := range []string{gitRepo, bareGitRepo, sourceDir} {
+			err := os.RemoveAll(dir)
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+	})
+
+	It("promotes a lock from one branch to another", func() {
+		source := out.Source{
+			URI:        bareGitRepo,
+			Branch:     "master",
+			Pool:       "lock-pool",
+			RetryDelay: 100 * time.Millisecond,
+		}
+
+		session := runOut(out.OutRequest{Source: source, Params: out.OutParams{Remove: "some-lock"}}, sourceDir)
+		Eventually(session).Should(gexec.Exit(0))
+
+		session = runOut(out.OutRequest{Source: source, Params: out.OutParams{Add: "some-lock", Branch: "prod"}}, sourceDir)
+		Eventually(session).Should(gexec.Exit(0))
+
+		reCloneRepo, err := ioutil.TempDir("", "git-version-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		defer os.RemoveAll(reCloneRepo)
+
+		reClone := exec.Command("git", "clone", bareGitRepo, ".")
+		reClone.Dir = reCloneRepo
+		err = reClone.Run()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(filepath.Join(reCloneRepo, "lock-pool", "claimed", "some-lock")).ShouldNot(BeAnExistingFile())
+
+		checkout := exec.Command("git", "checkout", "-q", "prod")
+		checkout.Dir = reCloneRepo
+		err = checkout.Run()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(filepath.Join(reCloneRepo, "lock-pool", "unclaimed", "some-lock")).Should(BeARegularFile())
+	})
+
+	It("rejects a branch that isn't a valid branch name", func() {
+		session := runOut(out.OutRequest{
+			Source: out.Source{
+				URI:    bareGitRepo,
+				Branch: "master",
+				Pool:   "lock-pool",
+			},
+			Params: out.OutParams{Add: "some-lock", Branch: "prod..locks"},
+		}, sourceDir)
+		Eventually(session).Should(gexec.Exit(1))
+
+		Ω(session.Err).Should(gbytes.Say(`invalid payload: params.branch "prod..locks" is not a valid branch name`))
+	})
+})
+
+var _ = Describe("Out with pipeline affinity", func() {
+	var gitRepo string
+	var bareGitRepo string
+	var sourceDir string
+
+	var source out.Source
+
+	BeforeEach(func() {
+		var err error
+		gitRepo, err = ioutil.TempDir("", "git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		bareGitRepo, err = ioutil.TempDir("", "bare-git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		sourceDir, err = ioutil.TempDir("", "source-dir")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		setupGitRepo(gitRepo)
+
+		clone := exec.Command("git", "clone", "--bare", gitRepo, bareGitRepo)
+		err = clone.Run()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		os.Setenv("BUILD_TEAM_NAME", "main")
+		os.Setenv("BUILD_PIPELINE_NAME", "deploy")
+
+		source = out.Source{
+			URI:        bareGitRepo,
+			Branch:     "master",
+			Pool:       "lock-pool",
+			RetryDelay: 100 * time.Millisecond,
+			Affinity:   out.AffinityPipeline,
+		}
+	})
+
+	AfterEach(func() {
+		os.Unsetenv("BUILD_TEAM_NAME")
+		os.Unsetenv("BUILD_PIPELINE_NAME")
+
+		for _, dir := range []string{gitRepo, bareGitRepo, sourceDir} {
+			err := os.RemoveAll(dir)
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+	})
+
+	claim := func() string {
+		session := runOut(out.OutRequest{Source: source, Params: out.OutParams{Acquire: true}}, sourceDir)
+		Eventually(session).Should(gexec.Exit(0))
+
+		var outResponse out.OutResponse
+		err := json.Unmarshal(session.Out.Contents(), &outResponse)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		return outResponse.Metadata[0].Value
+	}
+
+	release := func(lock string) {
+		lockDir := filepath.Join(sourceDir, lock)
+
+		err := os.MkdirAll(lockDir, 0755)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		err = ioutil.WriteFile(filepath.Join(lockDir, "name"), []byte(lock), 0644)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		session := runOut(out.OutRequest{Source: source, Params: out.OutParams{Release: lock}}, sourceDir)
+		Eventually(session).Should(gexec.Exit(0))
+	}
+
+	It("records the pipeline in the claim", func() {
+		claim()
+
+		log := exec.Command("git", "log", "-1", "--format=%B")
+		log.Dir = bareGitRepo
+		message, err := log.Output()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(string(message)).Should(ContainSubstring("Pipeline: main/deploy"))
+	})
+
+	It("keeps claiming the lock the pipeline held last", func() {
+		lock := claim()
+		release(lock)
+
+		for i := 0; i < 4; i++ {
+			Ω(claim()).Should(Equal(lock))
+			release(lock)
+		}
+	})
+
+	It("records the pipeline in claims whose messages come from a template", func() {
+		source.CommitMessageTemplate = "pool({{.Pool}}): {{.Action}} {{.Lock}} for {{.Env.BUILD_PIPELINE_NAME}}"
+
+		lock := claim()
+
+		log := exec.Command("git", "log", "-1", "--format=%B")
+		log.Dir = bareGitRepo
+		message, err := log.Output()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(string(message)).Should(Equal(fmt.Sprintf("pool(lock-pool): claiming %s for deploy\n\nPipeline: main/deploy\n\n", lock)))
+
+		release(lock)
+		Ω(claim()).Should(Equal(lock))
+	})
+})
+
+var _ = Describe("Out with a selection strategy", func() {
+	var gitRepo string
+	var bareGitRepo string
+	var sourceDir string
+
+	BeforeEach(func() {
+		var err error
+		gitRepo, err = ioutil.TempDir("", "git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		bareGitRepo, err = ioutil.TempDir("", "bare-git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		sourceDir, err = ioutil.TempDir("", "source-dir")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		setupGitRepo(gitRepo)
+
+		clone := exec.Command("git", "clone", "--bare", gitRepo, bareGitRepo)
+		err = clone.Run()
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		for _, dir := range []string{gitRepo, bareGitRepo, sourceDir} {
+			err := os.RemoveAll(dir)
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+	})
+
+	It("claims the lexically first lock", func() {
+		session := runOut(out.OutRequest{
+			Source: out.Source{
+				URI:               bareGitRepo,
+				Branch:            "master",
+				Pool:              "lock-pool",
+				RetryDelay:        100 * time.Millisecond,
+				SelectionStrategy: out.SelectionDeterministic,
+			},
+			Params: out.OutParams{Acquire: true},
+		}, sourceDir)
+		Eventually(session).Should(gexec.Exit(0))
+
+		var outResponse out.OutResponse
+		err := json.Unmarshal(session.Out.Contents(), &outResponse)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(outResponse.Metadata[0]).Should(Equal(out.MetadataPair{Name: "lock_name", Value: "some-lock"}))
+	})
+
+	It("claims the first available lock of claim_any_of instead", func() {
+		session := runOut(out.OutRequest{
+			Source: out.Source{
+				URI:               bareGitRepo,
+				Branch:            "master",
+				Pool:              "lock-pool",
+				RetryDelay:        100 * time.Millisecond,
+				SelectionStrategy: out.SelectionDeterministic,
+			},
+			Params: out.OutParams{
+				Acquire:    true,
+				ClaimAnyOf: []string{"missing-lock", "some-other-lock", "some-lock"},
+			},
+		}, sourceDir)
+		Eventually(session).Should(gexec.Exit(0))
+
+		var outResponse out.OutResponse
+		err := json.Unmarshal(session.Out.Contents(), &outResponse)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(outResponse.Metadata[0]).Should(Equal(out.MetadataPair{Name: "lock_name", Value: "some-other-lock"}))
+	})
+
+	for _, bare := range []bool{false, true} {
+		bare := bare
+
+		It(fmt.Sprintf("claims only a lock whose metadata matches metadata_query (bare: %v)", bare), func() {
+			source := out.Source{
+				URI:               bareGitRepo,
+				Branch:            "master",
+				Pool:              "lock-pool",
+				RetryDelay:        100 * time.Millisecond,
+				SelectionStrategy: out.SelectionDeterministic,
+				Bare:              bare,
+			}
+
+			session := runOut(out.OutRequest{
+				Source: source,
+				Params: out.OutParams{
+					Acquire:       true,
+					MetadataQuery: out.MetadataQuery{"some": "wrong-json"},
+				},
+			}, sourceDir)
+			Eventually(session).Should(gexec.Exit(0))
+
+			var outResponse out.OutResponse
+			err := json.Unmarshal(session.Out.Contents(), &outResponse)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(outResponse.Metadata[0]).Should(Equal(out.MetadataPair{Name: "lock_name", Value: "some-other-lock"}))
+
+			// the only lock that matches is claimed now, so the next acquire waits
+			source.RetryDelay = time.Second
+			session = runOut(out.OutRequest{
+				Source: source,
+				Params: out.OutParams{
+					Acquire:       true,
+					MetadataQuery: out.MetadataQuery{"some": "wrong-json"},
+				},
+			}, sourceDir)
+			Consistently(session, 2*time.Second).ShouldNot(gexec.Exit())
+			session.Kill()
+		})
+	}
+
+	It("spaces its remote git commands min_remote_interval apart", func() {
+		startedAt := time.Now()
+
+		session := runOut(out.OutRequest{
+			Source: out.Source{
+				URI:               bareGitRepo,
+				Branch:            "master",
+				Pool:              "lock-pool",
+				RetryDelay:        100 * time.Millisecond,
+				SelectionStrategy: out.SelectionDeterministic,
+				MinRemoteInterval: time.Second,
+			},
+			Params: out.OutParams{Acquire: true},
+		}, sourceDir)
+		Eventually(session, 10*time.Second).Should(gexec.Exit(0))
+
+		// the clone and the push, at the very least
+		Ω(time.Since(startedAt)).Should(BeNumerically(">=", time.Second))
+	})
+
+	It("claims the lock released longest ago", func() {
+		history := exec.Command("bash", "-e", "-c", fmt.Sprintf(`
+			git clone %s .
+			git config user.email "ginkgo@localhost"
+			git config user.name "Ginkgo Local"
+
+			export GIT_COMMITTER_DATE="2020-01-01T00:00:00Z"
+			git mv lock-pool/unclaimed/some-other-lock lock-pool/claimed/some-other-lock
+			git commit -m 'claiming: some-other-lock'
+			git mv lock-pool/claimed/some-other-lock lock-pool/unclaimed/some-other-lock
+			git commit -m 'unclaiming: some-other-lock'
+
+			export GIT_COMMITTER_DATE="2020-01-02T00:00:00Z"
+			git mv lock-pool/unclaimed/some-lock lock-pool/claimed/some-lock
+			git commit -m 'claiming: some-lock'
+			git mv lock-pool/claimed/some-lock lock-pool/unclaimed/some-lock
+			git commit -m 'unclaiming: some-lock'
+
+			git push origin HEAD:master
+		`, bareGitRepo))
+		history.Dir = sourceDir
+
+		err := history.Run()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		session := runOut(out.OutRequest{
+			Source: out.Source{
+				URI:               bareGitRepo,
+				Branch:            "master",
+				Pool:              "lock-pool",
+				RetryDelay:        100 * time.Millisecond,
+				SelectionStrategy: out.SelectionLeastRecentlyClaimed,
+			},
+			Params: out.OutParams{Acquire: true},
+		}, sourceDir)
+		Eventually(session).Should(gexec.Exit(0))
+
+		var outResponse out.OutResponse
+		err = json.Unmarshal(session.Out.Contents(), &outResponse)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(outResponse.Metadata[0]).Should(Equal(out.MetadataPair{Name: "lock_name", Value: "some-other-lock"}))
+	})
+})
+
+var _ = Describe("Out with encrypted metadata", func() {
+	var gitRepo string
+	var bareGitRepo string
+	var sourceDir string
+	var inDestination string
+
+	var source out.Source
+
+	BeforeEach(func() {
+		var err error
+		gitRepo, err = ioutil.TempDir("", "git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		bareGitRepo, err = ioutil.TempDir("", "bare-git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		sourceDir, err = ioutil.TempDir("", "source-dir")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		inDestination, err = ioutil.TempDir("", "in-destination")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		setupGitRepo(gitRepo)
+
+		clone := exec.Command("git", "clone", "--bare", gitRepo, bareGitRepo)
+		err = clone.Run()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		gnupgHome, err := ioutil.TempDir("", "gnupg")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		defer os.RemoveAll(gnupgHome)
+
+		gpg := func(args ...string) string {
+			output, err := exec.Command("gpg", append([]string{"--homedir", gnupgHome, "--batch", "--pinentry-mode", "loopback", "--passphrase", ""}, args...)...).Output()
+			Ω(err).ShouldNot(HaveOccurred())
+			return string(output)
+		}
+
+		gpg("--quick-gen-key", "Pool Resource <pool@example.com>", "default", "default", "never")
+
+		source = out.Source{
+			URI:        bareGitRepo,
+			Branch:     "master",
+			Pool:       "lock-pool",
+			RetryDelay: 100 * time.Millisecond,
+			Encryption: out.Encryption{
+				Type:       out.EncryptionGPG,
+				Recipients: []string{"pool@example.com"},
+				PublicKeys: gpg("--armor", "--export", "pool@example.com"),
+				PrivateKey: gpg("--armor", "--export-secret-keys", "pool@example.com"),
+			},
+		}
+
+		err = os.Mkdir(filepath.Join(sourceDir, "new-lock"), 0755)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		err = ioutil.WriteFile(filepath.Join(sourceDir, "new-lock", "name"), []byte("new-lock"), 0644)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		err = ioutil.WriteFile(filepath.Join(sourceDir, "new-lock", "metadata"), []byte(`{"password":"hunter2"}`), 0644)
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		for _, dir := range []string{gitRepo, bareGitRepo, sourceDir, inDestination} {
+			err := os.RemoveAll(dir)
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+	})
+
+	It("commits encrypted metadata that in decrypts", func() {
+		session := runOut(out.OutRequest{Source: source, Params: out.OutParams{Add: "new-lock"}}, sourceDir)
+		Eventually(session, 10*time.Second).Should(gexec.Exit(0))
+
+		show := exec.Command("git", "show", "master:lock-pool/unclaimed/new-lock")
+		show.Dir = bareGitRepo
+		committed, err := show.Output()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(string(committed)).Should(HavePrefix("-----BEGIN PGP MESSAGE-----"))
+		Ω(string(committed)).ShouldNot(ContainSubstring("hunter2"))
+
+		request, err := json.Marshal(map[string]interface{}{
+			"source": map[string]interface{}{
+				"uri":        source.URI,
+				"branch":     source.Branch,
+				"pool":       source.Pool,
+				"encryption": source.Encryption,
+			},
+			"params": map[string]string{"lock_name": "new-lock"},
+		})
+		Ω(err).ShouldNot(HaveOccurred())
+
+		runIn(string(request), inDestination, 0)
+
+		metadata, err := ioutil.ReadFile(filepath.Join(inDestination, "metadata"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(metadata)).Should(Equal(`{"password":"hunter2"}`))
+	})
+})
+
+var _ = Describe("Out with an operation timeout", func() {
+	var sourceDir string
+
+	BeforeEach(func() {
+		var err error
+		sourceDir, err = ioutil.TempDir("", "source-dir")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		// lets the clone below use a transport that never answers
+		os.Setenv("GIT_CONFIG_COUNT", "1")
+		os.Setenv("GIT_CONFIG_KEY_0", "protocol.ext.allow")
+		os.Setenv("GIT_CONFIG_VALUE_0", "always")
+	})
+
+	AfterEach(func() {
+		os.Unsetenv("GIT_CONFIG_COUNT")
+		os.Unsetenv("GIT_CONFIG_KEY_0")
+		os.Unsetenv("GIT_CONFIG_VALUE_0")
+
+		err := os.RemoveAll(sourceDir)
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	It("fails with a timeout instead of hanging on an unresponsive remote", func() {
+		session := runOut(out.OutRequest{
+			Source: out.Source{
+				URI:              "ext::sleep 30",
+				Branch:           "master",
+				Pool:             "lock-pool",
+				RetryDelay:       100 * time.Millisecond,
+				OperationTimeout: time.Second,
+			},
+			Params: out.OutParams{Acquire: true},
+		}, sourceDir)
+
+		Eventually(session, 10*time.Second).Should(gexec.Exit(1))
+		Ω(session.Err).Should(gbytes.Say(`git clone failed \(timed out\): no response within operation_timeout of 1s`))
+	})
+})
+
+var _ = Describe("Out over SSH", func() {
+	var gitRepo string
+	var bareGitRepo string
+	var sshDir string
+	var sourceDir string
+
+	BeforeEach(func() {
+		var err error
+		gitRepo, err = ioutil.TempDir("", "git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		bareGitRepo, err = ioutil.TempDir("", "bare-git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		sshDir, err = ioutil.TempDir("", "ssh-dir")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		sourceDir, err = ioutil.TempDir("", "source-dir")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		setupGitRepo(gitRepo)
+
+		clone := exec.Command("git", "clone", "--bare", gitRepo, bareGitRepo)
+		err = clone.Run()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		// stands in for ssh, noting how it was run and the known hosts it
+		// was given, and running the command meant for the remote locally
+		err = ioutil.WriteFile(filepath.Join(sshDir, "ssh"), []byte(fmt.Sprintf(`#!/bin/sh
+echo "$@" >> %[1]s/ssh.log
+for arg; do
+  case "$arg" in
+    UserKnownHostsFile=*) cat "${arg#UserKnownHostsFile=}" >> %[1]s/known_hosts.log ;;
+  esac
+done
+for command; do :; done
+exec sh -c "$command"
+`, sshDir)), 0755)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		os.Setenv("GIT_SSH_COMMAND", filepath.Join(sshDir, "ssh"))
+	})
+
+	AfterEach(func() {
+		os.Unsetenv("GIT_SSH_COMMAND")
+
+		for _, dir := range []string{gitRepo, bareGitRepo, sshDir, sourceDir} {
+			err := os.RemoveAll(dir)
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+	})
+
+	It("reaches a scp-like uri on the port, through the ssh command already given", func() {
+		session := runOut(out.OutRequest{
+			Source: out.Source{
+				URI:        "localhost:" + bareGitRepo,
+				Branch:     "master",
+				Pool:       "lock-pool",
+				Port:       7999,
+				RetryDelay: 100 * time.Millisecond,
+			},
+			Params: out.OutParams{Acquire: true},
+		}, sourceDir)
+		Eventually(session, 10*time.Second).Should(gexec.Exit(0))
+
+		log, err := ioutil.ReadFile(filepath.Join(sshDir, "ssh.log"))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		for _, line := range strings.Split(strings.TrimSpace(string(log)), "\n") {
+			Ω(line).Should(HavePrefix("-p 7999 "))
+		}
+	})
+
+	It("pins the host keys given, whatever ssh's own config says", func() {
+		session := runOut(out.OutRequest{
+			Source: out.Source{
+				URI:        "localhost:" + bareGitRepo,
+				Branch:     "master",
+				Pool:       "lock-pool",
+				KnownHosts: "localhost ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl",
+				RetryDelay: 100 * time.Millisecond,
+			},
+			Params: out.OutParams{Acquire: true},
+		}, sourceDir)
+		Eventually(session, 10*time.Second).Should(gexec.Exit(0))
+
+		log, err := ioutil.ReadFile(filepath.Join(sshDir, "ssh.log"))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		for _, line := range strings.Split(strings.TrimSpace(string(log)), "\n") {
+			Ω(line).Should(MatchRegexp(`^-o UserKnownHostsFile=\S+ -o StrictHostKeyChecking=yes -o LogLevel=ERROR `))
+		}
+
+		knownHosts, err := ioutil.ReadFile(filepath.Join(sshDir, "known_hosts.log"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(knownHosts)).Should(HavePrefix("localhost ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl\n"))
+
+		leftBehind, err := filepath.Glob(filepath.Join(os.TempDir(), out.TempDirPrefix+"-known-hosts*"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(leftBehind).Should(BeEmpty())
+	})
+})
+
+var _ = Describe("Out with a CA certificate", func() {
+	var gitRepo string
+	var repoRoot string
+	var sourceDir string
+	var server *httptest.Server
+
+	var source out.Source
+
+	BeforeEach(func() {
+		var err error
+		gitRepo, err = ioutil.TempDir("", "git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		repoRoot, err = ioutil.TempDir("", "repo-root")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		sourceDir, err = ioutil.TempDir("", "source-dir")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		setupGitRepo(gitRepo)
+
+		clone := exec.Command("git", "clone", "--bare", gitRepo, filepath.Join(repoRoot, "pool.git"))
+		err = clone.Run()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		enablePush := exec.Command("git", "config", "http.receivepack", "true")
+		enablePush.Dir = filepath.Join(repoRoot, "pool.git")
+		err = enablePush.Run()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		gitPath, err := exec.LookPath("git")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		// serves the repository over HTTPS with a certificate no system
+		// trusts
+		server = httptest.NewTLSServer(&cgi.Handler{
+			Path: gitPath,
+			Args: []string{"http-backend"},
+			Env:  []string{"GIT_PROJECT_ROOT=" + repoRoot, "GIT_HTTP_EXPORT_ALL=1"},
+		})
+
+		source = out.Source{
+			URI:        server.URL + "/pool.git",
+			Branch:     "master",
+			Pool:       "lock-pool",
+			RetryDelay: 100 * time.Millisecond,
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+
+		for _, dir := range []string{gitRepo, repoRoot, sourceDir} {
+			err := os.RemoveAll(dir)
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+	})
+
+	It("trusts a server whose certificate the bundle vouches for", func() {
+		source.CACert = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+
+		session := runOut(out.OutRequest{Source: source, Params: out.OutParams{Acquire: true}}, sourceDir)
+		Eventually(session, 10*time.Second).Should(gexec.Exit(0))
+
+		leftBehind, err := filepath.Glob(filepath.Join(os.TempDir(), out.TempDirPrefix+"-ca-cert*"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(leftBehind).Should(BeEmpty())
+	})
+
+	It("doesn't trust it otherwise", func() {
+		session := runOut(out.OutRequest{Source: source, Params: out.OutParams{Acquire: true}}, sourceDir)
+		Eventually(session, 10*time.Second).Should(gexec.Exit(1))
+
+		Ω(session.Err).Should(gbytes.Say("certificate"))
+	})
+})
+
+var _ = Describe("Out with a cache directory", func() {
+	var gitRepo string
+	var bareGitRepo string
+	var cacheDir string
+	var sourceDir string
+
+	var source out.Source
+
+	BeforeEach(func() {
+		var err error
+		gitRepo, err = ioutil.TempDir("", "git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		bareGitRepo, err = ioutil.TempDir("", "bare-git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		cacheDir, err = ioutil.TempDir("", "cache-dir")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		sourceDir, err = ioutil.TempDir("", "source-dir")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		setupGitRepo(gitRepo)
+
+		clone := exec.Command("git", "clone", "--bare", gitRepo, bareGitRepo)
+		err = clone.Run()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		source = out.Source{
+			URI:        bareGitRepo,
+			Branch:     "master",
+			Pool:       "lock-pool",
+			RetryDelay: 100 * time.Millisecond,
+			CacheDir:   cacheDir,
+		}
+	})
+
+	AfterEach(func() {
+		for _, dir := range []string{gitRepo, bareGitRepo, cacheDir, sourceDir} {
+			err := os.RemoveAll(dir)
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+	})
+
+	It("shares one clone between concurrent operations", func() {
+		first := runOut(out.OutRequest{Source: source, Params: out.OutParams{Acquire: true}}, sourceDir)
+		second := runOut(out.OutRequest{Source: source, Params: out.OutParams{Acquire: true}}, sourceDir)
+
+		Eventually(first, 10*time.Second).Should(gexec.Exit(0))
+		Eventually(second, 10*time.Second).Should(gexec.Exit(0))
+
+		var firstResponse, secondResponse out.OutResponse
+		Ω(json.Unmarshal(first.Out.Contents(), &firstResponse)).Should(Succeed())
+		Ω(json.Unmarshal(second.Out.Contents(), &secondResponse)).Should(Succeed())
+
+		Ω(firstResponse.Version.Lock).ShouldNot(Equal(secondResponse.Version.Lock))
+
+		clones, err := filepath.Glob(filepath.Join(cacheDir, "*"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(clones).Should(HaveLen(2), "a clone and its lock file")
+
+		worktrees := exec.Command("git", "worktree", "list", "--porcelain")
+		worktrees.Dir = strings.TrimSuffix(clones[0], ".lock")
+		list, err := worktrees.Output()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(strings.Count(string(list), "worktree ")).Should(Equal(1))
+	})
+
+	It("replaces a shared clone that has been left unusable", func() {
+		acquire := func() {
+			session := runOut(out.OutRequest{Source: source, Params: out.OutParams{Acquire: true}}, sourceDir)
+			Eventually(session, 10*time.Second).Should(gexec.Exit(0))
+		}
+
+		acquire()
+
+		clones, err := filepath.Glob(filepath.Join(cacheDir, "*[^k]"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(clones).Should(HaveLen(1))
+
+		err = ioutil.WriteFile(filepath.Join(clones[0], "packed-refs.lock"), nil, 0644)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		acquire()
+
+		Ω(filepath.Join(clones[0], "packed-refs.lock")).ShouldNot(BeAnExistingFile())
+
+		err = os.RemoveAll(filepath.Join(clones[0], "objects"))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		lockDir := filepath.Join(sourceDir, "fresh-lock")
+		Ω(os.MkdirAll(lockDir, 0755)).Should(Succeed())
+		Ω(ioutil.WriteFile(filepath.Join(lockDir, "name"), []byte("fresh-lock"), 0644)).Should(Succeed())
+		Ω(ioutil.WriteFile(filepath.Join(lockDir, "metadata"), nil, 0644)).Should(Succeed())
+
+		session := runOut(out.OutRequest{Source: source, Params: out.OutParams{Add: "fresh-lock"}}, sourceDir)
+		Eventually(session, 10*time.Second).Should(gexec.Exit(0))
+	})
+})
+
+var _ = Describe("Out with a server that drops a push", func() {
+	var gitRepo string
+	var bareGitRepo string
+	var sourceDir string
+
+	BeforeEach(func() {
+		var err error
+		gitRepo, err = ioutil.TempDir("", "git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		bareGitRepo, err = ioutil.TempDir("", "bare-git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		sourceDir, err = ioutil.TempDir("", "source-dir")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		setupGitRepo(gitRepo)
+
+		clone := exec.Command("git", "clone", "--bare", gitRepo, bareGitRepo)
+		err = clone.Run()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		// accepts the first push, and then puts the branch back as it was
+		hook := `#!/bin/sh
+if [ ! -e dropped ]; then
+  touch dropped
+  while read old new ref; do git update-ref $ref $old; done
+fi
+`
+		err = ioutil.WriteFile(filepath.Join(bareGitRepo, "hooks", "post-receive"), []byte(hook), 0755)
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		for _, dir := range []string{gitRepo, bareGitRepo, sourceDir} {
+			err := os.RemoveAll(dir)
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+	})
+
+	It("notices the push did not land and tries again", func() {
+		session := runOut(out.OutRequest{
+			Source: out.Source{
+				URI:        bareGitRepo,
+				Branch:     "master",
+				Pool:       "lock-pool",
+				RetryDelay: 100 * time.Millisecond,
+			},
+			Params: out.OutParams{Acquire: true},
+		}, sourceDir)
+		Eventually(session, 10*time.Second).Should(gexec.Exit(0))
+
+		Ω(filepath.Join(bareGitRepo, "dropped")).Should(BeAnExistingFile())
+
+		var response out.OutResponse
+		err := json.Unmarshal(session.Out.Contents(), &response)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		show := exec.Command("git", "show", "master:lock-pool/claimed/"+response.Version.Lock)
+		show.Dir = bareGitRepo
+		Ω(show.Run()).Should(Succeed())
+
+		head := exec.Command("git", "rev-parse", "master")
+		head.Dir = bareGitRepo
+		ref, err := head.Output()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(strings.TrimSpace(string(ref))).Should(Equal(response.Version.Ref))
+	})
+})
+
+var _ = Describe("Out with claim tags", func() {
+	var gitRepo string
+	var bareGitRepo string
+	var sourceDir string
+	var gnupgHome string
+
+	var source out.Source
+
+	BeforeEach(func() {
+		var err error
+		gitRepo, err = ioutil.TempDir("", "git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		bareGitRepo, err = ioutil.TempDir("", "bare-git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		sourceDir, err = ioutil.TempDir("", "source-dir")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		gnupgHome, err = ioutil.TempDir("", "gnupg")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		setupGitRepo(gitRepo)
+
+		clone := exec.Command("git", "clone", "--bare", gitRepo, bareGitRepo)
+		err = clone.Run()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		source = out.Source{
+			URI:        bareGitRepo,
+			Branch:     "master",
+			Pool:       "lock-pool",
+			RetryDelay: 100 * time.Millisecond,
+			ClaimTags:  out.ClaimTags{Enabled: true},
+		}
+	})
+
+	AfterEach(func() {
+		for _, dir := range []string{gitRepo, bareGitRepo, sourceDir, gnupgHome} {
+			err := os.RemoveAll(dir)
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+	})
+
+	acquire := func() out.OutResponse {
+		session := runOut(out.OutRequest{Source: source, Params: out.OutParams{Acquire: true}}, sourceDir)
+		Eventually(session, 10*time.Second).Should(gexec.Exit(0))
+
+		var response out.OutResponse
+		err := json.Unmarshal(session.Out.Contents(), &response)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		return response
+	}
+
+	bareGit := func(args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = bareGitRepo
+		cmd.Env = append(os.Environ(), "GNUPGHOME="+gnupgHome)
+		output, err := cmd.CombinedOutput()
+		Ω(err).ShouldNot(HaveOccurred(), string(output))
+		return strings.TrimSpace(string(output))
+	}
+
+	It("tags the commit of each claim", func() {
+		response := acquire()
+
+		short := bareGit("rev-parse", "--short", response.Version.Ref)
+		tag := out.ClaimTagName("lock-pool", response.Version.Lock, short)
+
+		Ω(bareGit("tag", "--list", "claim/*")).Should(Equal(tag))
+		Ω(bareGit("cat-file", "-t", tag)).Should(Equal("tag"))
+		Ω(bareGit("rev-parse", tag+"^{commit}")).Should(Equal(response.Version.Ref))
+	})
+
+	It("signs the tags with the key given", func() {
+		gpg := func(args ...string) string {
+			output, err := exec.Command("gpg", append([]string{"--homedir", gnupgHome, "--batch", "--pinentry-mode", "loopback", "--passphrase", ""}, args...)...).Output()
+			Ω(err).ShouldNot(HaveOccurred())
+			return string(output)
+		}
+
+		gpg("--quick-gen-key", "Pool Resource <pool@example.com>", "default", "default", "never")
+		source.ClaimTags.SigningKey = gpg("--armor", "--export-secret-keys", "pool@example.com")
+
+		acquire()
+
+		tag := bareGit("tag", "--list", "claim/*")
+		Ω(bareGit("verify-tag", tag)).Should(ContainSubstring("Good signature"))
+	})
+})
+
+var _ = Describe("Out reserving a lock", func() {
+	var gitRepo string
+	var bareGitRepo string
+	var sourceDir string
+
+	var source out.Source
+
+	BeforeEach(func() {
+		var err error
+		gitRepo, err = ioutil.TempDir("", "git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		bareGitRepo, err = ioutil.TempDir("", "bare-git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		sourceDir, err = ioutil.TempDir("", "source-dir")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		setupGitRepo(gitRepo)
+
+		clone := exec.Command("git", "clone", "--bare", gitRepo, bareGitRepo)
+		err = clone.Run()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		source = out.Source{
+			URI:               bareGitRepo,
+			Branch:            "master",
+			Pool:              "lock-pool",
+			RetryDelay:        100 * time.Millisecond,
+			SelectionStrategy: out.SelectionDeterministic,
+		}
+	})
+
+	AfterEach(func() {
+		for _, dir := range []string{gitRepo, bareGitRepo, sourceDir} {
+			err := os.RemoveAll(dir)
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+	})
+
+	lockState := func(lock string) string {
+		list := exec.Command("git", "ls-tree", "-r", "--name-only", "master", "lock-pool")
+		list.Dir = bareGitRepo
+		files, err := list.Output()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		for _, file := range strings.Split(strings.TrimSpace(string(files)), "\n") {
+			if filepath.Base(file) == lock && !strings.HasPrefix(filepath.Base(filepath.Dir(file)), ".") {
+				return filepath.Base(filepath.Dir(file))
+			}
+		}
+
+		return ""
+	}
+
+	reserve := func(reserveFor time.Duration) string {
+		session := runOut(out.OutRequest{
+			Source: source,
+			Params: out.OutParams{Reserve: true, ReserveFor: reserveFor},
+		}, sourceDir)
+		Eventually(session, 10*time.Second).Should(gexec.Exit(0))
+
+		var response out.OutResponse
+		err := json.Unmarshal(session.Out.Contents(), &response)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		err = os.MkdirAll(filepath.Join(sourceDir, response.Version.Lock), 0755)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		err = ioutil.WriteFile(filepath.Join(sourceDir, response.Version.Lock, "name"), []byte(response.Version.Lock), 0644)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		return response.Version.Lock
+	}
+
+	It("claims a reserved lock once it is confirmed", func() {
+		lock := reserve(time.Hour)
+		Ω(lockState(lock)).Should(Equal("reserved"))
+
+		session := runOut(out.OutRequest{Source: source, Params: out.OutParams{Confirm: lock}}, sourceDir)
+		Eventually(session, 10*time.Second).Should(gexec.Exit(0))
+
+		Ω(lockState(lock)).Should(Equal("claimed"))
+		Ω(lockState("." + lock + ".expires")).Should(BeEmpty())
+	})
+
+	It("returns a reservation that lapses to the pool", func() {
+		lock := reserve(time.Millisecond)
+		Ω(lockState(lock)).Should(Equal("reserved"))
+
+		session := runOut(out.OutRequest{Source: source, Params: out.OutParams{Confirm: lock}}, sourceDir)
+		Eventually(session, 10*time.Second).Should(gexec.Exit(1))
+		Ω(session.Err).Should(gbytes.Say("the reservation of lock %s lapsed", lock))
+
+		session = runOut(out.OutRequest{Source: source, Params: out.OutParams{Acquire: true}}, sourceDir)
+		Eventually(session, 10*time.Second).Should(gexec.Exit(0))
+		Ω(session.Err).Should(gbytes.Say("reservation of lock: %s lapsed", lock))
+
+		Ω(lockState(lock)).Should(Equal("claimed"))
+	})
+})
+
+var _ = Describe("Out leasing a lock", func() {
+	var gitRepo string
+	var bareGitRepo string
+	var sourceDir string
+
+	var source out.Source
+
+	BeforeEach(func() {
+		var err error
+		gitRepo, err = ioutil.TempDir("", "git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		bareGitRepo, err = ioutil.TempDir("", "bare-git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		sourceDir, err = ioutil.TempDir("", "source-dir")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		setupGitRepo(gitRepo)
+
+		clone := exec.Command("git", "clone", "--bare", gitRepo, bareGitRepo)
+		err = clone.Run()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		source = out.Source{
+			URI:               bareGitRepo,
+			Branch:            "master",
+			Pool:              "lock-pool",
+			RetryDelay:        100 * time.Millisecond,
+			SelectionStrategy: out.SelectionDeterministic,
+			LeaseDuration:     time.Hour,
+		}
+	})
+
+	AfterEach(func() {
+		for _, dir := range []string{gitRepo, bareGitRepo, sourceDir} {
+			err := os.RemoveAll(dir)
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+	})
+
+	leaseExpiry := func(lock string) string {
+		show := exec.Command("git", "show", "master:lock-pool/claimed/."+lock+".expires")
+		show.Dir = bareGitRepo
+		contents, err := show.Output()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		return strings.TrimSpace(string(contents))
+	}
+
+	acquire := func() out.OutResponse {
+		session := runOut(out.OutRequest{Source: source, Params: out.OutParams{Acquire: true}}, sourceDir)
+		Eventually(session, 10*time.Second).Should(gexec.Exit(0))
+
+		var response out.OutResponse
+		err := json.Unmarshal(session.Out.Contents(), &response)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		return response
+	}
+
+	It("renews the lease of a claimed lock with a heartbeat", func() {
+		lock := acquire().Version.Lock
+		leased := leaseExpiry(lock)
+
+		err := os.MkdirAll(filepath.Join(sourceDir, lock), 0755)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		err = ioutil.WriteFile(filepath.Join(sourceDir, lock, "name"), []byte(lock), 0644)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		time.Sleep(time.Second)
+
+		session := runOut(out.OutRequest{Source: source, Params: out.OutParams{Heartbeat: lock}}, sourceDir)
+		Eventually(session, 10*time.Second).Should(gexec.Exit(0))
+
+		Ω(leaseExpiry(lock) > leased).Should(BeTrue())
+
+		var response out.OutResponse
+		err = json.Unmarshal(session.Out.Contents(), &response)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(response.Version.Lock).Should(Equal(lock))
+
+		inDestination, err := ioutil.TempDir("", "in-destination")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		defer os.RemoveAll(inDestination)
+
+		runIn(fmt.Sprintf(`{
+			"source": {"uri": %q, "branch": "master", "pool": "lock-pool"},
+			"version": {"ref": %q, "lock": %q}
+		}`, bareGitRepo, response.Version.Ref, lock), inDestination, 0)
+
+		name, err := ioutil.ReadFile(filepath.Join(inDestination, "name"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(strings.TrimSpace(string(name))).Should(Equal(lock))
+	})
+
+	It("transfers a claimed lock to another build without releasing it", func() {
+		lock := acquire().Version.Lock
+
+		err := os.MkdirAll(filepath.Join(sourceDir, lock), 0755)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		err = ioutil.WriteFile(filepath.Join(sourceDir, lock, "name"), []byte(lock), 0644)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		transfer := runOut(out.OutRequest{Source: source, Params: out.OutParams{Transfer: lock}}, sourceDir)
+		Eventually(transfer, 10*time.Second).Should(gexec.Exit(0))
+
+		var response out.OutResponse
+		err = json.Unmarshal(transfer.Out.Contents(), &response)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(response.Version.Lock).Should(Equal(lock))
+		Ω(response.Metadata).Should(ContainElement(out.MetadataPair{Name: "fencing_token", Value: "2"}))
+
+		log := exec.Command("git", "log", "-1", "--format=%B", "master")
+		log.Dir = bareGitRepo
+		message, err := log.Output()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(message)).Should(HavePrefix("transferring: " + lock))
+
+		show := exec.Command("git", "show", "--name-only", "--format=", "master")
+		show.Dir = bareGitRepo
+		changed, err := show.Output()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(changed)).ShouldNot(ContainSubstring("unclaimed"))
+		Ω(leaseExpiry(lock)).ShouldNot(BeEmpty())
+	})
+
+	It("records the URL of the build holding a claimed lock until it is released", func() {
+		os.Setenv("ATC_EXTERNAL_URL", "https://ci.example.com")
+		os.Setenv("BUILD_ID", "1234")
+		defer os.Unsetenv("ATC_EXTERNAL_URL")
+		defer os.Unsetenv("BUILD_ID")
+
+		lock := acquire().Version.Lock
+
+		show := exec.Command("git", "show", "master:lock-pool/claimed/."+lock+".build_url")
+		show.Dir = bareGitRepo
+		contents, err := show.Output()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(strings.TrimSpace(string(contents))).Should(Equal("https://ci.example.com/builds/1234"))
+
+		err = os.MkdirAll(filepath.Join(sourceDir, lock), 0755)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		err = ioutil.WriteFile(filepath.Join(sourceDir, lock, "name"), []byte(lock), 0644)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		release := runOut(out.OutRequest{Source: source, Params: out.OutParams{Release: lock}}, sourceDir)
+		Eventually(release, 10*time.Second).Should(gexec.Exit(0))
+
+		ls := exec.Command("git", "ls-tree", "--name-only", "master", "lock-pool/claimed/")
+		ls.Dir = bareGitRepo
+		listed, err := ls.Output()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(listed)).ShouldNot(ContainSubstring(".build_url"))
+	})
+
+	It("reaps a claim whose lease has run out", func() {
+		source.LeaseDuration = time.Millisecond
+
+		lock := acquire().Version.Lock
+
+		session := runOut(out.OutRequest{Source: source, Params: out.OutParams{Acquire: true}}, sourceDir)
+		Eventually(session, 10*time.Second).Should(gexec.Exit(0))
+		Ω(session.Err).Should(gbytes.Say("lease of lock: %s expired", lock))
+	})
+
+	It("leases and reaps locks by the max_claim_duration in their metadata", func() {
+		source.LeaseDuration = 0
+
+		declareDuration := exec.Command("bash", "-e", "-c", fmt.Sprintf(`
+			echo '{"max_claim_duration": "1ms"}' > lock-pool/unclaimed/some-lock
+			echo '{"max_claim_duration": "1ms"}' > lock-pool/unclaimed/some-other-lock
+			git commit -am 'declaring claim durations'
+			git push %s HEAD:master
+		`, bareGitRepo))
+		declareDuration.Dir = gitRepo
+
+		err := declareDuration.Run()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		lock := acquire().Version.Lock
+		Ω(leaseExpiry(lock)).ShouldNot(BeEmpty())
+
+		session := runOut(out.OutRequest{Source: source, Params: out.OutParams{Acquire: true}}, sourceDir)
+		Eventually(session, 10*time.Second).Should(gexec.Exit(0))
+		Ω(session.Err).Should(gbytes.Say("lease of lock: %s expired", lock))
+	})
+})
+
+var _ = Describe("Out pausing a pool", func() {
+	var gitRepo string
+	var bareGitRepo string
+	var sourceDir string
+
+	var source out.Source
+
+	BeforeEach(func() {
+		var err error
+		gitRepo, err = ioutil.TempDir("", "git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		bareGitRepo, err = ioutil.TempDir("", "bare-git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		sourceDir, err = ioutil.TempDir("", "source-dir")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		setupGitRepo(gitRepo)
+
+		clone := exec.Command("git", "clone", "--bare", gitRepo, bareGitRepo)
+		err = clone.Run()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		source = out.Source{
+			URI:            bareGitRepo,
+			Branch:         "master",
+			Pool:           "lock-pool",
+			RetryDelay:     100 * time.Millisecond,
+			FailWhenPaused: true,
+		}
+	})
+
+	AfterEach(func() {
+		for _, dir := range []string{gitRepo, bareGitRepo, sourceDir} {
+			err := os.RemoveAll(dir)
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+	})
+
+	It("refuses to claim locks until the pool is unpaused", func() {
+		pause := runOut(out.OutRequest{Source: source, Params: out.OutParams{PausePool: true, Reason: "patching the hosts"}}, sourceDir)
+		Eventually(pause, 10*time.Second).Should(gexec.Exit(0))
+
+		show := exec.Command("git", "show", "master:lock-pool/.paused")
+		show.Dir = bareGitRepo
+		marker, err := show.Output()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(marker)).Should(Equal("patching the hosts\n"))
+
+		acquire := runOut(out.OutRequest{Source: source, Params: out.OutParams{Acquire: true}}, sourceDir)
+		Eventually(acquire, 10*time.Second).Should(gexec.Exit(1))
+		Ω(errorResponse(acquire).Error.Category).Should(Equal("paused"))
+
+		unpause := runOut(out.OutRequest{Source: source, Params: out.OutParams{UnpausePool: true}}, sourceDir)
+		Eventually(unpause, 10*time.Second).Should(gexec.Exit(0))
+
+		acquire = runOut(out.OutRequest{Source: source, Params: out.OutParams{Acquire: true}}, sourceDir)
+		Eventually(acquire, 10*time.Second).Should(gexec.Exit(0))
+	})
+})
+
+var _ = Describe("Out squashing history", func() {
+	var gitRepo string
+	var bareGitRepo string
+	var sourceDir string
+
+	var source out.Source
+
+	git := func(args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = bareGitRepo
+		output, err := cmd.Output()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		return strings.TrimSpace(string(output))
+	}
+
+	BeforeEach(func() {
+		var err error
+		gitRepo, err = ioutil.TempDir("", "git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		bareGitRepo, err = ioutil.TempDir("", "bare-git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		sourceDir, err = ioutil.TempDir("", "source-dir")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		setupAgedGitRepo(gitRepo)
+
+		clone := exec.Command("git", "clone", "--bare", gitRepo, bareGitRepo)
+		err = clone.Run()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		source = out.Source{
+			URI:        bareGitRepo,
+			Branch:     "master",
+			Pool:       "lock-pool",
+			RetryDelay: 100 * time.Millisecond,
+		}
+	})
+
+	AfterEach(func() {
+		for _, dir := range []string{gitRepo, bareGitRepo, sourceDir} {
+			err := os.RemoveAll(dir)
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+	})
+
+	It("folds old commits into one, keeping the pool and the claims still held", func() {
+		acquire := runOut(out.OutRequest{Source: source, Params: out.OutParams{Acquire: true}}, sourceDir)
+		Eventually(acquire, 10*time.Second).Should(gexec.Exit(0))
+
+		tree := git("rev-parse", "master^{tree}")
+
+		squash := runOut(out.OutRequest{Source: source, Params: out.OutParams{SquashHistory: true}}, sourceDir)
+		Eventually(squash, 10*time.Second).Should(gexec.Exit(0))
+		Ω(squash.Err).Should(gbytes.Say("squashed 4 commit"))
+
+		var response out.OutResponse
+		err := json.Unmarshal(squash.Out.Contents(), &response)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(response.Version.Ref).Should(Equal(git("rev-parse", "master")))
+		Ω(response.Metadata).Should(ContainElement(out.MetadataPair{Name: "squashed_commits", Value: "4"}))
+
+		Ω(git("rev-parse", "master^{tree}")).Should(Equal(tree))
+
+		subjects := strings.Split(git("log", "--format=%s", "master"), "\n")
+		Ω(subjects).Should(HaveLen(5))
+		Ω(subjects[1:]).Should(Equal([]string{"unclaiming: lock-2", "claiming: lock-2", "claiming: lock-1", "squashing history: lock-pool"}))
+
+		claimedAt := git("log", "-1", "--diff-filter=A", "--format=%cI", "master", "--", "lock-pool/claimed/lock-1")
+		Ω(claimedAt).Should(HavePrefix("2020-01-05"))
+
+		again := runOut(out.OutRequest{Source: source, Params: out.OutParams{SquashHistory: true}}, sourceDir)
+		Eventually(again, 10*time.Second).Should(gexec.Exit(0))
+		Ω(again.Err).Should(gbytes.Say("nothing to squash"))
+	})
+
+	It("keeps as many days of history as it is told to", func() {
+		days := int(time.Since(time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)).Hours() / 24)
+
+		squash := runOut(out.OutRequest{Source: source, Params: out.OutParams{SquashHistory: true, SquashOlderThanDays: days}}, sourceDir)
+		Eventually(squash, 10*time.Second).Should(gexec.Exit(0))
+		Ω(squash.Err).Should(gbytes.Say("squashed 2 commit"))
+
+		subjects := strings.Split(git("log", "--format=%s", "master"), "\n")
+		Ω(subjects).Should(Equal([]string{
+			"unclaiming: lock-2",
+			"claiming: lock-2",
+			"claiming: lock-1",
+			"adding: lock-4",
+			"adding: lock-3",
+			"squashing history: lock-pool",
+		}))
+	})
+})
+
+var _ = Describe("Out with clone_since", func() {
+	var gitRepo string
+	var bareGitRepo string
+	var cacheDir string
+	var sourceDir string
+
+	var source out.Source
+
+	BeforeEach(func() {
+		var err error
+		gitRepo, err = ioutil.TempDir("", "git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		bareGitRepo, err = ioutil.TempDir("", "bare-git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		cacheDir, err = ioutil.TempDir("", "cache-dir")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		sourceDir, err = ioutil.TempDir("", "source-dir")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		setupAgedGitRepo(gitRepo)
+
+		clone := exec.Command("git", "clone", "--bare", gitRepo, bareGitRepo)
+		err = clone.Run()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		source = out.Source{
+			URI:        bareGitRepo,
+			Branch:     "master",
+			Pool:       "lock-pool",
+			RetryDelay: 100 * time.Millisecond,
+			CloneSince: 720 * time.Hour,
+		}
+	})
+
+	AfterEach(func() {
+		for _, dir := range []string{gitRepo, bareGitRepo, cacheDir, sourceDir} {
+			err := os.RemoveAll(dir)
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+	})
+
+	It("fetches only the history made since, or the last commit if there is none", func() {
+		source.CacheDir = cacheDir
+
+		cachedCommits := func() []string {
+			clones, err := filepath.Glob(filepath.Join(cacheDir, "*[^k]"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(clones).Should(HaveLen(1))
+
+			log := exec.Command("git", "log", "--format=%s", "refs/remotes/origin/master")
+			log.Dir = clones[0]
+			output, err := log.Output()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			return strings.Split(strings.TrimSpace(string(output)), "\n")
+		}
+
+		acquire := runOut(out.OutRequest{Source: source, Params: out.OutParams{Acquire: true}}, sourceDir)
+		Eventually(acquire, 10*time.Second).Should(gexec.Exit(0))
+		Ω(cachedCommits()).Should(Equal([]string{"unclaiming: lock-2"}))
+
+		var response out.OutResponse
+		err := json.Unmarshal(acquire.Out.Contents(), &response)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		acquire = runOut(out.OutRequest{Source: source, Params: out.OutParams{Acquire: true}}, sourceDir)
+		Eventually(acquire, 10*time.Second).Should(gexec.Exit(0))
+		Ω(cachedCommits()).Should(Equal([]string{"claiming: " + response.Version.Lock}))
+	})
+
+	It("squashes the whole history all the same", func() {
+		acquire := runOut(out.OutRequest{Source: source, Params: out.OutParams{Acquire: true}}, sourceDir)
+		Eventually(acquire, 10*time.Second).Should(gexec.Exit(0))
+
+		squash := runOut(out.OutRequest{Source: source, Params: out.OutParams{SquashHistory: true}}, sourceDir)
+		Eventually(squash, 10*time.Second).Should(gexec.Exit(0))
+		Ω(squash.Err).Should(gbytes.Say("squashed 4 commit"))
+	})
+
+	It("tells which pipeline holds a lock claimed before the clone's history", func() {
+		os.Setenv("BUILD_PIPELINE_NAME", "deploy")
+		defer os.Unsetenv("BUILD_PIPELINE_NAME")
+
+		acquire := runOut(out.OutRequest{Source: source, Params: out.OutParams{Acquire: true}}, sourceDir)
+		Eventually(acquire, 10*time.Second).Should(gexec.Exit(0))
+
+		var response out.OutResponse
+		err := json.Unmarshal(acquire.Out.Contents(), &response)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		release := runOut(out.OutRequest{Source: source, Params: out.OutParams{ReleaseAllMine: true}}, sourceDir)
+		Eventually(release, 10*time.Second).Should(gexec.Exit(0))
+		Ω(release.Err).Should(gbytes.Say(`released 1 lock\(s\): %s\n`, response.Version.Lock))
+
+		handler := out.NewGitLockHandler(source.WithDefaults())
+		Ω(handler.Setup()).Should(Succeed())
+		defer handler.Cleanup()
+
+		Ω(handler.ListLocks("claimed")).Should(Equal([]string{"lock-1"}))
+	})
+})
+
+var _ = Describe("Out with a mirror", func() {
+	var gitRepo string
+	var bareGitRepo string
+	var mirrorGitRepo string
+	var sourceDir string
+
+	var source out.Source
+
+	BeforeEach(func() {
+		var err error
+		gitRepo, err = ioutil.TempDir("", "git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		bareGitRepo, err = ioutil.TempDir("", "bare-git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		mirrorGitRepo, err = ioutil.TempDir("", "mirror-git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		sourceDir, err = ioutil.TempDir("", "source-dir")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		setupGitRepo(gitRepo)
+
+		clone := exec.Command("git", "clone", "--bare", gitRepo, bareGitRepo)
+		err = clone.Run()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		initMirror := exec.Command("git", "init", "--bare", mirrorGitRepo)
+		err = initMirror.Run()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		source = out.Source{
+			URI:        bareGitRepo,
+			MirrorURI:  mirrorGitRepo,
+			Branch:     "master",
+			Pool:       "lock-pool",
+			RetryDelay: 100 * time.Millisecond,
+		}
+	})
+
+	AfterEach(func() {
+		for _, dir := range []string{gitRepo, bareGitRepo, mirrorGitRepo, sourceDir} {
+			err := os.RemoveAll(dir)
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+	})
+
+	head := func(repo string) string {
+		revParse := exec.Command("git", "rev-parse", "master")
+		revParse.Dir = repo
+		ref, err := revParse.Output()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		return strings.TrimSpace(string(ref))
+	}
+
+	It("pushes each change to the mirror too", func() {
+		session := runOut(out.OutRequest{Source: source, Params: out.OutParams{Acquire: true}}, sourceDir)
+		Eventually(session, 10*time.Second).Should(gexec.Exit(0))
+
+		var response out.OutResponse
+		err := json.Unmarshal(session.Out.Contents(), &response)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(head(mirrorGitRepo)).Should(Equal(response.Version.Ref))
+		Ω(head(bareGitRepo)).Should(Equal(response.Version.Ref))
+	})
+
+	It("changes the pool even if the mirror can't be reached", func() {
+		source.MirrorURI = filepath.Join(mirrorGitRepo, "missing")
+
+		session := runOut(out.OutRequest{Source: source, Params: out.OutParams{Acquire: true}}, sourceDir)
+		Eventually(session, 10*time.Second).Should(gexec.Exit(0))
+		Ω(session.Err).Should(gbytes.Say("failed to mirror pool: lock-pool"))
+
+		var response out.OutResponse
+		err := json.Unmarshal(session.Out.Contents(), &response)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(head(bareGitRepo)).Should(Equal(response.Version.Ref))
+
+		var names []string
+		for _, pair := range response.Metadata {
+			names = append(names, pair.Name)
+		}
+		Ω(names).Should(ContainElement("mirror_error"))
+	})
+})
+
+var _ = Describe("Out with a bare clone", func() {
+	var gitRepo string
+	var bareGitRepo string
+	var sourceDir string
+
+	var source out.Source
+
+	BeforeEach(func() {
+		var err error
+		gitRepo, err = ioutil.TempDir("", "git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		bareGitRepo, err = ioutil.TempDir("", "bare-git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		sourceDir, err = ioutil.TempDir("", "source-dir")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		setupGitRepo(gitRepo)
+
+		clone := exec.Command("git", "clone", "--bare", gitRepo, bareGitRepo)
+		err = clone.Run()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		source = out.Source{
+			URI:               bareGitRepo,
+			Branch:            "master",
+			Pool:              "lock-pool",
+			RetryDelay:        100 * time.Millisecond,
+			SelectionStrategy: out.SelectionDeterministic,
+			Bare:              true,
+		}
+	})
+
+	AfterEach(func() {
+		for _, dir := range []string{gitRepo, bareGitRepo, sourceDir} {
+			err := os.RemoveAll(dir)
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+	})
+
+	run := func(request out.OutRequest) out.OutResponse {
+		session := runOut(request, sourceDir)
+		Eventually(session, 10*time.Second).Should(gexec.Exit(0))
+
+		var response out.OutResponse
+		err := json.Unmarshal(session.Out.Contents(), &response)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		return response
+	}
+
+	writeLock := func(name string) string {
+		lockDir := filepath.Join(sourceDir, name)
+		Ω(os.MkdirAll(lockDir, 0755)).Should(Succeed())
+		Ω(ioutil.WriteFile(filepath.Join(lockDir, "name"), []byte(name), 0644)).Should(Succeed())
+		Ω(ioutil.WriteFile(filepath.Join(lockDir, "metadata"), []byte("some-metadata"), 0644)).Should(Succeed())
+
+		return name
+	}
+
+	files := func() []string {
+		lsTree := exec.Command("git", "ls-tree", "-r", "--name-only", "master", "lock-pool")
+		lsTree.Dir = bareGitRepo
+		output, err := lsTree.Output()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		return strings.Fields(string(output))
+	}
+
+	It("changes the pool without checking it out", func() {
+		source.LeaseDuration = time.Hour
+
+		response := run(out.OutRequest{Source: source, Params: out.OutParams{Acquire: true}})
+		Ω(response.Version.Lock).Should(Equal("some-lock"))
+		Ω(response.Version).Should(Equal(getVersion(bareGitRepo, "origin/master")))
+		Ω(files()).Should(ConsistOf(
+			"lock-pool/.fencing/some-lock",
+			"lock-pool/claimed/.gitkeep",
+			"lock-pool/claimed/.some-lock.expires",
+			"lock-pool/claimed/some-lock",
+			"lock-pool/unclaimed/.gitkeep",
+			"lock-pool/unclaimed/some-other-lock",
+		))
+
+		run(out.OutRequest{Source: source, Params: out.OutParams{Disable: writeLock("some-lock")}})
+		Ω(files()).Should(ContainElement("lock-pool/maintenance/some-lock"))
+		Ω(files()).ShouldNot(ContainElement("lock-pool/claimed/.some-lock.expires"))
+
+		run(out.OutRequest{Source: source, Params: out.OutParams{Enable: "some-lock"}})
+		run(out.OutRequest{Source: source, Params: out.OutParams{Acquire: true}})
+		run(out.OutRequest{Source: source, Params: out.OutParams{Remove: "some-lock"}})
+		run(out.OutRequest{Source: source, Params: out.OutParams{Add: writeLock("new-lock")}})
+
+		Ω(files()).Should(ConsistOf(
+			"lock-pool/.fencing/some-lock",
+			"lock-pool/claimed/.gitkeep",
+			"lock-pool/unclaimed/.gitkeep",
+			"lock-pool/unclaimed/new-lock",
+			"lock-pool/unclaimed/some-other-lock",
+		))
+
+		show := exec.Command("git", "show", "master:lock-pool/unclaimed/new-lock")
+		show.Dir = bareGitRepo
+		Ω(show.Output()).Should(Equal([]byte("some-metadata")))
+
+		fencingToken := exec.Command("git", "show", "master:lock-pool/.fencing/some-lock")
+		fencingToken.Dir = bareGitRepo
+		Ω(fencingToken.Output()).Should(Equal([]byte("2\n")))
+	})
+
+	It("retries conflicting changes from a fresh copy of the branch", func() {
+		first := runOut(out.OutRequest{Source: source, Params: out.OutParams{Acquire: true}}, sourceDir)
+		second := runOut(out.OutRequest{Source: source, Params: out.OutParams{Acquire: true}}, sourceDir)
+
+		Eventually(first, 10*time.Second).Should(gexec.Exit(0))
+		Eventually(second, 10*time.Second).Should(gexec.Exit(0))
+
+		Ω(files()).Should(ContainElement("lock-pool/claimed/some-lock"))
+		Ω(files()).Should(ContainElement("lock-pool/claimed/some-other-lock"))
+	})
+
+	It("creates the branch the pool is on", func() {
+		source.Branch = "brand-new-branch"
+		source.CreateBranch = true
+
+		response := run(out.OutRequest{Source: source, Params: out.OutParams{Acquire: true}})
+		Ω(response.Version).Should(Equal(getVersion(bareGitRepo, "origin/brand-new-branch")))
+	})
+})
+
+var _ = Describe("Out with a lock index", func() {
+	var gitRepo string
+	var bareGitRepo string
+	var sourceDir string
+
+	var source out.Source
+
+	BeforeEach(func() {
+		var err error
+		gitRepo, err = ioutil.TempDir("", "git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		bareGitRepo, err = ioutil.TempDir("", "bare-git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		sourceDir, err = ioutil.TempDir("", "source-dir")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		setupGitRepo(gitRepo)
+
+		clone := exec.Command("git", "clone", "--bare", gitRepo, bareGitRepo)
+		err = clone.Run()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		source = out.Source{
+			URI:               bareGitRepo,
+			Branch:            "master",
+			Pool:              "lock-pool",
+			RetryDelay:        100 * time.Millisecond,
+			SelectionStrategy: out.SelectionDeterministic,
+			LockIndex:         true,
+		}
+	})
+
+	AfterEach(func() {
+		for _, dir := range []string{gitRepo, bareGitRepo, sourceDir} {
+			err := os.RemoveAll(dir)
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+	})
+
+	run := func(request out.OutRequest) {
+		session := runOut(request, sourceDir)
+		Eventually(session, 10*time.Second).Should(gexec.Exit(0))
+	}
+
+	writeLock := func(name string) string {
+		lockDir := filepath.Join(sourceDir, name)
+		Ω(os.MkdirAll(lockDir, 0755)).Should(Succeed())
+		Ω(ioutil.WriteFile(filepath.Join(lockDir, "name"), []byte(name), 0644)).Should(Succeed())
+		Ω(ioutil.WriteFile(filepath.Join(lockDir, "metadata"), []byte("some-metadata"), 0644)).Should(Succeed())
+
+		return name
+	}
+
+	index := func() out.LockIndex {
+		show := exec.Command("git", "show", "master:lock-pool/"+out.LockIndexFile)
+		show.Dir = bareGitRepo
+		contents, err := show.Output()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		var index out.LockIndex
+		err = json.Unmarshal(contents, &index)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		return index
+	}
+
+	states := func() map[string]string {
+		states := map[string]string{}
+		for name, entry := range index().Locks {
+			states[name] = entry.State
+		}
+
+		return states
+	}
+
+	for _, bare := range []bool{false, true} {
+		bare := bare
+
+		It(fmt.Sprintf("keeps the index in step with each change (bare: %v)", bare), func() {
+			source.Bare = bare
+
+			before := time.Now().Add(-time.Second)
+
+			run(out.OutRequest{Source: source, Params: out.OutParams{Acquire: true}})
+			Ω(states()).Should(Equal(map[string]string{
+				"some-lock":       "claimed",
+				"some-other-lock": "unclaimed",
+			}))
+
+			claim := index().Locks["some-lock"]
+			Ω(claim.Claimer).ShouldNot(BeEmpty())
+			Ω(claim.Since).ShouldNot(BeNil())
+			Ω(*claim.Since).Should(BeTemporally(">=", before.Truncate(time.Second)))
+
+			// the lock's state hasn't changed since it was indexed
+			Ω(index().Locks["some-other-lock"].Since).Should(BeNil())
+
+			run(out.OutRequest{Source: source, Params: out.OutParams{Disable: writeLock("some-lock")}})
+			run(out.OutRequest{Source: source, Params: out.OutParams{Add: writeLock("new-lock")}})
+			run(out.OutRequest{Source: source, Params: out.OutParams{Acquire: true}})
+			run(out.OutRequest{Source: source, Params: out.OutParams{Remove: writeLock("new-lock")}})
+			Ω(states()).Should(Equal(map[string]string{
+				"some-lock":       "maintenance",
+				"some-other-lock": "unclaimed",
+			}))
+
+			disabled := index().Locks["some-lock"]
+			Ω(disabled.Claimer).Should(BeEmpty())
+			Ω(disabled.Since).ShouldNot(BeNil())
+		})
+	}
+
+	It("rebuilds the index if it is deleted", func() {
+		run(out.OutRequest{Source: source, Params: out.OutParams{Acquire: true}})
+		claim := index().Locks["some-lock"]
+
+		gitSetup := exec.Command("bash", "-e", "-c", `
+			git remote add origin `+bareGitRepo+`
+			git fetch -q origin master
+			git reset -q --hard origin/master
+			git rm -q lock-pool/.index.json
+			git commit -q -m 'dropping the index'
+			git push -q origin master
+		`)
+		gitSetup.Dir = gitRepo
+		gitSetup.Stderr = GinkgoWriter
+		gitSetup.Stdout = GinkgoWriter
+		err := gitSetup.Run()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		run(out.OutRequest{Source: source, Params: out.OutParams{Add: writeLock("new-lock")}})
+		Ω(states()).Should(Equal(map[string]string{
+			"new-lock":        "unclaimed",
+			"some-lock":       "claimed",
+			"some-other-lock": "unclaimed",
+		}))
+
+		rebuilt := index().Locks["some-lock"]
+		Ω(rebuilt.Claimer).Should(Equal(claim.Claimer))
+		Ω(*rebuilt.Since).Should(BeTemporally("~", *claim.Since, time.Second))
+	})
+})
+
+var _ = Describe("Out renaming a lock", func() {
+	var gitRepo string
+	var bareGitRepo string
+	var sourceDir string
+
+	var source out.Source
+
+	BeforeEach(func() {
+		var err error
+		gitRepo, err = ioutil.TempDir("", "git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		bareGitRepo, err = ioutil.TempDir("", "bare-git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		sourceDir, err = ioutil.TempDir("", "source-dir")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		setupGitRepo(gitRepo)
+
+		clone := exec.Command("git", "clone", "--bare", gitRepo, bareGitRepo)
+		err = clone.Run()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		source = out.Source{
+			URI:               bareGitRepo,
+			Branch:            "master",
+			Pool:              "lock-pool",
+			RetryDelay:        100 * time.Millisecond,
+			SelectionStrategy: out.SelectionDeterministic,
+			LeaseDuration:     time.Hour,
+			LockIndex:         true,
+		}
+	})
+
+	AfterEach(func() {
+		for _, dir := range []string{gitRepo, bareGitRepo, sourceDir} {
+			err := os.RemoveAll(dir)
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+	})
+
+	files := func() []string {
+		lsTree := exec.Command("git", "ls-tree", "-r", "--name-only", "master", "lock-pool")
+		lsTree.Dir = bareGitRepo
+		output, err := lsTree.Output()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		return strings.Fields(string(output))
+	}
+
+	index := func() out.LockIndex {
+		show := exec.Command("git", "show", "master:lock-pool/"+out.LockIndexFile)
+		show.Dir = bareGitRepo
+		contents, err := show.Output()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		var index out.LockIndex
+		err = json.Unmarshal(contents, &index)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		return index
+	}
+
+	for _, bare := range []bool{false, true} {
+		bare := bare
+
+		It(fmt.Sprintf("renames a claimed lock along with its records, keeping it claimed (bare: %v)", bare), func() {
+			source.Bare = bare
+
+			acquire := runOut(out.OutRequest{Source: source, Params: out.OutParams{Acquire: true}}, sourceDir)
+			Eventually(acquire, 10*time.Second).Should(gexec.Exit(0))
+
+			claim := index().Locks["some-lock"]
+
+			rename := runOut(out.OutRequest{Source: source, Params: out.OutParams{
+				Rename: &out.RenameParams{From: "some-lock", To: "renamed-lock"},
+			}}, sourceDir)
+			Eventually(rename, 10*time.Second).Should(gexec.Exit(0))
+
+			var response out.OutResponse
+			err := json.Unmarshal(rename.Out.Contents(), &response)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(response.Version).Should(Equal(getVersion(bareGitRepo, "origin/master")))
+			Ω(response.Version.Lock).Should(Equal("renamed-lock"))
+
+			Ω(files()).Should(ConsistOf(
+				"lock-pool/"+out.LockIndexFile,
+				"lock-pool/.fencing/renamed-lock",
+				"lock-pool/claimed/.gitkeep",
+				"lock-pool/claimed/.renamed-lock.expires",
+				"lock-pool/claimed/renamed-lock",
+				"lock-pool/unclaimed/.gitkeep",
+				"lock-pool/unclaimed/some-other-lock",
+			))
+
+			Ω(index().Locks).ShouldNot(HaveKey("some-lock"))
+			Ω(index().Locks["renamed-lock"]).Should(Equal(claim))
+
+			log := exec.Command("git", "log", "-1", "--format=%B", "master")
+			log.Dir = bareGitRepo
+			message, err := log.Output()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(message)).Should(ContainSubstring("renaming: some-lock\n\nRenamed-To: renamed-lock"))
+		})
+	}
+
+	It("refuses to rename a lock onto one the pool already has", func() {
+		rename := runOut(out.OutRequest{Source: source, Params: out.OutParams{
+			Rename: &out.RenameParams{From: "some-lock", To: "some-other-lock"},
+		}}, sourceDir)
+		Eventually(rename, 10*time.Second).Should(gexec.Exit(1))
+		Ω(rename.Err).Should(gbytes.Say("lock some-other-lock is already in pool lock-pool, in unclaimed"))
+	})
+})
+
+var _ = Describe("Out with content digests", func() {
+	var gitRepo string
+	var bareGitRepo string
+	var sourceDir string
+	var inDestination string
+
+	var source out.Source
+
+	BeforeEach(func() {
+		var err error
+		gitRepo, err = ioutil.TempDir("", "git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		bareGitRepo, err = ioutil.TempDir("", "bare-git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		sourceDir, err = ioutil.TempDir("", "source-dir")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		inDestination, err = ioutil.TempDir("", "in-destination")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		setupGitRepo(gitRepo)
+
+		clone := exec.Command("git", "clone", "--bare", gitRepo, bareGitRepo)
+		err = clone.Run()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		source = out.Source{
+			URI:               bareGitRepo,
+			Branch:            "master",
+			Pool:              "lock-pool",
+			RetryDelay:        100 * time.Millisecond,
+			SelectionStrategy: out.SelectionDeterministic,
+			ContentDigest:     true,
+		}
+	})
+
+	AfterEach(func() {
+		for _, dir := range []string{gitRepo, bareGitRepo, sourceDir, inDestination} {
+			err := os.RemoveAll(dir)
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+	})
+
+	acquire := func() out.Version {
+		session := runOut(out.OutRequest{Source: source, Params: out.OutParams{Acquire: true}}, sourceDir)
+		Eventually(session, 10*time.Second).Should(gexec.Exit(0))
+
+		var response out.OutResponse
+		err := json.Unmarshal(session.Out.Contents(), &response)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		return response.Version
+	}
+
+	inRequest := func(version out.Version) string {
+		return fmt.Sprintf(`
+			{
+				"source": {
+					"uri": "%s",
+					"branch": "master",
+					"pool": "lock-pool",
+					"content_digest": true
+				},
+				"version": {
+					"ref": "%s",
+					"lock": "%s",
+					"digest": "%s"
+				}
+			}`, bareGitRepo, version.Ref, version.Lock, version.Digest)
+	}
+
+	It("versions the claimed lock with the digest of its contents", func() {
+		version := acquire()
+		Ω(version.Lock).Should(Equal("some-lock"))
+
+		show := exec.Command("git", "show", version.Ref+":lock-pool/claimed/some-lock")
+		show.Dir = bareGitRepo
+		contents, err := show.Output()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(version.Digest).Should(Equal(out.ContentDigest(contents)))
+	})
+
+	It("fetches the lock when it matches the digest, passing the digest along", func() {
+		version := acquire()
+
+		session := runIn(inRequest(version), inDestination, 0)
+
+		var response struct {
+			Version out.Version `json:"version"`
+		}
+		err := json.Unmarshal(session.Out.Contents(), &response)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(response.Version.Digest).Should(Equal(version.Digest))
+
+		metadata, err := ioutil.ReadFile(filepath.Join(inDestination, "metadata"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(metadata)).Should(Equal("{\"some\":\"json\"}\n"))
+	})
+
+	It("refuses to fetch a lock that doesn't match the digest", func() {
+		version := acquire()
+		version.Digest = out.ContentDigest([]byte("something else"))
+
+		session := runIn(inRequest(version), inDestination, 1)
+		Ω(session.Err).Should(gbytes.Say("error: lock some-lock does not match the digest of version %s", version.Ref))
+	})
+})
+
+var _ = Describe("Out destroying a pool", func() {
+	var gitRepo string
+	var bareGitRepo string
+	var sourceDir string
+
+	var source out.Source
+
+	BeforeEach(func() {
+		var err error
+		gitRepo, err = ioutil.TempDir("", "git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		bareGitRepo, err = ioutil.TempDir("", "bare-git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		sourceDir, err = ioutil.TempDir("", "source-dir")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		setupGitRepo(gitRepo)
+
+		gitSetup := exec.Command("bash", "-e", "-c", `
+			mkdir -p other-pool/unclaimed
+			echo '{}' > other-pool/unclaimed/other-pool-lock
+			git add other-pool
+			git commit -q -m 'adding another pool'
+		`)
+		gitSetup.Dir = gitRepo
+		gitSetup.Stderr = GinkgoWriter
+		err = gitSetup.Run()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		clone := exec.Command("git", "clone", "--bare", gitRepo, bareGitRepo)
+		err = clone.Run()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		source = out.Source{
+			URI:        bareGitRepo,
+			Branch:     "master",
+			Pool:       "lock-pool",
+			RetryDelay: 100 * time.Millisecond,
+			LockIndex:  true,
+		}
+	})
+
+	AfterEach(func() {
+		for _, dir := range []string{gitRepo, bareGitRepo, sourceDir} {
+			err := os.RemoveAll(dir)
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+	})
+
+	files := func() []string {
+		list := exec.Command("git", "ls-tree", "-r", "--name-only", "master")
+		list.Dir = bareGitRepo
+		output, err := list.Output()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		return strings.Fields(string(output))
+	}
+
+	for _, bare := range []bool{false, true} {
+		bare := bare
+
+		It(fmt.Sprintf("removes the whole pool in one commit, leaving the others (bare: %v)", bare), func() {
+			source.Bare = bare
+
+			acquire := runOut(out.OutRequest{Source: source, Params: out.OutParams{Acquire: true}}, sourceDir)
+			Eventually(acquire, 10*time.Second).Should(gexec.Exit(0))
+			Ω(files()).Should(ContainElement("lock-pool/" + out.LockIndexFile))
+
+			destroy := runOut(out.OutRequest{Source: source, Params: out.OutParams{
+				DestroyPool:    true,
+				ConfirmDestroy: "lock-pool",
+			}}, sourceDir)
+			Eventually(destroy, 10*time.Second).Should(gexec.Exit(0))
+
+			Ω(files()).Should(Equal([]string{"other-pool/unclaimed/other-pool-lock"}))
+
+			message := exec.Command("git", "log", "-1", "--format=%s", "master")
+			message.Dir = bareGitRepo
+			output, err := message.Output()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(strings.TrimSpace(string(output))).Should(Equal("destroying: lock-pool"))
+		})
+	}
+
+	It("refuses to destroy a pool that isn't the one confirmed", func() {
+		destroy := runOut(out.OutRequest{Source: source, Params: out.OutParams{
+			DestroyPool:    true,
+			ConfirmDestroy: "other-pool",
+		}}, sourceDir)
+		Eventually(destroy, 10*time.Second).Should(gexec.Exit(1))
+		Ω(destroy.Err).Should(gbytes.Say(`destroying pool lock-pool must be confirmed with its name, not "other-pool"`))
+
+		Ω(files()).Should(ContainElement("lock-pool/unclaimed/some-other-lock"))
+	})
+
+	It("refuses to destroy a pool that doesn't exist", func() {
+		source.Pool = "missing-pool"
+
+		destroy := runOut(out.OutRequest{Source: source, Params: out.OutParams{
+			DestroyPool:    true,
+			ConfirmDestroy: "missing-pool",
+		}}, sourceDir)
+		Eventually(destroy, 10*time.Second).Should(gexec.Exit(1))
+		Ω(destroy.Err).Should(gbytes.Say("pool missing-pool does not exist"))
+	})
+})
+
+var _ = Describe("Out reverting a commit", func() {
+	var gitRepo string
+	var bareGitRepo string
+	var sourceDir string
+
+	var source out.Source
+
+	BeforeEach(func() {
+		var err error
+		gitRepo, err = ioutil.TempDir("", "git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		bareGitRepo, err = ioutil.TempDir("", "bare-git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		sourceDir, err = ioutil.TempDir("", "source-dir")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		setupGitRepo(gitRepo)
+
+		clone := exec.Command("git", "clone", "--bare", gitRepo, bareGitRepo)
+		err = clone.Run()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		source = out.Source{
+			URI:               bareGitRepo,
+			Branch:            "master",
+			Pool:              "lock-pool",
+			RetryDelay:        100 * time.Millisecond,
+			SelectionStrategy: out.SelectionDeterministic,
+			LockIndex:         true,
+		}
+	})
+
+	AfterEach(func() {
+		for _, dir := range []string{gitRepo, bareGitRepo, sourceDir} {
+			err := os.RemoveAll(dir)
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+	})
+
+	run := func(params out.OutParams) out.OutResponse {
+		session := runOut(out.OutRequest{Source: source, Params: params}, sourceDir)
+		Eventually(session, 10*time.Second).Should(gexec.Exit(0))
+
+		var response out.OutResponse
+		err := json.Unmarshal(session.Out.Contents(), &response)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		return response
+	}
+
+	files := func() []string {
+		list := exec.Command("git", "ls-tree", "-r", "--name-only", "master", "lock-pool")
+		list.Dir = bareGitRepo
+		output, err := list.Output()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		return strings.Fields(string(output))
+	}
+
+	for _, bare := range []bool{false, true} {
+		bare := bare
+
+		It(fmt.Sprintf("undoes a change, keeping what was changed since (bare: %v)", bare), func() {
+			source.Bare = bare
+
+			run(out.OutParams{Acquire: true})
+			removal := run(out.OutParams{RemoveList: []string{"some-other-lock"}})
+
+			lockDir := filepath.Join(sourceDir, "new-lock")
+			Ω(os.MkdirAll(lockDir, 0755)).Should(Succeed())
+			Ω(ioutil.WriteFile(filepath.Join(lockDir, "name"), []byte("new-lock"), 0644)).Should(Succeed())
+			Ω(ioutil.WriteFile(filepath.Join(lockDir, "metadata"), []byte("{}"), 0644)).Should(Succeed())
+			run(out.OutParams{Add: "new-lock"})
+
+			revert := run(out.OutParams{Revert: removal.Version.Ref})
+			Ω(revert.Metadata).Should(ContainElement(out.MetadataPair{Name: "reverted_commit", Value: removal.Version.Ref}))
+
+			Ω(files()).Should(ContainElement("lock-pool/unclaimed/some-other-lock"))
+			Ω(files()).Should(ContainElement("lock-pool/unclaimed/new-lock"))
+			Ω(files()).Should(ContainElement("lock-pool/claimed/some-lock"))
+
+			show := exec.Command("git", "show", "master:lock-pool/"+out.LockIndexFile)
+			show.Dir = bareGitRepo
+			contents, err := show.Output()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			var index out.LockIndex
+			err = json.Unmarshal(contents, &index)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(index.Locks["some-other-lock"].State).Should(Equal("unclaimed"))
+			Ω(index.Locks["some-lock"].State).Should(Equal("claimed"))
+
+			message := exec.Command("git", "log", "-1", "--format=%B", "master")
+			message.Dir = bareGitRepo
+			output, err := message.Output()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(output)).Should(ContainSubstring("This reverts commit " + removal.Version.Ref))
+		})
+	}
+
+	It("keeps fencing tokens moving forward when undoing a claim", func() {
+		acquire := run(out.OutParams{Acquire: true})
+		run(out.OutParams{Revert: acquire.Version.Ref})
+
+		Ω(files()).Should(ContainElement("lock-pool/unclaimed/some-lock"))
+
+		fencingToken := exec.Command("git", "show", "master:lock-pool/.fencing/some-lock")
+		fencingToken.Dir = bareGitRepo
+		Ω(fencingToken.Output()).Should(Equal([]byte("1\n")))
+	})
+
+	It("refuses to revert a change that was changed again since", func() {
+		acquire := run(out.OutParams{Acquire: true})
+
+		Ω(os.MkdirAll(filepath.Join(sourceDir, "some-lock"), 0755)).Should(Succeed())
+		Ω(ioutil.WriteFile(filepath.Join(sourceDir, "some-lock", "name"), []byte("some-lock"), 0644)).Should(Succeed())
+		run(out.OutParams{Release: "some-lock"})
+
+		revert := runOut(out.OutRequest{Source: source, Params: out.OutParams{Revert: acquire.Version.Ref}}, sourceDir)
+		Eventually(revert, 10*time.Second).Should(gexec.Exit(1))
+		Ω(revert.Err).Should(gbytes.Say("commit %s can't be reverted cleanly, as the pool has changed since", acquire.Version.Ref))
+	})
+
+	It("refuses to revert a commit that isn't in the branch's history", func() {
+		revert := runOut(out.OutRequest{Source: source, Params: out.OutParams{Revert: "0123456789abcdef0123456789abcdef01234567"}}, sourceDir)
+		Eventually(revert, 10*time.Second).Should(gexec.Exit(1))
+		Ω(revert.Err).Should(gbytes.Say("commit 0123456789abcdef0123456789abcdef01234567 is not in the history of branch master"))
+	})
+})
+
+var _ = Describe("Out writing a claim file", func() {
+	var gitRepo string
+	var bareGitRepo string
+	var sourceDir string
+	var inDestination string
+
+	BeforeEach(func() {
+		var err error
+		gitRepo, err = ioutil.TempDir("", "git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		bareGitRepo, err = ioutil.TempDir("", "bare-git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		sourceDir, err = ioutil.TempDir("", "source-dir")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		inDestination, err = ioutil.TempDir("", "in-destination")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		setupGitRepo(gitRepo)
+
+		clone := exec.Command("git", "clone", "--bare", gitRepo, bareGitRepo)
+		err = clone.Run()
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		for _, dir := range []string{gitRepo, bareGitRepo, sourceDir, inDestination} {
+			err := os.RemoveAll(dir)
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+	})
+
+	readClaim := func(dir string) out.Claim {
+		contents, err := ioutil.ReadFile(filepath.Join(dir, out.ClaimFile))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		var claim out.Claim
+		err = json.Unmarshal(contents, &claim)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		return claim
+	}
+
+	It("records the claimed lock in claim.json, as both out and in see it", func() {
+		session := runOut(out.OutRequest{
+			Source: out.Source{
+				URI:               bareGitRepo,
+				Branch:            "master",
+				Pool:              "lock-pool",
+				RetryDelay:        100 * time.Millisecond,
+				SelectionStrategy: out.SelectionDeterministic,
+			},
+			Params: out.OutParams{Acquire: true},
+		}, sourceDir)
+		Eventually(session, 10*time.Second).Should(gexec.Exit(0))
+
+		var response out.OutResponse
+		err := json.Unmarshal(session.Out.Contents(), &response)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		show := exec.Command("git", "show", response.Version.Ref+":lock-pool/claimed/some-lock")
+		show.Dir = bareGitRepo
+		contents, err := show.Output()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		claim := readClaim(sourceDir)
+		Ω(claim.Name).Should(Equal("some-lock"))
+		Ω(claim.Pool).Should(Equal("lock-pool"))
+		Ω(claim.Ref).Should(Equal(response.Version.Ref))
+		Ω(claim.State).Should(Equal("claimed"))
+		Ω(claim.Claimer).ShouldNot(BeEmpty())
+		Ω(claim.ClaimedAt).ShouldNot(BeNil())
+		Ω(claim.MetadataDigest).Should(Equal(out.ContentDigest(contents)))
+
+		runIn(fmt.Sprintf(`
+			{
+				"source": {
+					"uri": "%s",
+					"branch": "master",
+					"pool": "lock-pool"
+				},
+				"version": {
+					"ref": "%s",
+					"lock": "some-lock"
+				}
+			}`, bareGitRepo, response.Version.Ref), inDestination, 0)
+
+		fetched := readClaim(inDestination)
+		Ω(fetched.Name).Should(Equal(claim.Name))
+		Ω(fetched.Pool).Should(Equal(claim.Pool))
+		Ω(fetched.Ref).Should(Equal(claim.Ref))
+		Ω(fetched.State).Should(Equal(claim.State))
+		Ω(fetched.Claimer).Should(Equal(claim.Claimer))
+		Ω(fetched.ClaimedAt.Equal(*claim.ClaimedAt)).Should(BeTrue())
+		Ω(fetched.MetadataDigest).Should(Equal(claim.MetadataDigest))
+	})
+})
+
+var _ = Describe("Out with a metadata schema", func() {
+	var gitRepo string
+	var bareGitRepo string
+	var sourceDir string
+
+	BeforeEach(func() {
+		var err error
+		gitRepo, err = ioutil.TempDir("", "git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		bareGitRepo, err = ioutil.TempDir("", "bare-git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		sourceDir, err = ioutil.TempDir("", "source-dir")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		setupGitRepo(gitRepo)
+
+		gitSetup := exec.Command("bash", "-e", "-c", `
+			echo '{"type": "object", "required": ["region"], "properties": {"region": {"type": "string"}}}' > lock-pool/.schema.json
+			git add lock-pool/.schema.json
+			git commit -q -m 'adding a schema'
+		`)
+		gitSetup.Dir = gitRepo
+		gitSetup.Stderr = GinkgoWriter
+		err = gitSetup.Run()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		clone := exec.Command("git", "clone", "--bare", gitRepo, bareGitRepo)
+		err = clone.Run()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		err = os.Mkdir(filepath.Join(sourceDir, "new-lock"), 0755)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		err = ioutil.WriteFile(filepath.Join(sourceDir, "new-lock", "name"), []byte("new-lock"), 0644)
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		for _, dir := range []string{gitRepo, bareGitRepo, sourceDir} {
+			err := os.RemoveAll(dir)
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+	})
+
+	for _, bare := range []bool{false, true} {
+		bare := bare
+
+		Context(fmt.Sprintf("when bare is %t", bare), func() {
+			add := func(metadata string) *gexec.Session {
+				err := ioutil.WriteFile(filepath.Join(sourceDir, "new-lock", "metadata"), []byte(metadata), 0644)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				return runOut(out.OutRequest{
+					Source: out.Source{
+						URI:        bareGitRepo,
+						Branch:     "master",
+						Pool:       "lock-pool",
+						RetryDelay: 100 * time.Millisecond,
+						Bare:       bare,
+					},
+					Params: out.OutParams{Add: "new-lock"},
+				}, sourceDir)
+			}
+
+			It("adds a lock whose metadata matches the pool's schema", func() {
+				session := add(`{"region":"us-east-1"}`)
+				Eventually(session).Should(gexec.Exit(0))
+			})
+
+			It("refuses a lock whose metadata doesn't match, without committing it", func() {
+				session := add(`{"region":1}`)
+				Eventually(session).Should(gexec.Exit(1))
+
+				Ω(session.Err).Should(gbytes.Say("metadata of lock new-lock does not match the schema of pool lock-pool: metadata.region must be string, not integer"))
+
+				show := exec.Command("git", "log", "--oneline", "-1")
+				show.Dir = bareGitRepo
+				output, err := show.Output()
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(string(output)).Should(ContainSubstring("adding a schema"))
+			})
+		})
+	}
+})
+
+var _ = Describe("Out releasing all of a pipeline's locks", func() {
+	var gitRepo string
+	var bareGitRepo string
+	var sourceDir string
+
+	var source out.Source
+
+	BeforeEach(func() {
+		var err error
+		gitRepo, err = ioutil.TempDir("", "git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		bareGitRepo, err = ioutil.TempDir("", "bare-git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		sourceDir, err = ioutil.TempDir("", "source-dir")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		setupGitRepo(gitRepo)
+
+		clone := exec.Command("git", "clone", "--bare", gitRepo, bareGitRepo)
+		err = clone.Run()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		os.Setenv("BUILD_TEAM_NAME", "main")
+
+		source = out.Source{
+			URI:        bareGitRepo,
+			Branch:     "master",
+			Pool:       "lock-pool",
+			RetryDelay: 100 * time.Millisecond,
+		}
+	})
+
+	AfterEach(func() {
+		os.Unsetenv("BUILD_TEAM_NAME")
+		os.Unsetenv("BUILD_PIPELINE_NAME")
+
+		for _, dir := range []string{gitRepo, bareGitRepo, sourceDir} {
+			err := os.RemoveAll(dir)
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+	})
+
+	claimAs := func(pipeline string) string {
+		os.Setenv("BUILD_PIPELINE_NAME", pipeline)
+
+		session := runOut(out.OutRequest{Source: source, Params: out.OutParams{Acquire: true}}, sourceDir)
+		Eventually(session).Should(gexec.Exit(0))
+
+		var outResponse out.OutResponse
+		err := json.Unmarshal(session.Out.Contents(), &outResponse)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		return outResponse.Metadata[0].Value
+	}
+
+	releaseAllMine := func() *gexec.Session {
+		session := runOut(out.OutRequest{Source: source, Params: out.OutParams{ReleaseAllMine: true}}, sourceDir)
+		Eventually(session).Should(gexec.Exit(0))
+		return session
+	}
+
+	It("releases the locks the pipeline holds, and only those", func() {
+		theirs := claimAs("other")
+		mine := claimAs("deploy")
+
+		session := releaseAllMine()
+		Ω(session.Err).Should(gbytes.Say(`released 1 lock\(s\): %s`, mine))
+
+		reCloneRepo, err := ioutil.TempDir("", "git-version-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		defer os.RemoveAll(reCloneRepo)
+
+		reClone := exec.Command("git", "clone", bareGitRepo, ".")
+		reClone.Dir = reCloneRepo
+		err = reClone.Run()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(filepath.Join(reCloneRepo, "lock-pool", "unclaimed", mine)).Should(BeARegularFile())
+		Ω(filepath.Join(reCloneRepo, "lock-pool", "claimed", theirs)).Should(BeARegularFile())
+	})
+
+	It("releases a lock of the pipeline's that another pipeline has renamed since", func() {
+		mine := claimAs("deploy")
+
+		os.Setenv("BUILD_PIPELINE_NAME", "ops")
+
+		rename := runOut(out.OutRequest{Source: source, Params: out.OutParams{
+			Rename: &out.RenameParams{From: mine, To: "renamed-lock"},
+		}}, sourceDir)
+		Eventually(rename).Should(gexec.Exit(0))
+
+		os.Setenv("BUILD_PIPELINE_NAME", "deploy")
+
+		session := releaseAllMine()
+		Ω(session.Err).Should(gbytes.Say(`released 1 lock\(s\): renamed-lock`))
+	})
+
+	It("succeeds when the pipeline holds no locks", func() {
+		claimAs("other")
+
+		os.Setenv("BUILD_PIPELINE_NAME", "deploy")
+
+		session := releaseAllMine()
+		Ω(session.Err).Should(gbytes.Say("no claimed locks to release"))
+	})
+
+	It("fails outside of a pipeline", func() {
+		os.Unsetenv("BUILD_PIPELINE_NAME")
+
+		session := runOut(out.OutRequest{Source: source, Params: out.OutParams{ReleaseAllMine: true}}, sourceDir)
+		Eventually(session).Should(gexec.Exit(1))
+		Ω(session.Err).Should(gbytes.Say("BUILD_PIPELINE_NAME is not set"))
+	})
+})
+
+var _ = Describe("Out with audit notes", func() {
+	var gitRepo string
+	var bareGitRepo string
+	var sourceDir string
+	var inDestination string
+
+	var source out.Source
+
+	BeforeEach(func() {
+		var err error
+		gitRepo, err = ioutil.TempDir("", "git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		bareGitRepo, err = ioutil.TempDir("", "bare-git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		sourceDir, err = ioutil.TempDir("", "source-dir")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		inDestination, err = ioutil.TempDir("", "in-destination")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		setupGitRepo(gitRepo)
+
+		clone := exec.Command("git", "clone", "--bare", gitRepo, bareGitRepo)
+		err = clone.Run()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		source = out.Source{
+			URI:               bareGitRepo,
+			Branch:            "master",
+			Pool:              "lock-pool",
+			RetryDelay:        100 * time.Millisecond,
+			SelectionStrategy: out.SelectionDeterministic,
+			AuditNotes:        true,
+		}
+	})
+
+	AfterEach(func() {
+		for _, dir := range []string{gitRepo, bareGitRepo, sourceDir, inDestination} {
+			err := os.RemoveAll(dir)
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+	})
+
+	claimAndRelease := func() (string, string) {
+		session := runOut(out.OutRequest{Source: source, Params: out.OutParams{Acquire: true}}, sourceDir)
+		Eventually(session, 10*time.Second).Should(gexec.Exit(0))
+
+		var claimed out.OutResponse
+		err := json.Unmarshal(session.Out.Contents(), &claimed)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		err = os.MkdirAll(filepath.Join(sourceDir, "some-lock"), 0755)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		err = ioutil.WriteFile(filepath.Join(sourceDir, "some-lock", "name"), []byte("some-lock"), 0644)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		session = runOut(out.OutRequest{Source: source, Params: out.OutParams{Release: "some-lock"}}, sourceDir)
+		Eventually(session, 10*time.Second).Should(gexec.Exit(0))
+
+		var released out.OutResponse
+		err = json.Unmarshal(session.Out.Contents(), &released)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		return claimed.Version.Ref, released.Version.Ref
+	}
+
+	It("pushes a note on each claim and release, without touching the pool's files", func() {
+		claimRef, releaseRef := claimAndRelease()
+
+		show := exec.Command("git", "notes", "--ref=pool-audit", "show", claimRef)
+		show.Dir = bareGitRepo
+		contents, err := show.Output()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		var note out.AuditNote
+		err = json.Unmarshal(contents, &note)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(note.Action).Should(Equal(out.AuditClaimed))
+		Ω(note.Lock).Should(Equal("some-lock"))
+		Ω(note.Pool).Should(Equal("lock-pool"))
+		Ω(note.By).ShouldNot(BeEmpty())
+
+		changed := exec.Command("git", "diff", "--no-renames", "--name-only", claimRef, releaseRef)
+		changed.Dir = bareGitRepo
+		files, err := changed.Output()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(strings.Fields(string(files))).Should(ConsistOf("lock-pool/claimed/some-lock", "lock-pool/unclaimed/some-lock"))
+	})
+
+	It("reads the lock's notes back, oldest first, through the handler and in", func() {
+		claimRef, releaseRef := claimAndRelease()
+
+		handler := out.NewGitLockHandler(source)
+		err := handler.Setup()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		defer handler.Cleanup()
+
+		notes, err := handler.AuditLog("some-lock")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(notes).Should(HaveLen(2))
+
+		Ω(notes[0].Action).Should(Equal(out.AuditClaimed))
+		Ω(notes[0].Commit).Should(Equal(claimRef))
+		Ω(notes[1].Action).Should(Equal(out.AuditReleased))
+		Ω(notes[1].Commit).Should(Equal(releaseRef))
+		Ω(notes[1].HeldSeconds).Should(BeNumerically(">=", 0))
+
+		others, err := handler.AuditLog("some-other-lock")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(others).Should(BeEmpty())
+
+		runIn(fmt.Sprintf(`
+			{
+				"source": {
+					"uri": "%s",
+					"branch": "master",
+					"pool": "lock-pool",
+					"audit_notes": true
+				},
+				"params": {
+					"lock_name": "some-lock"
+				}
+			}`, bareGitRepo), inDestination, 0)
+
+		contents, err := ioutil.ReadFile(filepath.Join(inDestination, "audit.json"))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		var fetched []out.AuditNote
+		err = json.Unmarshal(contents, &fetched)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(fetched).Should(Equal(notes))
+	})
+})
+
+var _ = Describe("Out choosing from the available locks", func() {
+	var gitRepo string
+	var bareGitRepo string
+
+	BeforeEach(func() {
+		var err error
+		gitRepo, err = ioutil.TempDir("", "git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		bareGitRepo, err = ioutil.TempDir("", "bare-git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		setupGitRepo(gitRepo)
+
+		// the branch ends on a claim, as it does whenever a pool is busy
+		claim := exec.Command("bash", "-e", "-c", `
+			git mv lock-pool/unclaimed/some-lock lock-pool/claimed/some-lock
+			git commit -q -m 'claiming: some-lock'
+		`)
+		claim.Dir = gitRepo
+		claim.Stderr = GinkgoWriter
+		claim.Stdout = GinkgoWriter
+
+		err = claim.Run()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		clone := exec.Command("git", "clone", "--bare", gitRepo, bareGitRepo)
+		err = clone.Run()
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		for _, dir := range []string{gitRepo, bareGitRepo} {
+			err := os.RemoveAll(dir)
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+	})
+
+	for _, bare := range []bool{false, true} {
+		bare := bare
+
+		mode := "checked out"
+		if bare {
+			mode = "bare"
+		}
+
+		It("lists them from the pool's tree when its clone is "+mode, func() {
+			handler := out.NewGitLockHandler(out.Source{
+				URI:    bareGitRepo,
+				Branch: "master",
+				Pool:   "lock-pool",
+				Bare:   bare,
+			}.WithDefaults())
+
+			err := handler.Setup()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			defer handler.Cleanup()
+
+			noLease := func(string) time.Time { return time.Time{} }
+
+			lock, _, err := handler.LeaseLock(noLease)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(lock).Should(Equal("some-other-lock"))
+
+			// the claim just made is seen before it is pushed
+			_, _, err = handler.LeaseLock(noLease)
+			Ω(err).Should(Equal(out.ErrNoLocksAvailable))
+
+			_, err = handler.UnclaimLock("some-lock")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			lock, _, err = handler.LeaseLock(noLease)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(lock).Should(Equal("some-lock"))
+		})
+	}
+})
@@ -0,0 +1,221 @@
+package integration_test
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+
+	"github.com/concourse/pool-resource/out"
+)
+
+var _ = Describe("poolctl", func() {
+	var gitRepo string
+	var bareGitRepo string
+	var workDir string
+
+	BeforeEach(func() {
+		var err error
+		gitRepo, err = ioutil.TempDir("", "git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		bareGitRepo, err = ioutil.TempDir("", "bare-git-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		workDir, err = ioutil.TempDir("", "work-dir")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		setupGitRepo(gitRepo)
+
+		clone := exec.Command("git", "clone", "--bare", gitRepo, bareGitRepo)
+		err = clone.Run()
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		for _, dir := range []string{gitRepo, bareGitRepo, workDir} {
+			err := os.RemoveAll(dir)
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+	})
+
+	poolctl := func(args ...string) *gexec.Session {
+		flags := []string{"-uri", bareGitRepo, "-branch", "master", "-pool", "lock-pool"}
+
+		session, err := gexec.Start(exec.Command(poolctlPath, append(flags, args...)...), GinkgoWriter, GinkgoWriter)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Eventually(session, 10*time.Second).Should(gexec.Exit())
+
+		return session
+	}
+
+	It("counts the locks in each state", func() {
+		session := poolctl("stats")
+		Ω(session.ExitCode()).Should(Equal(0))
+		Ω(session.Out.Contents()).Should(MatchRegexp(`unclaimed:\s+2\n`))
+		Ω(session.Out.Contents()).Should(MatchRegexp(`claimed:\s+0\n`))
+		Ω(session.Out.Contents()).Should(MatchRegexp(`total:\s+2\n`))
+	})
+
+	It("adds locks and lists them", func() {
+		metadataPath := filepath.Join(workDir, "metadata")
+		err := ioutil.WriteFile(metadataPath, []byte(`{"host":"10.0.0.1"}`), 0644)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		session := poolctl("add", "new-lock", metadataPath)
+		Ω(session.ExitCode()).Should(Equal(0))
+
+		show := exec.Command("git", "show", "master:lock-pool/unclaimed/new-lock")
+		show.Dir = bareGitRepo
+		contents, err := show.Output()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(contents)).Should(Equal(`{"host":"10.0.0.1"}`))
+
+		session = poolctl("list")
+		Ω(session.ExitCode()).Should(Equal(0))
+		Ω(session.Out.Contents()).Should(MatchRegexp(`new-lock\s+unclaimed\n`))
+		Ω(session.Out.Contents()).Should(MatchRegexp(`some-lock\s+unclaimed\n`))
+	})
+
+	It("force unclaims a claimed lock", func() {
+		session := runOut(out.OutRequest{
+			Source: out.Source{
+				URI:               bareGitRepo,
+				Branch:            "master",
+				Pool:              "lock-pool",
+				RetryDelay:        100 * time.Millisecond,
+				SelectionStrategy: out.SelectionDeterministic,
+			},
+			Params: out.OutParams{Acquire: true},
+		}, workDir)
+		Eventually(session, 10*time.Second).Should(gexec.Exit(0))
+
+		session = poolctl("list")
+		Ω(session.Out.Contents()).Should(MatchRegexp(`some-lock\s+claimed\n`))
+
+		session = poolctl("force-unclaim", "some-lock")
+		Ω(session.ExitCode()).Should(Equal(0))
+
+		session = poolctl("list")
+		Ω(session.Out.Contents()).Should(MatchRegexp(`some-lock\s+unclaimed\n`))
+	})
+
+	It("lists the locks of a pool with a lock index from the index", func() {
+		session := runOut(out.OutRequest{
+			Source: out.Source{
+				URI:               bareGitRepo,
+				Branch:            "master",
+				Pool:              "lock-pool",
+				RetryDelay:        100 * time.Millisecond,
+				SelectionStrategy: out.SelectionDeterministic,
+				LockIndex:         true,
+			},
+			Params: out.OutParams{Acquire: true},
+		}, workDir)
+		Eventually(session, 10*time.Second).Should(gexec.Exit(0))
+
+		sourcePath := filepath.Join(workDir, "source.json")
+		err := ioutil.WriteFile(sourcePath, []byte(`{"lock_index": true}`), 0644)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		session = poolctl("-source", sourcePath, "list")
+		Ω(session.ExitCode()).Should(Equal(0))
+		Ω(session.Out.Contents()).Should(MatchRegexp(`LOCK\s+STATE\s+SINCE\s+CLAIMER\n`))
+		Ω(session.Out.Contents()).Should(MatchRegexp(`some-lock\s+claimed\s+\d{4}-\d\d-\d\dT\S+\s+\S.*\n`))
+		Ω(session.Out.Contents()).Should(MatchRegexp(`some-other-lock\s+unclaimed\s+-\s+-\n`))
+
+		session = poolctl("-source", sourcePath, "stats")
+		Ω(session.ExitCode()).Should(Equal(0))
+		Ω(session.Out.Contents()).Should(MatchRegexp(`unclaimed:\s+1\n`))
+		Ω(session.Out.Contents()).Should(MatchRegexp(`claimed:\s+1\n`))
+	})
+
+	It("refuses to force unclaim a lock that is not claimed", func() {
+		session := poolctl("force-unclaim", "some-lock")
+		Ω(session.ExitCode()).Should(Equal(1))
+		Ω(session.Err.Contents()).Should(ContainSubstring("lock some-lock is not claimed, reserved, disabled, or quarantined"))
+	})
+
+	It("migrates every lock to another pool", func() {
+		session := poolctl("migrate", "-to-pool", "new-pool")
+		Ω(session.ExitCode()).Should(Equal(0))
+		Ω(session.Out.Contents()).Should(MatchRegexp(`unclaimed\s+2\s+2\n`))
+
+		show := exec.Command("git", "show", "master:new-pool/unclaimed/some-lock")
+		show.Dir = bareGitRepo
+		contents, err := show.Output()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(contents)).Should(Equal("{\"some\":\"json\"}\n"))
+
+		session = poolctl("migrate", "-to-pool", "new-pool")
+		Ω(session.ExitCode()).Should(Equal(1))
+		Ω(session.Err.Contents()).Should(ContainSubstring("lock some-lock is already in new-pool"))
+	})
+
+	It("migrates the history of a pool", func() {
+		session := poolctl("migrate", "-history", "-to-pool", "new-pool")
+		Ω(session.ExitCode()).Should(Equal(0))
+		Ω(session.Out.Contents()).Should(MatchRegexp(`unclaimed\s+2\s+2\n`))
+		Ω(session.Out.Contents()).Should(ContainSubstring("replayed 1 commits"))
+
+		log := exec.Command("git", "log", "-1", "--format=%s", "master", "--", "new-pool")
+		log.Dir = bareGitRepo
+		subject, err := log.Output()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(subject)).Should(Equal("test-git-setup\n"))
+	})
+
+	It("exports a pool and imports it into another pool", func() {
+		session := runOut(out.OutRequest{
+			Source: out.Source{
+				URI:               bareGitRepo,
+				Branch:            "master",
+				Pool:              "lock-pool",
+				RetryDelay:        100 * time.Millisecond,
+				SelectionStrategy: out.SelectionDeterministic,
+			},
+			Params: out.OutParams{Acquire: true},
+		}, workDir)
+		Eventually(session, 10*time.Second).Should(gexec.Exit(0))
+
+		snapshotPath := filepath.Join(workDir, "snapshot.json")
+
+		session = poolctl("export", snapshotPath)
+		Ω(session.ExitCode()).Should(Equal(0))
+
+		contents, err := ioutil.ReadFile(snapshotPath)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(contents)).Should(ContainSubstring(`"state": "claimed"`))
+		Ω(string(contents)).Should(ContainSubstring(`"claimed_at"`))
+
+		session = poolctl("-pool", "new-pool", "import", snapshotPath)
+		Ω(session.ExitCode()).Should(Equal(0))
+		Ω(session.Out.Contents()).Should(ContainSubstring("imported 2 locks"))
+
+		show := exec.Command("git", "show", "master:new-pool/.fencing/some-lock")
+		show.Dir = bareGitRepo
+		token, err := show.Output()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(token)).Should(Equal("1\n"))
+
+		session = poolctl("-pool", "new-pool", "list")
+		Ω(session.Out.Contents()).Should(MatchRegexp(`some-lock\s+claimed\n`))
+		Ω(session.Out.Contents()).Should(MatchRegexp(`some-other-lock\s+unclaimed\n`))
+
+		session = poolctl("-pool", "new-pool", "import", snapshotPath)
+		Ω(session.ExitCode()).Should(Equal(1))
+		Ω(session.Err.Contents()).Should(ContainSubstring("is already in new-pool"))
+	})
+
+	It("refuses to migrate a pool onto itself", func() {
+		session := poolctl("migrate", "-to-branch", "master")
+		Ω(session.ExitCode()).Should(Equal(1))
+		Ω(session.Err.Contents()).Should(ContainSubstring("the pool to copy to is the pool being copied"))
+	})
+})
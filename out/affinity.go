@@ -0,0 +1,81 @@
+package out
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// AffinityPipeline prefers claiming the lock the claiming pipeline held most
+// recently.
+const AffinityPipeline = "pipeline"
+
+// pipelineTrailer records which pipeline made a claim in its commit message,
+// so that later claims can find the locks a pipeline held.
+const pipelineTrailer = "Pipeline: "
+
+// BuildPipeline identifies the pipeline running this step as team/pipeline,
+// from the build metadata Concourse provides, or is empty outside a
+// pipeline.
+func BuildPipeline() string {
+	pipeline := os.Getenv("BUILD_PIPELINE_NAME")
+	if pipeline == "" {
+		return ""
+	}
+
+	return os.Getenv("BUILD_TEAM_NAME") + "/" + pipeline
+}
+
+// preferredLock returns the available lock that pipeline claimed most
+// recently, or "" if it has claimed none of them.
+func (glh *GitLockHandler) preferredLock(pipeline string, available []string) string {
+	if pipeline == "" {
+		return ""
+	}
+
+	isAvailable := map[string]bool{}
+	for _, lock := range available {
+		isAvailable[lock] = true
+	}
+
+	claimed := filepath.Join(glh.pool, glh.Source.Paths.Claimed)
+	trailer := pipelineTrailer + pipeline
+
+	// --grep narrows the history down cheaply; the exact trailer is checked
+	// below, since it also matches pipelines whose names merely contain this
+	// one
+	output, err := glh.git("log", "--format=%x00%H%n%B", "--fixed-strings", "--grep="+trailer, "--", claimed)
+	if err != nil {
+		return ""
+	}
+
+	for _, commit := range strings.Split(string(output), "\x00") {
+		lines := strings.Split(strings.TrimSpace(commit), "\n")
+		if len(lines) < 2 || !containsLine(lines[1:], trailer) {
+			continue
+		}
+
+		changed, err := glh.git("diff-tree", "--no-commit-id", "--name-only", "-r", lines[0], "--", claimed)
+		if err != nil {
+			continue
+		}
+
+		for _, path := range strings.Split(strings.TrimSpace(string(changed)), "\n") {
+			if lock := filepath.Base(path); isAvailable[lock] {
+				return lock
+			}
+		}
+	}
+
+	return ""
+}
+
+func containsLine(lines []string, line string) bool {
+	for _, candidate := range lines {
+		if strings.TrimSpace(candidate) == line {
+			return true
+		}
+	}
+
+	return false
+}
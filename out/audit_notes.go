@@ -0,0 +1,247 @@
+package out
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AuditNotesRef is the notes ref on the remote that the audit notes of a
+// pool's claims and releases are pushed to.
+const AuditNotesRef = "refs/notes/pool-audit"
+
+// AuditNote records a claim or release of a lock. It is attached, as a git
+// note, to the commit that made the change, so the pool's history carries an
+// audit trail without any files being added to the worktree. At is when the
+// note was made, to the nanosecond, so that notes made within the same second
+// still sort in the order they were made. HeldSeconds is how long the lock
+// had been held, for releases and transfers. Commit is filled in when reading
+// the note back, from the commit it is attached to.
+type AuditNote struct {
+	Action      string    `json:"action"`
+	Lock        string    `json:"lock"`
+	Pool        string    `json:"pool"`
+	By          string    `json:"by"`
+	At          time.Time `json:"at"`
+	BuildURL    string    `json:"build_url,omitempty"`
+	Pipeline    string    `json:"pipeline,omitempty"`
+	HeldSeconds int64     `json:"held_seconds,omitempty"`
+	Commit      string    `json:"commit,omitempty"`
+}
+
+// The actions that audit notes record.
+const (
+	AuditClaimed     = "claimed"
+	AuditTransferred = "transferred"
+	AuditReleased    = "released"
+	AuditReaped      = "reaped"
+)
+
+// claimTimes reads when each of the locks was claimed, ahead of a commit that
+// releases them, so their notes can say how long they were held.
+func (glh *GitLockHandler) claimTimes(locks ...string) (map[string]time.Time, error) {
+	if !glh.Source.AuditNotes {
+		return nil, nil
+	}
+
+	times := map[string]time.Time{}
+	for _, lock := range locks {
+		info, err := glh.ClaimInfo(lock)
+		if err != nil {
+			return nil, err
+		}
+
+		times[lock] = info.At
+	}
+
+	return times, nil
+}
+
+// noteAudit attaches a note to the commit that was just made, recording the
+// action on each of the locks, to be pushed along with it.
+func (glh *GitLockHandler) noteAudit(action string, claimedAt map[string]time.Time, locks ...string) error {
+	if !glh.Source.AuditNotes {
+		return nil
+	}
+
+	output, err := glh.git("log", "-1", "--format=%cI%x00%an <%ae>", "HEAD")
+	if err != nil {
+		return err
+	}
+
+	fields := strings.SplitN(strings.TrimSpace(string(output)), "\x00", 2)
+	if len(fields) != 2 {
+		return fmt.Errorf("reading the commit to note: %q", output)
+	}
+
+	committedAt, err := time.Parse(time.RFC3339, fields[0])
+	if err != nil {
+		return err
+	}
+
+	at := time.Now().UTC()
+
+	// a commit changing several locks gets a single note holding a line for
+	// each
+	var lines []string
+	for _, lock := range locks {
+		note := AuditNote{
+			Action:   action,
+			Lock:     lock,
+			Pool:     glh.Source.Pool,
+			By:       fields[1],
+			At:       at,
+			BuildURL: BuildURL(),
+			Pipeline: BuildPipeline(),
+		}
+
+		if since := claimedAt[lock]; !since.IsZero() {
+			note.HeldSeconds = int64(committedAt.Sub(since) / time.Second)
+		}
+
+		encoded, err := json.Marshal(note)
+		if err != nil {
+			return err
+		}
+
+		lines = append(lines, string(encoded))
+	}
+
+	// notes are written into the store shared with the clone's other
+	// worktrees
+	unlock, err := glh.lockSharedClone()
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	_, err = glh.git("notes", "--ref="+glh.notesRef, "add", "--message", strings.Join(lines, "\n"), "HEAD")
+	if err != nil {
+		return err
+	}
+
+	glh.notesPending = true
+
+	return nil
+}
+
+// fetchAuditNotes brings the local notes ref up to date with the remote's,
+// dropping any notes that were never pushed, so that the notes added next
+// push as a fast-forward.
+func (glh *GitLockHandler) fetchAuditNotes() error {
+	if !glh.Source.AuditNotes {
+		return nil
+	}
+
+	glh.notesPending = false
+
+	// worktrees of a shared clone share its object store
+	unlock, err := glh.lockSharedClone()
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	remote, err := glh.git("ls-remote", "origin", AuditNotesRef)
+	if err != nil {
+		return err
+	}
+
+	// the pool's first note starts the ref afresh
+	if strings.TrimSpace(string(remote)) == "" {
+		_, err = glh.git("update-ref", "-d", glh.notesRef)
+		return err
+	}
+
+	_, err = glh.git("fetch", "--no-tags", "origin", "+"+AuditNotesRef+":"+glh.notesRef)
+	return err
+}
+
+// auditNotesRef names the local ref the handler keeps the pool's notes in.
+// The worktrees of a shared clone share its refs, so each keeps its own
+// rather than overwriting the notes another has yet to push.
+func (glh *GitLockHandler) auditNotesRef() string {
+	if glh.cache == "" {
+		return AuditNotesRef
+	}
+
+	return AuditNotesRef + "-" + filepath.Base(glh.dir)
+}
+
+// AuditLog reads the audit notes of the lock, or of every lock if lock is "",
+// oldest first.
+func (glh *GitLockHandler) AuditLog(lockName string) ([]AuditNote, error) {
+	exists, err := glh.plumbing(nil, "rev-parse", "--verify", "--quiet", glh.notesRef)
+	if err != nil || strings.TrimSpace(string(exists)) == "" {
+		return nil, nil
+	}
+
+	// each note is listed once, by the commit it is attached to, however
+	// git has fanned the notes out into directories
+	listed, err := glh.plumbing(nil, "notes", "--ref="+glh.notesRef, "list")
+	if err != nil {
+		return nil, err
+	}
+
+	var blobs bytes.Buffer
+	var commits []string
+	for _, line := range strings.Split(string(listed), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+
+		blobs.WriteString(fields[0] + "\n")
+		commits = append(commits, fields[1])
+	}
+
+	if len(commits) == 0 {
+		return nil, nil
+	}
+
+	output, err := glh.plumbing(blobs.Bytes(), "cat-file", "--batch")
+	if err != nil {
+		return nil, err
+	}
+
+	contents, err := readBatch(output, len(commits))
+	if err != nil {
+		return nil, err
+	}
+
+	var notes []AuditNote
+	for i, content := range contents {
+		for _, line := range strings.Split(string(content), "\n") {
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+
+			var note AuditNote
+			err := json.Unmarshal([]byte(line), &note)
+			if err != nil {
+				// notes someone added by hand are no business of the audit log
+				continue
+			}
+
+			if note.Pool != glh.Source.Pool || (lockName != "" && note.Lock != lockName) {
+				continue
+			}
+
+			note.Commit = commits[i]
+			notes = append(notes, note)
+		}
+	}
+
+	// the lines of a note keep their order, as they share its time
+	sort.SliceStable(notes, func(i, j int) bool {
+		return notes[i].At.Before(notes[j].At)
+	})
+
+	return notes, nil
+}
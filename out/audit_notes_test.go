@@ -0,0 +1,258 @@
+package out_test
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/concourse/pool-resource/out"
+)
+
+var _ = Describe("Reading a pool's audit notes", func() {
+	var (
+		origin string
+		source out.Source
+	)
+
+	git := func(dir string, script string) {
+		command := exec.Command("bash", "-e", "-c", script)
+		command.Dir = dir
+
+		output, err := command.CombinedOutput()
+		Ω(err).ShouldNot(HaveOccurred(), string(output))
+	}
+
+	BeforeEach(func() {
+		var err error
+		origin, err = ioutil.TempDir("", "audit-origin")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		git(origin, `
+			git init -q --bare origin.git
+			git init -q work
+			cd work
+
+			git config user.email "ginkgo@localhost"
+			git config user.name "Ginkgo Local"
+
+			mkdir -p lock-pool/unclaimed lock-pool/claimed
+			touch lock-pool/claimed/.gitkeep
+			echo '{}' > lock-pool/unclaimed/some-lock
+			echo '{}' > lock-pool/unclaimed/some-other-lock
+
+			git add .
+			git commit -q -m 'setup'
+			git branch -M master
+			git push -q ../origin.git master
+		`)
+
+		source = out.Source{
+			URI:               filepath.Join(origin, "origin.git"),
+			Branch:            "master",
+			Pool:              "lock-pool",
+			SelectionStrategy: out.SelectionDeterministic,
+			AuditNotes:        true,
+		}.WithDefaults()
+	})
+
+	AfterEach(func() {
+		os.Unsetenv("GIT_COMMITTER_DATE")
+
+		err := os.RemoveAll(origin)
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	setup := func(source out.Source) *out.GitLockHandler {
+		handler := out.NewGitLockHandler(source)
+
+		err := handler.Setup()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		return handler
+	}
+
+	claim := func(handler *out.GitLockHandler) string {
+		Ω(handler.ResetLock()).Should(Succeed())
+
+		lock, _, err := handler.LeaseLock(func(string) time.Time { return time.Time{} })
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(handler.BroadcastLockPool()).Should(Succeed())
+
+		return lock
+	}
+
+	release := func(handler *out.GitLockHandler, lock string) {
+		Ω(handler.ResetLock()).Should(Succeed())
+
+		_, err := handler.UnclaimLock(lock)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(handler.BroadcastLockPool()).Should(Succeed())
+	}
+
+	actions := func(notes []out.AuditNote) []string {
+		var actions []string
+		for _, note := range notes {
+			actions = append(actions, note.Action+" "+note.Lock)
+		}
+
+		return actions
+	}
+
+	It("lists the notes in the order they were added, though made within the same second", func() {
+		handler := setup(source)
+		defer handler.Cleanup()
+
+		lock := claim(handler)
+		release(handler, lock)
+		claim(handler)
+
+		notes, err := handler.AuditLog("")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(actions(notes)).Should(Equal([]string{
+			"claimed some-lock",
+			"released some-lock",
+			"claimed some-lock",
+		}))
+
+		Ω(notes[0].Commit).ShouldNot(Equal(notes[2].Commit))
+	})
+
+	It("records how long a released lock was held", func() {
+		handler := setup(source)
+		defer handler.Cleanup()
+
+		os.Setenv("GIT_COMMITTER_DATE", "2026-01-02T03:04:05Z")
+		lock := claim(handler)
+
+		os.Setenv("GIT_COMMITTER_DATE", "2026-01-02T03:05:35Z")
+		release(handler, lock)
+
+		notes, err := handler.AuditLog(lock)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(notes).Should(HaveLen(2))
+
+		Ω(notes[0].HeldSeconds).Should(BeZero())
+		Ω(notes[1].HeldSeconds).Should(Equal(int64(90)))
+	})
+
+	It("lists each note once after git has fanned the notes out", func() {
+		handler := setup(source)
+		defer handler.Cleanup()
+
+		claim(handler)
+
+		// past 256 notes git moves them into directories named for the
+		// start of the commit's hash
+		git(origin, `
+			cd work
+			git fetch -q ../origin.git master refs/notes/pool-audit:refs/notes/pool-audit
+			git checkout -q FETCH_HEAD
+
+			{
+				for i in $(seq 1 300); do
+					echo "commit refs/heads/filler"
+					echo "mark :$i"
+					echo "committer Ginkgo Local <ginkgo@localhost> 1767322800 +0000"
+					echo "data 0"
+					if [ $i = 1 ]; then echo "from HEAD"; fi
+					echo
+				done
+
+				echo "commit refs/notes/pool-audit"
+				echo "committer Ginkgo Local <ginkgo@localhost> 1767322800 +0000"
+				echo "data 0"
+				echo "from refs/notes/pool-audit^0"
+				for i in $(seq 1 300); do
+					note=$(printf '{"action":"claimed","lock":"filler-%03d","pool":"lock-pool","at":"2025-01-01T00:00:00.%09dZ"}' $i $i)
+					echo "N inline :$i"
+					echo "data ${#note}"
+					echo "$note"
+				done
+			} | git fast-import --quiet
+
+			git push -q ../origin.git refs/notes/pool-audit
+		`)
+
+		claim(handler)
+
+		notes, err := handler.AuditLog("")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(notes).Should(HaveLen(302))
+
+		Ω(notes[0].Lock).Should(Equal("filler-001"))
+		Ω(notes[299].Lock).Should(Equal("filler-300"))
+		Ω(actions(notes[300:])).Should(Equal([]string{
+			"claimed some-lock",
+			"claimed some-other-lock",
+		}))
+	})
+
+	It("keeps the notes of each worktree of a shared clone apart until they are pushed", func() {
+		cacheDir := filepath.Join(origin, "cache")
+		source.CacheDir = cacheDir
+
+		first := setup(source)
+		defer first.Cleanup()
+
+		second := setup(source)
+		defer second.Cleanup()
+
+		_, _, err := first.LeaseLock(func(string) time.Time { return time.Time{} })
+		Ω(err).ShouldNot(HaveOccurred())
+
+		_, _, err = second.LeaseLock(func(string) time.Time { return time.Time{} })
+		Ω(err).ShouldNot(HaveOccurred())
+
+		// the shared clone is kept alongside the file that locks it
+		locks, err := filepath.Glob(filepath.Join(cacheDir, "*.lock"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(locks).Should(HaveLen(1))
+
+		refs, err := exec.Command("git", "-C", strings.TrimSuffix(locks[0], ".lock"), "for-each-ref", "--format=%(refname)", "refs/notes/").Output()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(strings.Fields(string(refs))).Should(HaveLen(2))
+
+		Ω(first.BroadcastLockPool()).Should(Succeed())
+		Ω(second.BroadcastLockPool()).Should(Equal(out.ErrLockConflict))
+
+		claim(second)
+
+		notes, err := second.AuditLog("")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(actions(notes)).Should(Equal([]string{
+			"claimed some-lock",
+			"claimed some-other-lock",
+		}))
+	})
+
+	It("skips notes that weren't written as audit notes", func() {
+		handler := setup(source)
+		defer handler.Cleanup()
+
+		claim(handler)
+
+		git(origin, `
+			cd work
+			git fetch -q ../origin.git master refs/notes/pool-audit:refs/notes/pool-audit
+			git notes --ref=pool-audit add -m 'looked fine to me' "$(git rev-parse FETCH_HEAD)~1"
+			git push -q ../origin.git refs/notes/pool-audit
+		`)
+
+		claim(handler)
+
+		notes, err := handler.AuditLog("")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(actions(notes)).Should(Equal([]string{
+			"claimed some-lock",
+			"claimed some-other-lock",
+		}))
+	})
+})
@@ -0,0 +1,68 @@
+package out
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BuildURL links to the Concourse build running this step, from the build
+// metadata Concourse provides, or is empty outside of Concourse.
+func BuildURL() string {
+	atc := strings.TrimRight(os.Getenv("ATC_EXTERNAL_URL"), "/")
+	if atc == "" {
+		return ""
+	}
+
+	team := os.Getenv("BUILD_TEAM_NAME")
+	pipeline := os.Getenv("BUILD_PIPELINE_NAME")
+	job := os.Getenv("BUILD_JOB_NAME")
+	build := os.Getenv("BUILD_NAME")
+
+	if team != "" && pipeline != "" && job != "" && build != "" {
+		return atc + "/teams/" + url.PathEscape(team) +
+			"/pipelines/" + url.PathEscape(pipeline) +
+			"/jobs/" + url.PathEscape(job) +
+			"/builds/" + url.PathEscape(build)
+	}
+
+	// one-off builds belong to no job
+	if id := os.Getenv("BUILD_ID"); id != "" {
+		return atc + "/builds/" + url.PathEscape(id)
+	}
+
+	return ""
+}
+
+// recordBuildURL stages the URL of the build claiming a lock alongside it, so
+// that anyone browsing the pool can find the build holding each lock.
+func (glh *GitLockHandler) recordBuildURL(lockName string) error {
+	buildURL := BuildURL()
+	if buildURL == "" {
+		return glh.removeFile(glh.buildURLPath(lockName), true)
+	}
+
+	return glh.stageFile(glh.buildURLPath(lockName), []byte(buildURL+"\n"), 0644)
+}
+
+// buildURLPath is kept as a dotfile next to the claimed lock, so that it isn't
+// listed as a lock.
+func (glh *GitLockHandler) buildURLPath(lockName string) string {
+	return filepath.Join(glh.poolDir(), glh.Source.Paths.Claimed, "."+lockName+".build_url")
+}
+
+// removeRecords removes what was recorded alongside a lock that is leaving
+// the given state: its expiry, and the build that claimed it.
+func (glh *GitLockHandler) removeRecords(state string, lockName string) error {
+	err := glh.removeFile(glh.expiryPath(state, lockName), true)
+	if err != nil {
+		return err
+	}
+
+	if state != glh.Source.Paths.Claimed {
+		return nil
+	}
+
+	return glh.removeFile(glh.buildURLPath(lockName), true)
+}
@@ -0,0 +1,49 @@
+package out_test
+
+import (
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/concourse/pool-resource/out"
+)
+
+var _ = Describe("Build URLs", func() {
+	env := map[string]string{
+		"ATC_EXTERNAL_URL":    "https://ci.example.com/",
+		"BUILD_TEAM_NAME":     "main",
+		"BUILD_PIPELINE_NAME": "deploy envs",
+		"BUILD_JOB_NAME":      "claim",
+		"BUILD_NAME":          "42",
+		"BUILD_ID":            "1234",
+	}
+
+	BeforeEach(func() {
+		for name, value := range env {
+			os.Setenv(name, value)
+		}
+	})
+
+	AfterEach(func() {
+		for name := range env {
+			os.Unsetenv(name)
+		}
+	})
+
+	It("links to the job's build", func() {
+		Ω(out.BuildURL()).Should(Equal("https://ci.example.com/teams/main/pipelines/deploy%20envs/jobs/claim/builds/42"))
+	})
+
+	It("links to a one-off build by its id", func() {
+		os.Unsetenv("BUILD_JOB_NAME")
+
+		Ω(out.BuildURL()).Should(Equal("https://ci.example.com/builds/1234"))
+	})
+
+	It("is empty outside of Concourse", func() {
+		os.Unsetenv("ATC_EXTERNAL_URL")
+
+		Ω(out.BuildURL()).Should(BeEmpty())
+	})
+})
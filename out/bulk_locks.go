@@ -0,0 +1,92 @@
+package out
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// LockManifest names the file in an add directory that lists many locks at
+// once, as a JSON object from lock name to metadata.
+const LockManifest = "locks.json"
+
+// readBulkLocks reads the locks of an add directory that has no name file:
+// either the entries of its manifest, or each of its files, named after the
+// lock and holding its metadata. Hidden files are skipped, so that e.g. a
+// .gitkeep can keep an otherwise empty directory in a repository.
+func readBulkLocks(dir string) (map[string][]byte, error) {
+	manifest, err := ioutil.ReadFile(filepath.Join(dir, LockManifest))
+	if err == nil {
+		return parseLockManifest(manifest)
+	}
+
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	locks := map[string][]byte{}
+	for _, info := range infos {
+		if !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+
+		contents, err := ioutil.ReadFile(filepath.Join(dir, info.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		locks[info.Name()] = contents
+	}
+
+	return locks, nil
+}
+
+// parseLockManifest reads a manifest's locks. Metadata given as a JSON
+// string is used as is; any other value is written as compact JSON.
+func parseLockManifest(manifest []byte) (map[string][]byte, error) {
+	var entries map[string]json.RawMessage
+	err := json.Unmarshal(manifest, &entries)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %s", LockManifest, err)
+	}
+
+	locks := map[string][]byte{}
+	for name, raw := range entries {
+		var metadata string
+		if json.Unmarshal(raw, &metadata) == nil {
+			locks[name] = []byte(metadata)
+			continue
+		}
+
+		compact, err := json.Marshal(raw)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse %s: %s", LockManifest, err)
+		}
+
+		locks[name] = compact
+	}
+
+	return locks, nil
+}
+
+// sortedLockNames returns the names of locks in order, so that commits and
+// output list them the same way every time.
+func sortedLockNames(locks map[string][]byte) []string {
+	names := make([]string, 0, len(locks))
+	for name := range locks {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
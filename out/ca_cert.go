@@ -0,0 +1,76 @@
+package out
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+)
+
+// setupCACert writes source.ca_cert to a file for git to verify HTTPS
+// remotes against, in place of the system's certificate authorities.
+func (glh *GitLockHandler) setupCACert() error {
+	if glh.Source.CACert == "" {
+		return nil
+	}
+
+	file, err := ioutil.TempFile("", TempDirPrefix+"-ca-cert")
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	glh.caCert = file.Name()
+
+	_, err = file.WriteString(glh.Source.CACert)
+	return err
+}
+
+// caCertEnv has git trust the source's CA bundle for HTTPS remotes. It is
+// given as GIT_SSL_CAINFO, git's environment equivalent of http.sslCAInfo,
+// as that takes precedence over both the config and a bundle the image
+// itself points git at.
+func (glh *GitLockHandler) caCertEnv() []string {
+	if glh.caCert == "" {
+		return nil
+	}
+
+	return []string{"GIT_SSL_CAINFO=" + glh.caCert}
+}
+
+// validateCACert checks that source.ca_cert holds PEM certificates, as git
+// would otherwise only say that the server's certificate couldn't be
+// verified.
+func (source Source) validateCACert() []string {
+	if source.CACert == "" {
+		return nil
+	}
+
+	rest := []byte(source.CACert)
+	found := false
+
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		_, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return []string{"source.ca_cert holds a certificate that doesn't parse: " + err.Error()}
+		}
+
+		found = true
+	}
+
+	if !found {
+		return []string{"source.ca_cert must hold one or more PEM encoded certificates"}
+	}
+
+	return nil
+}
@@ -0,0 +1,54 @@
+package out
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// CandidateClaimer is implemented by LockHandlers that can be limited to
+// claiming the first available lock of an ordered list of candidates, rather
+// than choosing among all the available locks. Claiming from no candidates
+// lifts the limit.
+type CandidateClaimer interface {
+	ClaimFrom(candidates []string)
+}
+
+// FirstAvailable returns the first of candidates that is available, or "" if
+// none of them is.
+func FirstAvailable(candidates []string, available []string) string {
+	isAvailable := map[string]bool{}
+	for _, lock := range available {
+		isAvailable[lock] = true
+	}
+
+	for _, candidate := range candidates {
+		if isAvailable[candidate] {
+			return candidate
+		}
+	}
+
+	return ""
+}
+
+// ClaimFrom limits claims to the first available of candidates, which takes
+// precedence over the source's affinity and selection strategy.
+func (glh *GitLockHandler) ClaimFrom(candidates []string) {
+	glh.candidates = candidates
+}
+
+// AcquireAnyOf claims the first of candidates that is available, in order,
+// waiting as AcquireLock does while none of them is.
+func (lp *LockPool) AcquireAnyOf(candidates []string) (string, Version, error) {
+	claimer, ok := lp.LockHandler.(CandidateClaimer)
+	if !ok {
+		return "", Version{}, errors.New("the pool's lock handler cannot claim from a list of candidates")
+	}
+
+	fmt.Fprintf(lp.Output, "claiming any of: %s\n", strings.Join(candidates, ", "))
+
+	claimer.ClaimFrom(candidates)
+	defer claimer.ClaimFrom(nil)
+
+	return lp.AcquireLock()
+}
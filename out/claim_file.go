@@ -0,0 +1,83 @@
+package out
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+)
+
+// ClaimFile is the file that in and out write a Claim to, in the step's
+// directory, for downstream tasks to read the lock's particulars from one
+// machine-readable document instead of its loose files.
+const ClaimFile = "claim.json"
+
+// Claim is the record of a lock as a step left it. ClaimedAt and Claimer are
+// of the lock's current claim, if it is claimed, and MetadataDigest is of its
+// contents as committed, encrypted or not, like a version's digest.
+type Claim struct {
+	Name           string     `json:"name"`
+	Pool           string     `json:"pool"`
+	Ref            string     `json:"ref"`
+	State          string     `json:"state,omitempty"`
+	Claimer        string     `json:"claimer,omitempty"`
+	ClaimedAt      *time.Time `json:"claimed_at,omitempty"`
+	RecordedAt     time.Time  `json:"recorded_at"`
+	MetadataDigest string     `json:"metadata_digest,omitempty"`
+}
+
+// Claim is the record of the lock the operation changed, or nil if it
+// changed none.
+func (lp *LockPool) Claim() *Claim {
+	return lp.claim
+}
+
+// recordClaim records the lock as the change pushed as ref left it, while
+// the clone is still there to read it from. What can't be read is left out
+// of the record, as the change has already been made.
+func (lp *LockPool) recordClaim(ref string, lock string) {
+	claim := &Claim{
+		Name:       lock,
+		Pool:       lp.Source.Pool,
+		Ref:        ref,
+		State:      lp.lockState(lock),
+		RecordedAt: lp.now().UTC(),
+	}
+
+	if claim.State == "" {
+		lp.claim = claim
+		return
+	}
+
+	if reader, ok := lp.LockHandler.(ClaimInfoReader); ok && claim.State == lp.Source.Paths.Claimed {
+		info, err := reader.ClaimInfo(lock)
+		if err != nil {
+			fmt.Fprintf(lp.Output, "failed to read the claim of the lock: %s! (err: %s)\n", lock, err)
+		} else if !info.At.IsZero() {
+			claim.Claimer = info.By
+			claim.ClaimedAt = &info.At
+		}
+	}
+
+	if digester, ok := lp.LockHandler.(LockDigester); ok {
+		digest, err := digester.LockDigest(claim.State, lock)
+		if err != nil {
+			fmt.Fprintf(lp.Output, "failed to digest the lock: %s! (err: %s)\n", lock, err)
+		} else {
+			claim.MetadataDigest = digest
+		}
+	}
+
+	lp.claim = claim
+}
+
+// WriteClaim writes the claim to ClaimFile in dir.
+func WriteClaim(dir string, claim Claim) error {
+	contents, err := json.MarshalIndent(claim, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(dir, ClaimFile), append(contents, '\n'), 0644)
+}
@@ -0,0 +1,121 @@
+package out
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// ClaimTags configures the annotated tag made on each claim's commit, which
+// records the claim even if the branch is later rewritten.
+type ClaimTags struct {
+	Enabled bool `json:"enabled"`
+
+	// SigningKey is an armored GPG secret key, without a passphrase, to sign
+	// the tags with.
+	SigningKey string `json:"signing_key"`
+}
+
+// ClaimTagName names the tag recording a build's claim of a lock.
+func ClaimTagName(pool string, lock string, build string) string {
+	return path.Join("claim", pool, lock, build)
+}
+
+// tagClaim tags the commit that just claimed the lock, to be pushed along
+// with it.
+func (glh *GitLockHandler) tagClaim(lockName string) error {
+	if !glh.Source.ClaimTags.Enabled {
+		return nil
+	}
+
+	// builds outside of Concourse, e.g. by poolctl, are named after the
+	// claim's commit instead
+	build := os.Getenv("BUILD_ID")
+	if build == "" {
+		head, err := glh.git("rev-parse", "--short", "HEAD")
+		if err != nil {
+			return err
+		}
+
+		build = strings.TrimSpace(string(head))
+	}
+
+	name := ClaimTagName(glh.Source.Pool, lockName, build)
+
+	message := fmt.Sprintf("claiming: %s", lockName)
+	if pipeline := BuildPipeline(); pipeline != "" {
+		message += "\n\n" + pipelineTrailer + pipeline
+	}
+
+	args := []string{"tag", "--annotate", "--message", message}
+	var env []string
+	if glh.gnupgHome != "" {
+		args = append(args, "--local-user", glh.signingKey)
+		env = append(env, "GNUPGHOME="+glh.gnupgHome)
+	}
+	args = append(args, name, "HEAD")
+
+	_, err := glh.run(glh.repoDir, args, env...)
+	if err != nil {
+		return err
+	}
+
+	glh.pendingTags = append(glh.pendingTags, name)
+
+	return nil
+}
+
+// dropPendingTags deletes the tags of claims that were never pushed.
+func (glh *GitLockHandler) dropPendingTags() error {
+	if len(glh.pendingTags) == 0 {
+		return nil
+	}
+
+	_, err := glh.git(append([]string{"tag", "--delete"}, glh.pendingTags...)...)
+	if err != nil {
+		return err
+	}
+
+	glh.pendingTags = nil
+
+	return nil
+}
+
+// setupSigningKey imports the key claim tags are signed with into a keyring
+// of its own.
+func (glh *GitLockHandler) setupSigningKey() error {
+	home, err := ioutil.TempDir("", TempDirPrefix+"-gnupg")
+	if err != nil {
+		return err
+	}
+
+	glh.gnupgHome = home
+
+	err = glh.holdTempDir(home)
+	if err != nil {
+		return err
+	}
+
+	_, err = runCrypto(exec.Command("gpg", "--homedir", home, "--batch", "--import"), []byte(glh.Source.ClaimTags.SigningKey))
+	if err != nil {
+		return fmt.Errorf("importing claim tag signing key: %s", err)
+	}
+
+	keys, err := runCrypto(exec.Command("gpg", "--homedir", home, "--batch", "--with-colons", "--list-secret-keys"), nil)
+	if err != nil {
+		return fmt.Errorf("reading claim tag signing key: %s", err)
+	}
+
+	for _, line := range strings.Split(string(keys), "\n") {
+		fields := strings.Split(line, ":")
+		if fields[0] == "fpr" && len(fields) > 9 {
+			glh.signingKey = fields[9]
+			return nil
+		}
+	}
+
+	return fmt.Errorf("source.claim_tags.signing_key holds no secret key")
+}
@@ -0,0 +1,61 @@
+package out
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// noShallowCommits is how git refuses a clone or fetch bounded by date that
+// would take no commits at all.
+const noShallowCommits = "no commits selected for shallow requests"
+
+// runSince runs a git clone or fetch bounded by source.clone_since, so that
+// only the history made since is transferred however many commits that is.
+// A branch that hasn't changed since has no commits that new, and git
+// refuses to take none, so just its last commit is taken instead.
+func (glh *GitLockHandler) runSince(dir string, args []string, env ...string) ([]byte, error) {
+	if glh.Source.CloneSince <= 0 {
+		return glh.run(dir, args, env...)
+	}
+
+	since := time.Now().Add(-glh.Source.CloneSince).Format(time.RFC3339)
+
+	output, err := glh.run(dir, withOption(args, "--shallow-since="+since), env...)
+	if err != nil && strings.Contains(string(output), noShallowCommits) {
+		return glh.run(dir, withOption(args, "--depth=1"), env...)
+	}
+
+	return output, err
+}
+
+// withOption adds option to the git subcommand args.
+func withOption(args []string, option string) []string {
+	return append([]string{args[0], option}, args[1:]...)
+}
+
+// unshallow fetches the history that source.clone_since left out of the
+// clone, for operations that need all of it.
+func (glh *GitLockHandler) unshallow() error {
+	output, err := glh.git("rev-parse", "--is-shallow-repository")
+	if err != nil {
+		return err
+	}
+
+	if strings.TrimSpace(string(output)) != "true" {
+		return nil
+	}
+
+	// worktrees of a shared clone share its history
+	unlock, err := glh.lockSharedClone()
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	refspec := fmt.Sprintf("+refs/heads/%s:refs/remotes/origin/%s", glh.branch, glh.branch)
+
+	_, err = glh.git("fetch", "--unshallow", "--no-tags", "origin", refspec)
+	return err
+}
@@ -0,0 +1,63 @@
+package out
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// CommitMessageData is what a commit message template is rendered with.
+type CommitMessageData struct {
+	// Action is what the commit does to the lock, e.g. "claiming" or
+	// "unclaiming".
+	Action string
+
+	// Lock and Pool name the lock the commit changes and its pool.
+	Lock string
+	Pool string
+
+	// Message is the message the commit would have without a template, e.g.
+	// "claiming: some-lock".
+	Message string
+
+	// Env holds the build's BUILD_* variables and ATC_EXTERNAL_URL, as
+	// Concourse sets them for the step.
+	Env map[string]string
+}
+
+// ParseCommitMessageTemplate parses a template for the messages of the
+// commits made to the pool. Variables the build does not set render as empty
+// strings.
+func ParseCommitMessageTemplate(text string) (*template.Template, error) {
+	return template.New("commit_message_template").Funcs(metadataTemplateFuncs).Option("missingkey=zero").Parse(text)
+}
+
+// RenderCommitMessage renders the message of a commit making the given change
+// to a lock.
+func RenderCommitMessage(text string, action string, lock string, pool string) (string, error) {
+	tmpl, err := ParseCommitMessageTemplate(text)
+	if err != nil {
+		return "", err
+	}
+
+	var rendered bytes.Buffer
+	err = tmpl.Execute(&rendered, CommitMessageData{
+		Action:  action,
+		Lock:    lock,
+		Pool:    pool,
+		Message: fmt.Sprintf("%s: %s", action, lock),
+		Env:     buildEnv(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// git refuses to commit without a message
+	if strings.TrimSpace(rendered.String()) == "" {
+		return "", errors.New("source.commit_message_template rendered an empty commit message")
+	}
+
+	return rendered.String(), nil
+}
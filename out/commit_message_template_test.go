@@ -0,0 +1,42 @@
+package out_test
+
+import (
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/concourse/pool-resource/out"
+)
+
+var _ = Describe("Commit message templates", func() {
+	BeforeEach(func() {
+		os.Setenv("BUILD_PIPELINE_NAME", "some-pipeline")
+		os.Setenv("BUILD_NAME", "42")
+	})
+
+	AfterEach(func() {
+		os.Unsetenv("BUILD_PIPELINE_NAME")
+		os.Unsetenv("BUILD_NAME")
+	})
+
+	It("renders the change and the build's variables", func() {
+		message, err := out.RenderCommitMessage(
+			"[{{.Pool}}] {{.Action}} {{.Lock}}\n\nBuild: {{.Env.BUILD_PIPELINE_NAME}} #{{.Env.BUILD_NAME}}",
+			"claiming", "some-lock", "some-pool",
+		)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(message).Should(Equal("[some-pool] claiming some-lock\n\nBuild: some-pipeline #42"))
+	})
+
+	It("can wrap the usual message", func() {
+		message, err := out.RenderCommitMessage("chore: {{.Message}} [skip ci]", "force unclaiming", "some-lock", "some-pool")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(message).Should(Equal("chore: force unclaiming: some-lock [skip ci]"))
+	})
+
+	It("refuses to render an empty message", func() {
+		_, err := out.RenderCommitMessage("{{.Env.BUILD_TEAM_NAME}}\n", "claiming", "some-lock", "some-pool")
+		Ω(err).Should(MatchError("source.commit_message_template rendered an empty commit message"))
+	})
+})
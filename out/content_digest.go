@@ -0,0 +1,80 @@
+package out
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// With source.content_digest set, the version of each change to a lock
+// carries a digest of the lock's contents as committed, which get checks what
+// it fetches against. A commit's contents can't change without its ref
+// changing too, but what get reads can: a version refetched by itself after
+// the branch was force-pushed, or an LFS object replaced on the server. The
+// digest is of the file as git stores it, so for LFS it is of the pointer,
+// whose own digest git-lfs checks the object against in turn.
+
+// LockDigester is implemented by LockHandlers that can digest the contents
+// of a lock as committed, for the versions of changes to it.
+type LockDigester interface {
+	LockDigest(state string, lock string) (string, error)
+}
+
+// ContentDigest is the digest of contents, as versions carry it.
+func ContentDigest(contents []byte) string {
+	sum := sha256.Sum256(contents)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// LockDigest digests the lock in the given state as it was last committed.
+func (glh *GitLockHandler) LockDigest(state string, lock string) (string, error) {
+	path := glh.treePath(filepath.Join(glh.poolDir(), state, lock))
+
+	contents, err := glh.git("cat-file", "blob", "HEAD:"+path)
+	if err != nil {
+		return "", err
+	}
+
+	return ContentDigest(contents), nil
+}
+
+// version is the version of a change to the lock that was pushed as ref,
+// with the digest of the lock's contents if the source asks for it. The lock
+// is recorded as the change left it, for the step's claim file.
+func (lp *LockPool) version(ref string, lock string) Version {
+	ref = strings.TrimSpace(ref)
+
+	lp.recordClaim(ref, lock)
+
+	return Version{
+		Ref:    ref,
+		Lock:   lock,
+		Digest: lp.lockDigest(lock),
+	}
+}
+
+// lockDigest digests the lock for its version, or is empty if the source
+// doesn't ask for digests or the lock has been removed. Failing to digest a
+// lock that has already been changed is only reported, as the change can't
+// be undone.
+func (lp *LockPool) lockDigest(lock string) string {
+	digester, ok := lp.LockHandler.(LockDigester)
+	if !lp.Source.ContentDigest || !ok {
+		return ""
+	}
+
+	state := lp.lockState(lock)
+	if state == "" {
+		return ""
+	}
+
+	digest, err := digester.LockDigest(state, lock)
+	if err != nil {
+		fmt.Fprintf(lp.Output, "failed to digest the lock: %s! (err: %s)\n", lock, err)
+		return ""
+	}
+
+	return digest
+}
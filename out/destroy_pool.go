@@ -0,0 +1,65 @@
+package out
+
+import (
+	"fmt"
+	"os"
+)
+
+// DestroyPool removes the pool's directory and everything in it: its locks in
+// every state, and what is recorded alongside them.
+func (glh *GitLockHandler) DestroyPool() (string, error) {
+	pool := glh.poolDir()
+
+	if glh.treePath(pool) == "." {
+		return "", fmt.Errorf("pool %s is the whole repository, which is not destroyed", glh.Source.Pool)
+	}
+
+	exists, err := glh.poolExists()
+	if err != nil {
+		return "", err
+	}
+
+	if !exists {
+		return "", fmt.Errorf("pool %s does not exist", glh.Source.Pool)
+	}
+
+	if glh.Source.Bare {
+		err = glh.removeBareFile(pool, false)
+	} else {
+		_, err = glh.git("rm", "-r", "--quiet", "--", pool)
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	return glh.commit("destroying", glh.Source.Pool, "")
+}
+
+// poolExists tells whether anything of the pool is staged.
+func (glh *GitLockHandler) poolExists() (bool, error) {
+	if glh.Source.Bare {
+		entry, err := glh.bareEntry(glh.poolDir())
+		return entry != nil, err
+	}
+
+	_, err := os.Stat(glh.poolDir())
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// DestroyPool removes the whole pool in a single commit, for decommissioning
+// it. As there is no undoing it short of reverting the commit, confirmation
+// must name the pool being destroyed. The version it returns names no lock.
+func (lp *LockPool) DestroyPool(confirmation string) (string, Version, error) {
+	return lp.traced("destroy", func() (string, Version, error) {
+		if confirmation != lp.Source.Pool {
+			return "", Version{}, fmt.Errorf("destroying pool %s must be confirmed with its name, not %q", lp.Source.Pool, confirmation)
+		}
+
+		return lp.changePool("destroying", lp.LockHandler.DestroyPool)
+	})
+}
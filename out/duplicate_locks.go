@@ -0,0 +1,42 @@
+package out
+
+import "fmt"
+
+// checkNewLocks makes sure that none of the locks being added is already in
+// the pool, where adding it would silently replace its metadata, or leave it
+// in two states at once. With overwrite, the metadata of an unclaimed lock
+// may be replaced; a lock in any other state can't be, as whoever holds it
+// is relying on it as it is.
+func (lp *LockPool) checkNewLocks(names []string, overwrite bool) error {
+	adding := map[string]bool{}
+	for _, name := range names {
+		adding[name] = true
+	}
+
+	states := []string{lp.Source.Paths.Unclaimed, lp.Source.Paths.Claimed, lp.Source.Paths.Maintenance, lp.Source.Paths.Broken, lp.Source.Paths.Reserved}
+
+	for _, state := range states {
+		if state == "" {
+			continue
+		}
+
+		locks, err := lp.LockHandler.ListLocks(state)
+		if err != nil {
+			return err
+		}
+
+		for _, lock := range locks {
+			if !adding[lock] || (overwrite && state == lp.Source.Paths.Unclaimed) {
+				continue
+			}
+
+			if state == lp.Source.Paths.Unclaimed {
+				return fmt.Errorf("lock %s is already in pool %s; set params.overwrite to replace its metadata", lock, lp.Source.Pool)
+			}
+
+			return fmt.Errorf("lock %s is already in pool %s, in %s, and can't be overwritten", lock, lp.Source.Pool, state)
+		}
+	}
+
+	return nil
+}
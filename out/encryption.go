@@ -0,0 +1,170 @@
+package out
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+const (
+	EncryptionAge = "age"
+	EncryptionGPG = "gpg"
+)
+
+const ageArmorHeader = "-----BEGIN AGE ENCRYPTED FILE-----"
+const gpgArmorHeader = "-----BEGIN PGP MESSAGE-----"
+
+// Encryption configures encrypting lock metadata with age or GPG, for pool
+// repositories that must be broadly readable while metadata holds
+// credentials. The age or gpg binary must be available in the image.
+type Encryption struct {
+	Type string `json:"type"`
+
+	// Recipients are age public keys, or GPG key IDs or emails whose public
+	// keys are given in PublicKeys.
+	Recipients []string `json:"recipients"`
+	PublicKeys string   `json:"public_keys"`
+
+	// PrivateKey is the age identity or armored GPG secret key used to
+	// decrypt metadata.
+	PrivateKey string `json:"private_key"`
+}
+
+func (encryption Encryption) Enabled() bool {
+	return encryption.Type != ""
+}
+
+// Encrypt returns plaintext encrypted to every recipient, ASCII armored so
+// that it diffs sensibly in the pool repository.
+func (encryption Encryption) Encrypt(plaintext []byte) ([]byte, error) {
+	switch encryption.Type {
+	case EncryptionAge:
+		args := []string{"--encrypt", "--armor"}
+		for _, recipient := range encryption.Recipients {
+			args = append(args, "--recipient", recipient)
+		}
+
+		return runCrypto(exec.Command("age", args...), plaintext)
+
+	case EncryptionGPG:
+		return encryption.withGPGHome(encryption.PublicKeys, func(home string) ([]byte, error) {
+			args := []string{"--homedir", home, "--batch", "--yes", "--trust-model", "always", "--armor", "--encrypt"}
+			for _, recipient := range encryption.Recipients {
+				args = append(args, "--recipient", recipient)
+			}
+
+			return runCrypto(exec.Command("gpg", args...), plaintext)
+		})
+
+	default:
+		return plaintext, nil
+	}
+}
+
+func (encryption Encryption) Decrypt(ciphertext []byte) ([]byte, error) {
+	switch encryption.Type {
+	case EncryptionAge:
+		identity, err := ioutil.TempFile("", TempDirPrefix+"-age-identity")
+		if err != nil {
+			return nil, err
+		}
+
+		defer os.Remove(identity.Name())
+
+		_, err = identity.WriteString(encryption.PrivateKey)
+		identity.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		return runCrypto(exec.Command("age", "--decrypt", "--identity", identity.Name()), ciphertext)
+
+	case EncryptionGPG:
+		return encryption.withGPGHome(encryption.PrivateKey, func(home string) ([]byte, error) {
+			return runCrypto(exec.Command("gpg", "--homedir", home, "--batch", "--yes", "--pinentry-mode", "loopback", "--decrypt"), ciphertext)
+		})
+
+	default:
+		return ciphertext, nil
+	}
+}
+
+// Readable decrypts metadata if it is encrypted and a private key is
+// configured, and otherwise returns it as it is, so that locks added before
+// encryption was turned on keep working. Encrypted metadata that the key
+// can't decrypt is an error, rather than being read as the ciphertext.
+func (encryption Encryption) Readable(contents []byte) ([]byte, error) {
+	if encryption.PrivateKey == "" {
+		return contents, nil
+	}
+
+	trimmed := bytes.TrimSpace(contents)
+	if !bytes.HasPrefix(trimmed, []byte(ageArmorHeader)) && !bytes.HasPrefix(trimmed, []byte(gpgArmorHeader)) {
+		return contents, nil
+	}
+
+	plaintext, err := encryption.Decrypt(contents)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting metadata: %s", err)
+	}
+
+	return plaintext, nil
+}
+
+// readable decrypts a lock's metadata as Encryption.Readable does. Metadata
+// that can't be decrypted is reported, and read as it is, so that hooks and
+// releases still go ahead.
+func (lp *LockPool) readable(lock string, contents []byte) []byte {
+	plaintext, err := lp.Source.Encryption.Readable(contents)
+	if err != nil {
+		fmt.Fprintf(lp.Output, "\nfailed to read the metadata of lock: %s! (err: %s)\n", lock, err)
+		return contents
+	}
+
+	return plaintext
+}
+
+// withGPGHome runs gpg against a throwaway keyring holding only keys, so that
+// nothing is read from or left in the user's own keyring.
+func (encryption Encryption) withGPGHome(keys string, run func(home string) ([]byte, error)) ([]byte, error) {
+	home, err := ioutil.TempDir("", TempDirPrefix+"-gnupg")
+	if err != nil {
+		return nil, err
+	}
+
+	defer os.RemoveAll(home)
+
+	// held, so that a sweep of stale temp dirs leaves the keyring alone
+	// however long gpg takes
+	release, err := HoldTempDir(home)
+	if err != nil {
+		return nil, err
+	}
+
+	defer release()
+
+	_, err = runCrypto(exec.Command("gpg", "--homedir", home, "--batch", "--import"), []byte(keys))
+	if err != nil {
+		return nil, fmt.Errorf("importing keys: %s", err)
+	}
+
+	return run(home)
+}
+
+func runCrypto(cmd *exec.Cmd, input []byte) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %s", filepath.Base(cmd.Path), bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	return stdout.Bytes(), nil
+}
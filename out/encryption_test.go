@@ -0,0 +1,71 @@
+package out_test
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/concourse/pool-resource/out"
+)
+
+var _ = Describe("Encrypting metadata", func() {
+	var encryption out.Encryption
+
+	BeforeEach(func() {
+		home, err := ioutil.TempDir("", "gnupg")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		defer os.RemoveAll(home)
+
+		gpg := func(args ...string) []byte {
+			output, err := exec.Command("gpg", append([]string{"--homedir", home, "--batch", "--pinentry-mode", "loopback", "--passphrase", ""}, args...)...).Output()
+			Ω(err).ShouldNot(HaveOccurred())
+			return output
+		}
+
+		gpg("--quick-gen-key", "Pool Resource <pool@example.com>", "default", "default", "never")
+
+		encryption = out.Encryption{
+			Type:       out.EncryptionGPG,
+			Recipients: []string{"pool@example.com"},
+			PublicKeys: string(gpg("--armor", "--export", "pool@example.com")),
+			PrivateKey: string(gpg("--armor", "--export-secret-keys", "pool@example.com")),
+		}
+	})
+
+	It("round trips metadata through GPG", func() {
+		ciphertext, err := encryption.Encrypt([]byte(`{"password":"hunter2"}`))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(string(ciphertext)).Should(HavePrefix("-----BEGIN PGP MESSAGE-----"))
+		Ω(string(ciphertext)).ShouldNot(ContainSubstring("hunter2"))
+
+		plaintext, err := encryption.Decrypt(ciphertext)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(plaintext)).Should(Equal(`{"password":"hunter2"}`))
+
+		readable, err := encryption.Readable(ciphertext)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(readable)).Should(Equal(`{"password":"hunter2"}`))
+	})
+
+	It("reads metadata that was never encrypted as it is", func() {
+		readable, err := encryption.Readable([]byte(`{"some":"json"}`))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(readable)).Should(Equal(`{"some":"json"}`))
+	})
+
+	It("fails to read encrypted metadata that the key can't decrypt", func() {
+		_, err := encryption.Readable([]byte("-----BEGIN PGP MESSAGE-----\n\nnonsense\n-----END PGP MESSAGE-----\n"))
+		Ω(err).Should(HaveOccurred())
+	})
+
+	It("leaves metadata alone when encryption is off", func() {
+		plaintext, err := out.Encryption{}.Encrypt([]byte("metadata"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(plaintext)).Should(Equal("metadata"))
+	})
+})
@@ -0,0 +1,101 @@
+package out
+
+import "fmt"
+
+// Error categories group the reasons an operation fails for tooling that
+// reports them; git errors are categorized by their ErrorClass.
+const (
+	ErrorCategoryInvalidRequest = "invalid_request"
+	ErrorCategoryOperation      = "operation"
+	ErrorCategoryCircuitOpen    = "circuit_open"
+	ErrorCategoryNoLocks        = "no_locks"
+	ErrorCategoryPaused         = "paused"
+)
+
+// ErrorResponse is written as the last line of a failed step's log, so that
+// wrappers and the UI can tell why it failed without reading the rest.
+type ErrorResponse struct {
+	Error ErrorDetail `json:"error"`
+}
+
+type ErrorDetail struct {
+	Category string `json:"category"`
+	Message  string `json:"message"`
+
+	// Retryable tells whether running the step again may succeed without
+	// anything being changed.
+	Retryable bool `json:"retryable"`
+
+	// Doing says what the step was doing when it failed, e.g. "acquiring
+	// lock".
+	Doing string `json:"doing,omitempty"`
+}
+
+// NewErrorResponse describes err, which failed the step while doing the
+// given thing.
+func NewErrorResponse(doing string, err error) ErrorResponse {
+	detail := ErrorDetail{
+		Category: ErrorCategoryOperation,
+		Message:  err.Error(),
+		Doing:    doing,
+	}
+
+	switch typed := err.(type) {
+	case *GitError:
+		detail.Category = typed.Class.Category()
+		detail.Retryable = typed.Class.Retryable()
+	case *CircuitBreakerError:
+		detail.Category = ErrorCategoryCircuitOpen
+		detail.Retryable = true
+	case *NetworkRetriesError:
+		detail.Category = typed.Last.Class.Category()
+		detail.Retryable = true
+	default:
+		switch err {
+		case ErrLockConflict:
+			detail.Category = ErrorClassConflict.Category()
+			detail.Retryable = true
+		case ErrNoLocksAvailable, ErrReserveMinimum:
+			detail.Category = ErrorCategoryNoLocks
+			detail.Retryable = true
+		case ErrPoolPaused:
+			detail.Category = ErrorCategoryPaused
+			detail.Retryable = true
+		}
+	}
+
+	return ErrorResponse{Error: detail}
+}
+
+// CircuitBreakerError is returned once source.circuit_breaker gives up on a
+// remote that keeps failing.
+type CircuitBreakerError struct {
+	Pool      string
+	Failures  int
+	Over      string
+	Retries   int
+	Conflicts int
+	Last      error
+}
+
+func (err *CircuitBreakerError) Error() string {
+	return fmt.Sprintf(
+		"giving up on pool %s after %d consecutive failures over %s (%d retries in all, %d after conflicts); last error: %s",
+		err.Pool, err.Failures, err.Over, err.Retries, err.Conflicts, err.Last,
+	)
+}
+
+// NetworkRetriesError is returned once blips in the network between us and
+// the remote have gone on for more than source.network_retries retries.
+type NetworkRetriesError struct {
+	Pool     string
+	Failures int
+	Last     *GitError
+}
+
+func (err *NetworkRetriesError) Error() string {
+	return fmt.Sprintf(
+		"giving up on pool %s after %d consecutive network failures; last error: %s",
+		err.Pool, err.Failures, err.Last,
+	)
+}
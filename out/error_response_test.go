@@ -0,0 +1,61 @@
+package out_test
+
+import (
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/concourse/pool-resource/out"
+)
+
+var _ = Describe("Error responses", func() {
+	It("categorizes git errors by their class", func() {
+		response := out.NewErrorResponse("acquiring lock", &out.GitError{
+			Class:   out.ErrorClassAuth,
+			Command: "git push",
+			Output:  "Permission denied (publickey).",
+		})
+
+		Ω(response).Should(Equal(out.ErrorResponse{Error: out.ErrorDetail{
+			Category:  "auth",
+			Message:   "git push failed (authentication failed): Permission denied (publickey).",
+			Retryable: false,
+			Doing:     "acquiring lock",
+		}}))
+
+		detail := out.NewErrorResponse("acquiring lock", &out.GitError{Class: out.ErrorClassNetwork, Err: errors.New("eof")}).Error
+		Ω(detail.Category).Should(Equal("network"))
+		Ω(detail.Retryable).Should(BeTrue())
+	})
+
+	It("tells a tripped circuit breaker apart", func() {
+		detail := out.NewErrorResponse("acquiring lock", &out.CircuitBreakerError{Pool: "my-pool", Failures: 3, Last: errors.New("eof")}).Error
+
+		Ω(detail.Category).Should(Equal("circuit_open"))
+		Ω(detail.Retryable).Should(BeTrue())
+		Ω(detail.Message).Should(HavePrefix("giving up on pool my-pool after 3 consecutive failures"))
+	})
+
+	It("categorizes running out of network retries by the last failure", func() {
+		last := &out.GitError{Class: out.ErrorClassConnectionReset, Command: "git push", Output: "connection reset by peer"}
+		detail := out.NewErrorResponse("acquiring lock", &out.NetworkRetriesError{Pool: "my-pool", Failures: 4, Last: last}).Error
+
+		Ω(detail.Category).Should(Equal("network"))
+		Ω(detail.Retryable).Should(BeTrue())
+		Ω(detail.Message).Should(Equal("giving up on pool my-pool after 4 consecutive network failures; last error: git push failed (connection reset): connection reset by peer"))
+	})
+
+	It("counts other errors as failures of the operation itself", func() {
+		detail := out.NewErrorResponse("releasing lock", errors.New("lock some-lock is not claimed")).Error
+
+		Ω(detail.Category).Should(Equal("operation"))
+		Ω(detail.Retryable).Should(BeFalse())
+	})
+
+	It("tells a paused pool apart from other failures", func() {
+		detail := out.NewErrorResponse("acquiring lock", out.ErrPoolPaused).Error
+		Ω(detail.Category).Should(Equal("paused"))
+		Ω(detail.Retryable).Should(BeTrue())
+	})
+})
@@ -0,0 +1,65 @@
+package out
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Events are written as JSON, one per line, when source.json_logs is set.
+const (
+	EventStarted   = "started"
+	EventRetry     = "retry"
+	EventWaiting   = "waiting"
+	EventConflict  = "conflict"
+	EventSucceeded = "succeeded"
+	EventFailed    = "failed"
+)
+
+// Event describes something that happened during an operation on the pool.
+type Event struct {
+	Time      string `json:"time"`
+	Event     string `json:"event"`
+	Operation string `json:"operation"`
+	Pool      string `json:"pool"`
+
+	// Lock and Ref are set once an operation has succeeded.
+	Lock string `json:"lock,omitempty"`
+	Ref  string `json:"ref,omitempty"`
+
+	// Attempt counts the retries of the operation so far, and Reason says why
+	// it is retrying.
+	Attempt int    `json:"attempt,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+
+	// Unclaimed counts the pool's unclaimed locks while waiting for one.
+	Unclaimed *int `json:"unclaimed,omitempty"`
+
+	// Retries, Conflicts, DurationMS, and TimingsMS, the milliseconds spent
+	// in each phase, summarize a finished operation, and Error says why it
+	// failed. DurationMS is also how long a waiting operation has waited so
+	// far.
+	Retries    int              `json:"retries,omitempty"`
+	Conflicts  int              `json:"conflicts,omitempty"`
+	DurationMS int64            `json:"duration_ms,omitempty"`
+	TimingsMS  map[string]int64 `json:"timings_ms,omitempty"`
+	Error      string           `json:"error,omitempty"`
+}
+
+// emit writes an event of the current operation to the event stream, if
+// there is one.
+func (lp *LockPool) emit(event Event) {
+	if lp.Events == nil {
+		return
+	}
+
+	event.Time = lp.now().UTC().Format(time.RFC3339Nano)
+	event.Operation = lp.operation
+	event.Pool = lp.Source.Pool
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	lp.Events.Write(append(line, '\n'))
+}
@@ -3,19 +3,12 @@ package fakes
 
 import (
 	"sync"
+	"time"
 
 	"github.com/concourse/pool-resource/out"
 )
 
 type FakeLockHandler struct {
-	GrabAvailableLockStub        func() (lock string, version string, err error)
-	grabAvailableLockMutex       sync.RWMutex
-	grabAvailableLockArgsForCall []struct{}
-	grabAvailableLockReturns     struct {
-		result1 string
-		result2 string
-		result3 error
-	}
 	UnclaimLockStub        func(lock string) (version string, err error)
 	unclaimLockMutex       sync.RWMutex
 	unclaimLockArgsForCall []struct {
@@ -25,6 +18,15 @@ type FakeLockHandler struct {
 		result1 string
 		result2 error
 	}
+	UnclaimLocksStub        func(locks []string) (version string, err error)
+	unclaimLocksMutex       sync.RWMutex
+	unclaimLocksArgsForCall []struct {
+		locks []string
+	}
+	unclaimLocksReturns struct {
+		result1 string
+		result2 error
+	}
 	AddLockStub        func(lock string, contents []byte) (version string, err error)
 	addLockMutex       sync.RWMutex
 	addLockArgsForCall []struct {
@@ -35,6 +37,15 @@ type FakeLockHandler struct {
 		result1 string
 		result2 error
 	}
+	AddLocksStub        func(locks map[string][]byte) (version string, err error)
+	addLocksMutex       sync.RWMutex
+	addLocksArgsForCall []struct {
+		locks map[string][]byte
+	}
+	addLocksReturns struct {
+		result1 string
+		result2 error
+	}
 	RemoveLockStub        func(lock string) (version string, err error)
 	removeLockMutex       sync.RWMutex
 	removeLockArgsForCall []struct {
@@ -44,6 +55,289 @@ type FakeLockHandler struct {
 		result1 string
 		result2 error
 	}
+	RemoveLocksStub        func(locks map[string]string) (version string, err error)
+	removeLocksMutex       sync.RWMutex
+	removeLocksArgsForCall []struct {
+		locks map[string]string
+	}
+	removeLocksReturns struct {
+		result1 string
+		result2 error
+	}
+	DisableLockStub        func(lock string) (version string, err error)
+	disableLockMutex       sync.RWMutex
+	disableLockArgsForCall []struct {
+		lock string
+	}
+	disableLockReturns struct {
+		result1 string
+		result2 error
+	}
+	EnableLockStub        func(lock string) (version string, err error)
+	enableLockMutex       sync.RWMutex
+	enableLockArgsForCall []struct {
+		lock string
+	}
+	enableLockReturns struct {
+		result1 string
+		result2 error
+	}
+	QuarantineLockStub        func(lock string, reason string) (version string, err error)
+	quarantineLockMutex       sync.RWMutex
+	quarantineLockArgsForCall []struct {
+		lock   string
+		reason string
+	}
+	quarantineLockReturns struct {
+		result1 string
+		result2 error
+	}
+	ForceUnclaimLockStub        func(lock string, state string) (version string, err error)
+	forceUnclaimLockMutex       sync.RWMutex
+	forceUnclaimLockArgsForCall []struct {
+		lock  string
+		state string
+	}
+	forceUnclaimLockReturns struct {
+		result1 string
+		result2 error
+	}
+	RenameLockStub        func(from string, to string, state string) (version string, err error)
+	renameLockMutex       sync.RWMutex
+	renameLockArgsForCall []struct {
+		from  string
+		to    string
+		state string
+	}
+	renameLockReturns struct {
+		result1 string
+		result2 error
+	}
+	ImportLockStub        func(state string, lock string, contents []byte) (version string, err error)
+	importLockMutex       sync.RWMutex
+	importLockArgsForCall []struct {
+		state    string
+		lock     string
+		contents []byte
+	}
+	importLockReturns struct {
+		result1 string
+		result2 error
+	}
+	ReserveLockStub        func(until time.Time) (lock string, version string, err error)
+	reserveLockMutex       sync.RWMutex
+	reserveLockArgsForCall []struct {
+		until time.Time
+	}
+	reserveLockReturns struct {
+		result1 string
+		result2 string
+		result3 error
+	}
+	ConfirmLockStub        func(lock string) (version string, err error)
+	confirmLockMutex       sync.RWMutex
+	confirmLockArgsForCall []struct {
+		lock string
+	}
+	confirmLockReturns struct {
+		result1 string
+		result2 error
+	}
+	LapseReservationStub        func(lock string) (version string, err error)
+	lapseReservationMutex       sync.RWMutex
+	lapseReservationArgsForCall []struct {
+		lock string
+	}
+	lapseReservationReturns struct {
+		result1 string
+		result2 error
+	}
+	ReservationExpiryStub        func(lock string) (until time.Time, err error)
+	reservationExpiryMutex       sync.RWMutex
+	reservationExpiryArgsForCall []struct {
+		lock string
+	}
+	reservationExpiryReturns struct {
+		result1 time.Time
+		result2 error
+	}
+	FencingTokenStub        func(lock string) (token int, err error)
+	fencingTokenMutex       sync.RWMutex
+	fencingTokenArgsForCall []struct {
+		lock string
+	}
+	fencingTokenReturns struct {
+		result1 int
+		result2 error
+	}
+	LeaseLockStub        func(until func(lock string) time.Time) (lock string, version string, err error)
+	leaseLockMutex       sync.RWMutex
+	leaseLockArgsForCall []struct {
+		until func(lock string) time.Time
+	}
+	leaseLockReturns struct {
+		result1 string
+		result2 string
+		result3 error
+	}
+	RenewLeaseStub        func(lock string, until time.Time) (version string, err error)
+	renewLeaseMutex       sync.RWMutex
+	renewLeaseArgsForCall []struct {
+		lock  string
+		until time.Time
+	}
+	renewLeaseReturns struct {
+		result1 string
+		result2 error
+	}
+	TransferLockStub        func(lock string, until time.Time) (version string, err error)
+	transferLockMutex       sync.RWMutex
+	transferLockArgsForCall []struct {
+		lock  string
+		until time.Time
+	}
+	transferLockReturns struct {
+		result1 string
+		result2 error
+	}
+	PausePoolStub        func(reason string) (version string, err error)
+	pausePoolMutex       sync.RWMutex
+	pausePoolArgsForCall []struct {
+		reason string
+	}
+	pausePoolReturns struct {
+		result1 string
+		result2 error
+	}
+	UnpausePoolStub        func() (version string, err error)
+	unpausePoolMutex       sync.RWMutex
+	unpausePoolArgsForCall []struct{}
+	unpausePoolReturns     struct {
+		result1 string
+		result2 error
+	}
+	DestroyPoolStub        func() (version string, err error)
+	destroyPoolMutex       sync.RWMutex
+	destroyPoolArgsForCall []struct{}
+	destroyPoolReturns     struct {
+		result1 string
+		result2 error
+	}
+	PoolPausedStub        func() (paused bool, err error)
+	poolPausedMutex       sync.RWMutex
+	poolPausedArgsForCall []struct{}
+	poolPausedReturns     struct {
+		result1 bool
+		result2 error
+	}
+	HeadStub        func() (version string, err error)
+	headMutex       sync.RWMutex
+	headArgsForCall []struct{}
+	headReturns     struct {
+		result1 string
+		result2 error
+	}
+	RevertCommitStub        func(ref string) (version string, reverted string, err error)
+	revertCommitMutex       sync.RWMutex
+	revertCommitArgsForCall []struct {
+		ref string
+	}
+	revertCommitReturns struct {
+		result1 string
+		result2 string
+		result3 error
+	}
+	SquashHistoryStub        func(before time.Time) (version string, squashed int, err error)
+	squashHistoryMutex       sync.RWMutex
+	squashHistoryArgsForCall []struct {
+		before time.Time
+	}
+	squashHistoryReturns struct {
+		result1 string
+		result2 int
+		result3 error
+	}
+	ReapLeaseStub        func(lock string) (version string, err error)
+	reapLeaseMutex       sync.RWMutex
+	reapLeaseArgsForCall []struct {
+		lock string
+	}
+	reapLeaseReturns struct {
+		result1 string
+		result2 error
+	}
+	LeaseExpiryStub        func(lock string) (until time.Time, err error)
+	leaseExpiryMutex       sync.RWMutex
+	leaseExpiryArgsForCall []struct {
+		lock string
+	}
+	leaseExpiryReturns struct {
+		result1 time.Time
+		result2 error
+	}
+	WriteExpiryStub        func(state string, lock string, until time.Time) error
+	writeExpiryMutex       sync.RWMutex
+	writeExpiryArgsForCall []struct {
+		state string
+		lock  string
+		until time.Time
+	}
+	writeExpiryReturns struct {
+		result1 error
+	}
+	WriteFencingTokenStub        func(lock string, token int) error
+	writeFencingTokenMutex       sync.RWMutex
+	writeFencingTokenArgsForCall []struct {
+		lock  string
+		token int
+	}
+	writeFencingTokenReturns struct {
+		result1 error
+	}
+	ListLocksStub        func(state string) (locks []string, err error)
+	listLocksMutex       sync.RWMutex
+	listLocksArgsForCall []struct {
+		state string
+	}
+	listLocksReturns struct {
+		result1 []string
+		result2 error
+	}
+	ReadLockStub        func(state string, lock string) (contents []byte, err error)
+	readLockMutex       sync.RWMutex
+	readLockArgsForCall []struct {
+		state string
+		lock  string
+	}
+	readLockReturns struct {
+		result1 []byte
+		result2 error
+	}
+	ClaimPipelineStub        func(lock string) (pipeline string, err error)
+	claimPipelineMutex       sync.RWMutex
+	claimPipelineArgsForCall []struct {
+		lock string
+	}
+	claimPipelineReturns struct {
+		result1 string
+		result2 error
+	}
+	ReadSchemaStub        func() (schema []byte, err error)
+	readSchemaMutex       sync.RWMutex
+	readSchemaArgsForCall []struct{}
+	readSchemaReturns     struct {
+		result1 []byte
+		result2 error
+	}
+	AuditLogStub        func(lock string) (notes []out.AuditNote, err error)
+	auditLogMutex       sync.RWMutex
+	auditLogArgsForCall []struct {
+		lock string
+	}
+	auditLogReturns struct {
+		result1 []out.AuditNote
+		result2 error
+	}
 	SetupStub        func() error
 	setupMutex       sync.RWMutex
 	setupArgsForCall []struct{}
@@ -62,34 +356,14 @@ type FakeLockHandler struct {
 	resetLockReturns     struct {
 		result1 error
 	}
-}
-
-func (fake *FakeLockHandler) GrabAvailableLock() (lock string, version string, err error) {
-	fake.grabAvailableLockMutex.Lock()
-	fake.grabAvailableLockArgsForCall = append(fake.grabAvailableLockArgsForCall, struct{}{})
-	fake.grabAvailableLockMutex.Unlock()
-	if fake.GrabAvailableLockStub != nil {
-		return fake.GrabAvailableLockStub()
-	} else {
-		return fake.grabAvailableLockReturns.result1, fake.grabAvailableLockReturns.result2, fake.grabAvailableLockReturns.result3
+	CleanupStub        func() error
+	cleanupMutex       sync.RWMutex
+	cleanupArgsForCall []struct{}
+	cleanupReturns     struct {
+		result1 error
 	}
 }
 
-func (fake *FakeLockHandler) GrabAvailableLockCallCount() int {
-	fake.grabAvailableLockMutex.RLock()
-	defer fake.grabAvailableLockMutex.RUnlock()
-	return len(fake.grabAvailableLockArgsForCall)
-}
-
-func (fake *FakeLockHandler) GrabAvailableLockReturns(result1 string, result2 string, result3 error) {
-	fake.GrabAvailableLockStub = nil
-	fake.grabAvailableLockReturns = struct {
-		result1 string
-		result2 string
-		result3 error
-	}{result1, result2, result3}
-}
-
 func (fake *FakeLockHandler) UnclaimLock(lock string) (version string, err error) {
 	fake.unclaimLockMutex.Lock()
 	fake.unclaimLockArgsForCall = append(fake.unclaimLockArgsForCall, struct {
@@ -123,6 +397,39 @@ func (fake *FakeLockHandler) UnclaimLockReturns(result1 string, result2 error) {
 	}{result1, result2}
 }
 
+func (fake *FakeLockHandler) UnclaimLocks(locks []string) (version string, err error) {
+	fake.unclaimLocksMutex.Lock()
+	fake.unclaimLocksArgsForCall = append(fake.unclaimLocksArgsForCall, struct {
+		locks []string
+	}{locks})
+	fake.unclaimLocksMutex.Unlock()
+	if fake.UnclaimLocksStub != nil {
+		return fake.UnclaimLocksStub(locks)
+	} else {
+		return fake.unclaimLocksReturns.result1, fake.unclaimLocksReturns.result2
+	}
+}
+
+func (fake *FakeLockHandler) UnclaimLocksCallCount() int {
+	fake.unclaimLocksMutex.RLock()
+	defer fake.unclaimLocksMutex.RUnlock()
+	return len(fake.unclaimLocksArgsForCall)
+}
+
+func (fake *FakeLockHandler) UnclaimLocksArgsForCall(i int) []string {
+	fake.unclaimLocksMutex.RLock()
+	defer fake.unclaimLocksMutex.RUnlock()
+	return fake.unclaimLocksArgsForCall[i].locks
+}
+
+func (fake *FakeLockHandler) UnclaimLocksReturns(result1 string, result2 error) {
+	fake.UnclaimLocksStub = nil
+	fake.unclaimLocksReturns = struct {
+		result1 string
+		result2 error
+	}{result1, result2}
+}
+
 func (fake *FakeLockHandler) AddLock(lock string, contents []byte) (version string, err error) {
 	fake.addLockMutex.Lock()
 	fake.addLockArgsForCall = append(fake.addLockArgsForCall, struct {
@@ -157,6 +464,39 @@ func (fake *FakeLockHandler) AddLockReturns(result1 string, result2 error) {
 	}{result1, result2}
 }
 
+func (fake *FakeLockHandler) AddLocks(locks map[string][]byte) (version string, err error) {
+	fake.addLocksMutex.Lock()
+	fake.addLocksArgsForCall = append(fake.addLocksArgsForCall, struct {
+		locks map[string][]byte
+	}{locks})
+	fake.addLocksMutex.Unlock()
+	if fake.AddLocksStub != nil {
+		return fake.AddLocksStub(locks)
+	} else {
+		return fake.addLocksReturns.result1, fake.addLocksReturns.result2
+	}
+}
+
+func (fake *FakeLockHandler) AddLocksCallCount() int {
+	fake.addLocksMutex.RLock()
+	defer fake.addLocksMutex.RUnlock()
+	return len(fake.addLocksArgsForCall)
+}
+
+func (fake *FakeLockHandler) AddLocksArgsForCall(i int) map[string][]byte {
+	fake.addLocksMutex.RLock()
+	defer fake.addLocksMutex.RUnlock()
+	return fake.addLocksArgsForCall[i].locks
+}
+
+func (fake *FakeLockHandler) AddLocksReturns(result1 string, result2 error) {
+	fake.AddLocksStub = nil
+	fake.addLocksReturns = struct {
+		result1 string
+		result2 error
+	}{result1, result2}
+}
+
 func (fake *FakeLockHandler) RemoveLock(lock string) (version string, err error) {
 	fake.removeLockMutex.Lock()
 	fake.removeLockArgsForCall = append(fake.removeLockArgsForCall, struct {
@@ -190,74 +530,1095 @@ func (fake *FakeLockHandler) RemoveLockReturns(result1 string, result2 error) {
 	}{result1, result2}
 }
 
-func (fake *FakeLockHandler) Setup() error {
-	fake.setupMutex.Lock()
-	fake.setupArgsForCall = append(fake.setupArgsForCall, struct{}{})
-	fake.setupMutex.Unlock()
-	if fake.SetupStub != nil {
-		return fake.SetupStub()
+func (fake *FakeLockHandler) RemoveLocks(locks map[string]string) (version string, err error) {
+	fake.removeLocksMutex.Lock()
+	fake.removeLocksArgsForCall = append(fake.removeLocksArgsForCall, struct {
+		locks map[string]string
+	}{locks})
+	fake.removeLocksMutex.Unlock()
+	if fake.RemoveLocksStub != nil {
+		return fake.RemoveLocksStub(locks)
 	} else {
-		return fake.setupReturns.result1
+		return fake.removeLocksReturns.result1, fake.removeLocksReturns.result2
 	}
 }
 
-func (fake *FakeLockHandler) SetupCallCount() int {
-	fake.setupMutex.RLock()
-	defer fake.setupMutex.RUnlock()
-	return len(fake.setupArgsForCall)
+func (fake *FakeLockHandler) RemoveLocksCallCount() int {
+	fake.removeLocksMutex.RLock()
+	defer fake.removeLocksMutex.RUnlock()
+	return len(fake.removeLocksArgsForCall)
 }
 
-func (fake *FakeLockHandler) SetupReturns(result1 error) {
-	fake.SetupStub = nil
-	fake.setupReturns = struct {
-		result1 error
-	}{result1}
+func (fake *FakeLockHandler) RemoveLocksArgsForCall(i int) map[string]string {
+	fake.removeLocksMutex.RLock()
+	defer fake.removeLocksMutex.RUnlock()
+	return fake.removeLocksArgsForCall[i].locks
 }
 
-func (fake *FakeLockHandler) BroadcastLockPool() error {
-	fake.broadcastLockPoolMutex.Lock()
-	fake.broadcastLockPoolArgsForCall = append(fake.broadcastLockPoolArgsForCall, struct{}{})
-	fake.broadcastLockPoolMutex.Unlock()
-	if fake.BroadcastLockPoolStub != nil {
-		return fake.BroadcastLockPoolStub()
+func (fake *FakeLockHandler) RemoveLocksReturns(result1 string, result2 error) {
+	fake.RemoveLocksStub = nil
+	fake.removeLocksReturns = struct {
+		result1 string
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeLockHandler) DisableLock(lock string) (version string, err error) {
+	fake.disableLockMutex.Lock()
+	fake.disableLockArgsForCall = append(fake.disableLockArgsForCall, struct {
+		lock string
+	}{lock})
+	fake.disableLockMutex.Unlock()
+	if fake.DisableLockStub != nil {
+		return fake.DisableLockStub(lock)
 	} else {
-		return fake.broadcastLockPoolReturns.result1
+		return fake.disableLockReturns.result1, fake.disableLockReturns.result2
 	}
 }
 
-func (fake *FakeLockHandler) BroadcastLockPoolCallCount() int {
-	fake.broadcastLockPoolMutex.RLock()
-	defer fake.broadcastLockPoolMutex.RUnlock()
-	return len(fake.broadcastLockPoolArgsForCall)
+func (fake *FakeLockHandler) DisableLockCallCount() int {
+	fake.disableLockMutex.RLock()
+	defer fake.disableLockMutex.RUnlock()
+	return len(fake.disableLockArgsForCall)
 }
 
-func (fake *FakeLockHandler) BroadcastLockPoolReturns(result1 error) {
-	fake.BroadcastLockPoolStub = nil
-	fake.broadcastLockPoolReturns = struct {
-		result1 error
-	}{result1}
+func (fake *FakeLockHandler) DisableLockArgsForCall(i int) string {
+	fake.disableLockMutex.RLock()
+	defer fake.disableLockMutex.RUnlock()
+	return fake.disableLockArgsForCall[i].lock
 }
 
-func (fake *FakeLockHandler) ResetLock() error {
-	fake.resetLockMutex.Lock()
-	fake.resetLockArgsForCall = append(fake.resetLockArgsForCall, struct{}{})
-	fake.resetLockMutex.Unlock()
-	if fake.ResetLockStub != nil {
-		return fake.ResetLockStub()
+func (fake *FakeLockHandler) DisableLockReturns(result1 string, result2 error) {
+	fake.DisableLockStub = nil
+	fake.disableLockReturns = struct {
+		result1 string
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeLockHandler) EnableLock(lock string) (version string, err error) {
+	fake.enableLockMutex.Lock()
+	fake.enableLockArgsForCall = append(fake.enableLockArgsForCall, struct {
+		lock string
+	}{lock})
+	fake.enableLockMutex.Unlock()
+	if fake.EnableLockStub != nil {
+		return fake.EnableLockStub(lock)
 	} else {
-		return fake.resetLockReturns.result1
+		return fake.enableLockReturns.result1, fake.enableLockReturns.result2
 	}
 }
 
-func (fake *FakeLockHandler) ResetLockCallCount() int {
-	fake.resetLockMutex.RLock()
-	defer fake.resetLockMutex.RUnlock()
-	return len(fake.resetLockArgsForCall)
+func (fake *FakeLockHandler) EnableLockCallCount() int {
+	fake.enableLockMutex.RLock()
+	defer fake.enableLockMutex.RUnlock()
+	return len(fake.enableLockArgsForCall)
 }
 
-func (fake *FakeLockHandler) ResetLockReturns(result1 error) {
-	fake.ResetLockStub = nil
-	fake.resetLockReturns = struct {
+func (fake *FakeLockHandler) EnableLockArgsForCall(i int) string {
+	fake.enableLockMutex.RLock()
+	defer fake.enableLockMutex.RUnlock()
+	return fake.enableLockArgsForCall[i].lock
+}
+
+func (fake *FakeLockHandler) EnableLockReturns(result1 string, result2 error) {
+	fake.EnableLockStub = nil
+	fake.enableLockReturns = struct {
+		result1 string
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeLockHandler) QuarantineLock(lock string, reason string) (version string, err error) {
+	fake.quarantineLockMutex.Lock()
+	fake.quarantineLockArgsForCall = append(fake.quarantineLockArgsForCall, struct {
+		lock   string
+		reason string
+	}{lock, reason})
+	fake.quarantineLockMutex.Unlock()
+	if fake.QuarantineLockStub != nil {
+		return fake.QuarantineLockStub(lock, reason)
+	} else {
+		return fake.quarantineLockReturns.result1, fake.quarantineLockReturns.result2
+	}
+}
+
+func (fake *FakeLockHandler) QuarantineLockCallCount() int {
+	fake.quarantineLockMutex.RLock()
+	defer fake.quarantineLockMutex.RUnlock()
+	return len(fake.quarantineLockArgsForCall)
+}
+
+func (fake *FakeLockHandler) QuarantineLockArgsForCall(i int) (string, string) {
+	fake.quarantineLockMutex.RLock()
+	defer fake.quarantineLockMutex.RUnlock()
+	return fake.quarantineLockArgsForCall[i].lock, fake.quarantineLockArgsForCall[i].reason
+}
+
+func (fake *FakeLockHandler) QuarantineLockReturns(result1 string, result2 error) {
+	fake.QuarantineLockStub = nil
+	fake.quarantineLockReturns = struct {
+		result1 string
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeLockHandler) ForceUnclaimLock(lock string, state string) (version string, err error) {
+	fake.forceUnclaimLockMutex.Lock()
+	fake.forceUnclaimLockArgsForCall = append(fake.forceUnclaimLockArgsForCall, struct {
+		lock  string
+		state string
+	}{lock, state})
+	fake.forceUnclaimLockMutex.Unlock()
+	if fake.ForceUnclaimLockStub != nil {
+		return fake.ForceUnclaimLockStub(lock, state)
+	} else {
+		return fake.forceUnclaimLockReturns.result1, fake.forceUnclaimLockReturns.result2
+	}
+}
+
+func (fake *FakeLockHandler) ForceUnclaimLockCallCount() int {
+	fake.forceUnclaimLockMutex.RLock()
+	defer fake.forceUnclaimLockMutex.RUnlock()
+	return len(fake.forceUnclaimLockArgsForCall)
+}
+
+func (fake *FakeLockHandler) ForceUnclaimLockArgsForCall(i int) (string, string) {
+	fake.forceUnclaimLockMutex.RLock()
+	defer fake.forceUnclaimLockMutex.RUnlock()
+	return fake.forceUnclaimLockArgsForCall[i].lock, fake.forceUnclaimLockArgsForCall[i].state
+}
+
+func (fake *FakeLockHandler) ForceUnclaimLockReturns(result1 string, result2 error) {
+	fake.ForceUnclaimLockStub = nil
+	fake.forceUnclaimLockReturns = struct {
+		result1 string
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeLockHandler) RenameLock(from string, to string, state string) (version string, err error) {
+	fake.renameLockMutex.Lock()
+	fake.renameLockArgsForCall = append(fake.renameLockArgsForCall, struct {
+		from  string
+		to    string
+		state string
+	}{from, to, state})
+	fake.renameLockMutex.Unlock()
+	if fake.RenameLockStub != nil {
+		return fake.RenameLockStub(from, to, state)
+	} else {
+		return fake.renameLockReturns.result1, fake.renameLockReturns.result2
+	}
+}
+
+func (fake *FakeLockHandler) RenameLockCallCount() int {
+	fake.renameLockMutex.RLock()
+	defer fake.renameLockMutex.RUnlock()
+	return len(fake.renameLockArgsForCall)
+}
+
+func (fake *FakeLockHandler) RenameLockArgsForCall(i int) (string, string, string) {
+	fake.renameLockMutex.RLock()
+	defer fake.renameLockMutex.RUnlock()
+	return fake.renameLockArgsForCall[i].from, fake.renameLockArgsForCall[i].to, fake.renameLockArgsForCall[i].state
+}
+
+func (fake *FakeLockHandler) RenameLockReturns(result1 string, result2 error) {
+	fake.RenameLockStub = nil
+	fake.renameLockReturns = struct {
+		result1 string
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeLockHandler) ImportLock(state string, lock string, contents []byte) (version string, err error) {
+	fake.importLockMutex.Lock()
+	fake.importLockArgsForCall = append(fake.importLockArgsForCall, struct {
+		state    string
+		lock     string
+		contents []byte
+	}{state, lock, contents})
+	fake.importLockMutex.Unlock()
+	if fake.ImportLockStub != nil {
+		return fake.ImportLockStub(state, lock, contents)
+	} else {
+		return fake.importLockReturns.result1, fake.importLockReturns.result2
+	}
+}
+
+func (fake *FakeLockHandler) ImportLockCallCount() int {
+	fake.importLockMutex.RLock()
+	defer fake.importLockMutex.RUnlock()
+	return len(fake.importLockArgsForCall)
+}
+
+func (fake *FakeLockHandler) ImportLockArgsForCall(i int) (string, string, []byte) {
+	fake.importLockMutex.RLock()
+	defer fake.importLockMutex.RUnlock()
+	return fake.importLockArgsForCall[i].state, fake.importLockArgsForCall[i].lock, fake.importLockArgsForCall[i].contents
+}
+
+func (fake *FakeLockHandler) ImportLockReturns(result1 string, result2 error) {
+	fake.ImportLockStub = nil
+	fake.importLockReturns = struct {
+		result1 string
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeLockHandler) ReserveLock(until time.Time) (lock string, version string, err error) {
+	fake.reserveLockMutex.Lock()
+	fake.reserveLockArgsForCall = append(fake.reserveLockArgsForCall, struct {
+		until time.Time
+	}{until})
+	fake.reserveLockMutex.Unlock()
+	if fake.ReserveLockStub != nil {
+		return fake.ReserveLockStub(until)
+	} else {
+		return fake.reserveLockReturns.result1, fake.reserveLockReturns.result2, fake.reserveLockReturns.result3
+	}
+}
+
+func (fake *FakeLockHandler) ReserveLockCallCount() int {
+	fake.reserveLockMutex.RLock()
+	defer fake.reserveLockMutex.RUnlock()
+	return len(fake.reserveLockArgsForCall)
+}
+
+func (fake *FakeLockHandler) ReserveLockArgsForCall(i int) time.Time {
+	fake.reserveLockMutex.RLock()
+	defer fake.reserveLockMutex.RUnlock()
+	return fake.reserveLockArgsForCall[i].until
+}
+
+func (fake *FakeLockHandler) ReserveLockReturns(result1 string, result2 string, result3 error) {
+	fake.ReserveLockStub = nil
+	fake.reserveLockReturns = struct {
+		result1 string
+		result2 string
+		result3 error
+	}{result1, result2, result3}
+}
+
+func (fake *FakeLockHandler) ConfirmLock(lock string) (version string, err error) {
+	fake.confirmLockMutex.Lock()
+	fake.confirmLockArgsForCall = append(fake.confirmLockArgsForCall, struct {
+		lock string
+	}{lock})
+	fake.confirmLockMutex.Unlock()
+	if fake.ConfirmLockStub != nil {
+		return fake.ConfirmLockStub(lock)
+	} else {
+		return fake.confirmLockReturns.result1, fake.confirmLockReturns.result2
+	}
+}
+
+func (fake *FakeLockHandler) ConfirmLockCallCount() int {
+	fake.confirmLockMutex.RLock()
+	defer fake.confirmLockMutex.RUnlock()
+	return len(fake.confirmLockArgsForCall)
+}
+
+func (fake *FakeLockHandler) ConfirmLockArgsForCall(i int) string {
+	fake.confirmLockMutex.RLock()
+	defer fake.confirmLockMutex.RUnlock()
+	return fake.confirmLockArgsForCall[i].lock
+}
+
+func (fake *FakeLockHandler) ConfirmLockReturns(result1 string, result2 error) {
+	fake.ConfirmLockStub = nil
+	fake.confirmLockReturns = struct {
+		result1 string
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeLockHandler) LapseReservation(lock string) (version string, err error) {
+	fake.lapseReservationMutex.Lock()
+	fake.lapseReservationArgsForCall = append(fake.lapseReservationArgsForCall, struct {
+		lock string
+	}{lock})
+	fake.lapseReservationMutex.Unlock()
+	if fake.LapseReservationStub != nil {
+		return fake.LapseReservationStub(lock)
+	} else {
+		return fake.lapseReservationReturns.result1, fake.lapseReservationReturns.result2
+	}
+}
+
+func (fake *FakeLockHandler) LapseReservationCallCount() int {
+	fake.lapseReservationMutex.RLock()
+	defer fake.lapseReservationMutex.RUnlock()
+	return len(fake.lapseReservationArgsForCall)
+}
+
+func (fake *FakeLockHandler) LapseReservationArgsForCall(i int) string {
+	fake.lapseReservationMutex.RLock()
+	defer fake.lapseReservationMutex.RUnlock()
+	return fake.lapseReservationArgsForCall[i].lock
+}
+
+func (fake *FakeLockHandler) LapseReservationReturns(result1 string, result2 error) {
+	fake.LapseReservationStub = nil
+	fake.lapseReservationReturns = struct {
+		result1 string
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeLockHandler) ReservationExpiry(lock string) (until time.Time, err error) {
+	fake.reservationExpiryMutex.Lock()
+	fake.reservationExpiryArgsForCall = append(fake.reservationExpiryArgsForCall, struct {
+		lock string
+	}{lock})
+	fake.reservationExpiryMutex.Unlock()
+	if fake.ReservationExpiryStub != nil {
+		return fake.ReservationExpiryStub(lock)
+	} else {
+		return fake.reservationExpiryReturns.result1, fake.reservationExpiryReturns.result2
+	}
+}
+
+func (fake *FakeLockHandler) ReservationExpiryCallCount() int {
+	fake.reservationExpiryMutex.RLock()
+	defer fake.reservationExpiryMutex.RUnlock()
+	return len(fake.reservationExpiryArgsForCall)
+}
+
+func (fake *FakeLockHandler) ReservationExpiryArgsForCall(i int) string {
+	fake.reservationExpiryMutex.RLock()
+	defer fake.reservationExpiryMutex.RUnlock()
+	return fake.reservationExpiryArgsForCall[i].lock
+}
+
+func (fake *FakeLockHandler) ReservationExpiryReturns(result1 time.Time, result2 error) {
+	fake.ReservationExpiryStub = nil
+	fake.reservationExpiryReturns = struct {
+		result1 time.Time
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeLockHandler) FencingToken(lock string) (token int, err error) {
+	fake.fencingTokenMutex.Lock()
+	fake.fencingTokenArgsForCall = append(fake.fencingTokenArgsForCall, struct {
+		lock string
+	}{lock})
+	fake.fencingTokenMutex.Unlock()
+	if fake.FencingTokenStub != nil {
+		return fake.FencingTokenStub(lock)
+	} else {
+		return fake.fencingTokenReturns.result1, fake.fencingTokenReturns.result2
+	}
+}
+
+func (fake *FakeLockHandler) FencingTokenCallCount() int {
+	fake.fencingTokenMutex.RLock()
+	defer fake.fencingTokenMutex.RUnlock()
+	return len(fake.fencingTokenArgsForCall)
+}
+
+func (fake *FakeLockHandler) FencingTokenArgsForCall(i int) string {
+	fake.fencingTokenMutex.RLock()
+	defer fake.fencingTokenMutex.RUnlock()
+	return fake.fencingTokenArgsForCall[i].lock
+}
+
+func (fake *FakeLockHandler) FencingTokenReturns(result1 int, result2 error) {
+	fake.FencingTokenStub = nil
+	fake.fencingTokenReturns = struct {
+		result1 int
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeLockHandler) LeaseLock(until func(lock string) time.Time) (lock string, version string, err error) {
+	fake.leaseLockMutex.Lock()
+	fake.leaseLockArgsForCall = append(fake.leaseLockArgsForCall, struct {
+		until func(lock string) time.Time
+	}{until})
+	fake.leaseLockMutex.Unlock()
+	if fake.LeaseLockStub != nil {
+		return fake.LeaseLockStub(until)
+	} else {
+		return fake.leaseLockReturns.result1, fake.leaseLockReturns.result2, fake.leaseLockReturns.result3
+	}
+}
+
+func (fake *FakeLockHandler) LeaseLockCallCount() int {
+	fake.leaseLockMutex.RLock()
+	defer fake.leaseLockMutex.RUnlock()
+	return len(fake.leaseLockArgsForCall)
+}
+
+func (fake *FakeLockHandler) LeaseLockArgsForCall(i int) func(lock string) time.Time {
+	fake.leaseLockMutex.RLock()
+	defer fake.leaseLockMutex.RUnlock()
+	return fake.leaseLockArgsForCall[i].until
+}
+
+func (fake *FakeLockHandler) LeaseLockReturns(result1 string, result2 string, result3 error) {
+	fake.LeaseLockStub = nil
+	fake.leaseLockReturns = struct {
+		result1 string
+		result2 string
+		result3 error
+	}{result1, result2, result3}
+}
+
+func (fake *FakeLockHandler) RenewLease(lock string, until time.Time) (version string, err error) {
+	fake.renewLeaseMutex.Lock()
+	fake.renewLeaseArgsForCall = append(fake.renewLeaseArgsForCall, struct {
+		lock  string
+		until time.Time
+	}{lock, until})
+	fake.renewLeaseMutex.Unlock()
+	if fake.RenewLeaseStub != nil {
+		return fake.RenewLeaseStub(lock, until)
+	} else {
+		return fake.renewLeaseReturns.result1, fake.renewLeaseReturns.result2
+	}
+}
+
+func (fake *FakeLockHandler) RenewLeaseCallCount() int {
+	fake.renewLeaseMutex.RLock()
+	defer fake.renewLeaseMutex.RUnlock()
+	return len(fake.renewLeaseArgsForCall)
+}
+
+func (fake *FakeLockHandler) RenewLeaseArgsForCall(i int) (string, time.Time) {
+	fake.renewLeaseMutex.RLock()
+	defer fake.renewLeaseMutex.RUnlock()
+	return fake.renewLeaseArgsForCall[i].lock, fake.renewLeaseArgsForCall[i].until
+}
+
+func (fake *FakeLockHandler) RenewLeaseReturns(result1 string, result2 error) {
+	fake.RenewLeaseStub = nil
+	fake.renewLeaseReturns = struct {
+		result1 string
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeLockHandler) TransferLock(lock string, until time.Time) (version string, err error) {
+	fake.transferLockMutex.Lock()
+	fake.transferLockArgsForCall = append(fake.transferLockArgsForCall, struct {
+		lock  string
+		until time.Time
+	}{lock, until})
+	fake.transferLockMutex.Unlock()
+	if fake.TransferLockStub != nil {
+		return fake.TransferLockStub(lock, until)
+	} else {
+		return fake.transferLockReturns.result1, fake.transferLockReturns.result2
+	}
+}
+
+func (fake *FakeLockHandler) TransferLockCallCount() int {
+	fake.transferLockMutex.RLock()
+	defer fake.transferLockMutex.RUnlock()
+	return len(fake.transferLockArgsForCall)
+}
+
+func (fake *FakeLockHandler) TransferLockArgsForCall(i int) (string, time.Time) {
+	fake.transferLockMutex.RLock()
+	defer fake.transferLockMutex.RUnlock()
+	return fake.transferLockArgsForCall[i].lock, fake.transferLockArgsForCall[i].until
+}
+
+func (fake *FakeLockHandler) TransferLockReturns(result1 string, result2 error) {
+	fake.TransferLockStub = nil
+	fake.transferLockReturns = struct {
+		result1 string
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeLockHandler) PausePool(reason string) (version string, err error) {
+	fake.pausePoolMutex.Lock()
+	fake.pausePoolArgsForCall = append(fake.pausePoolArgsForCall, struct {
+		reason string
+	}{reason})
+	fake.pausePoolMutex.Unlock()
+	if fake.PausePoolStub != nil {
+		return fake.PausePoolStub(reason)
+	} else {
+		return fake.pausePoolReturns.result1, fake.pausePoolReturns.result2
+	}
+}
+
+func (fake *FakeLockHandler) PausePoolCallCount() int {
+	fake.pausePoolMutex.RLock()
+	defer fake.pausePoolMutex.RUnlock()
+	return len(fake.pausePoolArgsForCall)
+}
+
+func (fake *FakeLockHandler) PausePoolArgsForCall(i int) string {
+	fake.pausePoolMutex.RLock()
+	defer fake.pausePoolMutex.RUnlock()
+	return fake.pausePoolArgsForCall[i].reason
+}
+
+func (fake *FakeLockHandler) PausePoolReturns(result1 string, result2 error) {
+	fake.PausePoolStub = nil
+	fake.pausePoolReturns = struct {
+		result1 string
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeLockHandler) UnpausePool() (version string, err error) {
+	fake.unpausePoolMutex.Lock()
+	fake.unpausePoolArgsForCall = append(fake.unpausePoolArgsForCall, struct{}{})
+	fake.unpausePoolMutex.Unlock()
+	if fake.UnpausePoolStub != nil {
+		return fake.UnpausePoolStub()
+	} else {
+		return fake.unpausePoolReturns.result1, fake.unpausePoolReturns.result2
+	}
+}
+
+func (fake *FakeLockHandler) UnpausePoolCallCount() int {
+	fake.unpausePoolMutex.RLock()
+	defer fake.unpausePoolMutex.RUnlock()
+	return len(fake.unpausePoolArgsForCall)
+}
+
+func (fake *FakeLockHandler) UnpausePoolReturns(result1 string, result2 error) {
+	fake.UnpausePoolStub = nil
+	fake.unpausePoolReturns = struct {
+		result1 string
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeLockHandler) DestroyPool() (version string, err error) {
+	fake.destroyPoolMutex.Lock()
+	fake.destroyPoolArgsForCall = append(fake.destroyPoolArgsForCall, struct{}{})
+	fake.destroyPoolMutex.Unlock()
+	if fake.DestroyPoolStub != nil {
+		return fake.DestroyPoolStub()
+	} else {
+		return fake.destroyPoolReturns.result1, fake.destroyPoolReturns.result2
+	}
+}
+
+func (fake *FakeLockHandler) DestroyPoolCallCount() int {
+	fake.destroyPoolMutex.RLock()
+	defer fake.destroyPoolMutex.RUnlock()
+	return len(fake.destroyPoolArgsForCall)
+}
+
+func (fake *FakeLockHandler) DestroyPoolReturns(result1 string, result2 error) {
+	fake.DestroyPoolStub = nil
+	fake.destroyPoolReturns = struct {
+		result1 string
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeLockHandler) PoolPaused() (paused bool, err error) {
+	fake.poolPausedMutex.Lock()
+	fake.poolPausedArgsForCall = append(fake.poolPausedArgsForCall, struct{}{})
+	fake.poolPausedMutex.Unlock()
+	if fake.PoolPausedStub != nil {
+		return fake.PoolPausedStub()
+	} else {
+		return fake.poolPausedReturns.result1, fake.poolPausedReturns.result2
+	}
+}
+
+func (fake *FakeLockHandler) PoolPausedCallCount() int {
+	fake.poolPausedMutex.RLock()
+	defer fake.poolPausedMutex.RUnlock()
+	return len(fake.poolPausedArgsForCall)
+}
+
+func (fake *FakeLockHandler) PoolPausedReturns(result1 bool, result2 error) {
+	fake.PoolPausedStub = nil
+	fake.poolPausedReturns = struct {
+		result1 bool
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeLockHandler) Head() (version string, err error) {
+	fake.headMutex.Lock()
+	fake.headArgsForCall = append(fake.headArgsForCall, struct{}{})
+	fake.headMutex.Unlock()
+	if fake.HeadStub != nil {
+		return fake.HeadStub()
+	} else {
+		return fake.headReturns.result1, fake.headReturns.result2
+	}
+}
+
+func (fake *FakeLockHandler) HeadCallCount() int {
+	fake.headMutex.RLock()
+	defer fake.headMutex.RUnlock()
+	return len(fake.headArgsForCall)
+}
+
+func (fake *FakeLockHandler) HeadReturns(result1 string, result2 error) {
+	fake.HeadStub = nil
+	fake.headReturns = struct {
+		result1 string
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeLockHandler) RevertCommit(ref string) (version string, reverted string, err error) {
+	fake.revertCommitMutex.Lock()
+	fake.revertCommitArgsForCall = append(fake.revertCommitArgsForCall, struct {
+		ref string
+	}{ref})
+	fake.revertCommitMutex.Unlock()
+	if fake.RevertCommitStub != nil {
+		return fake.RevertCommitStub(ref)
+	} else {
+		return fake.revertCommitReturns.result1, fake.revertCommitReturns.result2, fake.revertCommitReturns.result3
+	}
+}
+
+func (fake *FakeLockHandler) RevertCommitCallCount() int {
+	fake.revertCommitMutex.RLock()
+	defer fake.revertCommitMutex.RUnlock()
+	return len(fake.revertCommitArgsForCall)
+}
+
+func (fake *FakeLockHandler) RevertCommitArgsForCall(i int) string {
+	fake.revertCommitMutex.RLock()
+	defer fake.revertCommitMutex.RUnlock()
+	return fake.revertCommitArgsForCall[i].ref
+}
+
+func (fake *FakeLockHandler) RevertCommitReturns(result1 string, result2 string, result3 error) {
+	fake.RevertCommitStub = nil
+	fake.revertCommitReturns = struct {
+		result1 string
+		result2 string
+		result3 error
+	}{result1, result2, result3}
+}
+
+func (fake *FakeLockHandler) SquashHistory(before time.Time) (version string, squashed int, err error) {
+	fake.squashHistoryMutex.Lock()
+	fake.squashHistoryArgsForCall = append(fake.squashHistoryArgsForCall, struct {
+		before time.Time
+	}{before})
+	fake.squashHistoryMutex.Unlock()
+	if fake.SquashHistoryStub != nil {
+		return fake.SquashHistoryStub(before)
+	} else {
+		return fake.squashHistoryReturns.result1, fake.squashHistoryReturns.result2, fake.squashHistoryReturns.result3
+	}
+}
+
+func (fake *FakeLockHandler) SquashHistoryCallCount() int {
+	fake.squashHistoryMutex.RLock()
+	defer fake.squashHistoryMutex.RUnlock()
+	return len(fake.squashHistoryArgsForCall)
+}
+
+func (fake *FakeLockHandler) SquashHistoryArgsForCall(i int) time.Time {
+	fake.squashHistoryMutex.RLock()
+	defer fake.squashHistoryMutex.RUnlock()
+	return fake.squashHistoryArgsForCall[i].before
+}
+
+func (fake *FakeLockHandler) SquashHistoryReturns(result1 string, result2 int, result3 error) {
+	fake.SquashHistoryStub = nil
+	fake.squashHistoryReturns = struct {
+		result1 string
+		result2 int
+		result3 error
+	}{result1, result2, result3}
+}
+
+func (fake *FakeLockHandler) ReapLease(lock string) (version string, err error) {
+	fake.reapLeaseMutex.Lock()
+	fake.reapLeaseArgsForCall = append(fake.reapLeaseArgsForCall, struct {
+		lock string
+	}{lock})
+	fake.reapLeaseMutex.Unlock()
+	if fake.ReapLeaseStub != nil {
+		return fake.ReapLeaseStub(lock)
+	} else {
+		return fake.reapLeaseReturns.result1, fake.reapLeaseReturns.result2
+	}
+}
+
+func (fake *FakeLockHandler) ReapLeaseCallCount() int {
+	fake.reapLeaseMutex.RLock()
+	defer fake.reapLeaseMutex.RUnlock()
+	return len(fake.reapLeaseArgsForCall)
+}
+
+func (fake *FakeLockHandler) ReapLeaseArgsForCall(i int) string {
+	fake.reapLeaseMutex.RLock()
+	defer fake.reapLeaseMutex.RUnlock()
+	return fake.reapLeaseArgsForCall[i].lock
+}
+
+func (fake *FakeLockHandler) ReapLeaseReturns(result1 string, result2 error) {
+	fake.ReapLeaseStub = nil
+	fake.reapLeaseReturns = struct {
+		result1 string
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeLockHandler) LeaseExpiry(lock string) (until time.Time, err error) {
+	fake.leaseExpiryMutex.Lock()
+	fake.leaseExpiryArgsForCall = append(fake.leaseExpiryArgsForCall, struct {
+		lock string
+	}{lock})
+	fake.leaseExpiryMutex.Unlock()
+	if fake.LeaseExpiryStub != nil {
+		return fake.LeaseExpiryStub(lock)
+	} else {
+		return fake.leaseExpiryReturns.result1, fake.leaseExpiryReturns.result2
+	}
+}
+
+func (fake *FakeLockHandler) LeaseExpiryCallCount() int {
+	fake.leaseExpiryMutex.RLock()
+	defer fake.leaseExpiryMutex.RUnlock()
+	return len(fake.leaseExpiryArgsForCall)
+}
+
+func (fake *FakeLockHandler) LeaseExpiryArgsForCall(i int) string {
+	fake.leaseExpiryMutex.RLock()
+	defer fake.leaseExpiryMutex.RUnlock()
+	return fake.leaseExpiryArgsForCall[i].lock
+}
+
+func (fake *FakeLockHandler) LeaseExpiryReturns(result1 time.Time, result2 error) {
+	fake.LeaseExpiryStub = nil
+	fake.leaseExpiryReturns = struct {
+		result1 time.Time
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeLockHandler) WriteExpiry(state string, lock string, until time.Time) error {
+	fake.writeExpiryMutex.Lock()
+	fake.writeExpiryArgsForCall = append(fake.writeExpiryArgsForCall, struct {
+		state string
+		lock  string
+		until time.Time
+	}{state, lock, until})
+	fake.writeExpiryMutex.Unlock()
+	if fake.WriteExpiryStub != nil {
+		return fake.WriteExpiryStub(state, lock, until)
+	} else {
+		return fake.writeExpiryReturns.result1
+	}
+}
+
+func (fake *FakeLockHandler) WriteExpiryCallCount() int {
+	fake.writeExpiryMutex.RLock()
+	defer fake.writeExpiryMutex.RUnlock()
+	return len(fake.writeExpiryArgsForCall)
+}
+
+func (fake *FakeLockHandler) WriteExpiryArgsForCall(i int) (string, string, time.Time) {
+	fake.writeExpiryMutex.RLock()
+	defer fake.writeExpiryMutex.RUnlock()
+	return fake.writeExpiryArgsForCall[i].state, fake.writeExpiryArgsForCall[i].lock, fake.writeExpiryArgsForCall[i].until
+}
+
+func (fake *FakeLockHandler) WriteExpiryReturns(result1 error) {
+	fake.WriteExpiryStub = nil
+	fake.writeExpiryReturns = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *FakeLockHandler) WriteFencingToken(lock string, token int) error {
+	fake.writeFencingTokenMutex.Lock()
+	fake.writeFencingTokenArgsForCall = append(fake.writeFencingTokenArgsForCall, struct {
+		lock  string
+		token int
+	}{lock, token})
+	fake.writeFencingTokenMutex.Unlock()
+	if fake.WriteFencingTokenStub != nil {
+		return fake.WriteFencingTokenStub(lock, token)
+	} else {
+		return fake.writeFencingTokenReturns.result1
+	}
+}
+
+func (fake *FakeLockHandler) WriteFencingTokenCallCount() int {
+	fake.writeFencingTokenMutex.RLock()
+	defer fake.writeFencingTokenMutex.RUnlock()
+	return len(fake.writeFencingTokenArgsForCall)
+}
+
+func (fake *FakeLockHandler) WriteFencingTokenArgsForCall(i int) (string, int) {
+	fake.writeFencingTokenMutex.RLock()
+	defer fake.writeFencingTokenMutex.RUnlock()
+	return fake.writeFencingTokenArgsForCall[i].lock, fake.writeFencingTokenArgsForCall[i].token
+}
+
+func (fake *FakeLockHandler) WriteFencingTokenReturns(result1 error) {
+	fake.WriteFencingTokenStub = nil
+	fake.writeFencingTokenReturns = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *FakeLockHandler) ListLocks(state string) (locks []string, err error) {
+	fake.listLocksMutex.Lock()
+	fake.listLocksArgsForCall = append(fake.listLocksArgsForCall, struct {
+		state string
+	}{state})
+	fake.listLocksMutex.Unlock()
+	if fake.ListLocksStub != nil {
+		return fake.ListLocksStub(state)
+	} else {
+		return fake.listLocksReturns.result1, fake.listLocksReturns.result2
+	}
+}
+
+func (fake *FakeLockHandler) ListLocksCallCount() int {
+	fake.listLocksMutex.RLock()
+	defer fake.listLocksMutex.RUnlock()
+	return len(fake.listLocksArgsForCall)
+}
+
+func (fake *FakeLockHandler) ListLocksArgsForCall(i int) string {
+	fake.listLocksMutex.RLock()
+	defer fake.listLocksMutex.RUnlock()
+	return fake.listLocksArgsForCall[i].state
+}
+
+func (fake *FakeLockHandler) ListLocksReturns(result1 []string, result2 error) {
+	fake.ListLocksStub = nil
+	fake.listLocksReturns = struct {
+		result1 []string
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeLockHandler) ReadLock(state string, lock string) (contents []byte, err error) {
+	fake.readLockMutex.Lock()
+	fake.readLockArgsForCall = append(fake.readLockArgsForCall, struct {
+		state string
+		lock  string
+	}{state, lock})
+	fake.readLockMutex.Unlock()
+	if fake.ReadLockStub != nil {
+		return fake.ReadLockStub(state, lock)
+	} else {
+		return fake.readLockReturns.result1, fake.readLockReturns.result2
+	}
+}
+
+func (fake *FakeLockHandler) ReadLockCallCount() int {
+	fake.readLockMutex.RLock()
+	defer fake.readLockMutex.RUnlock()
+	return len(fake.readLockArgsForCall)
+}
+
+func (fake *FakeLockHandler) ReadLockArgsForCall(i int) (string, string) {
+	fake.readLockMutex.RLock()
+	defer fake.readLockMutex.RUnlock()
+	return fake.readLockArgsForCall[i].state, fake.readLockArgsForCall[i].lock
+}
+
+func (fake *FakeLockHandler) ReadLockReturns(result1 []byte, result2 error) {
+	fake.ReadLockStub = nil
+	fake.readLockReturns = struct {
+		result1 []byte
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeLockHandler) ClaimPipeline(lock string) (pipeline string, err error) {
+	fake.claimPipelineMutex.Lock()
+	fake.claimPipelineArgsForCall = append(fake.claimPipelineArgsForCall, struct {
+		lock string
+	}{lock})
+	fake.claimPipelineMutex.Unlock()
+	if fake.ClaimPipelineStub != nil {
+		return fake.ClaimPipelineStub(lock)
+	} else {
+		return fake.claimPipelineReturns.result1, fake.claimPipelineReturns.result2
+	}
+}
+
+func (fake *FakeLockHandler) ClaimPipelineCallCount() int {
+	fake.claimPipelineMutex.RLock()
+	defer fake.claimPipelineMutex.RUnlock()
+	return len(fake.claimPipelineArgsForCall)
+}
+
+func (fake *FakeLockHandler) ClaimPipelineArgsForCall(i int) string {
+	fake.claimPipelineMutex.RLock()
+	defer fake.claimPipelineMutex.RUnlock()
+	return fake.claimPipelineArgsForCall[i].lock
+}
+
+func (fake *FakeLockHandler) ClaimPipelineReturns(result1 string, result2 error) {
+	fake.ClaimPipelineStub = nil
+	fake.claimPipelineReturns = struct {
+		result1 string
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeLockHandler) ReadSchema() (schema []byte, err error) {
+	fake.readSchemaMutex.Lock()
+	fake.readSchemaArgsForCall = append(fake.readSchemaArgsForCall, struct{}{})
+	fake.readSchemaMutex.Unlock()
+	if fake.ReadSchemaStub != nil {
+		return fake.ReadSchemaStub()
+	} else {
+		return fake.readSchemaReturns.result1, fake.readSchemaReturns.result2
+	}
+}
+
+func (fake *FakeLockHandler) ReadSchemaCallCount() int {
+	fake.readSchemaMutex.RLock()
+	defer fake.readSchemaMutex.RUnlock()
+	return len(fake.readSchemaArgsForCall)
+}
+
+func (fake *FakeLockHandler) ReadSchemaReturns(result1 []byte, result2 error) {
+	fake.ReadSchemaStub = nil
+	fake.readSchemaReturns = struct {
+		result1 []byte
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeLockHandler) AuditLog(lock string) (notes []out.AuditNote, err error) {
+	fake.auditLogMutex.Lock()
+	fake.auditLogArgsForCall = append(fake.auditLogArgsForCall, struct {
+		lock string
+	}{lock})
+	fake.auditLogMutex.Unlock()
+	if fake.AuditLogStub != nil {
+		return fake.AuditLogStub(lock)
+	} else {
+		return fake.auditLogReturns.result1, fake.auditLogReturns.result2
+	}
+}
+
+func (fake *FakeLockHandler) AuditLogCallCount() int {
+	fake.auditLogMutex.RLock()
+	defer fake.auditLogMutex.RUnlock()
+	return len(fake.auditLogArgsForCall)
+}
+
+func (fake *FakeLockHandler) AuditLogArgsForCall(i int) string {
+	fake.auditLogMutex.RLock()
+	defer fake.auditLogMutex.RUnlock()
+	return fake.auditLogArgsForCall[i].lock
+}
+
+func (fake *FakeLockHandler) AuditLogReturns(result1 []out.AuditNote, result2 error) {
+	fake.AuditLogStub = nil
+	fake.auditLogReturns = struct {
+		result1 []out.AuditNote
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeLockHandler) Setup() error {
+	fake.setupMutex.Lock()
+	fake.setupArgsForCall = append(fake.setupArgsForCall, struct{}{})
+	fake.setupMutex.Unlock()
+	if fake.SetupStub != nil {
+		return fake.SetupStub()
+	} else {
+		return fake.setupReturns.result1
+	}
+}
+
+func (fake *FakeLockHandler) SetupCallCount() int {
+	fake.setupMutex.RLock()
+	defer fake.setupMutex.RUnlock()
+	return len(fake.setupArgsForCall)
+}
+
+func (fake *FakeLockHandler) SetupReturns(result1 error) {
+	fake.SetupStub = nil
+	fake.setupReturns = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *FakeLockHandler) BroadcastLockPool() error {
+	fake.broadcastLockPoolMutex.Lock()
+	fake.broadcastLockPoolArgsForCall = append(fake.broadcastLockPoolArgsForCall, struct{}{})
+	fake.broadcastLockPoolMutex.Unlock()
+	if fake.BroadcastLockPoolStub != nil {
+		return fake.BroadcastLockPoolStub()
+	} else {
+		return fake.broadcastLockPoolReturns.result1
+	}
+}
+
+func (fake *FakeLockHandler) BroadcastLockPoolCallCount() int {
+	fake.broadcastLockPoolMutex.RLock()
+	defer fake.broadcastLockPoolMutex.RUnlock()
+	return len(fake.broadcastLockPoolArgsForCall)
+}
+
+func (fake *FakeLockHandler) BroadcastLockPoolReturns(result1 error) {
+	fake.BroadcastLockPoolStub = nil
+	fake.broadcastLockPoolReturns = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *FakeLockHandler) ResetLock() error {
+	fake.resetLockMutex.Lock()
+	fake.resetLockArgsForCall = append(fake.resetLockArgsForCall, struct{}{})
+	fake.resetLockMutex.Unlock()
+	if fake.ResetLockStub != nil {
+		return fake.ResetLockStub()
+	} else {
+		return fake.resetLockReturns.result1
+	}
+}
+
+func (fake *FakeLockHandler) ResetLockCallCount() int {
+	fake.resetLockMutex.RLock()
+	defer fake.resetLockMutex.RUnlock()
+	return len(fake.resetLockArgsForCall)
+}
+
+func (fake *FakeLockHandler) ResetLockReturns(result1 error) {
+	fake.ResetLockStub = nil
+	fake.resetLockReturns = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *FakeLockHandler) Cleanup() error {
+	fake.cleanupMutex.Lock()
+	fake.cleanupArgsForCall = append(fake.cleanupArgsForCall, struct{}{})
+	fake.cleanupMutex.Unlock()
+	if fake.CleanupStub != nil {
+		return fake.CleanupStub()
+	} else {
+		return fake.cleanupReturns.result1
+	}
+}
+
+func (fake *FakeLockHandler) CleanupCallCount() int {
+	fake.cleanupMutex.RLock()
+	defer fake.cleanupMutex.RUnlock()
+	return len(fake.cleanupArgsForCall)
+}
+
+func (fake *FakeLockHandler) CleanupReturns(result1 error) {
+	fake.CleanupStub = nil
+	fake.cleanupReturns = struct {
 		result1 error
 	}{result1}
 }
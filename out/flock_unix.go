@@ -0,0 +1,40 @@
+//go:build unix
+
+package out
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes a lock on file, shared or exclusive, waiting for any lock
+// that conflicts with it to be released. Locks are flock(2) locks, which are
+// seen by every process on the host and go away with the process holding
+// them.
+func lockFile(file *os.File, exclusive bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+
+	return syscall.Flock(int(file.Fd()), how)
+}
+
+// tryLockFile takes an exclusive lock on file unless another is held on it,
+// and says whether it did.
+func tryLockFile(file *os.File) (bool, error) {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// unlockFile releases the lock held on file.
+func unlockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
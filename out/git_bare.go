@@ -0,0 +1,300 @@
+package out
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A bare clone has no working tree to check the pool out into, which for
+// pools of tens of thousands of locks is most of the cost of an operation.
+// Changes are made to the trees of the branch directly instead: each one
+// rewrites only the trees along the path it changes, and commits the result.
+
+// treeEntry is an entry of a git tree, as listed by `git ls-tree`.
+type treeEntry struct {
+	mode string
+	kind string
+	oid  string
+}
+
+// cloneBare clones just the pool's branch, without checking it out.
+func (glh *GitLockHandler) cloneBare(branchExists bool) error {
+	args := []string{"clone", "--bare", "--single-branch", "--no-tags"}
+	if branchExists {
+		args = append(args, "--branch", glh.Source.Branch)
+	}
+	args = append(args, glh.Source.URI, glh.dir)
+
+	_, err := glh.runSince("", args)
+	return err
+}
+
+// createBareBranch is createBranch for a bare clone.
+func (glh *GitLockHandler) createBareBranch() error {
+	_, err := glh.git("update-ref", "refs/heads/"+glh.branch, "HEAD")
+	if err != nil {
+		return err
+	}
+
+	_, err = glh.git("symbolic-ref", "HEAD", "refs/heads/"+glh.branch)
+	if err != nil {
+		return err
+	}
+
+	_, err = glh.git("push", "origin", "HEAD:refs/heads/"+glh.branch)
+	if err == nil {
+		return nil
+	}
+
+	err = glh.fetchBranch(glh.branch)
+	if err != nil {
+		return fmt.Errorf("failed to create branch %s", glh.branch)
+	}
+
+	_, err = glh.git("update-ref", "refs/heads/"+glh.branch, "origin/"+glh.branch)
+	return err
+}
+
+// resetBare points the branch at what was just fetched, dropping anything
+// staged or committed since.
+func (glh *GitLockHandler) resetBare() error {
+	_, err := glh.git("update-ref", "HEAD", "origin/"+glh.branch)
+	if err != nil {
+		return err
+	}
+
+	return glh.readTree()
+}
+
+// readTree stages the tree of HEAD, as if nothing had changed yet.
+func (glh *GitLockHandler) readTree() error {
+	output, err := glh.git("rev-parse", "HEAD^{tree}")
+	if err != nil {
+		return err
+	}
+
+	glh.tree = strings.TrimSpace(string(output))
+
+	return nil
+}
+
+func (glh *GitLockHandler) commitBare(message string) (string, error) {
+	output, err := glh.git("rev-parse", "HEAD")
+	if err != nil {
+		return "", err
+	}
+
+	parent := strings.TrimSpace(string(output))
+
+	ref, err := glh.git("commit-tree", glh.tree, "-p", parent, "-m", message)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = glh.git("update-ref", "HEAD", strings.TrimSpace(string(ref)), parent)
+	if err != nil {
+		return "", err
+	}
+
+	return string(ref), nil
+}
+
+func (glh *GitLockHandler) readBareFile(file string) ([]byte, error) {
+	entry, err := glh.bareEntry(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry == nil || entry.kind != "blob" {
+		return nil, &os.PathError{Op: "open", Path: file, Err: os.ErrNotExist}
+	}
+
+	return glh.git("cat-file", "blob", entry.oid)
+}
+
+func (glh *GitLockHandler) listBareFiles(dir string) ([]string, error) {
+	return glh.listTreeFiles(glh.tree, dir)
+}
+
+func (glh *GitLockHandler) stageBareFile(file string, contents []byte, perm os.FileMode) error {
+	output, err := glh.runWithInput(glh.repoDir, contents, []string{"hash-object", "-w", "--stdin"})
+	if err != nil {
+		return err
+	}
+
+	// git only records whether a file is executable
+	mode := "100644"
+	if perm&0111 != 0 {
+		mode = "100755"
+	}
+
+	return glh.stageBareEntry(file, &treeEntry{mode: mode, kind: "blob", oid: strings.TrimSpace(string(output))})
+}
+
+func (glh *GitLockHandler) removeBareFile(file string, ignoreMissing bool) error {
+	entry, err := glh.bareEntry(file)
+	if err != nil {
+		return err
+	}
+
+	if entry == nil {
+		if ignoreMissing {
+			return nil
+		}
+
+		return fmt.Errorf("pathspec '%s' did not match any files", glh.treePath(file))
+	}
+
+	return glh.stageBareEntry(file, nil)
+}
+
+func (glh *GitLockHandler) moveBareFile(from string, to string) error {
+	entry, err := glh.bareEntry(from)
+	if err != nil {
+		return err
+	}
+
+	if entry == nil {
+		return fmt.Errorf("bad source, source=%s, destination=%s", glh.treePath(from), glh.treePath(to))
+	}
+
+	err = glh.stageBareEntry(from, nil)
+	if err != nil {
+		return err
+	}
+
+	return glh.stageBareEntry(to, entry)
+}
+
+// bareEntry finds the staged tree's entry for a file, or nil if it has none.
+func (glh *GitLockHandler) bareEntry(file string) (*treeEntry, error) {
+	output, err := glh.git("--literal-pathspecs", "ls-tree", "-z", glh.tree, "--", glh.treePath(file))
+	if err != nil {
+		return nil, err
+	}
+
+	// a path names at most one entry
+	for _, entry := range parseTree(output) {
+		return &entry, nil
+	}
+
+	return nil, nil
+}
+
+// stageBareEntry replaces the staged tree with one where the file has the
+// given entry, or none if entry is nil.
+func (glh *GitLockHandler) stageBareEntry(file string, entry *treeEntry) error {
+	tree, err := glh.updateTree(glh.tree, strings.Split(glh.treePath(file), "/"), entry)
+	if err != nil {
+		return err
+	}
+
+	// a pool with nothing left in it is still a tree, if an empty one
+	if tree == "" {
+		tree, err = glh.makeTree(nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	glh.tree = tree
+
+	return nil
+}
+
+// updateTree writes the tree that results from setting the entry at the
+// given path within tree, returning "" if nothing is left in it. Only the
+// trees along the path are rewritten.
+func (glh *GitLockHandler) updateTree(tree string, parts []string, entry *treeEntry) (string, error) {
+	entries := map[string]treeEntry{}
+	if tree != "" {
+		output, err := glh.git("ls-tree", "-z", tree)
+		if err != nil {
+			return "", err
+		}
+
+		entries = parseTree(output)
+	}
+
+	name := parts[0]
+
+	if len(parts) == 1 {
+		if entry == nil {
+			delete(entries, name)
+		} else {
+			entries[name] = *entry
+		}
+	} else {
+		subtree := ""
+		if existing, found := entries[name]; found && existing.kind == "tree" {
+			subtree = existing.oid
+		}
+
+		subtree, err := glh.updateTree(subtree, parts[1:], entry)
+		if err != nil {
+			return "", err
+		}
+
+		// git does not track empty directories
+		if subtree == "" {
+			delete(entries, name)
+		} else {
+			entries[name] = treeEntry{mode: "040000", kind: "tree", oid: subtree}
+		}
+	}
+
+	if len(entries) == 0 {
+		return "", nil
+	}
+
+	return glh.makeTree(entries)
+}
+
+func (glh *GitLockHandler) makeTree(entries map[string]treeEntry) (string, error) {
+	var input bytes.Buffer
+	for name, entry := range entries {
+		fmt.Fprintf(&input, "%s %s %s\t%s\x00", entry.mode, entry.kind, entry.oid, name)
+	}
+
+	output, err := glh.runWithInput(glh.repoDir, input.Bytes(), []string{"mktree", "-z"})
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
+
+// parseTree reads the entries of `git ls-tree -z` output by name.
+func parseTree(output []byte) map[string]treeEntry {
+	entries := map[string]treeEntry{}
+
+	for _, line := range strings.Split(string(output), "\x00") {
+		tab := strings.Index(line, "\t")
+		if tab == -1 {
+			continue
+		}
+
+		fields := strings.Fields(line[:tab])
+		if len(fields) != 3 {
+			continue
+		}
+
+		entries[path.Base(line[tab+1:])] = treeEntry{mode: fields[0], kind: fields[1], oid: fields[2]}
+	}
+
+	return entries
+}
+
+// treePath is the path of a file of the clone within its trees.
+func (glh *GitLockHandler) treePath(file string) string {
+	rel, err := filepath.Rel(glh.repoDir, file)
+	if err != nil {
+		return filepath.ToSlash(file)
+	}
+
+	return filepath.ToSlash(rel)
+}
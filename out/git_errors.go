@@ -0,0 +1,245 @@
+package out
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type ErrorClass int
+
+const (
+	ErrorClassUnknown ErrorClass = iota
+	ErrorClassAuth
+	ErrorClassNetwork
+	ErrorClassNotFound
+	ErrorClassConflict
+	ErrorClassRefused
+	ErrorClassTimeout
+
+	// ErrorClassDNS, ErrorClassConnectionReset, and ErrorClassNetworkTimeout
+	// tell the commonest network failures apart from ErrorClassNetwork's
+	// others, such as a refused connection or a server error.
+	ErrorClassDNS
+	ErrorClassConnectionReset
+	ErrorClassNetworkTimeout
+)
+
+func (class ErrorClass) String() string {
+	switch class {
+	case ErrorClassAuth:
+		return "authentication failed"
+	case ErrorClassNetwork:
+		return "network error"
+	case ErrorClassNotFound:
+		return "repository or branch not found"
+	case ErrorClassConflict:
+		return "conflicting change"
+	case ErrorClassRefused:
+		return "push refused by remote"
+	case ErrorClassTimeout:
+		return "timed out"
+	case ErrorClassDNS:
+		return "DNS failure"
+	case ErrorClassConnectionReset:
+		return "connection reset"
+	case ErrorClassNetworkTimeout:
+		return "network timeout"
+	default:
+		return "unexpected error"
+	}
+}
+
+// Category names the class in structured error responses.
+func (class ErrorClass) Category() string {
+	switch class {
+	case ErrorClassAuth:
+		return "auth"
+	case ErrorClassNetwork, ErrorClassDNS, ErrorClassConnectionReset, ErrorClassNetworkTimeout:
+		return "network"
+	case ErrorClassNotFound:
+		return "not_found"
+	case ErrorClassConflict:
+		return "conflict"
+	case ErrorClassRefused:
+		return "refused"
+	case ErrorClassTimeout:
+		return "timeout"
+	default:
+		return "unknown"
+	}
+}
+
+// Retryable reports whether an error of this class may go away on its own.
+// Unknown errors are retried, as they always have been, so that only failures
+// we are sure about stop a build.
+func (class ErrorClass) Retryable() bool {
+	switch class {
+	case ErrorClassAuth, ErrorClassNotFound, ErrorClassRefused, ErrorClassTimeout:
+		return false
+	default:
+		return true
+	}
+}
+
+// Transient reports whether an error of this class is a blip in the network
+// between us and the remote, which is retried a bounded number of times,
+// backing off, rather than as long as the operation runs.
+func (class ErrorClass) Transient() bool {
+	switch class {
+	case ErrorClassNetwork, ErrorClassDNS, ErrorClassConnectionReset, ErrorClassNetworkTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// classifiers are checked in order; the first class with a matching pattern
+// wins. Authentication is checked first since servers often describe denied
+// access as a missing repository. Network failures are checked before
+// conflicts, as a push whose connection dropped says nothing reliable about
+// the branch, whatever else it printed.
+var classifiers = []struct {
+	class    ErrorClass
+	patterns []string
+}{
+	{ErrorClassAuth, []string{
+		"permission denied",
+		"authentication failed",
+		"could not read username",
+		"could not read password",
+		"host key verification failed",
+		"access denied",
+		"invalid username or password",
+		"the requested url returned error: 401",
+		"the requested url returned error: 403",
+	}},
+	{ErrorClassNotFound, []string{
+		"repository not found",
+		"does not appear to be a git repository",
+		"couldn't find remote ref",
+		"could not find remote branch",
+		"not found in upstream",
+		"the requested url returned error: 404",
+	}},
+	{ErrorClassDNS, []string{
+		"could not resolve host",
+		"could not resolve hostname",
+		"temporary failure in name resolution",
+		"name or service not known",
+		"nodename nor servname",
+		"no address associated with hostname",
+	}},
+	{ErrorClassConnectionReset, []string{
+		"connection reset",
+		"broken pipe",
+		"connection closed by",
+		"the remote end hung up unexpectedly",
+		"unexpected disconnect",
+		"early eof",
+		"rpc failed",
+		"gnutls_handshake",
+		"ssl_read",
+	}},
+	{ErrorClassNetworkTimeout, []string{
+		"connection timed out",
+		"operation timed out",
+		"timeout was reached",
+	}},
+	{ErrorClassNetwork, []string{
+		"connection refused",
+		"network is unreachable",
+		"no route to host",
+		"the requested url returned error: 5",
+	}},
+	{ErrorClassConflict, []string{
+		"[rejected]",
+		"non-fast-forward",
+		"fetch first",
+		"cannot lock ref",
+	}},
+	{ErrorClassRefused, []string{
+		"[remote rejected]",
+	}},
+}
+
+// ClassifyGitOutput guesses why a git command failed from what it printed.
+func ClassifyGitOutput(output string) ErrorClass {
+	output = strings.ToLower(output)
+
+	for _, classifier := range classifiers {
+		for _, pattern := range classifier.patterns {
+			if strings.Contains(output, pattern) {
+				return classifier.class
+			}
+		}
+	}
+
+	return ErrorClassUnknown
+}
+
+// GitError is returned when a git command exits unsuccessfully.
+type GitError struct {
+	Class   ErrorClass
+	Command string
+	Output  string
+	Err     error
+}
+
+// gitCommand names the git command that args run, after any options given to
+// git itself, such as -c or --literal-pathspecs.
+func gitCommand(args []string) string {
+	if command := subcommand(args); command != "" {
+		return "git " + command
+	}
+
+	return "git"
+}
+
+func newGitError(args []string, output []byte, err error) *GitError {
+	return &GitError{
+		Class:   ClassifyGitOutput(string(output)),
+		Command: gitCommand(args),
+		Output:  strings.TrimSpace(string(output)),
+		Err:     err,
+	}
+}
+
+func newTimeoutError(args []string, timeout time.Duration) *GitError {
+	return &GitError{
+		Class:   ErrorClassTimeout,
+		Command: gitCommand(args),
+		Output:  fmt.Sprintf("no response within operation_timeout of %s", timeout),
+		Err:     context.DeadlineExceeded,
+	}
+}
+
+func (err *GitError) Error() string {
+	if err.Output == "" {
+		return fmt.Sprintf("%s failed (%s): %s", err.Command, err.Class, err.Err)
+	}
+
+	return fmt.Sprintf("%s failed (%s): %s", err.Command, err.Class, err.Output)
+}
+
+// IsRetryable reports whether an operation that failed with err should be
+// retried rather than failing the build.
+func IsRetryable(err error) bool {
+	if err == ErrLockConflict || err == ErrNoLocksAvailable {
+		return true
+	}
+
+	if gitErr, ok := err.(*GitError); ok {
+		return gitErr.Class.Retryable()
+	}
+
+	return true
+}
+
+// IsTransient reports whether err is a blip in the network, as
+// ErrorClass.Transient tells.
+func IsTransient(err error) bool {
+	gitErr, ok := err.(*GitError)
+	return ok && gitErr.Class.Transient()
+}
@@ -0,0 +1,150 @@
+package out_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/concourse/pool-resource/out"
+)
+
+var _ = Describe("Git errors", func() {
+	Describe("classifying git output", func() {
+		for _, example := range []struct {
+			description string
+			output      string
+			class       out.ErrorClass
+		}{
+			{"ssh auth", "git@github.com: Permission denied (publickey).\nfatal: Could not read from remote repository.", out.ErrorClassAuth},
+			{"https auth", "fatal: Authentication failed for 'https://example.com/locks.git/'", out.ErrorClassAuth},
+			{"missing credentials", "fatal: could not read Username for 'https://example.com': terminal prompts disabled", out.ErrorClassAuth},
+			{"dns", "ssh: Could not resolve hostname example.invalid: Name or service not known", out.ErrorClassDNS},
+			{"https dns", "fatal: unable to access 'https://example.com/': Could not resolve host: example.com", out.ErrorClassDNS},
+			{"reset", "error: RPC failed; curl 56 Recv failure: Connection reset by peer\nfatal: the remote end hung up unexpectedly", out.ErrorClassConnectionReset},
+			{"dropped push", "send-pack: unexpected disconnect while reading sideband packet\n ! [rejected]        HEAD -> master (fetch first)", out.ErrorClassConnectionReset},
+			{"network timeout", "ssh: connect to host example.com port 22: Connection timed out", out.ErrorClassNetworkTimeout},
+			{"refused", "fatal: unable to connect to localhost:\nlocalhost[0: 127.0.0.1]: errno=Connection refused", out.ErrorClassNetwork},
+			{"server error", "fatal: unable to access 'https://example.com/': The requested URL returned error: 502", out.ErrorClassNetwork},
+			{"missing repo", "ERROR: Repository not found.\nfatal: Could not read from remote repository.", out.ErrorClassNotFound},
+			{"missing local repo", "fatal: '/nope' does not appear to be a git repository", out.ErrorClassNotFound},
+			{"missing branch", "warning: Could not find remote branch nope to clone.\nfatal: Remote branch nope not found in upstream origin", out.ErrorClassNotFound},
+			{"rejected push", " ! [rejected]        HEAD -> master (fetch first)\nerror: failed to push some refs", out.ErrorClassConflict},
+			{"refused push", " ! [remote rejected] HEAD -> master (pre-receive hook declined)\nerror: failed to push some refs", out.ErrorClassRefused},
+			{"push refused by a hook naming a branch", " ! [remote rejected] HEAD -> master (protected remote branch)\nerror: failed to push some refs", out.ErrorClassRefused},
+			{"something else", "fatal: bad object HEAD", out.ErrorClassUnknown},
+		} {
+			example := example
+
+			It("classifies "+example.description+" as "+example.class.String(), func() {
+				Ω(out.ClassifyGitOutput(example.output)).Should(Equal(example.class))
+			})
+		}
+	})
+
+	Describe("naming the failed command", func() {
+		var tmpDir string
+
+		BeforeEach(func() {
+			var err error
+			tmpDir, err = ioutil.TempDir("", "git-errors")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			os.Unsetenv("TMPDIR")
+
+			err := os.RemoveAll(tmpDir)
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("names git's subcommand rather than the options given to git itself", func() {
+			origin := filepath.Join(tmpDir, "origin.git")
+
+			setup := exec.Command("bash", "-e", "-c", `
+				git init -q --bare origin.git
+				git init -q work
+				cd work
+				git config user.email "ginkgo@localhost"
+				git config user.name "Ginkgo Local"
+				mkdir -p lock-pool/unclaimed lock-pool/claimed
+				echo '{}' > lock-pool/unclaimed/some-lock
+				touch lock-pool/claimed/.gitkeep
+				git add .
+				git commit -q -m 'setup'
+				git push -q ../origin.git HEAD:master
+			`)
+			setup.Dir = tmpDir
+			output, err := setup.CombinedOutput()
+			Ω(err).ShouldNot(HaveOccurred(), string(output))
+
+			clones := filepath.Join(tmpDir, "clones")
+			Ω(os.Mkdir(clones, 0755)).Should(Succeed())
+			os.Setenv("TMPDIR", clones)
+
+			handler := out.NewGitLockHandler(out.Source{
+				URI:    origin,
+				Branch: "master",
+				Pool:   "lock-pool",
+				Bare:   true,
+			}.WithDefaults())
+
+			Ω(handler.Setup()).Should(Succeed())
+			defer handler.Cleanup()
+
+			// the clone's trees are gone, so listing one fails
+			objects, err := filepath.Glob(filepath.Join(clones, "*", "objects", "[0-9a-f][0-9a-f]"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(objects).ShouldNot(BeEmpty())
+
+			for _, object := range objects {
+				Ω(os.RemoveAll(object)).Should(Succeed())
+			}
+
+			_, err = handler.ListLocks("unclaimed")
+			Ω(err).Should(HaveOccurred())
+
+			gitErr, ok := err.(*out.GitError)
+			Ω(ok).Should(BeTrue(), err.Error())
+			Ω(gitErr.Command).Should(Equal("git ls-tree"))
+		})
+	})
+
+	Describe("IsTransient", func() {
+		It("tells blips in the network apart", func() {
+			Ω(out.IsTransient(&out.GitError{Class: out.ErrorClassDNS})).Should(BeTrue())
+			Ω(out.IsTransient(&out.GitError{Class: out.ErrorClassConnectionReset})).Should(BeTrue())
+			Ω(out.IsTransient(&out.GitError{Class: out.ErrorClassNetworkTimeout})).Should(BeTrue())
+			Ω(out.IsTransient(&out.GitError{Class: out.ErrorClassNetwork})).Should(BeTrue())
+		})
+
+		It("leaves out errors that aren't about the network", func() {
+			Ω(out.IsTransient(out.ErrLockConflict)).Should(BeFalse())
+			Ω(out.IsTransient(&out.GitError{Class: out.ErrorClassConflict})).Should(BeFalse())
+			Ω(out.IsTransient(&out.GitError{Class: out.ErrorClassTimeout})).Should(BeFalse())
+			Ω(out.IsTransient(&out.GitError{Class: out.ErrorClassUnknown})).Should(BeFalse())
+			Ω(out.IsTransient(errors.New("disaster"))).Should(BeFalse())
+		})
+	})
+
+	Describe("IsRetryable", func() {
+		It("retries conflicts and transient failures", func() {
+			Ω(out.IsRetryable(out.ErrLockConflict)).Should(BeTrue())
+			Ω(out.IsRetryable(&out.GitError{Class: out.ErrorClassNetwork})).Should(BeTrue())
+			Ω(out.IsRetryable(&out.GitError{Class: out.ErrorClassConflict})).Should(BeTrue())
+			Ω(out.IsRetryable(&out.GitError{Class: out.ErrorClassUnknown})).Should(BeTrue())
+			Ω(out.IsRetryable(errors.New("disaster"))).Should(BeTrue())
+		})
+
+		It("does not retry failures that need a human", func() {
+			Ω(out.IsRetryable(&out.GitError{Class: out.ErrorClassAuth})).Should(BeFalse())
+			Ω(out.IsRetryable(&out.GitError{Class: out.ErrorClassNotFound})).Should(BeFalse())
+			Ω(out.IsRetryable(&out.GitError{Class: out.ErrorClassRefused})).Should(BeFalse())
+			Ω(out.IsRetryable(&out.GitError{Class: out.ErrorClassTimeout})).Should(BeFalse())
+		})
+	})
+})
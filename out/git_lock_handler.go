@@ -1,14 +1,22 @@
 package out
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"math/rand"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var ErrNoLocksAvailable = errors.New("no locks to claim")
@@ -17,122 +25,484 @@ var ErrLockConflict = errors.New("pool state out of date")
 type GitLockHandler struct {
 	Source Source
 
+	// Selector picks which available lock to claim.
+	Selector Selector
+
+	// GitHubApp, if set, supplies the token git authenticates with.
+	GitHubApp *GitHubAppTokenSource
+
 	dir string
-}
 
-const falsePushString = "Everything up-to-date"
-const pushRejectedString = "[rejected]"
-const pushRemoteRejectedString = "[remote rejected]"
+	// repoDir, pool, and branch locate the pool within the clone; they only
+	// differ from dir and the source when the pool lives in a submodule
+	repoDir string
+	pool    string
+	branch  string
+
+	// cache is the shared clone that dir is a worktree of, if any
+	cache string
+
+	// tree is the staged tree of a bare clone, which stands in for the index
+	// and working tree that a bare clone does not have
+	tree string
+
+	// pendingTags are the claim tags made since the pool was last pushed
+	pendingTags []string
+
+	// notesRef is the local ref holding the pool's audit notes, and
+	// notesPending whether any were added since the pool was last pushed
+	notesRef     string
+	notesPending bool
+
+	// knownHosts is the file holding the source's known_hosts, if any
+	knownHosts string
+
+	// caCert is the file holding the source's ca_cert, if any
+	caCert string
+
+	// renamed maps the new names of the locks renamed by what is staged to
+	// their old ones
+	renamed map[string]string
+
+	// forcePushLease is the head the branch's history was rewritten from,
+	// which the next push replaces only if the remote still holds it
+	forcePushLease string
+
+	// mirrorLease is the head the history last broadcast was rewritten from,
+	// which the mirror's history is replaced from likewise
+	mirrorLease string
+
+	// releaseTempDirs release the temp dirs the handler holds for as long as
+	// it is set up
+	releaseTempDirs []func()
+
+	// gnupgHome holds the key claim tags are signed with, if any, which
+	// signingKey identifies
+	gnupgHome  string
+	signingKey string
+
+	// negotiated is the version of the git protocol the remote spoke
+	negotiated int
+
+	// committing is the time spent committing changes so far
+	committing time.Duration
+
+	// candidates, if any, are the only locks that may be claimed, in order of
+	// preference
+	candidates []string
+
+	// allow, if set, accepts the only locks that may be claimed
+	allow func(lock string) bool
+}
 
 func NewGitLockHandler(source Source) *GitLockHandler {
-	return &GitLockHandler{
-		Source: source,
+	handler := &GitLockHandler{
+		Source:   source,
+		Selector: SelectorFor(source.SelectionStrategy),
+	}
+
+	if source.SelectionStrategy == SelectionLeastRecentlyClaimed {
+		handler.Selector = FIFOSelector{ReleasedAt: handler.releaseTimes}
+	}
+
+	if source.GitHubApp.Enabled() {
+		handler.GitHubApp = NewGitHubAppTokenSource(source.GitHubApp)
 	}
+
+	return handler
 }
 
 func (glh *GitLockHandler) RemoveLock(lockName string) (string, error) {
-	pool := filepath.Join(glh.dir, glh.Source.Pool)
+	err := glh.removeRecords(glh.Source.Paths.Claimed, lockName)
+	if err != nil {
+		return "", err
+	}
 
-	_, err := glh.git("rm", filepath.Join(pool, "claimed", lockName))
+	err = glh.removeFile(filepath.Join(glh.poolDir(), glh.Source.Paths.Claimed, lockName), false)
 	if err != nil {
 		return "", err
 	}
 
-	_, err = glh.git("commit", "-m", fmt.Sprintf("removing: %s", lockName))
+	return glh.commit("removing", lockName, "")
+}
+
+// RemoveLocks removes several locks, each from the state it is in, in a
+// single commit.
+func (glh *GitLockHandler) RemoveLocks(locks map[string]string) (string, error) {
+	names := make([]string, 0, len(locks))
+	for lockName := range locks {
+		names = append(names, lockName)
+	}
+
+	sort.Strings(names)
+
+	for _, lockName := range names {
+		state := locks[lockName]
+
+		err := glh.removeRecords(state, lockName)
+		if err != nil {
+			return "", err
+		}
+
+		err = glh.removeFile(filepath.Join(glh.poolDir(), state, lockName), false)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return glh.commit("removing", strings.Join(names, ", "), "")
+}
+
+func (glh *GitLockHandler) UnclaimLock(lockName string) (string, error) {
+	claimedAt, err := glh.claimTimes(lockName)
 	if err != nil {
 		return "", err
 	}
 
-	ref, err := glh.git("rev-parse", "HEAD")
+	ref, err := glh.moveLock(lockName, glh.Source.Paths.Claimed, glh.Source.Paths.Unclaimed, "unclaiming", "")
 	if err != nil {
 		return "", err
 	}
 
-	return string(ref), nil
+	return ref, glh.noteAudit(AuditReleased, claimedAt, lockName)
 }
 
-func (glh *GitLockHandler) UnclaimLock(lockName string) (string, error) {
-	pool := filepath.Join(glh.dir, glh.Source.Pool)
+// UnclaimLocks unclaims several claimed locks in a single commit.
+func (glh *GitLockHandler) UnclaimLocks(lockNames []string) (string, error) {
+	pool := glh.poolDir()
 
-	_, err := glh.git("mv", filepath.Join(pool, "claimed", lockName), filepath.Join(pool, "unclaimed", lockName))
+	claimedAt, err := glh.claimTimes(lockNames...)
 	if err != nil {
 		return "", err
 	}
 
-	_, err = glh.git("commit", "-m", fmt.Sprintf("unclaiming: %s", lockName))
+	for _, lockName := range lockNames {
+		err := glh.removeRecords(glh.Source.Paths.Claimed, lockName)
+		if err != nil {
+			return "", err
+		}
+
+		err = glh.moveFile(filepath.Join(pool, glh.Source.Paths.Claimed, lockName), filepath.Join(pool, glh.Source.Paths.Unclaimed, lockName))
+		if err != nil {
+			return "", err
+		}
+	}
+
+	ref, err := glh.commit("unclaiming", strings.Join(lockNames, ", "), "")
 	if err != nil {
 		return "", err
 	}
 
-	ref, err := glh.git("rev-parse", "HEAD")
+	return ref, glh.noteAudit(AuditReleased, claimedAt, lockNames...)
+}
+
+func (glh *GitLockHandler) DisableLock(lockName string) (string, error) {
+	return glh.moveLock(lockName, glh.Source.Paths.Claimed, glh.Source.Paths.Maintenance, "disabling", "")
+}
+
+func (glh *GitLockHandler) EnableLock(lockName string) (string, error) {
+	return glh.moveLock(lockName, glh.Source.Paths.Maintenance, glh.Source.Paths.Unclaimed, "enabling", "")
+}
+
+func (glh *GitLockHandler) QuarantineLock(lockName string, reason string) (string, error) {
+	return glh.moveLock(lockName, glh.Source.Paths.Claimed, glh.Source.Paths.Broken, "quarantining", reason)
+}
+
+func (glh *GitLockHandler) ForceUnclaimLock(lockName string, state string) (string, error) {
+	return glh.moveLock(lockName, state, glh.Source.Paths.Unclaimed, "force unclaiming", "")
+}
+
+// moveLock moves a lock between two state directories of the pool and
+// commits the change.
+func (glh *GitLockHandler) moveLock(lockName string, from string, to string, action string, body string) (string, error) {
+	pool := glh.poolDir()
+
+	// an expiry only applies to the state it was recorded in, as does the
+	// build that claimed the lock
+	err := glh.removeRecords(from, lockName)
 	if err != nil {
 		return "", err
 	}
 
-	return string(ref), nil
+	err = glh.moveFile(filepath.Join(pool, from, lockName), filepath.Join(pool, to, lockName))
+	if err != nil {
+		return "", err
+	}
+
+	return glh.commit(action, lockName, body)
 }
 
 func (glh *GitLockHandler) ResetLock() error {
-	_, err := glh.git("fetch", "origin", glh.Source.Branch)
+	// an operation that timed out may have left the clone unusable
+	if glh.corruption(glh.repoDir) != "" {
+		err := glh.reclone()
+		if err != nil {
+			return err
+		}
+	}
+
+	err := glh.dropPendingTags()
 	if err != nil {
 		return err
 	}
 
-	_, err = glh.git("reset", "--hard", "origin/"+glh.Source.Branch)
+	glh.forcePushLease = ""
+	glh.renamed = nil
+
+	err = glh.fetchBranch(glh.branch)
 	if err != nil {
 		return err
 	}
 
-	return nil
-}
+	err = glh.fetchAuditNotes()
+	if err != nil {
+		return err
+	}
 
-func (glh *GitLockHandler) AddLock(lock string, contents []byte) (string, error) {
-	pool := filepath.Join(glh.dir, glh.Source.Pool)
-	lockPath := filepath.Join(pool, "unclaimed", lock)
+	if glh.Source.Bare {
+		return glh.resetBare()
+	}
 
-	err := ioutil.WriteFile(lockPath, contents, 0555)
+	// resetting reads the refs and objects that others sharing the clone
+	// write
+	unlock, err := glh.lockSharedClone()
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	_, err = glh.git("add", lockPath)
+	defer unlock()
+
+	_, err = glh.git("reset", "--hard", "origin/"+glh.branch)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	_, err = glh.git("commit", lockPath, "-m", fmt.Sprintf("adding: %s", lock))
+	return nil
+}
+
+// ImportLock puts a lock straight into the given state, for copying locks
+// from another pool.
+func (glh *GitLockHandler) ImportLock(state string, lock string, contents []byte) (string, error) {
+	err := glh.stageLock(filepath.Join(glh.poolDir(), state, lock), contents)
 	if err != nil {
 		return "", err
 	}
 
-	ref, err := glh.git("rev-parse", "HEAD")
+	return glh.commit("importing", lock, "")
+}
+
+func (glh *GitLockHandler) AddLock(lock string, contents []byte) (string, error) {
+	err := glh.stageLock(filepath.Join(glh.poolDir(), glh.Source.Paths.Unclaimed, lock), contents)
 	if err != nil {
 		return "", err
 	}
 
-	return string(ref), nil
+	return glh.commit("adding", lock, "")
+}
+
+// AddLocks adds every lock to the unclaimed locks in a single commit.
+func (glh *GitLockHandler) AddLocks(locks map[string][]byte) (string, error) {
+	names := sortedLockNames(locks)
+
+	for _, lock := range names {
+		err := glh.stageLock(filepath.Join(glh.poolDir(), glh.Source.Paths.Unclaimed, lock), locks[lock])
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return glh.commit("adding", strings.Join(names, ", "), "")
 }
 
 func (glh *GitLockHandler) Setup() error {
 	var err error
 
-	glh.dir, err = ioutil.TempDir("", "pool-resource")
+	glh.dir, err = ioutil.TempDir("", TempDirPrefix)
+	if err != nil {
+		return err
+	}
+
+	err = glh.holdTempDir(glh.dir)
+	if err != nil {
+		return err
+	}
+
+	err = glh.setupKnownHosts()
+	if err != nil {
+		return err
+	}
+
+	err = glh.setupCACert()
+	if err != nil {
+		return err
+	}
+
+	branchExists := true
+	if glh.Source.CreateBranch {
+		branchExists, err = glh.remoteBranchExists()
+		if err != nil {
+			return err
+		}
+	}
+
+	if glh.Source.CacheDir != "" {
+		err = glh.addWorktree(branchExists)
+	} else if glh.Source.Bare {
+		err = glh.cloneBare(branchExists)
+	} else {
+		// only the pool's branch is ever needed, which keeps clones of
+		// repositories holding more than the pool small
+		cloneArgs := []string{"clone", "--single-branch", "--no-tags"}
+		if branchExists {
+			cloneArgs = append(cloneArgs, "--branch", glh.Source.Branch)
+		}
+		cloneArgs = append(cloneArgs, glh.Source.URI, glh.dir)
+
+		// LFS objects are fetched explicitly below, once we know the pool
+		// needs them
+		_, err = glh.runSince("", cloneArgs, "GIT_LFS_SKIP_SMUDGE=1")
+	}
+
+	if err != nil {
+		return err
+	}
+
+	glh.negotiateProtocol()
+
+	glh.repoDir = glh.dir
+	glh.pool = glh.Source.Pool
+	glh.branch = glh.Source.Branch
+
+	if !branchExists {
+		err = glh.createBranch()
+		if err != nil {
+			return err
+		}
+	}
+
+	if !glh.Source.Submodules.None() {
+		err = glh.setupSubmodules()
+		if err != nil {
+			return err
+		}
+	}
+
+	glh.notesRef = glh.auditNotesRef()
+
+	err = glh.fetchAuditNotes()
+	if err != nil {
+		return err
+	}
+
+	// a worktree shares its configuration with the other worktrees of the
+	// clone, so it is only changed while holding the clone's lock
+	unlock, err := glh.lockSharedClone()
 	if err != nil {
 		return err
 	}
 
-	cmd := exec.Command("git", "clone", "--branch", glh.Source.Branch, glh.Source.URI, glh.dir)
-	err = cmd.Run()
+	defer unlock()
+
+	err = glh.configureIdentity()
 	if err != nil {
 		return err
 	}
 
-	_, err = glh.git("config", "user.name", "CI Pool Resource")
+	if glh.usesLFS() {
+		if glh.Source.Bare {
+			return errors.New("pool uses git-lfs, which source.bare does not support")
+		}
+
+		err = glh.setupLFS()
+		if err != nil {
+			return err
+		}
+	}
+
+	if glh.Source.Bare {
+		err = glh.readTree()
+		if err != nil {
+			return err
+		}
+	}
+
+	if glh.Source.ClaimTags.SigningKey != "" {
+		err = glh.setupSigningKey()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// configureIdentity sets who the pool's commits are by. With
+// source.inherit_git_config, an identity the image's git config already gives
+// is kept instead.
+func (glh *GitLockHandler) configureIdentity() error {
+	identity := [][2]string{
+		{"user.name", "CI Pool Resource"},
+		{"user.email", "ci-pool@localhost"},
+	}
+
+	for _, setting := range identity {
+		if glh.Source.InheritGitConfig {
+			_, err := glh.git("config", "--get", setting[0])
+			if err == nil {
+				continue
+			}
+		}
+
+		_, err := glh.git("config", setting[0], setting[1])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (glh *GitLockHandler) remoteBranchExists() (bool, error) {
+	args := []string{"ls-remote", "--exit-code", "--heads", glh.Source.URI, glh.Source.Branch}
+	_, err := glh.run("", args)
+	if err == nil {
+		return true, nil
+	}
+
+	// ls-remote exits with 2 when the remote is reachable but has no such ref
+	if gitErr, ok := err.(*GitError); ok {
+		if exitErr, ok := gitErr.Err.(*exec.ExitError); ok && exitErr.ExitCode() == 2 {
+			return false, nil
+		}
+	}
+
+	return false, err
+}
+
+// createBranch creates the configured branch from the default branch of the
+// clone and pushes it. If another process pushes the branch first, theirs is
+// used instead.
+func (glh *GitLockHandler) createBranch() error {
+	if glh.Source.Bare {
+		return glh.createBareBranch()
+	}
+
+	_, err := glh.git("checkout", "-b", glh.branch)
 	if err != nil {
 		return err
 	}
 
-	_, err = glh.git("config", "user.email", "ci-pool@localhost")
+	_, err = glh.git("push", "origin", "HEAD:refs/heads/"+glh.branch)
+	if err == nil {
+		return nil
+	}
+
+	err = glh.fetchBranch(glh.branch)
+	if err != nil {
+		return fmt.Errorf("failed to create branch %s", glh.branch)
+	}
+
+	_, err = glh.git("checkout", "-B", glh.branch, "origin/"+glh.branch)
 	if err != nil {
 		return err
 	}
@@ -140,71 +510,1153 @@ func (glh *GitLockHandler) Setup() error {
 	return nil
 }
 
-func (glh *GitLockHandler) GrabAvailableLock() (string, string, error) {
-	var files []os.FileInfo
+// usesLFS reports whether any .gitattributes file between the repository root
+// and the pool routes files through the LFS filter.
+func (glh *GitLockHandler) usesLFS() bool {
+	dir := glh.repoDir
+
+	for _, part := range append([]string{""}, strings.Split(glh.pool, "/")...) {
+		dir = filepath.Join(dir, part)
+
+		attributes, err := glh.readFile(filepath.Join(dir, ".gitattributes"))
+		if err != nil {
+			continue
+		}
+
+		if strings.Contains(string(attributes), "filter=lfs") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setupLFS installs the LFS filters into the clone, so that lock files added
+// later are staged as LFS pointers, and downloads the objects for the branch.
+func (glh *GitLockHandler) setupLFS() error {
+	_, err := glh.git("lfs", "install", "--local")
+	if err != nil {
+		return fmt.Errorf("pool uses git-lfs but it could not be installed: %s", err)
+	}
 
-	allFiles, err := ioutil.ReadDir(filepath.Join(glh.dir, glh.Source.Pool, "unclaimed"))
+	_, err = glh.git("lfs", "pull")
 	if err != nil {
-		return "", "", err
+		return fmt.Errorf("failed to fetch git-lfs objects: %s", err)
 	}
 
-	for _, file := range allFiles {
-		fileName := filepath.Base(file.Name())
-		if !strings.HasPrefix(fileName, ".") {
-			files = append(files, file)
+	return nil
+}
+
+func (glh *GitLockHandler) Cleanup() error {
+	if glh.dir == "" {
+		return nil
+	}
+
+	if glh.cache != "" {
+		if glh.Source.AuditNotes {
+			glh.git("update-ref", "-d", glh.notesRef)
 		}
+
+		// the worktree is pruned from the shared clone later if this fails
+		glh.removeWorktree()
 	}
 
-	if len(files) == 0 {
-		return "", "", ErrNoLocksAvailable
+	if glh.gnupgHome != "" {
+		os.RemoveAll(glh.gnupgHome)
+		glh.gnupgHome = ""
+	}
+
+	if glh.knownHosts != "" {
+		os.Remove(glh.knownHosts)
+		glh.knownHosts = ""
+	}
+
+	if glh.caCert != "" {
+		os.Remove(glh.caCert)
+		glh.caCert = ""
 	}
 
-	index := rand.Int() % len(files)
-	name := filepath.Base(files[index].Name())
+	glh.pendingTags = nil
+	glh.notesPending = false
+
+	for _, release := range glh.releaseTempDirs {
+		release()
+	}
+	glh.releaseTempDirs = nil
 
-	_, err = glh.git("mv", filepath.Join(glh.Source.Pool, "unclaimed", name), filepath.Join(glh.Source.Pool, "claimed", name))
+	err := os.RemoveAll(glh.dir)
 	if err != nil {
-		return "", "", err
+		return err
 	}
 
-	commitMessage := fmt.Sprintf("claiming: %s", name)
-	_, err = glh.git("commit", "-m", commitMessage)
+	glh.dir = ""
+	glh.repoDir = ""
+	glh.cache = ""
+
+	return nil
+}
+
+// holdTempDir keeps the temp dir from being swept while the handler is set
+// up.
+func (glh *GitLockHandler) holdTempDir(dir string) error {
+	release, err := HoldTempDir(dir)
 	if err != nil {
-		return "", "", err
+		return err
 	}
 
-	ref, err := glh.git("rev-parse", "HEAD")
+	glh.releaseTempDirs = append(glh.releaseTempDirs, release)
+
+	return nil
+}
+
+// Head is the commit the pool is at, including any changes committed since
+// it was last reset.
+func (glh *GitLockHandler) Head() (string, error) {
+	output, err := glh.git("rev-parse", "HEAD")
 	if err != nil {
-		return "", "", err
+		return "", err
 	}
 
-	return name, string(ref), nil
+	return string(output), nil
 }
 
-func (glh *GitLockHandler) BroadcastLockPool() error {
-	contents, err := glh.git("push", "origin", "HEAD:"+glh.Source.Branch)
+func (glh *GitLockHandler) ListLocks(state string) ([]string, error) {
+	allFiles, err := glh.listFiles(filepath.Join(glh.poolDir(), state))
+	return lockFiles(allFiles, err)
+}
 
-	// if we push and everything is up to date then someone else has made
-	// a commit in the same second acquiring the same lock
-	//
-	// we need to stop and try again
-	if strings.Contains(string(contents), falsePushString) {
-		return ErrLockConflict
+// lockFiles picks the locks out of the files listed in a state's directory,
+// or the error listing them.
+func lockFiles(allFiles []string, err error) ([]string, error) {
+	if err != nil {
+		// states other than unclaimed and claimed only exist while they
+		// contain a lock, since git does not track empty directories
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
 	}
 
-	if strings.Contains(string(contents), pushRejectedString) {
-		return ErrLockConflict
+	var locks []string
+	for _, fileName := range allFiles {
+		if !strings.HasPrefix(fileName, ".") {
+			locks = append(locks, fileName)
+		}
 	}
 
-	if strings.Contains(string(contents), pushRemoteRejectedString) {
-		return ErrLockConflict
+	return locks, nil
+}
+
+func (glh *GitLockHandler) ReadLock(state string, lock string) ([]byte, error) {
+	return glh.readFile(filepath.Join(glh.poolDir(), state, lock))
+}
+
+// ReserveLock moves an available lock to the reserved state, recording when
+// the reservation lapses alongside it.
+func (glh *GitLockHandler) ReserveLock(until time.Time) (string, string, error) {
+	return glh.grabLock(glh.Source.Paths.Reserved, "reserving", func(name string) error {
+		return glh.WriteExpiry(glh.Source.Paths.Reserved, name, until)
+	})
+}
+
+func (glh *GitLockHandler) ConfirmLock(lockName string) (string, error) {
+	err := glh.incrementFencingToken(lockName)
+	if err != nil {
+		return "", err
 	}
 
-	return err
+	err = glh.recordBuildURL(lockName)
+	if err != nil {
+		return "", err
+	}
+
+	ref, err := glh.moveLock(lockName, glh.Source.Paths.Reserved, glh.Source.Paths.Claimed, "confirming", "")
+	if err != nil {
+		return "", err
+	}
+
+	err = glh.noteAudit(AuditClaimed, nil, lockName)
+	if err != nil {
+		return "", err
+	}
+
+	return ref, glh.tagClaim(lockName)
 }
 
-func (glh *GitLockHandler) git(args ...string) ([]byte, error) {
-	arguments := append([]string{"-C", glh.dir}, args...)
-	cmd := exec.Command("git", arguments...)
-	return cmd.CombinedOutput()
+func (glh *GitLockHandler) LapseReservation(lockName string) (string, error) {
+	return glh.moveLock(lockName, glh.Source.Paths.Reserved, glh.Source.Paths.Unclaimed, "lapsing reservation", "")
+}
+
+// ReservationExpiry reads when the reservation of a reserved lock lapses. A
+// reserved lock without a recorded expiry has already lapsed.
+func (glh *GitLockHandler) ReservationExpiry(lockName string) (time.Time, error) {
+	return glh.readExpiry(glh.Source.Paths.Reserved, lockName)
+}
+
+// LeaseLock claims an available lock, recording when its lease runs out
+// alongside it. until decides that once the lock is chosen; a zero time
+// leaves the claim without a lease.
+func (glh *GitLockHandler) LeaseLock(until func(lock string) time.Time) (string, string, error) {
+	return glh.grabLock(glh.Source.Paths.Claimed, "claiming", func(name string) error {
+		err := glh.incrementFencingToken(name)
+		if err != nil {
+			return err
+		}
+
+		err = glh.recordBuildURL(name)
+		if err != nil {
+			return err
+		}
+
+		expiry := until(name)
+		if expiry.IsZero() {
+			return nil
+		}
+
+		return glh.WriteExpiry(glh.Source.Paths.Claimed, name, expiry)
+	})
+}
+
+func (glh *GitLockHandler) RenewLease(lockName string, until time.Time) (string, error) {
+	_, err := glh.readFile(filepath.Join(glh.poolDir(), glh.Source.Paths.Claimed, lockName))
+	if err != nil {
+		return "", err
+	}
+
+	err = glh.WriteExpiry(glh.Source.Paths.Claimed, lockName, until)
+	if err != nil {
+		return "", err
+	}
+
+	return glh.commit("renewing lease", lockName, "")
+}
+
+// TransferLock records this build as the claimer of a lock another build
+// claimed: its fencing token is bumped, its build URL replaced, its lease
+// restarted to run out at until, or dropped if until is zero, and the claim
+// is tagged again, all in a single commit.
+func (glh *GitLockHandler) TransferLock(lockName string, until time.Time) (string, error) {
+	_, err := glh.readFile(filepath.Join(glh.poolDir(), glh.Source.Paths.Claimed, lockName))
+	if err != nil {
+		return "", err
+	}
+
+	claimedAt, err := glh.claimTimes(lockName)
+	if err != nil {
+		return "", err
+	}
+
+	err = glh.incrementFencingToken(lockName)
+	if err != nil {
+		return "", err
+	}
+
+	err = glh.recordBuildURL(lockName)
+	if err != nil {
+		return "", err
+	}
+
+	if until.IsZero() {
+		err = glh.removeFile(glh.expiryPath(glh.Source.Paths.Claimed, lockName), true)
+	} else {
+		err = glh.WriteExpiry(glh.Source.Paths.Claimed, lockName, until)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	body := transferTrailer + lockName
+	if pipeline := BuildPipeline(); pipeline != "" {
+		body += "\n" + pipelineTrailer + pipeline
+	}
+
+	ref, err := glh.commit("transferring", lockName, body)
+	if err != nil {
+		return "", err
+	}
+
+	err = glh.noteAudit(AuditTransferred, claimedAt, lockName)
+	if err != nil {
+		return "", err
+	}
+
+	return ref, glh.tagClaim(lockName)
+}
+
+func (glh *GitLockHandler) ReapLease(lockName string) (string, error) {
+	claimedAt, err := glh.claimTimes(lockName)
+	if err != nil {
+		return "", err
+	}
+
+	ref, err := glh.moveLock(lockName, glh.Source.Paths.Claimed, glh.Source.Paths.Unclaimed, "reaping", "")
+	if err != nil {
+		return "", err
+	}
+
+	return ref, glh.noteAudit(AuditReaped, claimedAt, lockName)
+}
+
+// LeaseExpiry reads when the lease of a claimed lock runs out. A claimed lock
+// without a recorded expiry has no lease, and is never reaped.
+func (glh *GitLockHandler) LeaseExpiry(lockName string) (time.Time, error) {
+	return glh.readExpiry(glh.Source.Paths.Claimed, lockName)
+}
+
+// WriteExpiry stages when the lock's time in the given state runs out, to be
+// committed with the next change.
+func (glh *GitLockHandler) WriteExpiry(state string, lockName string, until time.Time) error {
+	return glh.stageFile(glh.expiryPath(state, lockName), []byte(until.UTC().Format(time.RFC3339)+"\n"), 0644)
+}
+
+// readExpiry reads when the lock's time in the given state runs out, or the
+// zero time if none is recorded.
+func (glh *GitLockHandler) readExpiry(state string, lockName string) (time.Time, error) {
+	_, err := glh.readFile(filepath.Join(glh.poolDir(), state, lockName))
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	contents, err := glh.readFile(glh.expiryPath(state, lockName))
+	if os.IsNotExist(err) {
+		return time.Time{}, nil
+	}
+
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Parse(time.RFC3339, strings.TrimSpace(string(contents)))
+}
+
+// expiryPath is kept as a dotfile so that it isn't listed as a lock of the
+// state.
+func (glh *GitLockHandler) expiryPath(state string, lockName string) string {
+	return filepath.Join(glh.poolDir(), state, "."+lockName+".expires")
+}
+
+// FencingToken reads how many times the lock has been claimed.
+func (glh *GitLockHandler) FencingToken(lockName string) (int, error) {
+	contents, err := glh.readFile(glh.fencingTokenPath(lockName))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(strings.TrimSpace(string(contents)))
+}
+
+// incrementFencingToken stages the next fencing token of a lock that is being
+// claimed.
+func (glh *GitLockHandler) incrementFencingToken(lockName string) error {
+	token, err := glh.FencingToken(lockName)
+	if err != nil {
+		return err
+	}
+
+	return glh.WriteFencingToken(lockName, token+1)
+}
+
+// WriteFencingToken stages the fencing token of a lock, to be committed with
+// the next change.
+func (glh *GitLockHandler) WriteFencingToken(lockName string, token int) error {
+	return glh.stageFile(glh.fencingTokenPath(lockName), []byte(strconv.Itoa(token)+"\n"), 0644)
+}
+
+// transferTrailer marks the commits that transferred a claimed lock to
+// another build, which don't otherwise touch the lock.
+const transferTrailer = "Transferred: "
+
+// ClaimInfo finds when the lock was last claimed, and by whom, from the
+// commit that moved it into the claimed state, or from the last commit that
+// transferred it since.
+func (glh *GitLockHandler) ClaimInfo(lockName string) (ClaimInfo, error) {
+	claim, err := glh.currentClaimCommit(lockName)
+	if err != nil || claim == "" {
+		return ClaimInfo{}, err
+	}
+
+	output, err := glh.git("log", "-1", "--format=%cI%x00%an <%ae>", claim)
+	if err != nil {
+		return ClaimInfo{}, err
+	}
+
+	fields := strings.SplitN(strings.TrimSpace(string(output)), "\x00", 2)
+	if len(fields) != 2 {
+		return ClaimInfo{}, nil
+	}
+
+	at, err := time.Parse(time.RFC3339, fields[0])
+	if err != nil {
+		return ClaimInfo{}, err
+	}
+
+	return ClaimInfo{At: at, By: fields[1]}, nil
+}
+
+// ClaimPipeline reads the pipeline recorded in the commit that gave the lock
+// to the build holding it, or "" if the build ran in none or didn't say.
+func (glh *GitLockHandler) ClaimPipeline(lockName string) (string, error) {
+	claim, err := glh.currentClaimCommit(lockName)
+	if err != nil || claim == "" {
+		return "", err
+	}
+
+	output, err := glh.git("log", "-1", "--format=%B", claim)
+	if err != nil {
+		return "", err
+	}
+
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, pipelineTrailer) {
+			return strings.TrimPrefix(line, pipelineTrailer), nil
+		}
+	}
+
+	return "", nil
+}
+
+// currentClaimCommit is the commit that gave the lock to the build holding it.
+func (glh *GitLockHandler) currentClaimCommit(lockName string) (string, error) {
+	claim, names, err := glh.claimCommit(lockName)
+	if err != nil || claim == "" {
+		return "", err
+	}
+
+	// a transfer made before the lock was renamed names it as it was then
+	var grep []string
+	for _, name := range names {
+		grep = append(grep, "--grep=^"+transferTrailer+regexp.QuoteMeta(name)+"$")
+	}
+
+	transferred, err := glh.git(append([]string{"log", "-1", "--format=%H", "--extended-regexp"}, append(grep, claim+"..HEAD")...)...)
+	if err != nil {
+		return "", err
+	}
+
+	if transfer := strings.TrimSpace(string(transferred)); transfer != "" {
+		return transfer, nil
+	}
+
+	return claim, nil
+}
+
+// claimCommit is the commit that moved a claimed lock into the claimed
+// state, if any, along with each name the lock has had since. Renaming a
+// claimed lock keeps it claimed, so the claim is followed back through the
+// commits that renamed it.
+func (glh *GitLockHandler) claimCommit(lockName string) (string, []string, error) {
+	names := []string{lockName}
+	from := "HEAD"
+
+	for {
+		added, err := glh.addedCommit(lockName, from)
+		if err != nil || added == "" {
+			return "", nil, err
+		}
+
+		renamed, err := glh.renamedFrom(added, lockName)
+		if err != nil {
+			return "", nil, err
+		}
+
+		if renamed == "" {
+			return added, names, nil
+		}
+
+		lockName = renamed
+		names = append(names, renamed)
+		from = added + "^"
+	}
+}
+
+// addedCommit is the last commit up to from that added the lock to the
+// claimed state, if any.
+func (glh *GitLockHandler) addedCommit(lockName string, from string) (string, error) {
+	claimed := filepath.Join(glh.pool, glh.Source.Paths.Claimed, lockName)
+
+	for unshallowed := false; ; unshallowed = true {
+		added, err := glh.git("log", "-1", "--no-renames", "--diff-filter=A", "--format=%H %P", from, "--", claimed)
+		if err != nil {
+			return "", err
+		}
+
+		fields := strings.Fields(string(added))
+		if len(fields) == 0 {
+			return "", nil
+		}
+
+		// the boundary of a clone_since clone shows every lock as added in
+		// it, so a claim found there was made before, in the history the
+		// clone left out
+		if len(fields) > 1 || unshallowed {
+			return fields[0], nil
+		}
+
+		err = glh.unshallow()
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+// renamedFrom is the name the claimed lock had before the commit, if the
+// commit renamed it.
+func (glh *GitLockHandler) renamedFrom(commit string, lockName string) (string, error) {
+	body, err := glh.git("log", "-1", "--format=%B", commit)
+	if err != nil {
+		return "", err
+	}
+
+	renamed := false
+	for _, line := range strings.Split(string(body), "\n") {
+		if strings.TrimSpace(line) == renamedTrailer+lockName {
+			renamed = true
+		}
+	}
+
+	if !renamed {
+		return "", nil
+	}
+
+	claimed := filepath.Join(glh.pool, glh.Source.Paths.Claimed)
+
+	deleted, err := glh.git("diff-tree", "--no-commit-id", "--no-renames", "--diff-filter=D", "--name-only", "-r", commit, "--", claimed)
+	if err != nil {
+		return "", err
+	}
+
+	// what else was recorded alongside the lock moved with it
+	for _, path := range strings.Split(string(deleted), "\n") {
+		name := strings.TrimPrefix(path, claimed+"/")
+		if name != path && name != "" && !strings.Contains(name, "/") && !strings.HasPrefix(name, ".") {
+			return name, nil
+		}
+	}
+
+	return "", nil
+}
+
+// fencingTokenPath is kept outside of the state directories, so that the
+// token stays put as the lock moves between them.
+func (glh *GitLockHandler) fencingTokenPath(lockName string) string {
+	return filepath.Join(glh.poolDir(), FencingDir, lockName)
+}
+
+// grabLock moves an available lock to the given state, running record, if
+// given, to stage anything else that belongs in the same commit.
+func (glh *GitLockHandler) grabLock(to string, verb string, record func(name string) error) (string, string, error) {
+	locks, err := glh.availableLocks()
+	if err != nil {
+		return "", "", err
+	}
+
+	if glh.allow != nil {
+		locks = allowedLocks(locks, glh.allow)
+	}
+
+	if len(locks) == 0 {
+		return "", "", ErrNoLocksAvailable
+	}
+
+	pipeline := BuildPipeline()
+
+	var name string
+	if len(glh.candidates) > 0 {
+		name = FirstAvailable(glh.candidates, locks)
+	} else {
+		if glh.Source.Affinity == AffinityPipeline {
+			name = glh.preferredLock(pipeline, locks)
+		}
+
+		if name == "" {
+			name = glh.Selector.Select(locks, glh.lockWeights(locks))
+		}
+	}
+
+	if name == "" {
+		return "", "", ErrNoLocksAvailable
+	}
+
+	err = glh.moveFile(filepath.Join(glh.poolDir(), glh.Source.Paths.Unclaimed, name), filepath.Join(glh.poolDir(), to, name))
+	if err != nil {
+		return "", "", err
+	}
+
+	if record != nil {
+		err = record(name)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	body := ""
+	if pipeline != "" {
+		body = pipelineTrailer + pipeline
+	}
+	ref, err := glh.commit(verb, name, body)
+	if err != nil {
+		return "", "", err
+	}
+
+	if to == glh.Source.Paths.Claimed {
+		err = glh.noteAudit(AuditClaimed, nil, name)
+		if err != nil {
+			return "", "", err
+		}
+
+		err = glh.tagClaim(name)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	return name, ref, nil
+}
+
+// availableLocks lists the unclaimed locks from the tree of the commit the
+// pool is at, the branch as fetched along with anything committed to it
+// since, rather than from the checkout. Listing a tree only reads the
+// directories along its path, and works whether or not the pool is checked
+// out. A bare clone lists its staged tree instead, as it always has.
+func (glh *GitLockHandler) availableLocks() ([]string, error) {
+	tree := "HEAD"
+	if glh.Source.Bare {
+		tree = glh.tree
+	}
+
+	return lockFiles(glh.listTreeFiles(tree, filepath.Join(glh.poolDir(), glh.Source.Paths.Unclaimed)))
+}
+
+// releaseTimes finds when each lock last left the claimed directory, as the
+// commit time in seconds since the epoch, from a single walk of its history.
+func (glh *GitLockHandler) releaseTimes() map[string]int64 {
+	releasedAt := map[string]int64{}
+
+	claimed := filepath.Join(glh.pool, glh.Source.Paths.Claimed)
+
+	output, err := glh.git("log", "--format=%x00%ct", "--name-only", "--no-renames", "--", claimed)
+	if err != nil {
+		return releasedAt
+	}
+
+	for _, commit := range strings.Split(string(output), "\x00") {
+		lines := strings.Split(strings.TrimSpace(commit), "\n")
+
+		committedAt, err := strconv.ParseInt(lines[0], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		// commits are listed newest first, so the first one seen for each lock
+		// is the last time it moved in or out of claimed
+		for _, path := range lines[1:] {
+			lock := filepath.Base(strings.TrimSpace(path))
+			if _, seen := releasedAt[lock]; !seen && path != "" {
+				releasedAt[lock] = committedAt
+			}
+		}
+	}
+
+	return releasedAt
+}
+
+// lockWeights reads the weight declared by each lock whose metadata is a
+// JSON object with a numeric "weight".
+func (glh *GitLockHandler) lockWeights(locks []string) map[string]float64 {
+	weights := map[string]float64{}
+
+	unclaimed, err := glh.readLocks(glh.Source.Paths.Unclaimed, locks)
+	if err != nil {
+		return weights
+	}
+
+	// a lock whose metadata can't be decrypted weighs nothing in particular
+	for lock, contents := range unclaimed {
+		metadata, err := glh.Source.Encryption.Readable(contents)
+		if err != nil {
+			continue
+		}
+
+		if weight, ok := MetadataWeight(metadata); ok {
+			weights[lock] = weight
+		}
+	}
+
+	return weights
+}
+
+func (glh *GitLockHandler) BroadcastLockPool() error {
+	// every ref is spelled out in full so that nothing depends on how the
+	// remote or push.default resolve them, and the push is atomic so that
+	// claim tags and audit notes only land along with their claims
+	args := []string{"push", "--porcelain", "--atomic", "origin", "HEAD:refs/heads/" + glh.branch}
+	if glh.forcePushLease != "" {
+		args = append(args, "--force-with-lease=refs/heads/"+glh.branch+":"+glh.forcePushLease)
+	}
+	for _, tag := range glh.pendingTags {
+		args = append(args, "refs/tags/"+tag+":refs/tags/"+tag)
+	}
+	if glh.notesPending {
+		args = append(args, glh.notesRef+":"+AuditNotesRef)
+	}
+
+	output, err := glh.git(args...)
+
+	switch status, reason := ParsePushOutput(string(output)); status {
+	case PushUpToDate:
+		// someone else has made a commit in the same second acquiring the
+		// same lock
+		//
+		// we need to stop and try again
+		return ErrLockConflict
+
+	case PushConflicted:
+		return ErrLockConflict
+
+	case PushRefused:
+		return &GitError{
+			Class:   ErrorClassRefused,
+			Command: "git push",
+			Output:  reason,
+			Err:     err,
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	err = glh.verifyPush()
+	if err != nil {
+		return err
+	}
+
+	glh.pendingTags = nil
+	glh.notesPending = false
+	glh.mirrorLease = glh.forcePushLease
+	glh.forcePushLease = ""
+
+	return nil
+}
+
+// verifyPush checks that the branch on the remote now holds the commit just
+// pushed, treating it as a conflict if not, as some servers report success
+// for pushes they did not apply.
+func (glh *GitLockHandler) verifyPush() error {
+	output, err := glh.git("ls-remote", "origin", "refs/heads/"+glh.branch)
+	if err != nil {
+		return err
+	}
+
+	head, err := glh.git("rev-parse", "HEAD")
+	if err != nil {
+		return err
+	}
+
+	fields := strings.Fields(string(output))
+	if len(fields) > 0 && fields[0] == strings.TrimSpace(string(head)) {
+		return nil
+	}
+
+	// the branch may have moved on already, in which case it must have moved
+	// on from our commit
+	err = glh.fetchBranch(glh.branch)
+	if err != nil {
+		return err
+	}
+
+	_, err = glh.git("merge-base", "--is-ancestor", "HEAD", "origin/"+glh.branch)
+	if err != nil {
+		return ErrLockConflict
+	}
+
+	return nil
+}
+
+// fetchBranch updates origin/<branch> and nothing else: no other branches, no
+// tags, and only the history of the checked out commit is offered to the
+// remote when working out what to send, so retries transfer as little as
+// possible.
+func (glh *GitLockHandler) fetchBranch(branch string) error {
+	// worktrees of a shared clone share its remote-tracking refs
+	unlock, err := glh.lockSharedClone()
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	refspec := fmt.Sprintf("+refs/heads/%s:refs/remotes/origin/%s", branch, branch)
+
+	_, err = glh.runSince(glh.repoDir, []string{"fetch", "--no-tags", "--negotiation-tip=HEAD", "origin", refspec})
+	return err
+}
+
+func (glh *GitLockHandler) poolDir() string {
+	return filepath.Join(glh.repoDir, glh.pool)
+}
+
+// readFile reads a file of the pool's branch, failing with an error that
+// os.IsNotExist recognizes if it has none.
+func (glh *GitLockHandler) readFile(path string) ([]byte, error) {
+	if glh.Source.Bare {
+		return glh.readBareFile(path)
+	}
+
+	return ioutil.ReadFile(path)
+}
+
+// listFiles lists the names of the files in a directory of the pool's
+// branch.
+func (glh *GitLockHandler) listFiles(dir string) ([]string, error) {
+	if glh.Source.Bare {
+		return glh.listBareFiles(dir)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(files))
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+
+	return names, nil
+}
+
+// readLocks reads the contents of the locks in the state, leaving out any
+// that can't be read. A bare clone reads them all with two git commands,
+// rather than two for each, which for large pools is most of the time taken
+// to choose a lock.
+func (glh *GitLockHandler) readLocks(state string, locks []string) (map[string][]byte, error) {
+	dir := filepath.Join(glh.poolDir(), state)
+
+	if glh.Source.Bare {
+		return glh.readTreeFiles(glh.tree, dir, locks)
+	}
+
+	contents := map[string][]byte{}
+	for _, lock := range locks {
+		file, err := glh.readFile(filepath.Join(dir, lock))
+		if err == nil {
+			contents[lock] = file
+		}
+	}
+
+	return contents, nil
+}
+
+// readTreeFiles reads the named files in dir as of the given tree, leaving out
+// any that aren't there.
+func (glh *GitLockHandler) readTreeFiles(tree string, dir string, names []string) (map[string][]byte, error) {
+	output, err := glh.plumbing(nil, "--literal-pathspecs", "ls-tree", "-z", tree, "--", glh.treePath(dir)+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	entries := parseTree(output)
+
+	var oids bytes.Buffer
+	var found []string
+	for _, name := range names {
+		entry, ok := entries[name]
+		if !ok || entry.kind != "blob" {
+			continue
+		}
+
+		oids.WriteString(entry.oid + "\n")
+		found = append(found, name)
+	}
+
+	contents := map[string][]byte{}
+	if len(found) == 0 {
+		return contents, nil
+	}
+
+	output, err = glh.plumbing(oids.Bytes(), "cat-file", "--batch")
+	if err != nil {
+		return nil, err
+	}
+
+	blobs, err := readBatch(output, len(found))
+	if err != nil {
+		return nil, err
+	}
+
+	for i, name := range found {
+		contents[name] = blobs[i]
+	}
+
+	return contents, nil
+}
+
+// readBatch splits the output of git cat-file --batch into the contents of
+// each of the count objects asked for.
+func readBatch(output []byte, count int) ([][]byte, error) {
+	reader := bufio.NewReader(bytes.NewReader(output))
+
+	contents := make([][]byte, 0, count)
+	for len(contents) < count {
+		header, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("reading objects: %s", err)
+		}
+
+		fields := strings.Fields(header)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("reading objects: %s", strings.TrimSpace(header))
+		}
+
+		size, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("reading objects: %s", err)
+		}
+
+		content := make([]byte, size+1)
+		_, err = io.ReadFull(reader, content)
+		if err != nil {
+			return nil, fmt.Errorf("reading objects: %s", err)
+		}
+
+		contents = append(contents, content[:size])
+	}
+
+	return contents, nil
+}
+
+// listTreeFiles lists the files in dir as of the given tree, as listFiles
+// lists them from the working tree.
+func (glh *GitLockHandler) listTreeFiles(tree string, dir string) ([]string, error) {
+	output, err := glh.plumbing(nil, "--literal-pathspecs", "ls-tree", "-z", "--name-only", tree, "--", glh.treePath(dir)+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	// git does not track empty directories, so a directory without files
+	// does not exist
+	if len(output) == 0 {
+		return nil, &os.PathError{Op: "open", Path: dir, Err: os.ErrNotExist}
+	}
+
+	var names []string
+	for _, name := range strings.Split(strings.TrimSuffix(string(output), "\x00"), "\x00") {
+		names = append(names, path.Base(name))
+	}
+
+	return names, nil
+}
+
+// stageLock writes a lock file with the source's lock_file_mode, to be
+// committed with the next change.
+func (glh *GitLockHandler) stageLock(path string, contents []byte) error {
+	perm, err := glh.Source.LockFilePerm()
+	if err != nil {
+		return err
+	}
+
+	return glh.stageFile(path, contents, perm)
+}
+
+// stageFile writes a file, to be committed with the next change.
+func (glh *GitLockHandler) stageFile(path string, contents []byte, perm os.FileMode) error {
+	if glh.Source.Bare {
+		return glh.stageBareFile(path, contents, perm)
+	}
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	// a file that already exists may be read-only, and WriteFile would leave
+	// its mode alone anyway
+	err = os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	err = ioutil.WriteFile(path, contents, perm)
+	if err != nil {
+		return err
+	}
+
+	_, err = glh.git("add", path)
+	return err
+}
+
+// removeFile stages the removal of a file, which must exist unless
+// ignoreMissing is set.
+func (glh *GitLockHandler) removeFile(path string, ignoreMissing bool) error {
+	if glh.Source.Bare {
+		return glh.removeBareFile(path, ignoreMissing)
+	}
+
+	args := []string{"rm", "--quiet"}
+	if ignoreMissing {
+		args = append(args, "--ignore-unmatch")
+	}
+
+	_, err := glh.git(append(args, path)...)
+	return err
+}
+
+// moveFile stages moving a file.
+func (glh *GitLockHandler) moveFile(from string, to string) error {
+	if glh.Source.Bare {
+		return glh.moveBareFile(from, to)
+	}
+
+	// git does not track empty directories, so states that are often empty
+	// may not exist in the clone yet
+	err := os.MkdirAll(filepath.Dir(to), 0755)
+	if err != nil {
+		return err
+	}
+
+	_, err = glh.git("mv", from, to)
+	return err
+}
+
+// commit commits the staged changes, which do action to the lock, returning
+// the new commit. body, if any, follows the message in a paragraph of its
+// own.
+func (glh *GitLockHandler) commit(action string, lockName string, body string) (string, error) {
+	startedAt := time.Now()
+	defer func() {
+		glh.committing += time.Since(startedAt)
+	}()
+
+	message := fmt.Sprintf("%s: %s", action, lockName)
+	if glh.Source.CommitMessageTemplate != "" {
+		var err error
+		message, err = RenderCommitMessage(glh.Source.CommitMessageTemplate, action, lockName, glh.Source.Pool)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if body != "" {
+		message = strings.TrimRight(message, "\n") + "\n\n" + body
+	}
+
+	err := glh.stageLockIndex()
+	if err != nil {
+		return "", err
+	}
+
+	if glh.Source.Bare {
+		return glh.commitBare(message)
+	}
+
+	// a commit writes its objects into the store shared with the clone's
+	// other worktrees
+	unlock, err := glh.lockSharedClone()
+	if err != nil {
+		return "", err
+	}
+
+	defer unlock()
+
+	_, err = glh.git("commit", "-m", message)
+	if err != nil {
+		return "", err
+	}
+
+	ref, err := glh.git("rev-parse", "HEAD")
+	if err != nil {
+		return "", err
+	}
+
+	return string(ref), nil
+}
+
+func (glh *GitLockHandler) git(args ...string) ([]byte, error) {
+	return glh.run(glh.repoDir, args)
+}
+
+// run runs git in dir, authenticated with a current GitHub App installation
+// token if one is configured, and killed if it outlasts the source's
+// operation_timeout.
+func (glh *GitLockHandler) run(dir string, args []string, env ...string) ([]byte, error) {
+	return glh.runWithInput(dir, nil, args, env...)
+}
+
+// runWithInput runs git as run does, with input as its standard input.
+func (glh *GitLockHandler) runWithInput(dir string, input []byte, args []string, env ...string) ([]byte, error) {
+	return glh.runGit(dir, input, true, args, env...)
+}
+
+// plumbing runs a git command in the repository whose output is to be
+// parsed, given input as its standard input if any. Only its standard output
+// is returned, so that warnings can't be mistaken for what it was asked for;
+// its standard error is reported in the error if it fails.
+func (glh *GitLockHandler) plumbing(input []byte, args ...string) ([]byte, error) {
+	return glh.runGit(glh.repoDir, input, false, args)
+}
+
+func (glh *GitLockHandler) runGit(dir string, input []byte, combined bool, args []string, env ...string) ([]byte, error) {
+	// waiting for a turn doesn't count against the operation's timeout
+	err := glh.throttleRemote(args)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	if glh.Source.OperationTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, glh.Source.OperationTimeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, "git", append(glh.protocolArgs(), args...)...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), glh.sshEnv()...)
+	cmd.Env = append(cmd.Env, glh.caCertEnv()...)
+	cmd.Env = append(cmd.Env, env...)
+
+	if input != nil {
+		cmd.Stdin = bytes.NewReader(input)
+	}
+
+	// ssh and other helpers git starts can outlive it holding its output
+	// open; don't wait on them once git itself is gone
+	cmd.WaitDelay = time.Second
+
+	if glh.GitHubApp != nil {
+		appEnv, err := glh.GitHubApp.GitEnv(glh.Source.URI)
+		if err != nil {
+			return nil, err
+		}
+
+		cmd.Env = append(cmd.Env, appEnv...)
+	}
+
+	var output, diagnostics []byte
+	if combined {
+		output, err = cmd.CombinedOutput()
+		diagnostics = output
+	} else {
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		output, err = cmd.Output()
+		diagnostics = stderr.Bytes()
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return output, newTimeoutError(args, glh.Source.OperationTimeout)
+	}
+
+	if err != nil {
+		return output, newGitError(args, diagnostics, err)
+	}
+
+	return output, nil
 }
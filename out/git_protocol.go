@@ -0,0 +1,65 @@
+package out
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// DefaultProtocolVersion is the version of the git protocol asked for when the
+// source doesn't say. Version 2 only advertises the refs a command asks for,
+// rather than every ref of the repository on every fetch.
+const DefaultProtocolVersion = 2
+
+// ProtocolNegotiator is implemented by LockHandlers that can tell which
+// version of the git protocol the remote spoke to them, or 0 if they don't
+// know.
+type ProtocolNegotiator interface {
+	NegotiatedProtocol() int
+}
+
+// protocolV2 matches the capability advertisement of a remote speaking
+// protocol version 2, as traced by GIT_TRACE_PACKET.
+var protocolV2 = regexp.MustCompile(`(?m)< version 2$`)
+
+// protocolArgs configures git to ask for the source's protocol version.
+func (glh *GitLockHandler) protocolArgs() []string {
+	if glh.Source.ProtocolVersion == 0 {
+		return nil
+	}
+
+	return []string{"-c", "protocol.version=" + strconv.Itoa(glh.Source.ProtocolVersion)}
+}
+
+// NegotiatedProtocol is the version of the git protocol the remote spoke when
+// the pool was set up: 2 if it supports it, or 0 if it fell back to the
+// original protocol or protocol version 2 wasn't asked for.
+func (glh *GitLockHandler) NegotiatedProtocol() int {
+	return glh.negotiated
+}
+
+// negotiateProtocol asks the remote for the pool's branch with the packets
+// traced, to find whether it speaks protocol version 2; git silently falls
+// back to the original protocol otherwise.
+func (glh *GitLockHandler) negotiateProtocol() {
+	glh.negotiated = 0
+	if glh.Source.ProtocolVersion != 2 {
+		return
+	}
+
+	output, err := glh.run("", []string{"ls-remote", glh.Source.URI, "refs/heads/" + glh.Source.Branch}, "GIT_TRACE_PACKET=1")
+	if err == nil && protocolV2.Match(output) {
+		glh.negotiated = 2
+	}
+}
+
+// warnIfProtocolFellBack says so when the remote doesn't speak the protocol
+// version asked for, and every fetch pays for advertising all of its refs.
+func (lp *LockPool) warnIfProtocolFellBack() {
+	negotiator, ok := lp.LockHandler.(ProtocolNegotiator)
+	if !ok || lp.Source.ProtocolVersion != 2 || negotiator.NegotiatedProtocol() == 2 {
+		return
+	}
+
+	fmt.Fprintf(lp.Output, "the remote of pool: %s does not support git protocol version 2; using the original protocol\n", lp.Source.Pool)
+}
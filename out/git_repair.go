@@ -0,0 +1,69 @@
+package out
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// leftovers are files a git process leaves behind in the git directory when
+// it is killed partway through, e.g. by operation_timeout, and which make
+// later commands in the same clone fail.
+var leftovers = []struct {
+	name   string
+	reason string
+}{
+	{"index.lock", "a git process left index.lock behind"},
+	{"HEAD.lock", "a git process left HEAD.lock behind"},
+	{"config.lock", "a git process left config.lock behind"},
+	{"packed-refs.lock", "a git process left packed-refs.lock behind"},
+	{"shallow.lock", "a git process left shallow.lock behind"},
+	{"rebase-merge", "a rebase was interrupted"},
+	{"rebase-apply", "a rebase was interrupted"},
+	{"MERGE_HEAD", "a merge was interrupted"},
+}
+
+// corruption describes why the clone or worktree at dir is unusable, or
+// returns "" if it looks sound.
+func (glh *GitLockHandler) corruption(dir string) string {
+	output, err := glh.run(dir, []string{"rev-parse", "--absolute-git-dir"})
+	if err != nil {
+		return "it is not a git repository"
+	}
+
+	gitDir := strings.TrimSpace(string(output))
+
+	for _, leftover := range leftovers {
+		_, err := os.Stat(filepath.Join(gitDir, leftover.name))
+		if err == nil {
+			return leftover.reason
+		}
+	}
+
+	_, err = glh.run(dir, []string{"rev-parse", "--verify", "--quiet", "HEAD^{tree}"})
+	if err != nil {
+		return "its HEAD commit is missing"
+	}
+
+	// a shallow clone whose history has lost the commits it is cut off at
+	// only shows itself when the history is walked
+	_, err = os.Stat(filepath.Join(gitDir, "shallow"))
+	if err == nil {
+		_, err = glh.run(dir, []string{"rev-list", "--quiet", "HEAD"})
+		if err != nil {
+			return "its shallow history is incomplete"
+		}
+	}
+
+	return ""
+}
+
+// reclone replaces a clone that has become unusable with a fresh one.
+func (glh *GitLockHandler) reclone() error {
+	err := glh.Cleanup()
+	if err != nil {
+		return err
+	}
+
+	return glh.Setup()
+}
@@ -0,0 +1,77 @@
+package out
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// setupSubmodules initializes the configured submodules and, if the pool lives
+// inside one of them, points the handler at that submodule so that claims are
+// committed and pushed there rather than to the superproject.
+func (glh *GitLockHandler) setupSubmodules() error {
+	args := []string{"submodule", "update", "--init"}
+	if !glh.Source.Submodules.All {
+		args = append(args, "--")
+		args = append(args, glh.Source.Submodules.Paths...)
+	}
+
+	_, err := glh.git(args...)
+	if err != nil {
+		return fmt.Errorf("failed to update submodules: %s", err)
+	}
+
+	name, path, found := glh.poolSubmodule()
+	if !found {
+		return nil
+	}
+
+	branch := glh.Source.Branch
+
+	configuredBranch, err := glh.git("config", "-f", ".gitmodules", "submodule."+name+".branch")
+	if err == nil && strings.TrimSpace(string(configuredBranch)) != "" {
+		branch = strings.TrimSpace(string(configuredBranch))
+	}
+
+	glh.repoDir = filepath.Join(glh.dir, path)
+	glh.pool = strings.TrimPrefix(strings.TrimPrefix(glh.Source.Pool, path), "/")
+	glh.branch = branch
+
+	err = glh.fetchBranch(branch)
+	if err != nil {
+		return fmt.Errorf("failed to fetch branch %s of submodule %s: %s", branch, path, err)
+	}
+
+	_, err = glh.git("checkout", "-B", branch, "origin/"+branch)
+	if err != nil {
+		return fmt.Errorf("failed to check out branch %s of submodule %s: %s", branch, path, err)
+	}
+
+	return nil
+}
+
+// poolSubmodule finds the submodule, if any, that contains the pool.
+func (glh *GitLockHandler) poolSubmodule() (string, string, bool) {
+	output, err := glh.git("config", "-f", ".gitmodules", "--get-regexp", `^submodule\..*\.path$`)
+	if err != nil {
+		return "", "", false
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+
+		key, path := fields[0], filepath.Clean(fields[1])
+		if glh.Source.Pool != path && !strings.HasPrefix(glh.Source.Pool, path+"/") {
+			continue
+		}
+
+		name := strings.TrimSuffix(strings.TrimPrefix(key, "submodule."), ".path")
+
+		return name, path, true
+	}
+
+	return "", "", false
+}
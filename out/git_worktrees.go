@@ -0,0 +1,139 @@
+package out
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// addWorktree sets the handler's directory up as a worktree of a clone of the
+// pool's repository kept in source.cache_dir, rather than cloning afresh, so
+// that operations run by the same container share one object store. The
+// shared clone is created on first use and brought up to date with the
+// branch each time.
+func (glh *GitLockHandler) addWorktree(branchExists bool) error {
+	err := os.MkdirAll(glh.Source.CacheDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	glh.cache = filepath.Join(glh.Source.CacheDir, fmt.Sprintf("%x", sha1.Sum([]byte(glh.Source.URI))))
+
+	unlock, err := lockCache(glh.cache)
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	_, err = os.Stat(glh.cache)
+	if err == nil && glh.corruption(glh.cache) != "" {
+		// nothing else can be using the clone while we hold its lock, so
+		// whatever is wrong with it won't be put right by waiting
+		err = os.RemoveAll(glh.cache)
+		if err != nil {
+			return err
+		}
+
+		_, err = os.Stat(glh.cache)
+	}
+
+	if os.IsNotExist(err) {
+		cloneArgs := []string{"clone", "--bare", "--single-branch", "--no-tags"}
+		if branchExists {
+			cloneArgs = append(cloneArgs, "--branch", glh.Source.Branch)
+		}
+		cloneArgs = append(cloneArgs, glh.Source.URI, glh.cache)
+
+		_, err = glh.runSince("", cloneArgs)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	start := "HEAD"
+	if branchExists {
+		refspec := fmt.Sprintf("+refs/heads/%s:refs/remotes/origin/%s", glh.Source.Branch, glh.Source.Branch)
+
+		_, err = glh.runSince(glh.cache, []string{"fetch", "--no-tags", "origin", refspec})
+		if err != nil {
+			return err
+		}
+
+		start = "refs/remotes/origin/" + glh.Source.Branch
+	}
+
+	// git would otherwise collect garbage during whichever operation happened
+	// to trigger it, racing the others; it is only done here instead, under
+	// the clone's lock, at git's usual threshold
+	_, err = glh.run(glh.cache, []string{"config", "gc.auto", "0"})
+	if err != nil {
+		return err
+	}
+
+	_, err = glh.run(glh.cache, []string{"-c", "gc.auto=6700", "gc", "--auto", "--quiet"})
+	if err != nil {
+		return err
+	}
+
+	// forget the worktrees of operations that were killed before cleaning up
+	_, err = glh.run(glh.cache, []string{"worktree", "prune"})
+	if err != nil {
+		return err
+	}
+
+	// worktrees are detached, as a branch can only be checked out in one of
+	// them at a time; pushes name the branch explicitly anyway
+	_, err = glh.run(glh.cache, []string{"worktree", "add", "--detach", glh.dir, start}, "GIT_LFS_SKIP_SMUDGE=1")
+	return err
+}
+
+// removeWorktree removes the handler's worktree from the shared clone.
+func (glh *GitLockHandler) removeWorktree() error {
+	unlock, err := lockCache(glh.cache)
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	_, err = glh.run(glh.cache, []string{"worktree", "remove", "--force", glh.dir})
+	return err
+}
+
+// lockSharedClone takes the lock on the shared clone the handler's worktree
+// belongs to, if it has one, for changes that other containers sharing the
+// clone must not see half made. The returned function releases it.
+func (glh *GitLockHandler) lockSharedClone() (func(), error) {
+	if glh.cache == "" {
+		return func() {}, nil
+	}
+
+	return lockCache(glh.cache)
+}
+
+// lockCache takes an exclusive lock on a shared clone, held until the
+// returned function is called, so that operations sharing it, in this
+// container or in others on the same cache volume, don't race to create it,
+// to update the refs all of its worktrees see, or to write objects while it
+// is collecting garbage. The lock is a file beside the clone, so it is seen
+// by every container that mounts the volume.
+func lockCache(cache string) (func(), error) {
+	file, err := os.OpenFile(cache+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	err = lockFile(file, true)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return func() {
+		unlockFile(file)
+		file.Close()
+	}, nil
+}
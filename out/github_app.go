@@ -0,0 +1,207 @@
+package out
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultGitHubAPIURL = "https://api.github.com"
+
+// installation tokens are refreshed this long before they expire, so that a
+// token never runs out part way through a clone or push
+const gitHubTokenRefreshMargin = 5 * time.Minute
+
+// GitHubApp authenticates to GitHub as an installation of a GitHub App, so
+// that pools don't depend on a machine user's personal access token.
+type GitHubApp struct {
+	AppID          string `json:"app_id"`
+	InstallationID string `json:"installation_id"`
+	PrivateKey     string `json:"private_key"`
+
+	// APIURL is the GitHub API to mint tokens with, for GitHub Enterprise
+	// Server; it defaults to DefaultGitHubAPIURL.
+	APIURL string `json:"api_url"`
+}
+
+func (app GitHubApp) Enabled() bool {
+	return app.AppID != "" || app.InstallationID != "" || app.PrivateKey != ""
+}
+
+// GitHubAppTokenSource mints installation tokens when they are first needed
+// and again shortly before they expire, since a build waiting for a lock can
+// outlive a single token.
+type GitHubAppTokenSource struct {
+	App    GitHubApp
+	Client *http.Client
+
+	// Now is the current time; it is only replaced in tests.
+	Now func() time.Time
+
+	mutex   sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func NewGitHubAppTokenSource(app GitHubApp) *GitHubAppTokenSource {
+	return &GitHubAppTokenSource{
+		App:    app,
+		Client: &http.Client{Timeout: 30 * time.Second},
+		Now:    time.Now,
+	}
+}
+
+// Token returns an installation token that is valid for at least a few more
+// minutes.
+func (source *GitHubAppTokenSource) Token() (string, error) {
+	source.mutex.Lock()
+	defer source.mutex.Unlock()
+
+	if source.token != "" && source.Now().Add(gitHubTokenRefreshMargin).Before(source.expires) {
+		return source.token, nil
+	}
+
+	jwt, err := source.appJWT()
+	if err != nil {
+		return "", err
+	}
+
+	apiURL := source.App.APIURL
+	if apiURL == "" {
+		apiURL = DefaultGitHubAPIURL
+	}
+
+	url := fmt.Sprintf("%s/app/installations/%s/access_tokens", strings.TrimSuffix(apiURL, "/"), source.App.InstallationID)
+
+	request, err := http.NewRequest("POST", url, nil)
+	if err != nil {
+		return "", err
+	}
+
+	request.Header.Set("Authorization", "Bearer "+jwt)
+	request.Header.Set("Accept", "application/vnd.github+json")
+
+	response, err := source.Client.Do(request)
+	if err != nil {
+		return "", fmt.Errorf("minting GitHub App installation token: %s", err)
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusCreated {
+		var failure struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(response.Body).Decode(&failure)
+
+		return "", fmt.Errorf("minting GitHub App installation token: %s: %s", response.Status, failure.Message)
+	}
+
+	var minted struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+
+	err = json.NewDecoder(response.Body).Decode(&minted)
+	if err != nil {
+		return "", fmt.Errorf("minting GitHub App installation token: %s", err)
+	}
+
+	source.token = minted.Token
+	source.expires = minted.ExpiresAt
+
+	return source.token, nil
+}
+
+// GitEnv returns the environment that has git send the current installation
+// token to the host of the given URI, appended to any config the environment
+// already passes to git. The token is only sent to that host, and not to
+// mirrors, submodules or LFS servers elsewhere; a URI that isn't HTTP(S) gets
+// nothing, as git would have nowhere to send it.
+func (source *GitHubAppTokenSource) GitEnv(uri string) ([]string, error) {
+	parsed, err := url.Parse(uri)
+	if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+		return nil, nil
+	}
+
+	token, err := source.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	index, _ := strconv.Atoi(os.Getenv("GIT_CONFIG_COUNT"))
+	credentials := base64.StdEncoding.EncodeToString([]byte("x-access-token:" + token))
+
+	return []string{
+		fmt.Sprintf("GIT_CONFIG_KEY_%d=http.%s://%s/.extraHeader", index, parsed.Scheme, parsed.Host),
+		fmt.Sprintf("GIT_CONFIG_VALUE_%d=Authorization: Basic %s", index, credentials),
+		fmt.Sprintf("GIT_CONFIG_COUNT=%d", index+1),
+	}, nil
+}
+
+// appJWT signs the short-lived JWT that identifies the app itself, which is
+// only good for minting installation tokens.
+func (source *GitHubAppTokenSource) appJWT() (string, error) {
+	key, err := parseRSAPrivateKey(source.App.PrivateKey)
+	if err != nil {
+		return "", err
+	}
+
+	// backdated to allow for clock drift between us and GitHub, which
+	// rejects JWTs issued in the future or valid for more than 10 minutes
+	now := source.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": source.App.AppID,
+	})
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func parseRSAPrivateKey(encoded string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(bytes.TrimSpace([]byte(encoded)))
+	if block == nil {
+		return nil, errors.New("github_app.private_key is not a PEM encoded key")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("github_app.private_key is not an RSA private key: %s", err)
+	}
+
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("github_app.private_key is not an RSA private key")
+	}
+
+	return key, nil
+}
@@ -0,0 +1,166 @@
+package out_test
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/concourse/pool-resource/out"
+)
+
+var _ = Describe("GitHub App installation tokens", func() {
+	var (
+		key    *rsa.PrivateKey
+		server *httptest.Server
+		now    time.Time
+
+		requests []*http.Request
+		minted   int
+
+		tokenSource *out.GitHubAppTokenSource
+	)
+
+	BeforeEach(func() {
+		var err error
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		now = time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+		requests = nil
+		minted = 0
+
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests = append(requests, r)
+			minted++
+
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"token":      "ghs_token" + string(rune('0'+minted)),
+				"expires_at": now.Add(time.Hour),
+			})
+		}))
+
+		tokenSource = out.NewGitHubAppTokenSource(out.GitHubApp{
+			AppID:          "1234",
+			InstallationID: "5678",
+			PrivateKey:     string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})),
+			APIURL:         server.URL,
+		})
+		tokenSource.Now = func() time.Time { return now }
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("mints a token for the installation with a JWT signed by the app", func() {
+		token, err := tokenSource.Token()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(token).Should(Equal("ghs_token1"))
+
+		Ω(requests).Should(HaveLen(1))
+		Ω(requests[0].Method).Should(Equal("POST"))
+		Ω(requests[0].URL.Path).Should(Equal("/app/installations/5678/access_tokens"))
+
+		jwt := strings.TrimPrefix(requests[0].Header.Get("Authorization"), "Bearer ")
+		parts := strings.Split(jwt, ".")
+		Ω(parts).Should(HaveLen(3))
+
+		signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+		Ω(err).ShouldNot(HaveOccurred())
+
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		Ω(rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature)).Should(Succeed())
+
+		payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+		Ω(err).ShouldNot(HaveOccurred())
+
+		var claims map[string]interface{}
+		Ω(json.Unmarshal(payload, &claims)).Should(Succeed())
+		Ω(claims["iss"]).Should(Equal("1234"))
+		Ω(claims["exp"]).Should(BeNumerically("<=", now.Add(10*time.Minute).Unix()))
+	})
+
+	It("reuses a token until it is about to expire", func() {
+		token, err := tokenSource.Token()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(token).Should(Equal("ghs_token1"))
+
+		now = now.Add(50 * time.Minute)
+
+		token, err = tokenSource.Token()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(token).Should(Equal("ghs_token1"))
+
+		now = now.Add(6 * time.Minute)
+
+		token, err = tokenSource.Token()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(token).Should(Equal("ghs_token2"))
+	})
+
+	It("has git send the token as an HTTP header to the pool's host", func() {
+		env, err := tokenSource.GitEnv("https://github.example.com/org/pool.git")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		credentials := base64.StdEncoding.EncodeToString([]byte("x-access-token:ghs_token1"))
+		Ω(env).Should(ContainElement("GIT_CONFIG_VALUE_0=Authorization: Basic " + credentials))
+		Ω(env).Should(ContainElement("GIT_CONFIG_KEY_0=http.https://github.example.com/.extraHeader"))
+		Ω(env).Should(ContainElement("GIT_CONFIG_COUNT=1"))
+	})
+
+	It("keeps the token from a mirror on another host", func() {
+		env, err := tokenSource.GitEnv("https://github.example.com/org/pool.git")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		header := func(uri string) string {
+			config := exec.Command("git", "config", "--get-urlmatch", "http.extraHeader", uri)
+			config.Env = append(os.Environ(), env...)
+
+			// git exits 1 when no config matches
+			output, _ := config.Output()
+			return strings.TrimSpace(string(output))
+		}
+
+		Ω(header("https://github.example.com/org/other.git")).Should(HavePrefix("Authorization: Basic "))
+		Ω(header("https://mirror.example.com/org/pool.git")).Should(BeEmpty())
+	})
+
+	It("has nothing for git to send over ssh", func() {
+		env, err := tokenSource.GitEnv("git@github.example.com:org/pool.git")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(env).Should(BeEmpty())
+		Ω(requests).Should(BeEmpty())
+	})
+
+	It("says why GitHub refused to mint a token", func() {
+		server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message":"Not Found"}`))
+		})
+
+		_, err := tokenSource.Token()
+		Ω(err).Should(MatchError("minting GitHub App installation token: 404 Not Found: Not Found"))
+	})
+
+	It("rejects a private key that is not PEM encoded", func() {
+		tokenSource.App.PrivateKey = "not a key"
+
+		_, err := tokenSource.Token()
+		Ω(err).Should(MatchError("github_app.private_key is not a PEM encoded key"))
+	})
+})
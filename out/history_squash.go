@@ -0,0 +1,272 @@
+package out
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultSquashOlderThanDays is how much history squash_history keeps when
+// the params don't say.
+const DefaultSquashOlderThanDays = 30
+
+// A pool's branch gains a commit for every change to it, so left alone its
+// history, and with it every clone, grows without bound. SquashHistory folds
+// the commits made before a cutoff into a single snapshot commit of the tree
+// they left behind, and rebuilds the commits made since on top of it with
+// their trees, messages, authors and dates intact. The result is pushed with
+// a lease on the head it was rewritten from, so a change made to the pool in
+// the meantime is never lost: the push is refused as a conflict, and the
+// squash is done again on top of it.
+
+// SquashHistory squashes the commits of the pool's branch made before
+// before, returning the head and how many commits were squashed. It
+// stops short of the commit that claimed any lock that is still claimed, so
+// that when and by whom it was claimed is still known. Nothing is squashed
+// when there is at most one commit to squash.
+func (glh *GitLockHandler) SquashHistory(before time.Time) (string, int, error) {
+	// what is squashed is decided from the whole history, not just what
+	// clone_since fetched
+	err := glh.unshallow()
+	if err != nil {
+		return "", 0, err
+	}
+
+	output, err := glh.git("rev-parse", "HEAD")
+	if err != nil {
+		return "", 0, err
+	}
+
+	head := strings.TrimSpace(string(output))
+
+	base, err := glh.squashBase(before)
+	if err != nil || base == "" {
+		return head, 0, err
+	}
+
+	output, err = glh.git("rev-list", "--count", base)
+	if err != nil {
+		return "", 0, err
+	}
+
+	squashed, err := strconv.Atoi(strings.TrimSpace(string(output)))
+	if err != nil {
+		return "", 0, err
+	}
+
+	if squashed < 2 {
+		return head, 0, nil
+	}
+
+	if !glh.Source.Bare {
+		// the rewritten commits are written into the store shared with the
+		// clone's other worktrees
+		unlock, err := glh.lockSharedClone()
+		if err != nil {
+			return "", 0, err
+		}
+
+		defer unlock()
+	}
+
+	snapshot, err := glh.snapshotCommit(base, squashed)
+	if err != nil {
+		return "", 0, err
+	}
+
+	rebuilt, err := glh.rebuildCommits(base, snapshot)
+	if err != nil {
+		return "", 0, err
+	}
+
+	// the pool must look exactly as it did, only with less history behind it
+	same, err := glh.sameTree(head, rebuilt)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if !same {
+		return "", 0, fmt.Errorf("squashed history of pool %s doesn't end in the tree it started from", glh.Source.Pool)
+	}
+
+	_, err = glh.git("update-ref", "HEAD", rebuilt, head)
+	if err != nil {
+		return "", 0, err
+	}
+
+	glh.forcePushLease = head
+
+	return rebuilt, squashed, nil
+}
+
+// squashBase finds the newest commit made before before that precedes the
+// claim of every lock that is still claimed, or nothing if there is none.
+// Only the first parents of commits are followed.
+func (glh *GitLockHandler) squashBase(before time.Time) (string, error) {
+	base, err := glh.newestCommitBefore(before, "HEAD")
+	if err != nil || base == "" {
+		return "", err
+	}
+
+	claimed, err := glh.ListLocks(glh.Source.Paths.Claimed)
+	if err != nil {
+		return "", err
+	}
+
+	// each claim can only move the base further back, so claims that were
+	// already after it stay after it
+	for _, lock := range claimed {
+		claim, _, err := glh.claimCommit(lock)
+		if err != nil {
+			return "", err
+		}
+
+		if claim == "" {
+			continue
+		}
+
+		_, err = glh.git("merge-base", "--is-ancestor", claim, base)
+		if err != nil {
+			// not an ancestor, so the claim is kept
+			continue
+		}
+
+		base, err = glh.newestCommitBefore(before, claim+"^")
+		if err != nil || base == "" {
+			return "", err
+		}
+	}
+
+	return base, nil
+}
+
+func (glh *GitLockHandler) newestCommitBefore(before time.Time, from string) (string, error) {
+	// the root commit has no parent to start from
+	_, err := glh.git("rev-parse", "--verify", "--quiet", from+"^{commit}")
+	if err != nil {
+		return "", nil
+	}
+
+	output, err := glh.git("rev-list", "-1", "--first-parent", "--before="+before.Format(time.RFC3339), from)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
+
+// snapshotCommit commits the tree of base without a parent. It is dated as
+// base was, so that anything that reads times from the history finds the
+// locks no younger than they are.
+func (glh *GitLockHandler) snapshotCommit(base string, squashed int) (string, error) {
+	output, err := glh.git("log", "-1", "--format=%cI", base)
+	if err != nil {
+		return "", err
+	}
+
+	date := strings.TrimSpace(string(output))
+	message := fmt.Sprintf("squashing history: %s\n\n%d commit(s) made up to %s", glh.Source.Pool, squashed, date)
+
+	output, err = glh.run(glh.repoDir, []string{"commit-tree", base + "^{tree}", "-m", message}, "GIT_AUTHOR_DATE="+date, "GIT_COMMITTER_DATE="+date)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
+
+// rebuildCommits commits each commit made after base again on top of
+// parent, in order, returning the last of them.
+func (glh *GitLockHandler) rebuildCommits(base string, parent string) (string, error) {
+	// fields are split by unit separators and commits by NULs, neither of
+	// which a commit message holds
+	output, err := glh.git("log", "-z", "--first-parent", "--reverse", "--format=%T%x1f%an%x1f%ae%x1f%aI%x1f%cn%x1f%ce%x1f%cI%x1f%B", base+"..HEAD")
+	if err != nil {
+		return "", err
+	}
+
+	for _, record := range strings.Split(string(output), "\x00") {
+		fields := strings.SplitN(record, "\x1f", 8)
+		if len(fields) != 8 {
+			continue
+		}
+
+		env := []string{
+			"GIT_AUTHOR_NAME=" + fields[1],
+			"GIT_AUTHOR_EMAIL=" + fields[2],
+			"GIT_AUTHOR_DATE=" + fields[3],
+			"GIT_COMMITTER_NAME=" + fields[4],
+			"GIT_COMMITTER_EMAIL=" + fields[5],
+			"GIT_COMMITTER_DATE=" + fields[6],
+		}
+
+		commit, err := glh.runWithInput(glh.repoDir, []byte(fields[7]), []string{"commit-tree", fields[0], "-p", parent}, env...)
+		if err != nil {
+			return "", err
+		}
+
+		parent = strings.TrimSpace(string(commit))
+	}
+
+	return parent, nil
+}
+
+func (glh *GitLockHandler) sameTree(a string, b string) (bool, error) {
+	output, err := glh.git("rev-parse", a+"^{tree}", b+"^{tree}")
+	if err != nil {
+		return false, err
+	}
+
+	trees := strings.Fields(string(output))
+
+	return len(trees) == 2 && trees[0] == trees[1], nil
+}
+
+// SquashHistory squashes the history of the pool's branch older than
+// olderThan into a single commit. Builds changing the pool meanwhile are
+// waited out rather than overwritten.
+func (lp *LockPool) SquashHistory(olderThan time.Duration) (string, Version, error) {
+	return lp.traced("squash", func() (string, Version, error) {
+		before := lp.now().Add(-olderThan)
+		fmt.Fprintf(lp.Output, "squashing history of pool: %s made before %s\n", lp.Source.Pool, before.Format(time.RFC3339))
+
+		err := lp.setup()
+		if err != nil {
+			return "", Version{}, err
+		}
+
+		defer lp.LockHandler.Cleanup()
+
+		squashed := 0
+
+		ref, err := lp.commitChange("the pool", func() (string, error) {
+			ref, count, err := lp.LockHandler.SquashHistory(before)
+			if err != nil {
+				fmt.Fprintf(lp.Output, "\nfailed squashing the history of the pool: %s! (err: %s)\n", lp.Source.Pool, err)
+				return "", err
+			}
+
+			squashed = count
+
+			if squashed == 0 {
+				return ref, errUnchanged
+			}
+
+			return ref, nil
+		})
+		if err != nil {
+			return "", Version{}, err
+		}
+
+		if squashed == 0 {
+			fmt.Fprintln(lp.Output, "nothing to squash")
+		} else {
+			fmt.Fprintf(lp.Output, "squashed %d commit(s)\n", squashed)
+		}
+
+		lp.addMetadata("squashed_commits", strconv.Itoa(squashed))
+
+		return "", Version{Ref: strings.TrimSpace(ref)}, nil
+	})
+}
@@ -0,0 +1,51 @@
+package out
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// Hooks are scripts run around changes to a lock, for side effects such as
+// registering claims in an external system.
+type Hooks struct {
+	PostClaim  string `json:"post_claim"`
+	PreRelease string `json:"pre_release"`
+}
+
+// RelativeTo resolves relative hook paths against dir, the directory holding
+// the step's inputs.
+func (hooks Hooks) RelativeTo(dir string) Hooks {
+	resolve := func(path string) string {
+		if path == "" || filepath.IsAbs(path) {
+			return path
+		}
+
+		return filepath.Join(dir, path)
+	}
+
+	return Hooks{
+		PostClaim:  resolve(hooks.PostClaim),
+		PreRelease: resolve(hooks.PreRelease),
+	}
+}
+
+// RunHook runs script with the lock's name as its argument and its metadata
+// on stdin. LOCK_NAME and POOL_NAME are set in its environment as well.
+func RunHook(script string, lock string, pool string, metadata []byte, output io.Writer) error {
+	cmd := exec.Command(script, lock)
+	cmd.Env = append(os.Environ(), "LOCK_NAME="+lock, "POOL_NAME="+pool)
+	cmd.Stdin = bytes.NewReader(metadata)
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("hook %s failed: %s", script, err)
+	}
+
+	return nil
+}
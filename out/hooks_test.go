@@ -0,0 +1,65 @@
+package out_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+
+	"github.com/concourse/pool-resource/out"
+)
+
+var _ = Describe("Hooks", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "hooks")
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	writeScript := func(name string, contents string) string {
+		path := filepath.Join(dir, name)
+		err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+contents), 0755)
+		Ω(err).ShouldNot(HaveOccurred())
+		return path
+	}
+
+	It("resolves relative paths against the inputs directory", func() {
+		hooks := out.Hooks{PostClaim: "repo/post-claim.sh", PreRelease: "/bin/pre-release"}
+
+		Ω(hooks.RelativeTo("/tmp/build")).Should(Equal(out.Hooks{
+			PostClaim:  "/tmp/build/repo/post-claim.sh",
+			PreRelease: "/bin/pre-release",
+		}))
+	})
+
+	It("gives the script the lock's name, pool, and metadata", func() {
+		recorded := filepath.Join(dir, "recorded")
+		script := writeScript("hook", `echo "$1 $LOCK_NAME $POOL_NAME $(cat)" > `+recorded+"\necho registered\n")
+
+		output := gbytes.NewBuffer()
+		err := out.RunHook(script, "some-lock", "some-pool", []byte("some-metadata"), output)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		contents, err := ioutil.ReadFile(recorded)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(contents)).Should(Equal("some-lock some-lock some-pool some-metadata\n"))
+
+		Ω(output).Should(gbytes.Say("registered"))
+	})
+
+	It("fails when the script does", func() {
+		script := writeScript("hook", "exit 3\n")
+
+		err := out.RunHook(script, "some-lock", "some-pool", nil, gbytes.NewBuffer())
+		Ω(err).Should(MatchError(ContainSubstring("hook " + script + " failed")))
+	})
+})
@@ -0,0 +1,285 @@
+package out
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// LockIndexFile is the file, at the top of a pool, that source.lock_index
+// keeps every lock's state in.
+const LockIndexFile = ".index.json"
+
+// Finding out which state each lock of a pool is in means listing every state
+// directory, and finding out when and by whom a lock was claimed means walking
+// the history of the branch, neither of which scales to pools of thousands of
+// locks. With source.lock_index set, every commit also updates an index of the
+// pool, mapping each lock to its state, who put it there if it is claimed, and
+// since when, from just the files that the commit changes. As it is committed
+// along with the change it describes, the index is never out of step with the
+// pool, as long as everything changing the pool keeps it. A pool without an
+// index has one built from its locks by the next change made to it, so
+// deleting the index rebuilds it.
+
+// LockIndex is the index of a pool's locks, by name.
+type LockIndex struct {
+	Locks map[string]LockIndexEntry `json:"locks"`
+}
+
+// LockIndexEntry is a lock in the LockIndex. State is one of SnapshotStates,
+// rather than the path the pool keeps it in.
+type LockIndexEntry struct {
+	State   string     `json:"state"`
+	Claimer string     `json:"claimer,omitempty"`
+	Since   *time.Time `json:"since,omitempty"`
+}
+
+// LockIndexReader is implemented by LockHandlers that can read the pool's
+// index, if it keeps one.
+type LockIndexReader interface {
+	// ReadLockIndex returns false if the pool keeps no index.
+	ReadLockIndex() (LockIndex, bool, error)
+}
+
+// ReadLockIndex reads the index of the pool, as of the last change staged.
+func (glh *GitLockHandler) ReadLockIndex() (LockIndex, bool, error) {
+	if !glh.Source.LockIndex {
+		return LockIndex{}, false, nil
+	}
+
+	contents, err := glh.readFile(glh.lockIndexPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return LockIndex{}, false, nil
+		}
+
+		return LockIndex{}, false, err
+	}
+
+	index := LockIndex{}
+	err = json.Unmarshal(contents, &index)
+	if err != nil {
+		return LockIndex{}, false, err
+	}
+
+	if index.Locks == nil {
+		index.Locks = map[string]LockIndexEntry{}
+	}
+
+	return index, true, nil
+}
+
+// stageLockIndex updates the index with the changes staged to the pool, to
+// be committed along with them.
+func (glh *GitLockHandler) stageLockIndex() error {
+	if !glh.Source.LockIndex {
+		return nil
+	}
+
+	// a destroyed pool takes its index with it
+	exists, err := glh.poolExists()
+	if err != nil || !exists {
+		return err
+	}
+
+	index, found, err := glh.ReadLockIndex()
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		index, err = glh.buildLockIndex()
+		if err != nil {
+			return err
+		}
+	}
+
+	changes, err := glh.stagedChanges()
+	if err != nil {
+		return err
+	}
+
+	states := map[string]string{}
+	for state, path := range snapshotPaths(glh.Source) {
+		states[path] = state
+	}
+
+	removed := map[string]bool{}
+	added := map[string]string{}
+	claimed := map[string]bool{}
+
+	for _, change := range changes {
+		dir, name := filepath.Split(change.path)
+		dir = filepath.Clean(dir)
+
+		// the fencing token of a lock is only ever bumped by claiming it, or
+		// by taking its claim over
+		if dir == FencingDir && change.status != "D" {
+			claimed[name] = true
+			continue
+		}
+
+		state, found := states[dir]
+		if !found || strings.HasPrefix(name, ".") {
+			continue
+		}
+
+		switch change.status {
+		case "D":
+			removed[name] = true
+		case "A":
+			added[name] = state
+		}
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+
+	renamed := map[string]LockIndexEntry{}
+	for to, from := range glh.renamed {
+		if entry, found := index.Locks[from]; found && removed[from] && added[to] == entry.State {
+			renamed[to] = entry
+		}
+	}
+
+	glh.renamed = nil
+
+	for name := range removed {
+		delete(index.Locks, name)
+	}
+
+	for name, state := range added {
+		if entry, found := renamed[name]; found {
+			index.Locks[name] = entry
+			delete(added, name)
+			delete(claimed, name)
+			continue
+		}
+
+		index.Locks[name] = LockIndexEntry{State: state, Since: &now}
+	}
+
+	claimer := ""
+	for name, entry := range index.Locks {
+		if entry.State != "claimed" || (added[name] == "" && !claimed[name]) {
+			continue
+		}
+
+		if claimer == "" {
+			claimer, err = glh.claimer()
+			if err != nil {
+				return err
+			}
+		}
+
+		index.Locks[name] = LockIndexEntry{State: entry.State, Claimer: claimer, Since: &now}
+	}
+
+	contents, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return glh.stageFile(glh.lockIndexPath(), append(contents, '\n'), 0644)
+}
+
+// buildLockIndex indexes each lock of the pool. Only claimed locks are known
+// to have been put in their state by someone since some time, which is found
+// from the history; locks that the staged changes move are indexed again
+// afterwards anyway.
+func (glh *GitLockHandler) buildLockIndex() (LockIndex, error) {
+	index := LockIndex{Locks: map[string]LockIndexEntry{}}
+
+	for state, path := range snapshotPaths(glh.Source) {
+		locks, err := glh.ListLocks(path)
+		if err != nil {
+			return index, err
+		}
+
+		for _, name := range locks {
+			entry := LockIndexEntry{State: state}
+
+			if state == "claimed" {
+				info, err := glh.ClaimInfo(name)
+				if err != nil {
+					return index, err
+				}
+
+				if !info.At.IsZero() {
+					at := info.At.UTC()
+					entry.Claimer = info.By
+					entry.Since = &at
+				}
+			}
+
+			index.Locks[name] = entry
+		}
+	}
+
+	return index, nil
+}
+
+// stagedChange is a file within the pool that is changed by what is staged,
+// with git's status letter for the change.
+type stagedChange struct {
+	status string
+	path   string
+}
+
+// stagedChanges lists the files of the pool changed by what is staged, with
+// their paths relative to the pool. Moves are listed as a removal and an
+// addition.
+func (glh *GitLockHandler) stagedChanges() ([]stagedChange, error) {
+	pool := glh.treePath(glh.poolDir())
+
+	var (
+		output []byte
+		err    error
+	)
+
+	if glh.Source.Bare {
+		output, err = glh.git("diff-tree", "-r", "-z", "--no-renames", "--name-status", "HEAD", glh.tree, "--", pool)
+	} else {
+		output, err = glh.git("diff", "--cached", "-z", "--no-renames", "--name-status", "HEAD", "--", pool)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []stagedChange
+
+	fields := strings.Split(strings.TrimSuffix(string(output), "\x00"), "\x00")
+	for i := 0; i+1 < len(fields); i += 2 {
+		rel := strings.TrimPrefix(fields[i+1], pool+"/")
+		changes = append(changes, stagedChange{status: fields[i], path: filepath.FromSlash(rel)})
+	}
+
+	return changes, nil
+}
+
+// claimer is who is claiming a lock: the build doing it, or else the git
+// identity it is done as.
+func (glh *GitLockHandler) claimer() (string, error) {
+	if buildURL := BuildURL(); buildURL != "" {
+		return buildURL, nil
+	}
+
+	output, err := glh.git("var", "GIT_AUTHOR_IDENT")
+	if err != nil {
+		return "", err
+	}
+
+	// the ident ends in a timestamp and timezone
+	ident := strings.TrimSpace(string(output))
+	if end := strings.LastIndex(ident, ">"); end >= 0 {
+		ident = ident[:end+1]
+	}
+
+	return ident, nil
+}
+
+func (glh *GitLockHandler) lockIndexPath() string {
+	return filepath.Join(glh.poolDir(), LockIndexFile)
+}
@@ -0,0 +1,80 @@
+package out
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// MaxShownMetadataSize is the largest lock metadata that show_metadata
+// includes whole; anything bigger would swamp the build page.
+const MaxShownMetadataSize = 1024
+
+// ShowsMetadata reports whether any of a lock's metadata should be shown in
+// the step's metadata.
+func (source Source) ShowsMetadata() bool {
+	return source.ShowMetadata || len(source.ShowMetadataKeys) > 0
+}
+
+// ShownMetadata picks out the parts of a lock's metadata to show: the given
+// keys of a JSON object, or else the whole of a small enough file.
+func ShownMetadata(source Source, contents []byte) []MetadataPair {
+	var shown []MetadataPair
+
+	if len(source.ShowMetadataKeys) > 0 {
+		var fields map[string]interface{}
+		if json.Unmarshal(contents, &fields) != nil {
+			return nil
+		}
+
+		for _, key := range source.ShowMetadataKeys {
+			value, found := fields[key]
+			if !found {
+				continue
+			}
+
+			text, isString := value.(string)
+			if !isString {
+				encoded, _ := json.Marshal(value)
+				text = string(encoded)
+			}
+
+			shown = append(shown, MetadataPair{Name: key, Value: text})
+		}
+
+		return shown
+	}
+
+	if source.ShowMetadata && len(contents) <= MaxShownMetadataSize {
+		shown = append(shown, MetadataPair{Name: "metadata", Value: strings.TrimRight(string(contents), "\n")})
+	}
+
+	return shown
+}
+
+// MaxClaimDuration reads how long a lock may stay claimed from the
+// "max_claim_duration" of its metadata, as a duration such as "2h" or a
+// number of nanoseconds. It is zero when the metadata is not a JSON object or
+// doesn't say.
+func MaxClaimDuration(contents []byte) (time.Duration, error) {
+	var metadata struct {
+		MaxClaimDuration *json.RawMessage `json:"max_claim_duration"`
+	}
+
+	if json.Unmarshal(contents, &metadata) != nil || metadata.MaxClaimDuration == nil {
+		return 0, nil
+	}
+
+	var duration jsonDuration
+	err := json.Unmarshal(*metadata.MaxClaimDuration, &duration)
+	if err != nil {
+		return 0, fmt.Errorf("max_claim_duration is not a duration: %s", err)
+	}
+
+	if duration <= 0 {
+		return 0, fmt.Errorf("max_claim_duration must be positive")
+	}
+
+	return time.Duration(duration), nil
+}
@@ -0,0 +1,64 @@
+package out_test
+
+import (
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/concourse/pool-resource/out"
+)
+
+var _ = Describe("Showing lock metadata", func() {
+	contents := []byte(`{"host":"env-1.example.com","port":8443,"secret":"hunter2"}` + "\n")
+
+	It("shows nothing unless asked", func() {
+		Ω(out.ShownMetadata(out.Source{}, contents)).Should(BeEmpty())
+	})
+
+	It("shows small metadata whole", func() {
+		Ω(out.ShownMetadata(out.Source{ShowMetadata: true}, contents)).Should(Equal([]out.MetadataPair{
+			{Name: "metadata", Value: `{"host":"env-1.example.com","port":8443,"secret":"hunter2"}`},
+		}))
+	})
+
+	It("leaves out metadata too large to show", func() {
+		large := []byte(strings.Repeat("x", out.MaxShownMetadataSize+1))
+		Ω(out.ShownMetadata(out.Source{ShowMetadata: true}, large)).Should(BeEmpty())
+	})
+
+	It("shows only the selected keys of JSON metadata", func() {
+		source := out.Source{ShowMetadataKeys: []string{"host", "port", "missing"}}
+
+		Ω(out.ShownMetadata(source, contents)).Should(Equal([]out.MetadataPair{
+			{Name: "host", Value: "env-1.example.com"},
+			{Name: "port", Value: "8443"},
+		}))
+	})
+
+	It("shows no keys of metadata that isn't JSON", func() {
+		source := out.Source{ShowMetadataKeys: []string{"host"}}
+		Ω(out.ShownMetadata(source, []byte("host: env-1"))).Should(BeEmpty())
+	})
+})
+
+var _ = Describe("Reading a lock's max claim duration", func() {
+	It("reads a duration string or a number of nanoseconds", func() {
+		Ω(out.MaxClaimDuration([]byte(`{"max_claim_duration":"90m"}`))).Should(Equal(90 * time.Minute))
+		Ω(out.MaxClaimDuration([]byte(`{"max_claim_duration":1000000000}`))).Should(Equal(time.Second))
+	})
+
+	It("is zero for metadata that doesn't declare one", func() {
+		Ω(out.MaxClaimDuration([]byte(`{"host":"env-1"}`))).Should(BeZero())
+		Ω(out.MaxClaimDuration([]byte("host: env-1"))).Should(BeZero())
+	})
+
+	It("rejects durations that can't lease a lock", func() {
+		_, err := out.MaxClaimDuration([]byte(`{"max_claim_duration":"forever"}`))
+		Ω(err).Should(MatchError(ContainSubstring("max_claim_duration is not a duration")))
+
+		_, err = out.MaxClaimDuration([]byte(`{"max_claim_duration":"-1h"}`))
+		Ω(err).Should(MatchError("max_claim_duration must be positive"))
+	})
+})
@@ -0,0 +1,22 @@
+package out
+
+import (
+	"fmt"
+	"regexp"
+)
+
+var validLockName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// ValidateLockName rejects names that could escape the pool directory or be
+// mistaken for git bookkeeping files such as .gitkeep.
+func ValidateLockName(name string) error {
+	if name == "" {
+		return fmt.Errorf("invalid lock name: name is empty")
+	}
+
+	if !validLockName.MatchString(name) {
+		return fmt.Errorf("invalid lock name %q: must start with a letter or digit and contain only letters, digits, '.', '_' or '-'", name)
+	}
+
+	return nil
+}
@@ -1,10 +1,16 @@
 package out
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -15,193 +21,1511 @@ type LockPool struct {
 
 	LockHandler LockHandler
 	dir         string
+
+	// Random returns a number in [0, 1) used to jitter retry delays; it
+	// defaults to math/rand and can be replaced for deterministic tests.
+	Random func() float64
+
+	// Now tells the time reservations are made and lapse by; it defaults to
+	// time.Now.
+	Now func() time.Time
+
+	// Tracer records spans for each operation; nil disables tracing.
+	Tracer *Tracer
+
+	// Events receives a JSON event stream of each operation; nil disables
+	// it.
+	Events io.Writer
+
+	metadata  []MetadataPair
+	claim     *Claim
+	span      *Span
+	operation string
+	retries   int
+	conflicts int
+
+	// failures counts the consecutive hard failures of the operation, which
+	// began at failingSince.
+	failures     int
+	failingSince time.Time
+
+	// networkFailures counts the consecutive failures among them that were
+	// blips in the network, which source.network_retries bounds.
+	networkFailures int
+
+	// heartbeatAt is when a build waiting on an empty pool next says it is
+	// still waiting.
+	heartbeatAt time.Time
+
+	// timings is how long the operation has spent in each phase. changing
+	// sums the time from the pool being brought up to date, at resetAt, to
+	// each change being pushed, and committedBefore is the handler's commit
+	// time before the operation began.
+	timings         PhaseTimings
+	resetAt         time.Time
+	changing        time.Duration
+	committedBefore time.Duration
+}
+
+func NewLockPool(source Source, output io.Writer) LockPool {
+	lockPool := LockPool{
+		Source: source,
+		Output: output,
+	}
+	lockPool.LockHandler = NewGitLockHandler(source)
+	lockPool.Tracer = NewTracer(source.Tracing)
+
+	// the event stream takes the place of the usual log, which would
+	// otherwise be interleaved with it
+	if source.JSONLogs {
+		lockPool.Events = output
+		lockPool.Output = ioutil.Discard
+	}
+
+	return lockPool
+}
+
+// RetryDelay is the source's retry delay spread by up to RetryJitter in either
+// direction, so that waiting builds don't all hit the remote at once.
+func (lp *LockPool) RetryDelay() time.Duration {
+	if lp.Source.RetryJitter <= 0 {
+		return lp.Source.RetryDelay
+	}
+
+	random := lp.Random
+	if random == nil {
+		random = rand.Float64
+	}
+
+	spread := lp.Source.RetryJitter * (2*random() - 1)
+
+	return time.Duration(float64(lp.Source.RetryDelay) * (1 + spread))
+}
+
+// Metadata describes how the last operation went, for inclusion in the
+// resource's response.
+func (lp *LockPool) Metadata() []MetadataPair {
+	return lp.metadata
+}
+
+func (lp *LockPool) addMetadata(name string, value string) {
+	lp.metadata = append(lp.metadata, MetadataPair{Name: name, Value: value})
+}
+
+// showLockMetadata adds the parts of a lock's metadata that the source asks
+// to show to the step's metadata.
+func (lp *LockPool) showLockMetadata(contents []byte) {
+	lp.metadata = append(lp.metadata, ShownMetadata(lp.Source, contents)...)
+}
+
+// warnIfPoolIsLow gives early notice before a pool starves, based on the
+// unclaimed locks left after the operation that was just broadcast.
+func (lp *LockPool) warnIfPoolIsLow(unclaimed int) {
+	threshold := lp.Source.MinUnclaimedWarning
+	if threshold <= 0 || unclaimed >= threshold {
+		return
+	}
+
+	warning := fmt.Sprintf("only %d unclaimed lock(s) left in pool %s (warning below %d)", unclaimed, lp.Source.Pool, threshold)
+
+	fmt.Fprintf(lp.Output, "\n*** WARNING: %s ***\n", warning)
+	lp.addMetadata("low_pool_warning", warning)
+}
+
+func (lp *LockPool) now() time.Time {
+	if lp.Now == nil {
+		return time.Now()
+	}
+
+	return lp.Now()
+}
+
+// sleep waits before retrying after err, a conflict or an empty pool. Either
+// means the remote was reached, so backing off starts afresh.
+func (lp *LockPool) sleep(err error) {
+	lp.resetBackOff()
+	lp.retries++
+	lp.emit(Event{Event: EventRetry, Attempt: lp.retries, Reason: err.Error()})
+	time.Sleep(lp.RetryDelay())
+}
+
+// waitForLocks sleeps before retrying to claim from an empty pool like sleep,
+// but says every source.heartbeat_interval how long it has been waiting and
+// how many locks are unclaimed, so that a long wait doesn't look like a hung
+// build.
+func (lp *LockPool) waitForLocks(err error, startedWaiting time.Time) {
+	interval := lp.Source.HeartbeatInterval
+	if interval <= 0 {
+		lp.sleep(err)
+		return
+	}
+
+	// counted before sleeping, while the clone still holds the pool that
+	// had no locks to claim
+	unclaimed := -1
+	if locks, listErr := lp.LockHandler.ListLocks(lp.Source.Paths.Unclaimed); listErr == nil {
+		unclaimed = len(locks)
+	}
+
+	lp.resetBackOff()
+	lp.retries++
+	lp.emit(Event{Event: EventRetry, Attempt: lp.retries, Reason: err.Error()})
+
+	wakeAt := time.Now().Add(lp.RetryDelay())
+
+	for {
+		now := time.Now()
+		if !now.Before(wakeAt) {
+			return
+		}
+
+		if !now.Before(lp.heartbeatAt) {
+			lp.heartbeat(now.Sub(startedWaiting), unclaimed)
+			lp.heartbeatAt = now.Add(interval)
+		}
+
+		next := wakeAt
+		if lp.heartbeatAt.Before(next) {
+			next = lp.heartbeatAt
+		}
+
+		time.Sleep(next.Sub(now))
+	}
+}
+
+func (lp *LockPool) heartbeat(waited time.Duration, unclaimed int) {
+	waited = waited.Round(time.Millisecond)
+
+	event := Event{Event: EventWaiting, DurationMS: int64(waited / time.Millisecond)}
+
+	count := "unknown"
+	if unclaimed >= 0 {
+		count = strconv.Itoa(unclaimed)
+		event.Unclaimed = &unclaimed
+	}
+
+	fmt.Fprintf(lp.Output, "\nstill waiting for a lock on: %s after %s (unclaimed locks: %s)\n", lp.Source.Pool, waited, count)
+	lp.emit(event)
+}
+
+// MaxBackOffDelay caps how long backing off waits between retries when
+// source.retry_backoff_max doesn't say.
+const MaxBackOffDelay = 5 * time.Minute
+
+// backOff waits before retrying after err, a hard failure such as the remote
+// being unreachable. With source.circuit_breaker or source.retry_backoff_max,
+// or when err is a blip in the network, each consecutive failure doubles the
+// wait, up to retry_backoff_max, and with circuit_breaker the operation gives
+// up once there have been that many in a row. Blips in the network are only
+// retried source.network_retries times in a row.
+func (lp *LockPool) backOff(err error) error {
+	if lp.failures == 0 {
+		lp.failingSince = lp.now()
+	}
+	lp.failures++
+
+	transient := IsTransient(err)
+	if transient {
+		lp.networkFailures++
+
+		limit := lp.Source.NetworkRetryLimit()
+		if lp.networkFailures > limit {
+			return &NetworkRetriesError{
+				Pool:     lp.Source.Pool,
+				Failures: lp.networkFailures,
+				Last:     err.(*GitError),
+			}
+		}
+
+		fmt.Fprintf(lp.Output, "%s reaching the remote; network retry %d of %d\n", err.(*GitError).Class, lp.networkFailures, limit)
+	} else {
+		lp.networkFailures = 0
+	}
+
+	breaker := lp.Source.CircuitBreaker
+	if breaker <= 0 && lp.Source.RetryBackoffMax <= 0 && !transient {
+		lp.retries++
+		lp.emit(Event{Event: EventRetry, Attempt: lp.retries, Reason: err.Error()})
+		time.Sleep(lp.RetryDelay())
+		return nil
+	}
+
+	if breaker > 0 && lp.failures >= breaker {
+		return &CircuitBreakerError{
+			Pool:      lp.Source.Pool,
+			Failures:  lp.failures,
+			Over:      lp.now().Sub(lp.failingSince).Round(time.Millisecond).String(),
+			Retries:   lp.retries,
+			Conflicts: lp.conflicts,
+			Last:      err,
+		}
+	}
+
+	maxDelay := lp.Source.RetryBackoffMax
+	if maxDelay <= 0 {
+		maxDelay = MaxBackOffDelay
+	}
+
+	delay := lp.RetryDelay()
+	for i := 1; i < lp.failures && delay < maxDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+
+	fmt.Fprintf(lp.Output, "backing off for %s after %d consecutive failure(s)\n", delay, lp.failures)
+
+	lp.retries++
+	lp.emit(Event{Event: EventRetry, Attempt: lp.retries, Reason: err.Error()})
+	time.Sleep(delay)
+
+	return nil
+}
+
+// resetBackOff counts consecutive failures afresh once the remote has
+// answered, unless source.retry_backoff_reset is false, in which case backing
+// off carries on from where it was until the operation ends.
+func (lp *LockPool) resetBackOff() {
+	if lp.Source.ResetsBackOff() {
+		lp.failures = 0
+		lp.networkFailures = 0
+	}
+}
+
+//go:generate counterfeiter . LockHandler
+
+type LockHandler interface {
+	UnclaimLock(lock string) (version string, err error)
+	UnclaimLocks(locks []string) (version string, err error)
+	AddLock(lock string, contents []byte) (version string, err error)
+	AddLocks(locks map[string][]byte) (version string, err error)
+	RemoveLock(lock string) (version string, err error)
+	RemoveLocks(locks map[string]string) (version string, err error)
+	DisableLock(lock string) (version string, err error)
+	EnableLock(lock string) (version string, err error)
+	QuarantineLock(lock string, reason string) (version string, err error)
+	ForceUnclaimLock(lock string, state string) (version string, err error)
+	ImportLock(state string, lock string, contents []byte) (version string, err error)
+	ReserveLock(until time.Time) (lock string, version string, err error)
+	ConfirmLock(lock string) (version string, err error)
+	LapseReservation(lock string) (version string, err error)
+	ReservationExpiry(lock string) (until time.Time, err error)
+	FencingToken(lock string) (token int, err error)
+	LeaseLock(until func(lock string) time.Time) (lock string, version string, err error)
+	RenewLease(lock string, until time.Time) (version string, err error)
+	TransferLock(lock string, until time.Time) (version string, err error)
+	RenameLock(from string, to string, state string) (version string, err error)
+	PausePool(reason string) (version string, err error)
+	UnpausePool() (version string, err error)
+	DestroyPool() (version string, err error)
+	PoolPaused() (paused bool, err error)
+	SquashHistory(before time.Time) (version string, squashed int, err error)
+	RevertCommit(ref string) (version string, reverted string, err error)
+	Head() (version string, err error)
+	ReapLease(lock string) (version string, err error)
+	LeaseExpiry(lock string) (until time.Time, err error)
+	WriteExpiry(state string, lock string, until time.Time) error
+	WriteFencingToken(lock string, token int) error
+	ListLocks(state string) (locks []string, err error)
+	ReadLock(state string, lock string) (contents []byte, err error)
+	ClaimPipeline(lock string) (pipeline string, err error)
+	ReadSchema() (schema []byte, err error)
+	AuditLog(lock string) (notes []AuditNote, err error)
+
+	Setup() error
+	BroadcastLockPool() error
+	ResetLock() error
+	Cleanup() error
+}
+
+func (lp *LockPool) AcquireLock() (string, Version, error) {
+	return lp.traced("acquire", func() (string, Version, error) {
+		var until time.Time
+
+		lock, version, err := lp.acquireLock(lp.Source.Paths.Claimed, func() (string, string, error) {
+			return lp.LockHandler.LeaseLock(func(lock string) time.Time {
+				until = lp.leaseUntil(lock)
+				return until
+			})
+		})
+
+		if err == nil && !until.IsZero() {
+			lp.reportLease(until)
+		}
+
+		return lock, version, err
+	})
+}
+
+// RenewLease extends the lease of the claimed lock named in inDir by the
+// source's lease_duration from now, so that it isn't reaped while the build
+// holding it is still alive.
+func (lp *LockPool) RenewLease(inDir string) (string, Version, error) {
+	return lp.traced("renew_lease", func() (string, Version, error) {
+		var until time.Time
+
+		lock, version, err := lp.changeLockState(inDir, "renewing lease of", func(lock string) (string, error) {
+			if _, err := lp.LockHandler.ReadLock(lp.Source.Paths.Claimed, lock); err != nil {
+				return "", fmt.Errorf("lock %s is not claimed; its lease may have been reaped", lock)
+			}
+
+			until = lp.leaseUntil(lock)
+			if until.IsZero() {
+				return "", fmt.Errorf("lock %s has no lease to renew: set source.lease_duration, or max_claim_duration in its metadata", lock)
+			}
+
+			return lp.LockHandler.RenewLease(lock, until)
+		})
+
+		if err == nil {
+			lp.reportLease(until)
+		}
+
+		return lock, version, err
+	})
+}
+
+// TransferLock hands the claimed lock named in inDir over to this build, in a
+// single commit that records the build as its claimer, bumps its fencing
+// token, and restarts its lease. The lock stays claimed throughout, so no
+// other build can take it in between.
+func (lp *LockPool) TransferLock(inDir string) (string, Version, error) {
+	return lp.traced("transfer", func() (string, Version, error) {
+		var (
+			until    time.Time
+			token    int
+			tokenErr error
+		)
+
+		lock, version, err := lp.changeLockState(inDir, "transferring", func(lock string) (string, error) {
+			if _, err := lp.LockHandler.ReadLock(lp.Source.Paths.Claimed, lock); err != nil {
+				return "", fmt.Errorf("lock %s is not claimed, so there is nothing to transfer", lock)
+			}
+
+			until = lp.leaseUntil(lock)
+
+			ref, err := lp.LockHandler.TransferLock(lock, until)
+			if err != nil {
+				return "", err
+			}
+
+			token, tokenErr = lp.LockHandler.FencingToken(lock)
+
+			return ref, nil
+		})
+
+		if err == nil {
+			lp.reportFencingToken(lock, token, tokenErr)
+
+			if !until.IsZero() {
+				lp.reportLease(until)
+			}
+		}
+
+		return lock, version, err
+	})
+}
+
+// leaseUntil decides when the lease of a lock claimed now runs out: after
+// the max_claim_duration in its metadata, if any, or else after
+// source.lease_duration. It is zero when the claim holds no lease.
+func (lp *LockPool) leaseUntil(lock string) time.Time {
+	contents, err := lp.LockHandler.ReadLock(lp.Source.Paths.Claimed, lock)
+	if err == nil {
+		duration, err := MaxClaimDuration(lp.readable(lock, contents))
+		if err != nil {
+			fmt.Fprintf(lp.Output, "\nignoring the lease of lock: %s, as its %s\n", lock, err)
+		}
+
+		if duration > 0 {
+			return lp.now().Add(duration)
+		}
+	}
+
+	if lp.Source.LeaseDuration <= 0 {
+		return time.Time{}
+	}
+
+	return lp.now().Add(lp.Source.LeaseDuration)
+}
+
+func (lp *LockPool) reportLease(until time.Time) {
+	fmt.Fprintf(lp.Output, "lease expires: %s\n", until.UTC().Format(time.RFC3339))
+	lp.addMetadata("lease_expires", until.UTC().Format(time.RFC3339))
+}
+
+// ReserveLock acquires a lock as a reservation, which lapses back to
+// unclaimed after the given duration unless ConfirmLock claims it first.
+func (lp *LockPool) ReserveLock(duration time.Duration) (string, Version, error) {
+	return lp.traced("reserve", func() (string, Version, error) {
+		var until time.Time
+
+		lock, version, err := lp.acquireLock(lp.Source.Paths.Reserved, func() (string, string, error) {
+			until = lp.now().Add(duration)
+			return lp.LockHandler.ReserveLock(until)
+		})
+
+		if err == nil {
+			fmt.Fprintf(lp.Output, "reserved until: %s\n", until.UTC().Format(time.RFC3339))
+			lp.addMetadata("reserved_until", until.UTC().Format(time.RFC3339))
+		}
+
+		return lock, version, err
+	})
+}
+
+// ConfirmLock claims the reserved lock named in inDir, as long as its
+// reservation has not lapsed.
+func (lp *LockPool) ConfirmLock(inDir string) (string, Version, error) {
+	return lp.traced("confirm", func() (string, Version, error) {
+		var (
+			token    int
+			tokenErr error
+		)
+
+		lock, version, err := lp.changeLockState(inDir, "confirming", func(lock string) (string, error) {
+			until, err := lp.LockHandler.ReservationExpiry(lock)
+			if err != nil {
+				return "", fmt.Errorf("lock %s is not reserved; its reservation may have lapsed", lock)
+			}
+
+			if !lp.now().Before(until) {
+				return "", fmt.Errorf("the reservation of lock %s lapsed at %s", lock, until.UTC().Format(time.RFC3339))
+			}
+
+			ref, err := lp.LockHandler.ConfirmLock(lock)
+			if err != nil {
+				return "", err
+			}
+
+			// read before the clone is cleaned up; the last attempt is the one
+			// that was broadcast
+			token, tokenErr = lp.LockHandler.FencingToken(lock)
+
+			return ref, nil
+		})
+
+		if err == nil {
+			lp.reportFencingToken(lock, token, tokenErr)
+		}
+
+		return lock, version, err
+	})
+}
+
+// FencingDir is the directory of a pool holding the fencing token of each
+// lock, which counts the times it has been claimed. Systems a lock guards
+// can reject requests carrying a lower token than one they have seen, as
+// they come from a build that has since lost the lock.
+const FencingDir = ".fencing"
+
+// showFencingToken adds the fencing token of a lock that was just claimed to
+// the step's metadata.
+func (lp *LockPool) showFencingToken(lock string) {
+	token, err := lp.LockHandler.FencingToken(lock)
+	lp.reportFencingToken(lock, token, err)
+}
+
+func (lp *LockPool) reportFencingToken(lock string, token int, err error) {
+	if err != nil {
+		fmt.Fprintf(lp.Output, "failed to read the fencing token of lock: %s! (err: %s)\n", lock, err)
+		return
+	}
+
+	fmt.Fprintf(lp.Output, "fencing token: %d\n", token)
+	lp.addMetadata("fencing_token", strconv.Itoa(token))
+}
+
+func (lp *LockPool) ReleaseLock(inDir string) (string, Version, error) {
+	return lp.traced("release", func() (string, Version, error) {
+		return lp.releaseLock(inDir, false)
+	})
+}
+
+// ReleaseLockIfClaimed releases the lock named in inDir as ReleaseLock does,
+// but if the lock is not claimed, e.g. because a release that failed part
+// way through is being run again, it does nothing and returns the pool's
+// current version.
+func (lp *LockPool) ReleaseLockIfClaimed(inDir string) (string, Version, error) {
+	return lp.traced("release", func() (string, Version, error) {
+		return lp.releaseLock(inDir, true)
+	})
+}
+
+// ReleaseMatching releases every claimed lock whose name matches the glob
+// pattern in a single commit. The version it returns names no lock.
+func (lp *LockPool) ReleaseMatching(pattern string) (string, Version, error) {
+	return lp.traced("release_matching", func() (string, Version, error) {
+		return lp.releaseMatching(pattern)
+	})
+}
+
+func (lp *LockPool) AddLock(inDir string) (string, Version, error) {
+	return lp.AddTemplatedLock(inDir, "")
+}
+
+// AddTemplatedLock adds the lock named in inDir with metadata rendered from
+// metadataTemplate, e.g. to record who added it; the lock's metadata file is
+// then optional, and available to the template. When inDir has no name file,
+// every lock it holds is added in a single commit, and the version it
+// returns names no lock.
+func (lp *LockPool) AddTemplatedLock(inDir string, metadataTemplate string) (string, Version, error) {
+	return lp.traced("add", func() (string, Version, error) {
+		return lp.addLock(inDir, metadataTemplate, false)
+	})
+}
+
+// ReplaceLock adds locks as AddTemplatedLock does, except that the metadata
+// of a lock already unclaimed in the pool is replaced rather than refused.
+func (lp *LockPool) ReplaceLock(inDir string, metadataTemplate string) (string, Version, error) {
+	return lp.traced("add", func() (string, Version, error) {
+		return lp.addLock(inDir, metadataTemplate, true)
+	})
+}
+
+func (lp *LockPool) RemoveLock(inDir string) (string, Version, error) {
+	return lp.traced("remove", func() (string, Version, error) {
+		return lp.removeLock(inDir)
+	})
+}
+
+// RemoveMatching removes every claimed or unclaimed lock whose name matches
+// the glob pattern in a single commit. The version it returns names no lock.
+func (lp *LockPool) RemoveMatching(pattern string) (string, Version, error) {
+	return lp.traced("remove_matching", func() (string, Version, error) {
+		return lp.removeLocks(pattern, func() (map[string]string, error) {
+			return lp.removableMatching(pattern)
+		})
+	})
+}
+
+// RemoveList removes the named locks, each either claimed or unclaimed, in a
+// single commit. The version it returns names no lock.
+func (lp *LockPool) RemoveList(locks []string) (string, Version, error) {
+	return lp.traced("remove_list", func() (string, Version, error) {
+		for _, lock := range locks {
+			err := ValidateLockName(lock)
+			if err != nil {
+				return "", Version{}, err
+			}
+		}
+
+		return lp.removeLocks(strings.Join(locks, ", "), func() (map[string]string, error) {
+			return lp.removableList(locks)
+		})
+	})
+}
+
+func (lp *LockPool) DisableLock(inDir string) (string, Version, error) {
+	return lp.traced("disable", func() (string, Version, error) {
+		return lp.changeLockState(inDir, "disabling", lp.LockHandler.DisableLock)
+	})
 }
 
-func NewLockPool(source Source, output io.Writer) LockPool {
-	lockPool := LockPool{
-		Source: source,
-		Output: output,
+func (lp *LockPool) EnableLock(inDir string) (string, Version, error) {
+	return lp.traced("enable", func() (string, Version, error) {
+		return lp.changeLockState(inDir, "enabling", lp.LockHandler.EnableLock)
+	})
+}
+
+func (lp *LockPool) QuarantineLock(inDir string, reason string) (string, Version, error) {
+	if reason != "" {
+		fmt.Fprintf(lp.Output, "quarantine reason: %s\n", reason)
+	}
+
+	return lp.traced("quarantine", func() (string, Version, error) {
+		return lp.changeLockState(inDir, "quarantining", func(lock string) (string, error) {
+			return lp.LockHandler.QuarantineLock(lock, reason)
+		})
+	})
+}
+
+// ForceUnclaimLock returns the lock named in inDir to the unclaimed state from
+// whichever state it is in, without running hooks, for operators rescuing
+// locks by hand.
+func (lp *LockPool) ForceUnclaimLock(inDir string) (string, Version, error) {
+	return lp.traced("force_unclaim", func() (string, Version, error) {
+		return lp.changeLockState(inDir, "force unclaiming", func(lock string) (string, error) {
+			for _, state := range []string{lp.Source.Paths.Claimed, lp.Source.Paths.Maintenance, lp.Source.Paths.Broken} {
+				if _, err := lp.LockHandler.ReadLock(state, lock); err == nil {
+					return lp.LockHandler.ForceUnclaimLock(lock, state)
+				}
+			}
+
+			if lp.Source.Paths.Reserved != "" {
+				if _, err := lp.LockHandler.ReadLock(lp.Source.Paths.Reserved, lock); err == nil {
+					return lp.LockHandler.LapseReservation(lock)
+				}
+			}
+
+			return "", fmt.Errorf("lock %s is not claimed, reserved, disabled, or quarantined", lock)
+		})
+	})
+}
+
+// traced runs operation within a span recording its outcome and how many
+// times it had to retry. How many of those retries were down to conflicting
+// changes is also reported, as a pool that conflicts often needs splitting.
+func (lp *LockPool) traced(operation string, run func() (string, Version, error)) (string, Version, error) {
+	lp.span = lp.Tracer.StartSpan("pool." + operation)
+	lp.span.SetAttribute("pool.name", lp.Source.Pool)
+	lp.operation = operation
+	lp.retries = 0
+	lp.conflicts = 0
+	lp.failures = 0
+	lp.networkFailures = 0
+	lp.startTimings()
+
+	startedAt := lp.now()
+	lp.emit(Event{Event: EventStarted})
+
+	lock, version, err := run()
+
+	lp.finishTimings()
+
+	finished := Event{
+		Event:      EventSucceeded,
+		Lock:       lock,
+		Ref:        version.Ref,
+		Retries:    lp.retries,
+		Conflicts:  lp.conflicts,
+		DurationMS: lp.now().Sub(startedAt).Milliseconds(),
+		TimingsMS:  lp.timings.milliseconds(),
+	}
+	if err != nil {
+		finished.Event = EventFailed
+		finished.Error = err.Error()
+	}
+	lp.emit(finished)
+
+	if lp.conflicts > 0 {
+		fmt.Fprintf(lp.Output, "\nretried %d time(s) after conflicting changes to the pool\n", lp.conflicts)
+		lp.addMetadata("conflict_retries", strconv.Itoa(lp.conflicts))
+	}
+
+	lp.span.SetAttribute("pool.retries", lp.retries)
+	lp.span.SetAttribute("pool.conflicts", lp.conflicts)
+	if lock != "" {
+		lp.span.SetAttribute("pool.lock", lock)
+	}
+
+	if version.Ref != "" {
+		lp.span.SetAttribute("pool.ref", version.Ref)
+	}
+
+	lp.span.EndWithError(err)
+	lp.span = nil
+
+	return lock, version, err
+}
+
+func (lp *LockPool) setup() error {
+	startedAt := time.Now()
+	span := lp.span.StartChild("setup")
+	err := lp.LockHandler.Setup()
+	span.EndWithError(err)
+	lp.timings.Clone += time.Since(startedAt)
+
+	if err != nil {
+		// callers only defer Cleanup once setup succeeds, so what setup
+		// left behind (the clone, known_hosts or CA bundle) goes here
+		lp.LockHandler.Cleanup()
+		return err
+	}
+
+	lp.warnIfProtocolFellBack()
+
+	return nil
+}
+
+// reset brings the pool up to date with the remote before a change is made
+// to it.
+func (lp *LockPool) reset() error {
+	startedAt := time.Now()
+	err := lp.LockHandler.ResetLock()
+	lp.resetAt = time.Now()
+	lp.timings.Clone += lp.resetAt.Sub(startedAt)
+
+	return err
+}
+
+func (lp *LockPool) broadcast() error {
+	startedAt := time.Now()
+	if !lp.resetAt.IsZero() {
+		lp.changing += startedAt.Sub(lp.resetAt)
+		lp.resetAt = time.Time{}
+	}
+
+	span := lp.span.StartChild("broadcast")
+	err := lp.LockHandler.BroadcastLockPool()
+	span.EndWithError(err)
+	lp.timings.Push += time.Since(startedAt)
+
+	if err == ErrLockConflict {
+		lp.conflicts++
+		lp.span.AddEvent("conflict", nil)
+		lp.emit(Event{Event: EventConflict, Attempt: lp.retries + 1})
+	}
+
+	if err == nil {
+		lp.mirror()
+	}
+
+	return err
+}
+
+// lapseReservations returns the locks whose reservations have expired to
+// unclaimed, so that they can be claimed again.
+func (lp *LockPool) lapseReservations() error {
+	if lp.Source.Paths.Reserved == "" {
+		return nil
+	}
+
+	reserved, err := lp.LockHandler.ListLocks(lp.Source.Paths.Reserved)
+	if err != nil {
+		return err
+	}
+
+	for _, lock := range reserved {
+		until, err := lp.LockHandler.ReservationExpiry(lock)
+		if err != nil {
+			return err
+		}
+
+		if lp.now().Before(until) {
+			continue
+		}
+
+		fmt.Fprintf(lp.Output, "\nreservation of lock: %s lapsed\n", lock)
+
+		_, err = lp.LockHandler.LapseReservation(lock)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reapLeases returns claimed locks whose leases have run out to unclaimed.
+// Any pool may hold leases, as locks can declare their own.
+func (lp *LockPool) reapLeases() error {
+	claimed, err := lp.LockHandler.ListLocks(lp.Source.Paths.Claimed)
+	if err != nil {
+		return err
+	}
+
+	for _, lock := range claimed {
+		until, err := lp.LockHandler.LeaseExpiry(lock)
+		if err != nil {
+			return err
+		}
+
+		if until.IsZero() || lp.now().Before(until) {
+			continue
+		}
+
+		fmt.Fprintf(lp.Output, "\nlease of lock: %s expired at %s, reaping it\n", lock, until.UTC().Format(time.RFC3339))
+
+		_, err = lp.LockHandler.ReapLease(lock)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// acquireLock moves an available lock to state with grab, retrying until the
+// change is broadcast.
+func (lp *LockPool) acquireLock(state string, grab func() (string, string, error)) (string, Version, error) {
+	err := lp.setup()
+	if err != nil {
+		return "", Version{}, err
+	}
+
+	defer lp.LockHandler.Cleanup()
+
+	var (
+		lock string
+		ref  string
+	)
+
+	fmt.Fprintf(lp.Output, "acquiring lock on: %s\n", lp.Source.Pool)
+
+	startedWaiting := time.Now()
+	lp.heartbeatAt = startedWaiting.Add(lp.Source.HeartbeatInterval)
+
+	var paused, waitingForUnpause, atMinimum, waitingForMinimum bool
+
+	for {
+		err = lp.reset()
+		if err != nil {
+			return "", Version{}, err
+		}
+
+		paused, err = lp.LockHandler.PoolPaused()
+		if err != nil {
+			return "", Version{}, err
+		}
+
+		if paused {
+			if lp.Source.FailWhenPaused {
+				return "", Version{}, ErrPoolPaused
+			}
+
+			if !waitingForUnpause {
+				fmt.Fprintf(lp.Output, "pool: %s is paused; waiting for it to be unpaused\n", lp.Source.Pool)
+				waitingForUnpause = true
+			}
+
+			fmt.Fprint(lp.Output, ".")
+			lp.waitForLocks(ErrPoolPaused, startedWaiting)
+			continue
+		}
+
+		err = lp.lapseReservations()
+		if err != nil {
+			return "", Version{}, err
+		}
+
+		err = lp.reapLeases()
+		if err != nil {
+			return "", Version{}, err
+		}
+
+		atMinimum, err = lp.atReserveMinimum()
+		if err != nil {
+			return "", Version{}, err
+		}
+
+		if atMinimum {
+			if !waitingForMinimum {
+				fmt.Fprintf(lp.Output, "pool: %s is down to its reserve_minimum of %d unclaimed lock(s); waiting for more\n", lp.Source.Pool, lp.Source.ReserveMinimum)
+				waitingForMinimum = true
+			}
+
+			fmt.Fprint(lp.Output, ".")
+			lp.waitForLocks(ErrReserveMinimum, startedWaiting)
+			continue
+		}
+
+		claim := lp.span.StartChild("claim")
+		lock, ref, err = grab()
+		claim.EndWithError(err)
+
+		if err == ErrNoLocksAvailable {
+			fmt.Fprint(lp.Output, ".")
+			lp.waitForLocks(err, startedWaiting)
+			continue
+		}
+
+		if err != nil {
+			if !IsRetryable(err) {
+				return "", Version{}, err
+			}
+
+			fmt.Fprintf(lp.Output, "\nfailed to acquire lock on pool: %s! (err: %s) retrying...\n", lp.Source.Pool, err)
+			err = lp.backOff(err)
+			if err != nil {
+				return "", Version{}, err
+			}
+			continue
+		}
+
+		err = lp.broadcast()
+
+		if err == ErrLockConflict {
+			fmt.Fprint(lp.Output, ".")
+			lp.sleep(err)
+			continue
+		}
+
+		if err != nil {
+			if !IsRetryable(err) {
+				return "", Version{}, err
+			}
+
+			fmt.Fprintf(lp.Output, "\nfailed to broadcast the change to lock state! (err: %s) retrying...\n", err)
+			err = lp.backOff(err)
+			if err != nil {
+				return "", Version{}, err
+			}
+			continue
+		}
+
+		break
+	}
+
+	waited := time.Since(startedWaiting).Round(time.Millisecond)
+
+	fmt.Fprintf(lp.Output, "\nacquired lock: %s after waiting %s\n", lock, waited)
+	lp.addMetadata("wait_duration", waited.String())
+
+	claimed := state == lp.Source.Paths.Claimed
+	if claimed {
+		lp.showFencingToken(lock)
+	}
+	postClaim := claimed && lp.Source.Hooks.PostClaim != ""
+
+	if lp.Source.ShowsMetadata() || postClaim {
+		contents, err := lp.LockHandler.ReadLock(state, lock)
+		if err == nil {
+			contents = lp.readable(lock, contents)
+			lp.showLockMetadata(contents)
+		}
+
+		if postClaim {
+			err = RunHook(lp.Source.Hooks.PostClaim, lock, lp.Source.Pool, contents, lp.Output)
+			if err != nil {
+				return "", Version{}, fmt.Errorf("%s; lock %s remains claimed", err, lock)
+			}
+		}
+	}
+
+	lp.reportPoolStats()
+
+	return lock, lp.version(ref, lock), nil
+}
+
+func (lp *LockPool) releaseLock(inDir string, allowMissing bool) (string, Version, error) {
+	nameFileContents, err := ioutil.ReadFile(filepath.Join(inDir, "name"))
+	if err != nil {
+		return "", Version{}, err
+	}
+
+	lockName := strings.TrimSpace(string(nameFileContents))
+
+	err = ValidateLockName(lockName)
+	if err != nil {
+		return "", Version{}, err
+	}
+
+	fmt.Fprintf(lp.Output, "releasing lock: %s on pool: %s\n", lockName, lp.Source.Pool)
+
+	err = lp.setup()
+	if err != nil {
+		return "", Version{}, err
+	}
+
+	defer lp.LockHandler.Cleanup()
+
+	if lp.Source.Hooks.PreRelease != "" {
+		metadata, err := lp.LockHandler.ReadLock(lp.Source.Paths.Claimed, lockName)
+
+		// a lock that is no longer claimed had its hook run when it was
+		// released, if it was ever claimed at all; releasing it fails below
+		// unless allow_missing is set
+		if err == nil {
+			metadata = lp.readable(lockName, metadata)
+
+			err = RunHook(lp.Source.Hooks.PreRelease, lockName, lp.Source.Pool, metadata, lp.Output)
+			if err != nil {
+				return "", Version{}, err
+			}
+		}
+	}
+
+	alreadyReleased := false
+
+	ref, err := lp.commitChange("lock state", func() (string, error) {
+		err := lp.missingClaim(lockName)
+		if err != nil && allowMissing {
+			fmt.Fprintf(lp.Output, "lock %s is not claimed, so there is nothing to release\n", lockName)
+
+			ref, err := lp.LockHandler.Head()
+			if err != nil {
+				return "", err
+			}
+
+			lp.addMetadata("already_released", "true")
+			alreadyReleased = true
+
+			return ref, errUnchanged
+		}
+
+		if err != nil {
+			return "", err
+		}
+
+		release := lp.span.StartChild("release")
+		ref, err := lp.LockHandler.UnclaimLock(lockName)
+		release.EndWithError(err)
+		if err != nil {
+			fmt.Fprintf(lp.Output, "\nfailed to unclaim the lock: %s! (err: %s)\n", lockName, err)
+			return "", err
+		}
+
+		return ref, nil
+	})
+	if err != nil {
+		return "", Version{}, err
 	}
-	lockPool.LockHandler = NewGitLockHandler(source)
 
-	return lockPool
+	if alreadyReleased {
+		return lockName, lp.version(ref, lockName), nil
+	}
+
+	lp.reportPoolStats()
+
+	return lockName, lp.version(ref, lockName), nil
 }
 
-//go:generate counterfeiter . LockHandler
+func (lp *LockPool) releaseMatching(pattern string) (string, Version, error) {
+	fmt.Fprintf(lp.Output, "releasing locks matching: %s on pool: %s\n", pattern, lp.Source.Pool)
 
-type LockHandler interface {
-	GrabAvailableLock() (lock string, version string, err error)
-	UnclaimLock(lock string) (version string, err error)
-	AddLock(lock string, contents []byte) (version string, err error)
-	RemoveLock(lock string) (version string, err error)
+	return lp.releaseLocks(func() ([]string, error) {
+		locks, err := lp.claimedMatching(pattern)
+		if err == nil && len(locks) == 0 {
+			err = fmt.Errorf("no claimed locks in pool %s match %s", lp.Source.Pool, pattern)
+		}
 
-	Setup() error
-	BroadcastLockPool() error
-	ResetLock() error
+		return locks, err
+	})
 }
 
-func (lp *LockPool) AcquireLock() (string, Version, error) {
-	err := lp.LockHandler.Setup()
+// releaseLocks releases the claimed locks that find returns, looking them up
+// afresh on each attempt, in a single commit. find fails if there are none.
+func (lp *LockPool) releaseLocks(find func() ([]string, error)) (string, Version, error) {
+	err := lp.setup()
 	if err != nil {
 		return "", Version{}, err
 	}
 
-	var (
-		lock string
-		ref  string
-	)
+	defer lp.LockHandler.Cleanup()
 
-	fmt.Fprintf(lp.Output, "acquiring lock on: %s\n", lp.Source.Pool)
+	// each lock's pre_release hook only runs once, however many times the
+	// release is retried
+	hooked := map[string]bool{}
 
-	for {
-		err = lp.LockHandler.ResetLock()
+	var locks []string
+
+	ref, err := lp.commitChange("lock state", func() (string, error) {
+		var err error
+		locks, err = find()
 		if err != nil {
-			return "", Version{}, err
+			return "", err
 		}
 
-		lock, ref, err = lp.LockHandler.GrabAvailableLock()
+		for _, lock := range locks {
+			if lp.Source.Hooks.PreRelease == "" || hooked[lock] {
+				continue
+			}
 
-		if err == ErrNoLocksAvailable {
-			fmt.Fprint(lp.Output, ".")
-			time.Sleep(lp.Source.RetryDelay)
-			continue
+			metadata, _ := lp.LockHandler.ReadLock(lp.Source.Paths.Claimed, lock)
+			metadata = lp.readable(lock, metadata)
+
+			err = RunHook(lp.Source.Hooks.PreRelease, lock, lp.Source.Pool, metadata, lp.Output)
+			if err != nil {
+				return "", err
+			}
+
+			hooked[lock] = true
 		}
 
+		release := lp.span.StartChild("release")
+		ref, err := lp.LockHandler.UnclaimLocks(locks)
+		release.EndWithError(err)
 		if err != nil {
-			fmt.Fprintf(lp.Output, "\nfailed to acquire lock on pool: %s! (err: %s) retrying...\n", lp.Source.Pool, err)
-			time.Sleep(lp.Source.RetryDelay)
-			continue
+			fmt.Fprintf(lp.Output, "\nfailed to unclaim the locks: %s! (err: %s)\n", strings.Join(locks, ", "), err)
+			return "", err
 		}
 
-		err = lp.LockHandler.BroadcastLockPool()
+		return ref, nil
+	})
+	if err != nil {
+		return "", Version{}, err
+	}
+
+	fmt.Fprintf(lp.Output, "released %d lock(s): %s\n", len(locks), strings.Join(locks, ", "))
+	lp.addMetadata("released_locks", strings.Join(locks, ", "))
 
-		if err == ErrLockConflict {
-			fmt.Fprint(lp.Output, ".")
-			time.Sleep(lp.Source.RetryDelay)
-			continue
-		}
+	lp.reportPoolStats()
+
+	return "", Version{Ref: strings.TrimSpace(ref)}, nil
+}
+
+// claimedMatching lists the claimed locks whose names match the glob pattern.
+func (lp *LockPool) claimedMatching(pattern string) ([]string, error) {
+	claimed, err := lp.LockHandler.ListLocks(lp.Source.Paths.Claimed)
+	if err != nil {
+		return nil, err
+	}
 
+	var matching []string
+	for _, lock := range claimed {
+		matched, err := path.Match(pattern, lock)
 		if err != nil {
-			fmt.Fprintf(lp.Output, "\nfailed to broadcast the change to lock state! (err: %s) retrying...\n", err)
-			time.Sleep(lp.Source.RetryDelay)
-			continue
+			return nil, err
 		}
 
-		break
+		if matched {
+			matching = append(matching, lock)
+		}
 	}
 
-	return lock, Version{
-		Ref: strings.TrimSpace(ref),
-	}, nil
+	return matching, nil
 }
 
-func (lp *LockPool) ReleaseLock(inDir string) (string, Version, error) {
+func (lp *LockPool) addLock(inDir string, metadataTemplate string, overwrite bool) (string, Version, error) {
 	nameFileContents, err := ioutil.ReadFile(filepath.Join(inDir, "name"))
+	if os.IsNotExist(err) {
+		locks, bulkErr := lp.bulkLocks(inDir)
+		if bulkErr != nil {
+			return "", Version{}, bulkErr
+		}
+
+		if len(locks) > 0 {
+			return lp.addLocks(locks, metadataTemplate, overwrite)
+		}
+	}
+
 	if err != nil {
-		return "", Version{}, err
+		return "", Version{}, fmt.Errorf("could not read the name file of your lock: %s", err)
 	}
 
 	lockName := strings.TrimSpace(string(nameFileContents))
 
-	fmt.Fprintf(lp.Output, "releasing lock: %s on pool: %s\n", lockName, lp.Source.Pool)
+	err = ValidateLockName(lockName)
+	if err != nil {
+		return "", Version{}, err
+	}
+
+	lockContents, err := ioutil.ReadFile(filepath.Join(inDir, "metadata"))
+	if err != nil && (metadataTemplate == "" || !os.IsNotExist(err)) {
+		return "", Version{}, fmt.Errorf("could not read the metadata file of your lock: %s", err)
+	}
 
-	err = lp.LockHandler.Setup()
+	if metadataTemplate != "" {
+		lockContents, err = RenderMetadataTemplate(metadataTemplate, lockName, lockContents, lp.now())
+		if err != nil {
+			return "", Version{}, fmt.Errorf("could not render the metadata template of your lock: %s", err)
+		}
+	}
+
+	lp.showLockMetadata(lockContents)
+
+	plainContents := lockContents
+
+	if lp.Source.Encryption.Enabled() {
+		lockContents, err = lp.Source.Encryption.Encrypt(lockContents)
+		if err != nil {
+			return "", Version{}, fmt.Errorf("could not encrypt the metadata of your lock: %s", err)
+		}
+	}
+
+	fmt.Fprintf(lp.Output, "adding lock: %s to pool: %s\n", lockName, lp.Source.Pool)
+
+	err = lp.setup()
 	if err != nil {
 		return "", Version{}, err
 	}
 
-	var ref string
-	for {
-		err = lp.LockHandler.ResetLock()
+	defer lp.LockHandler.Cleanup()
+
+	ref, err := lp.commitChange("lock state", func() (string, error) {
+		err := lp.validateMetadata(map[string][]byte{lockName: plainContents})
 		if err != nil {
-			return "", Version{}, err
+			return "", err
 		}
 
-		ref, err = lp.LockHandler.UnclaimLock(lockName)
+		err = lp.checkNewLocks([]string{lockName}, overwrite)
+		if err != nil {
+			return "", err
+		}
+
+		ref, err := lp.LockHandler.AddLock(lockName, lockContents)
+		if err != nil {
+			if !IsRetryable(err) {
+				return "", err
+			}
+
+			fmt.Fprintf(lp.Output, "failed to add the lock: %s! (err: %s) retrying...\n", lockName, err)
+			return "", lp.retryChange(err)
+		}
+
+		return ref, nil
+	})
+	if err != nil {
+		return "", Version{}, err
+	}
+
+	lp.reportPoolStats()
+
+	return lockName, lp.version(ref, lockName), nil
+}
+
+// bulkLocks reads the locks of an add directory without a name file. A
+// directory with just a metadata file is a single lock missing its name, so
+// none are returned for it.
+func (lp *LockPool) bulkLocks(inDir string) (map[string][]byte, error) {
+	_, err := os.Stat(filepath.Join(inDir, "metadata"))
+	if err == nil {
+		return nil, nil
+	}
+
+	locks, err := readBulkLocks(inDir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the locks to add: %s", err)
+	}
+
+	return locks, nil
+}
+
+func (lp *LockPool) addLocks(locks map[string][]byte, metadataTemplate string, overwrite bool) (string, Version, error) {
+	names := sortedLockNames(locks)
+
+	contents := map[string][]byte{}
+	plainContents := map[string][]byte{}
+	for _, name := range names {
+		err := ValidateLockName(name)
 		if err != nil {
-			fmt.Fprintf(lp.Output, "\nfailed to unclaim the lock: %s! (err: %s)\n", lockName, err)
 			return "", Version{}, err
 		}
 
-		err = lp.LockHandler.BroadcastLockPool()
+		lockContents := locks[name]
 
-		if err == ErrLockConflict {
-			fmt.Fprint(lp.Output, ".")
-			time.Sleep(lp.Source.RetryDelay)
-			continue
+		if metadataTemplate != "" {
+			lockContents, err = RenderMetadataTemplate(metadataTemplate, name, lockContents, lp.now())
+			if err != nil {
+				return "", Version{}, fmt.Errorf("could not render the metadata template of lock %s: %s", name, err)
+			}
+		}
+
+		plainContents[name] = lockContents
+
+		if lp.Source.Encryption.Enabled() {
+			lockContents, err = lp.Source.Encryption.Encrypt(lockContents)
+			if err != nil {
+				return "", Version{}, fmt.Errorf("could not encrypt the metadata of lock %s: %s", name, err)
+			}
+		}
+
+		contents[name] = lockContents
+	}
+
+	fmt.Fprintf(lp.Output, "adding %d lock(s): %s to pool: %s\n", len(names), strings.Join(names, ", "), lp.Source.Pool)
+
+	err := lp.setup()
+	if err != nil {
+		return "", Version{}, err
+	}
+
+	defer lp.LockHandler.Cleanup()
+
+	ref, err := lp.commitChange("lock state", func() (string, error) {
+		err := lp.validateMetadata(plainContents)
+		if err != nil {
+			return "", err
 		}
 
+		err = lp.checkNewLocks(names, overwrite)
 		if err != nil {
-			fmt.Fprintf(lp.Output, "\nfailed to broadcast the change to lock state! (err: %s) retrying...\n", err)
-			time.Sleep(lp.Source.RetryDelay)
-			continue
+			return "", err
 		}
 
-		break
+		ref, err := lp.LockHandler.AddLocks(contents)
+		if err != nil {
+			if !IsRetryable(err) {
+				return "", err
+			}
+
+			fmt.Fprintf(lp.Output, "failed to add the locks: %s! (err: %s) retrying...\n", strings.Join(names, ", "), err)
+			return "", lp.retryChange(err)
+		}
+
+		return ref, nil
+	})
+	if err != nil {
+		return "", Version{}, err
 	}
 
-	return lockName, Version{
-		Ref: strings.TrimSpace(ref),
-	}, nil
+	lp.addMetadata("added_locks", strings.Join(names, ", "))
+
+	lp.reportPoolStats()
+
+	return "", Version{Ref: strings.TrimSpace(ref)}, nil
 }
 
-func (lp *LockPool) AddLock(inDir string) (string, Version, error) {
+func (lp *LockPool) removeLock(inDir string) (string, Version, error) {
 	nameFileContents, err := ioutil.ReadFile(filepath.Join(inDir, "name"))
 	if err != nil {
-		return "", Version{}, fmt.Errorf("could not read the name file of your lock: %s", err)
+		return "", Version{}, err
 	}
 
 	lockName := strings.TrimSpace(string(nameFileContents))
 
-	lockContents, err := ioutil.ReadFile(filepath.Join(inDir, "metadata"))
+	err = ValidateLockName(lockName)
 	if err != nil {
-		return "", Version{}, fmt.Errorf("could not read the metadata file of your lock: %s", err)
+		return "", Version{}, err
 	}
 
-	fmt.Fprintf(lp.Output, "adding lock: %s to pool: %s\n", lockName, lp.Source.Pool)
+	fmt.Fprintf(lp.Output, "removing lock: %s on pool: %s\n", lockName, lp.Source.Pool)
 
-	err = lp.LockHandler.Setup()
+	err = lp.setup()
 	if err != nil {
 		return "", Version{}, err
 	}
 
-	var ref string
-	for {
-		err = lp.LockHandler.ResetLock()
+	defer lp.LockHandler.Cleanup()
+
+	ref, err := lp.commitChange("lock state", func() (string, error) {
+		err := lp.missingClaim(lockName)
 		if err != nil {
-			return "", Version{}, err
+			return "", err
 		}
 
-		ref, err = lp.LockHandler.AddLock(lockName, lockContents)
+		ref, err := lp.LockHandler.RemoveLock(lockName)
 		if err != nil {
-			fmt.Fprintf(lp.Output, "failed to add the lock: %s! (err: %s) retrying...\n", lockName, err)
-			time.Sleep(lp.Source.RetryDelay)
-			continue
+			fmt.Fprintf(lp.Output, "failed to remove the lock: %s! (err: %s)\n", lockName, err)
+			return "", err
 		}
 
-		err = lp.LockHandler.BroadcastLockPool()
+		return ref, nil
+	})
+	if err != nil {
+		return "", Version{}, err
+	}
+
+	lp.reportPoolStats()
 
-		if err == ErrLockConflict {
-			fmt.Fprint(lp.Output, ".")
-			time.Sleep(lp.Source.RetryDelay)
-			continue
+	return lockName, lp.version(ref, lockName), nil
+}
+
+// removeLocks removes the locks found by find, which maps each lock to the
+// state it is in. They are looked up afresh on every retry, as other
+// pipelines may have claimed or released them in the meantime.
+func (lp *LockPool) removeLocks(description string, find func() (map[string]string, error)) (string, Version, error) {
+	fmt.Fprintf(lp.Output, "removing locks: %s on pool: %s\n", description, lp.Source.Pool)
+
+	err := lp.setup()
+	if err != nil {
+		return "", Version{}, err
+	}
+
+	defer lp.LockHandler.Cleanup()
+
+	var names []string
+
+	ref, err := lp.commitChange("lock state", func() (string, error) {
+		locks, err := find()
+		if err != nil {
+			return "", err
+		}
+
+		names = make([]string, 0, len(locks))
+		for lock := range locks {
+			names = append(names, lock)
 		}
 
+		sort.Strings(names)
+
+		ref, err := lp.LockHandler.RemoveLocks(locks)
 		if err != nil {
-			fmt.Fprintf(lp.Output, "\nfailed to broadcast the change to lock state! (err: %s) retrying...\n", err)
-			time.Sleep(lp.Source.RetryDelay)
-			continue
+			fmt.Fprintf(lp.Output, "\nfailed to remove the locks: %s! (err: %s)\n", strings.Join(names, ", "), err)
+			return "", err
 		}
 
-		break
+		return ref, nil
+	})
+	if err != nil {
+		return "", Version{}, err
 	}
 
-	return lockName, Version{
-		Ref: strings.TrimSpace(ref),
-	}, nil
+	fmt.Fprintf(lp.Output, "removed %d lock(s): %s\n", len(names), strings.Join(names, ", "))
+	lp.addMetadata("removed_locks", strings.Join(names, ", "))
+
+	lp.reportPoolStats()
+
+	return "", Version{Ref: strings.TrimSpace(ref)}, nil
 }
 
-func (lp *LockPool) RemoveLock(inDir string) (string, Version, error) {
+// removableMatching finds the claimed and unclaimed locks whose names match
+// the glob pattern.
+func (lp *LockPool) removableMatching(pattern string) (map[string]string, error) {
+	locks := map[string]string{}
+
+	for _, state := range []string{lp.Source.Paths.Claimed, lp.Source.Paths.Unclaimed} {
+		listed, err := lp.LockHandler.ListLocks(state)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, lock := range listed {
+			matched, err := path.Match(pattern, lock)
+			if err != nil {
+				return nil, err
+			}
+
+			if matched {
+				locks[lock] = state
+			}
+		}
+	}
+
+	if len(locks) == 0 {
+		return nil, fmt.Errorf("no claimed or unclaimed locks in pool %s match %s", lp.Source.Pool, pattern)
+	}
+
+	return locks, nil
+}
+
+// removableList finds the state of each named lock, failing if any is
+// neither claimed nor unclaimed so that none are removed.
+func (lp *LockPool) removableList(names []string) (map[string]string, error) {
+	locks := map[string]string{}
+	var missing []string
+
+	for _, lock := range names {
+		for _, state := range []string{lp.Source.Paths.Claimed, lp.Source.Paths.Unclaimed} {
+			_, err := lp.LockHandler.ReadLock(state, lock)
+			if err == nil {
+				locks[lock] = state
+				break
+			}
+		}
+
+		if _, found := locks[lock]; !found {
+			missing = append(missing, lock)
+		}
+	}
+
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("locks are neither claimed nor unclaimed in pool %s: %s", lp.Source.Pool, strings.Join(missing, ", "))
+	}
+
+	return locks, nil
+}
+
+// missingClaim explains that a lock to be released or removed is not claimed,
+// listing the locks that are, and those that are unclaimed, in case its name
+// is mistaken.
+func (lp *LockPool) missingClaim(lock string) error {
+	_, err := lp.LockHandler.ReadLock(lp.Source.Paths.Claimed, lock)
+	if err == nil {
+		return nil
+	}
+
+	describe := func(state string) string {
+		locks, err := lp.LockHandler.ListLocks(state)
+		if err != nil || len(locks) == 0 {
+			return "none"
+		}
+
+		return strings.Join(locks, ", ")
+	}
+
+	return fmt.Errorf(
+		"lock %s is not claimed in pool %s (claimed: %s; unclaimed: %s)",
+		lock, lp.Source.Pool, describe(lp.Source.Paths.Claimed), describe(lp.Source.Paths.Unclaimed),
+	)
+}
+
+// changeLockState applies change to the lock named in inDir, retrying until
+// the result is broadcast without conflicting with another change to the pool.
+func (lp *LockPool) changeLockState(inDir string, verb string, change func(lock string) (string, error)) (string, Version, error) {
 	nameFileContents, err := ioutil.ReadFile(filepath.Join(inDir, "name"))
 	if err != nil {
 		return "", Version{}, err
@@ -209,45 +1533,110 @@ func (lp *LockPool) RemoveLock(inDir string) (string, Version, error) {
 
 	lockName := strings.TrimSpace(string(nameFileContents))
 
-	fmt.Fprintf(lp.Output, "removing lock: %s on pool: %s\n", lockName, lp.Source.Pool)
+	err = ValidateLockName(lockName)
+	if err != nil {
+		return "", Version{}, err
+	}
 
-	err = lp.LockHandler.Setup()
+	return lp.changeLock(lockName, verb, change)
+}
+
+// changeLock applies change to the named lock, retrying until the result is
+// broadcast without conflicting with another change to the pool.
+func (lp *LockPool) changeLock(lockName string, verb string, change func(lock string) (string, error)) (string, Version, error) {
+	fmt.Fprintf(lp.Output, "%s lock: %s on pool: %s\n", verb, lockName, lp.Source.Pool)
+
+	err := lp.setup()
+	if err != nil {
+		return "", Version{}, err
+	}
+
+	defer lp.LockHandler.Cleanup()
+
+	ref, err := lp.commitChange("lock state", func() (string, error) {
+		ref, err := change(lockName)
+		if err != nil {
+			fmt.Fprintf(lp.Output, "\nfailed %s the lock: %s! (err: %s)\n", verb, lockName, err)
+		}
+
+		return ref, err
+	})
 	if err != nil {
 		return "", Version{}, err
 	}
 
-	var ref string
+	lp.reportPoolStats()
+
+	return lockName, lp.version(ref, lockName), nil
+}
+
+// errUnchanged is returned by a change given to commitChange that found
+// nothing to do, along with the ref the pool is at, so that nothing is
+// broadcast.
+var errUnchanged = errors.New("nothing changed")
 
+// errChangeRetried is returned by a change given to commitChange, through
+// retryChange, to have it made again from a fresh clone.
+var errChangeRetried = errors.New("retrying the change")
+
+// commitChange resets the clone to the pool, makes change and broadcasts it,
+// starting over when the broadcast conflicts with another change to the pool
+// or fails in a way that is worth retrying. subject says what the change is
+// to in the message logged for such a failure. It returns the ref that change
+// committed.
+func (lp *LockPool) commitChange(subject string, change func() (string, error)) (string, error) {
 	for {
-		err = lp.LockHandler.ResetLock()
+		err := lp.reset()
 		if err != nil {
-			fmt.Fprintf(lp.Output, "failed to reset the lock: %s! (err: %s)\n", lockName, err)
-			return "", Version{}, err
+			return "", err
+		}
+
+		ref, err := change()
+		if err == errChangeRetried {
+			continue
+		}
+
+		if err == errUnchanged {
+			return ref, nil
 		}
 
-		ref, err = lp.LockHandler.RemoveLock(lockName)
 		if err != nil {
-			fmt.Fprintf(lp.Output, "failed to remove the lock: %s! (err: %s)\n", lockName, err)
-			return "", Version{}, err
+			return "", err
 		}
 
-		err = lp.LockHandler.BroadcastLockPool()
+		err = lp.broadcast()
 
 		if err == ErrLockConflict {
-			fmt.Fprintf(lp.Output, ".")
-			time.Sleep(lp.Source.RetryDelay)
+			fmt.Fprint(lp.Output, ".")
+			lp.sleep(err)
 			continue
 		}
 
 		if err != nil {
-			fmt.Fprintf(lp.Output, "\nfailed to broadcast the change to lock state! (err: %s) retrying...\n", err)
-			time.Sleep(lp.Source.RetryDelay)
+			if !IsRetryable(err) {
+				return "", err
+			}
+
+			fmt.Fprintf(lp.Output, "\nfailed to broadcast the change to %s! (err: %s) retrying...\n", subject, err)
+			err = lp.backOff(err)
+			if err != nil {
+				return "", err
+			}
 			continue
 		}
-		break
+
+		return ref, nil
+	}
+}
+
+// retryChange backs off after err, a failure making a change that is worth
+// retrying, and has commitChange make the change again, or gives up with the
+// error backing off returns.
+func (lp *LockPool) retryChange(err error) error {
+	err = lp.backOff(err)
+	if err != nil {
+		return err
 	}
 
-	return lockName, Version{
-		Ref: strings.TrimSpace(ref),
-	}, nil
+	return errChangeRetried
 }
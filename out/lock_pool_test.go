@@ -1,6 +1,8 @@
 package out_test
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"io/ioutil"
 	"os"
@@ -31,12 +33,806 @@ var _ = Describe("Lock Pool", func() {
 				Pool:       "my-pool",
 				Branch:     "some-branch",
 				RetryDelay: 100 * time.Millisecond,
+				Paths: out.Paths{
+					Unclaimed: "unclaimed",
+					Claimed:   "claimed",
+				},
 			},
 			Output:      output,
 			LockHandler: fakeLockHandler,
 		}
 	})
 
+	Context("Retry delays", func() {
+		It("uses the retry delay as-is without jitter", func() {
+			Ω(lockPool.RetryDelay()).Should(Equal(100 * time.Millisecond))
+		})
+
+		Context("with jitter", func() {
+			BeforeEach(func() {
+				lockPool.Source.RetryJitter = 0.5
+			})
+
+			It("spreads the delay by up to the jitter fraction either way", func() {
+				lockPool.Random = func() float64 { return 0 }
+				Ω(lockPool.RetryDelay()).Should(Equal(50 * time.Millisecond))
+
+				lockPool.Random = func() float64 { return 0.5 }
+				Ω(lockPool.RetryDelay()).Should(Equal(100 * time.Millisecond))
+
+				lockPool.Random = func() float64 { return 0.75 }
+				Ω(lockPool.RetryDelay()).Should(Equal(125 * time.Millisecond))
+			})
+
+			It("stays within bounds with the default source of randomness", func() {
+				for i := 0; i < 100; i++ {
+					Ω(lockPool.RetryDelay()).Should(BeNumerically(">=", 50*time.Millisecond))
+					Ω(lockPool.RetryDelay()).Should(BeNumerically("<", 150*time.Millisecond))
+				}
+			})
+		})
+	})
+
+	Context("Negotiating the git protocol", func() {
+		BeforeEach(func() {
+			lockPool.Source.ProtocolVersion = 2
+			fakeLockHandler.LeaseLockReturns("some-lock", "some-ref", nil)
+		})
+
+		It("warns when the remote falls back from protocol version 2", func() {
+			lockPool.LockHandler = negotiatingHandler{fakeLockHandler, 0}
+
+			_, _, err := lockPool.AcquireLock()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(output).Should(gbytes.Say("the remote of pool: my-pool does not support git protocol version 2"))
+		})
+
+		It("stays quiet when the remote speaks protocol version 2", func() {
+			lockPool.LockHandler = negotiatingHandler{fakeLockHandler, 2}
+
+			_, _, err := lockPool.AcquireLock()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(output.Contents()).ShouldNot(ContainSubstring("git protocol"))
+		})
+
+		It("stays quiet when protocol version 2 wasn't asked for", func() {
+			lockPool.Source.ProtocolVersion = 1
+			lockPool.LockHandler = negotiatingHandler{fakeLockHandler, 0}
+
+			_, _, err := lockPool.AcquireLock()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(output.Contents()).ShouldNot(ContainSubstring("git protocol"))
+		})
+	})
+
+	Context("Mirroring the pool", func() {
+		var handler *mirroringHandler
+
+		BeforeEach(func() {
+			lockPool.Source.MirrorURI = "some-mirror-uri"
+			fakeLockHandler.LeaseLockReturns("some-lock", "some-ref", nil)
+
+			handler = &mirroringHandler{FakeLockHandler: fakeLockHandler}
+			lockPool.LockHandler = handler
+		})
+
+		It("pushes each broadcast change to the mirror", func() {
+			_, _, err := lockPool.AcquireLock()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(handler.pushes).Should(Equal(1))
+		})
+
+		It("doesn't mirror a change the pool didn't take", func() {
+			fakeLockHandler.BroadcastLockPoolStub = func() error {
+				if fakeLockHandler.BroadcastLockPoolCallCount() == 1 {
+					return out.ErrLockConflict
+				}
+
+				return nil
+			}
+
+			_, _, err := lockPool.AcquireLock()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(fakeLockHandler.BroadcastLockPoolCallCount()).Should(Equal(2))
+			Ω(handler.pushes).Should(Equal(1))
+		})
+
+		It("reports failing to mirror without failing the operation", func() {
+			handler.err = errors.New("mirror unreachable")
+
+			_, _, err := lockPool.AcquireLock()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(output).Should(gbytes.Say(`failed to mirror pool: my-pool to some-mirror-uri! \(err: mirror unreachable\)`))
+			Ω(lockPool.Metadata()).Should(ContainElement(out.MetadataPair{Name: "mirror_error", Value: "mirror unreachable"}))
+		})
+	})
+
+	Context("Timing each phase", func() {
+		var handler *commitTimingHandler
+
+		BeforeEach(func() {
+			handler = &commitTimingHandler{FakeLockHandler: fakeLockHandler}
+			lockPool.LockHandler = handler
+
+			fakeLockHandler.SetupStub = func() error {
+				time.Sleep(20 * time.Millisecond)
+				return nil
+			}
+
+			fakeLockHandler.LeaseLockStub = func(func(string) time.Time) (string, string, error) {
+				time.Sleep(20 * time.Millisecond)
+				handler.committing += 5 * time.Millisecond
+				return "some-lock", "some-ref", nil
+			}
+
+			fakeLockHandler.BroadcastLockPoolStub = func() error {
+				time.Sleep(20 * time.Millisecond)
+				return nil
+			}
+		})
+
+		It("logs how long cloning, selecting, committing and pushing took", func() {
+			_, _, err := lockPool.AcquireLock()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			timings := lockPool.Timings()
+			Ω(timings.Clone).Should(BeNumerically(">=", 20*time.Millisecond))
+			Ω(timings.Select).Should(BeNumerically(">=", 15*time.Millisecond))
+			Ω(timings.Commit).Should(Equal(5 * time.Millisecond))
+			Ω(timings.Push).Should(BeNumerically(">=", 20*time.Millisecond))
+
+			Ω(output).Should(gbytes.Say(`timings: clone \S+, select \S+, commit 5ms, push \S+`))
+		})
+
+		It("leaves the timings out of the metadata by default", func() {
+			_, _, err := lockPool.AcquireLock()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			for _, pair := range lockPool.Metadata() {
+				Ω([]string{"clone_duration", "select_duration", "commit_duration", "push_duration"}).ShouldNot(ContainElement(pair.Name))
+			}
+		})
+
+		It("adds the timings to the metadata with show_timings", func() {
+			lockPool.Source.ShowTimings = true
+
+			_, _, err := lockPool.AcquireLock()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(lockPool.Metadata()).Should(ContainElement(out.MetadataPair{Name: "commit_duration", Value: "5ms"}))
+
+			names := []string{}
+			for _, pair := range lockPool.Metadata() {
+				names = append(names, pair.Name)
+			}
+			Ω(names).Should(ContainElement("clone_duration"))
+			Ω(names).Should(ContainElement("select_duration"))
+			Ω(names).Should(ContainElement("push_duration"))
+		})
+
+		It("sums the time of each phase over retries", func() {
+			fakeLockHandler.BroadcastLockPoolStub = func() error {
+				time.Sleep(20 * time.Millisecond)
+				if fakeLockHandler.BroadcastLockPoolCallCount() == 1 {
+					return out.ErrLockConflict
+				}
+
+				return nil
+			}
+
+			_, _, err := lockPool.AcquireLock()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			timings := lockPool.Timings()
+			Ω(timings.Commit).Should(Equal(10 * time.Millisecond))
+			Ω(timings.Push).Should(BeNumerically(">=", 40*time.Millisecond))
+			Ω(timings.Select).Should(BeNumerically(">=", 30*time.Millisecond))
+		})
+	})
+
+	It("can't claim from candidates through a handler that doesn't support it", func() {
+		_, _, err := lockPool.AcquireAnyOf([]string{"some-lock"})
+		Ω(err).Should(MatchError("the pool's lock handler cannot claim from a list of candidates"))
+
+		Ω(fakeLockHandler.SetupCallCount()).Should(BeZero())
+	})
+
+	It("can't claim by metadata through a handler that doesn't support it", func() {
+		_, _, err := lockPool.AcquireMatching(out.MetadataQuery{"cloud": "aws"})
+		Ω(err).Should(MatchError("the pool's lock handler cannot claim locks by their metadata"))
+
+		Ω(fakeLockHandler.SetupCallCount()).Should(BeZero())
+	})
+
+	Context("Backing off from a failing remote", func() {
+		BeforeEach(func() {
+			lockPool.Source.RetryDelay = time.Millisecond
+			lockPool.Source.CircuitBreaker = 4
+
+			fakeLockHandler.LeaseLockReturns("some-lock", "some-ref", nil)
+			fakeLockHandler.BroadcastLockPoolReturns(errors.New("could not resolve host"))
+		})
+
+		It("doubles the delay after each consecutive failure, then gives up", func() {
+			_, _, err := lockPool.AcquireLock()
+			Ω(err).Should(MatchError(MatchRegexp(`^giving up on pool my-pool after 4 consecutive failures over .* \(3 retries in all, 0 after conflicts\); last error: could not resolve host$`)))
+
+			Ω(fakeLockHandler.BroadcastLockPoolCallCount()).Should(Equal(4))
+
+			Ω(output).Should(gbytes.Say(`backing off for 1ms after 1 consecutive failure\(s\)`))
+			Ω(output).Should(gbytes.Say(`backing off for 2ms after 2 consecutive failure\(s\)`))
+			Ω(output).Should(gbytes.Say(`backing off for 4ms after 3 consecutive failure\(s\)`))
+		})
+
+		It("counts afresh once the remote answers again", func() {
+			fakeLockHandler.BroadcastLockPoolStub = func() error {
+				switch fakeLockHandler.BroadcastLockPoolCallCount() {
+				case 3:
+					return out.ErrLockConflict
+				case 6:
+					return nil
+				default:
+					return errors.New("could not resolve host")
+				}
+			}
+
+			_, _, err := lockPool.AcquireLock()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(fakeLockHandler.BroadcastLockPoolCallCount()).Should(Equal(6))
+		})
+
+		It("keeps retrying at the usual delay without a circuit breaker", func() {
+			lockPool.Source.CircuitBreaker = 0
+
+			fakeLockHandler.BroadcastLockPoolStub = func() error {
+				if fakeLockHandler.BroadcastLockPoolCallCount() < 10 {
+					return errors.New("could not resolve host")
+				}
+
+				return nil
+			}
+
+			_, _, err := lockPool.AcquireLock()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(fakeLockHandler.BroadcastLockPoolCallCount()).Should(Equal(10))
+			Ω(output).ShouldNot(gbytes.Say("backing off"))
+		})
+
+		It("caps the delay at retry_backoff_max", func() {
+			lockPool.Source.RetryBackoffMax = 3 * time.Millisecond
+
+			_, _, err := lockPool.AcquireLock()
+			Ω(err).Should(MatchError(ContainSubstring("giving up")))
+
+			Ω(output).Should(gbytes.Say(`backing off for 1ms after 1 consecutive failure\(s\)`))
+			Ω(output).Should(gbytes.Say(`backing off for 2ms after 2 consecutive failure\(s\)`))
+			Ω(output).Should(gbytes.Say(`backing off for 3ms after 3 consecutive failure\(s\)`))
+		})
+
+		It("backs off without a circuit breaker when retry_backoff_max is set", func() {
+			lockPool.Source.CircuitBreaker = 0
+			lockPool.Source.RetryBackoffMax = 2 * time.Millisecond
+
+			fakeLockHandler.BroadcastLockPoolStub = func() error {
+				if fakeLockHandler.BroadcastLockPoolCallCount() < 6 {
+					return errors.New("could not resolve host")
+				}
+
+				return nil
+			}
+
+			_, _, err := lockPool.AcquireLock()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(fakeLockHandler.BroadcastLockPoolCallCount()).Should(Equal(6))
+			Ω(output).Should(gbytes.Say(`backing off for 2ms after 5 consecutive failure\(s\)`))
+		})
+
+		It("keeps counting through conflicts when retry_backoff_reset is false", func() {
+			reset := false
+			lockPool.Source.RetryBackoffReset = &reset
+
+			fakeLockHandler.BroadcastLockPoolStub = func() error {
+				if fakeLockHandler.BroadcastLockPoolCallCount() == 3 {
+					return out.ErrLockConflict
+				}
+
+				return errors.New("could not resolve host")
+			}
+
+			_, _, err := lockPool.AcquireLock()
+			Ω(err).Should(MatchError(ContainSubstring("after 4 consecutive failures")))
+
+			Ω(fakeLockHandler.BroadcastLockPoolCallCount()).Should(Equal(5))
+			Ω(output).Should(gbytes.Say(`backing off for 4ms after 3 consecutive failure\(s\)`))
+		})
+
+		Context("when the network is to blame", func() {
+			var reset *out.GitError
+
+			BeforeEach(func() {
+				lockPool.Source.CircuitBreaker = 0
+				lockPool.Source.NetworkRetries = 3
+
+				reset = &out.GitError{Class: out.ErrorClassConnectionReset, Command: "git push", Output: "connection reset by peer"}
+				fakeLockHandler.BroadcastLockPoolReturns(reset)
+			})
+
+			It("backs off, naming the failure, then gives up after network_retries", func() {
+				_, _, err := lockPool.AcquireLock()
+				Ω(err).Should(Equal(&out.NetworkRetriesError{Pool: "my-pool", Failures: 4, Last: reset}))
+
+				Ω(fakeLockHandler.BroadcastLockPoolCallCount()).Should(Equal(4))
+
+				Ω(output).Should(gbytes.Say(`connection reset reaching the remote; network retry 1 of 3`))
+				Ω(output).Should(gbytes.Say(`backing off for 1ms after 1 consecutive failure\(s\)`))
+				Ω(output).Should(gbytes.Say(`connection reset reaching the remote; network retry 3 of 3`))
+				Ω(output).Should(gbytes.Say(`backing off for 4ms after 3 consecutive failure\(s\)`))
+			})
+
+			It("counts afresh once the remote answers again", func() {
+				fakeLockHandler.BroadcastLockPoolStub = func() error {
+					switch fakeLockHandler.BroadcastLockPoolCallCount() {
+					case 3:
+						return out.ErrLockConflict
+					case 7:
+						return nil
+					default:
+						return reset
+					}
+				}
+
+				_, _, err := lockPool.AcquireLock()
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakeLockHandler.BroadcastLockPoolCallCount()).Should(Equal(7))
+			})
+
+			It("counts afresh for each operation", func() {
+				_, _, err := lockPool.AcquireLock()
+				Ω(err).Should(BeAssignableToTypeOf(&out.NetworkRetriesError{}))
+
+				fakeLockHandler.BroadcastLockPoolStub = func() error {
+					if fakeLockHandler.BroadcastLockPoolCallCount() == 6 {
+						return nil
+					}
+
+					return reset
+				}
+
+				_, _, err = lockPool.AcquireLock()
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakeLockHandler.BroadcastLockPoolCallCount()).Should(Equal(6))
+			})
+
+			It("still gives up sooner with a circuit breaker", func() {
+				lockPool.Source.CircuitBreaker = 2
+
+				_, _, err := lockPool.AcquireLock()
+				Ω(err).Should(MatchError(ContainSubstring("after 2 consecutive failures")))
+			})
+		})
+
+		It("fails straight away on errors that retrying can't fix", func() {
+			fakeLockHandler.BroadcastLockPoolReturns(&out.GitError{Class: out.ErrorClassAuth, Err: errors.New("denied")})
+
+			_, _, err := lockPool.AcquireLock()
+			Ω(err).ShouldNot(MatchError(ContainSubstring("giving up")))
+
+			Ω(fakeLockHandler.BroadcastLockPoolCallCount()).Should(Equal(1))
+		})
+	})
+
+	Context("Keeping a minimum of unclaimed locks", func() {
+		var unclaimed [][]string
+
+		BeforeEach(func() {
+			lockPool.Source.ReserveMinimum = 2
+			lockPool.Source.RetryDelay = time.Millisecond
+
+			unclaimed = [][]string{{"lock-a", "lock-b"}, {"lock-a", "lock-b", "lock-c"}}
+			fakeLockHandler.ListLocksStub = func(state string) ([]string, error) {
+				if state != "unclaimed" {
+					return nil, nil
+				}
+
+				locks := unclaimed[0]
+				if len(unclaimed) > 1 {
+					unclaimed = unclaimed[1:]
+				}
+
+				return locks, nil
+			}
+
+			fakeLockHandler.LeaseLockReturns("lock-c", "some-ref", nil)
+		})
+
+		It("waits rather than take the last of the reserved minimum", func() {
+			lock, _, err := lockPool.AcquireLock()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(lock).Should(Equal("lock-c"))
+
+			Ω(output).Should(gbytes.Say(`pool: my-pool is down to its reserve_minimum of 2 unclaimed lock\(s\); waiting for more`))
+			Ω(fakeLockHandler.ResetLockCallCount()).Should(Equal(2))
+			Ω(fakeLockHandler.LeaseLockCallCount()).Should(Equal(1))
+		})
+
+		It("holds reservations to the same minimum", func() {
+			fakeLockHandler.ReserveLockReturns("lock-c", "some-ref", nil)
+
+			_, _, err := lockPool.ReserveLock(time.Minute)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(fakeLockHandler.ResetLockCallCount()).Should(Equal(2))
+			Ω(fakeLockHandler.ReserveLockCallCount()).Should(Equal(1))
+		})
+
+		It("takes the last locks without a minimum", func() {
+			lockPool.Source.ReserveMinimum = 0
+
+			_, _, err := lockPool.AcquireLock()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(output).ShouldNot(gbytes.Say("reserve_minimum"))
+			Ω(fakeLockHandler.ResetLockCallCount()).Should(Equal(1))
+			Ω(fakeLockHandler.LeaseLockCallCount()).Should(Equal(1))
+		})
+	})
+
+	Context("Acquiring a lock", func() {
+		BeforeEach(func() {
+			called := false
+
+			fakeLockHandler.LeaseLockStub = func(until func(string) time.Time) (string, string, error) {
+				// succeed on second call
+				if !called {
+					called = true
+					return "", "", out.ErrNoLocksAvailable
+				} else {
+					return "some-lock", "some-ref", nil
+				}
+			}
+		})
+
+		It("waits for a lock to become available", func() {
+			lockName, version, err := lockPool.AcquireLock()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(lockName).Should(Equal("some-lock"))
+			Ω(version).Should(Equal(out.Version{Ref: "some-ref", Lock: "some-lock"}))
+
+			Ω(fakeLockHandler.LeaseLockCallCount()).Should(Equal(2))
+			Ω(fakeLockHandler.BroadcastLockPoolCallCount()).Should(Equal(1))
+		})
+
+		It("says it is still waiting every heartbeat interval", func() {
+			lockPool.Source.HeartbeatInterval = 30 * time.Millisecond
+			fakeLockHandler.ListLocksReturns([]string{"tagged-lock"}, nil)
+
+			_, _, err := lockPool.AcquireLock()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(output).Should(gbytes.Say(`still waiting for a lock on: my-pool after \d+ms \(unclaimed locks: 1\)`))
+			Ω(output).Should(gbytes.Say(`still waiting for a lock on: my-pool after \d+ms \(unclaimed locks: 1\)`))
+			Ω(output).Should(gbytes.Say("acquired lock: some-lock"))
+		})
+
+		It("stays quiet when the wait is shorter than the heartbeat interval", func() {
+			lockPool.Source.HeartbeatInterval = time.Minute
+
+			_, _, err := lockPool.AcquireLock()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(output.Contents()).ShouldNot(ContainSubstring("still waiting"))
+		})
+
+		It("shows the claimed lock's metadata when asked", func() {
+			lockPool.Source.ShowMetadataKeys = []string{"host"}
+			fakeLockHandler.ReadLockReturns([]byte(`{"host":"env-1"}`), nil)
+
+			_, _, err := lockPool.AcquireLock()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			state, lock := fakeLockHandler.ReadLockArgsForCall(0)
+			Ω(state).Should(Equal("claimed"))
+			Ω(lock).Should(Equal("some-lock"))
+
+			Ω(lockPool.Metadata()).Should(ContainElement(out.MetadataPair{Name: "host", Value: "env-1"}))
+		})
+
+		It("surfaces the lock's fencing token", func() {
+			fakeLockHandler.FencingTokenReturns(7, nil)
+
+			_, _, err := lockPool.AcquireLock()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(fakeLockHandler.FencingTokenArgsForCall(0)).Should(Equal("some-lock"))
+			Ω(lockPool.Metadata()).Should(ContainElement(out.MetadataPair{Name: "fencing_token", Value: "7"}))
+			Ω(output).Should(gbytes.Say("fencing token: 7"))
+		})
+
+		It("reports a failing post-claim hook, leaving the lock claimed", func() {
+			lockPool.Source.Hooks.PostClaim = "/bin/false"
+
+			_, _, err := lockPool.AcquireLock()
+			Ω(err).Should(MatchError(ContainSubstring("lock some-lock remains claimed")))
+			Ω(fakeLockHandler.BroadcastLockPoolCallCount()).Should(Equal(1))
+		})
+
+		It("reports how long it waited", func() {
+			_, _, err := lockPool.AcquireLock()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(output).Should(gbytes.Say("acquired lock: some-lock after waiting"))
+
+			metadata := lockPool.Metadata()
+			Ω(metadata).Should(HaveLen(4))
+			Ω(metadata[0].Name).Should(Equal("wait_duration"))
+
+			waited, err := time.ParseDuration(metadata[0].Value)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(waited).Should(BeNumerically(">=", 100*time.Millisecond))
+		})
+	})
+
+	Context("Reserving a lock", func() {
+		var now time.Time
+
+		BeforeEach(func() {
+			now = time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+			lockPool.Source.Paths.Reserved = "reserved"
+			lockPool.Now = func() time.Time { return now }
+
+			fakeLockHandler.ReserveLockReturns("some-lock", "some-ref", nil)
+		})
+
+		It("reserves a lock until the reservation lapses", func() {
+			lockName, version, err := lockPool.ReserveLock(10 * time.Minute)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(lockName).Should(Equal("some-lock"))
+			Ω(version).Should(Equal(out.Version{Ref: "some-ref", Lock: "some-lock"}))
+
+			Ω(fakeLockHandler.ReserveLockCallCount()).Should(Equal(1))
+			Ω(fakeLockHandler.ReserveLockArgsForCall(0)).Should(Equal(now.Add(10 * time.Minute)))
+			Ω(fakeLockHandler.LeaseLockCallCount()).Should(Equal(0))
+
+			Ω(lockPool.Metadata()).Should(ContainElement(out.MetadataPair{Name: "reserved_until", Value: "2026-01-02T03:14:05Z"}))
+		})
+
+		It("returns lapsed reservations to the pool first", func() {
+			fakeLockHandler.ListLocksStub = func(state string) ([]string, error) {
+				if state == "reserved" {
+					return []string{"lapsed-lock", "reserved-lock"}, nil
+				}
+
+				return nil, nil
+			}
+
+			fakeLockHandler.ReservationExpiryStub = func(lock string) (time.Time, error) {
+				if lock == "lapsed-lock" {
+					return now.Add(-time.Second), nil
+				}
+
+				return now.Add(time.Minute), nil
+			}
+
+			_, _, err := lockPool.ReserveLock(10 * time.Minute)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(fakeLockHandler.LapseReservationCallCount()).Should(Equal(1))
+			Ω(fakeLockHandler.LapseReservationArgsForCall(0)).Should(Equal("lapsed-lock"))
+			Ω(output).Should(gbytes.Say("reservation of lock: lapsed-lock lapsed"))
+		})
+
+		It("doesn't run the post-claim hook", func() {
+			lockPool.Source.Hooks.PostClaim = "/bin/false"
+
+			_, _, err := lockPool.ReserveLock(10 * time.Minute)
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+	})
+
+	Context("Leasing a lock", func() {
+		var (
+			now   time.Time
+			until time.Time
+		)
+
+		BeforeEach(func() {
+			now = time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+			lockPool.Source.LeaseDuration = 5 * time.Minute
+			lockPool.Now = func() time.Time { return now }
+
+			fakeLockHandler.LeaseLockStub = func(leaseUntil func(string) time.Time) (string, string, error) {
+				until = leaseUntil("some-lock")
+				return "some-lock", "some-ref", nil
+			}
+		})
+
+		It("claims a lock with a lease", func() {
+			lockName, _, err := lockPool.AcquireLock()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(lockName).Should(Equal("some-lock"))
+
+			Ω(fakeLockHandler.LeaseLockCallCount()).Should(Equal(1))
+			Ω(until).Should(Equal(now.Add(5 * time.Minute)))
+
+			Ω(lockPool.Metadata()).Should(ContainElement(out.MetadataPair{Name: "lease_expires", Value: "2026-01-02T03:09:05Z"}))
+		})
+
+		It("leases the lock for the max_claim_duration in its metadata instead", func() {
+			fakeLockHandler.ReadLockReturns([]byte(`{"max_claim_duration":"2h"}`), nil)
+
+			_, _, err := lockPool.AcquireLock()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			state, lock := fakeLockHandler.ReadLockArgsForCall(0)
+			Ω(state).Should(Equal("claimed"))
+			Ω(lock).Should(Equal("some-lock"))
+
+			Ω(until).Should(Equal(now.Add(2 * time.Hour)))
+			Ω(lockPool.Metadata()).Should(ContainElement(out.MetadataPair{Name: "lease_expires", Value: "2026-01-02T05:04:05Z"}))
+		})
+
+		It("leases a lock declaring max_claim_duration without a lease_duration", func() {
+			lockPool.Source.LeaseDuration = 0
+			fakeLockHandler.ReadLockReturns([]byte(`{"max_claim_duration":"30s"}`), nil)
+
+			_, _, err := lockPool.AcquireLock()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(until).Should(Equal(now.Add(30 * time.Second)))
+		})
+
+		It("holds the claim without a lease when neither says how long", func() {
+			lockPool.Source.LeaseDuration = 0
+			fakeLockHandler.ReadLockReturns([]byte(`{"host":"env-1"}`), nil)
+
+			_, _, err := lockPool.AcquireLock()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(until).Should(BeZero())
+			for _, pair := range lockPool.Metadata() {
+				Ω(pair.Name).ShouldNot(Equal("lease_expires"))
+			}
+		})
+
+		It("falls back to lease_duration when max_claim_duration is not a duration", func() {
+			fakeLockHandler.ReadLockReturns([]byte(`{"max_claim_duration":"forever"}`), nil)
+
+			_, _, err := lockPool.AcquireLock()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(until).Should(Equal(now.Add(5 * time.Minute)))
+			Ω(output).Should(gbytes.Say("ignoring the lease of lock: some-lock, as its max_claim_duration is not a duration"))
+		})
+
+		It("reaps claims whose leases have run out first", func() {
+			fakeLockHandler.ListLocksStub = func(state string) ([]string, error) {
+				if state == "claimed" {
+					return []string{"dead-lock", "live-lock", "unleased-lock"}, nil
+				}
+
+				return nil, nil
+			}
+
+			fakeLockHandler.LeaseExpiryStub = func(lock string) (time.Time, error) {
+				switch lock {
+				case "dead-lock":
+					return now.Add(-time.Second), nil
+				case "live-lock":
+					return now.Add(time.Minute), nil
+				default:
+					return time.Time{}, nil
+				}
+			}
+
+			_, _, err := lockPool.AcquireLock()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(fakeLockHandler.ReapLeaseCallCount()).Should(Equal(1))
+			Ω(fakeLockHandler.ReapLeaseArgsForCall(0)).Should(Equal("dead-lock"))
+			Ω(output).Should(gbytes.Say("lease of lock: dead-lock expired at 2026-01-02T03:04:04Z, reaping it"))
+		})
+	})
+
+	Context("Warning about a low pool", func() {
+		BeforeEach(func() {
+			fakeLockHandler.LeaseLockReturns("some-lock", "some-ref", nil)
+			fakeLockHandler.ListLocksStub = func(state string) ([]string, error) {
+				if state == "unclaimed" {
+					return []string{"other-lock"}, nil
+				}
+
+				return nil, nil
+			}
+		})
+
+		It("reports how many locks are claimed and unclaimed", func() {
+			fakeLockHandler.ListLocksStub = func(state string) ([]string, error) {
+				switch state {
+				case "claimed":
+					return []string{"some-lock", "another-lock"}, nil
+				case "unclaimed":
+					return []string{"other-lock"}, nil
+				}
+
+				return nil, nil
+			}
+
+			_, _, err := lockPool.AcquireLock()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(output).Should(gbytes.Say("pool: my-pool has 2 claimed and 1 unclaimed lock\\(s\\)"))
+			Ω(lockPool.Metadata()).Should(ContainElement(out.MetadataPair{Name: "claimed_count", Value: "2"}))
+			Ω(lockPool.Metadata()).Should(ContainElement(out.MetadataPair{Name: "unclaimed_count", Value: "1"}))
+			Ω(output).ShouldNot(gbytes.Say("WARNING"))
+		})
+
+		It("carries on when the locks cannot be counted", func() {
+			fakeLockHandler.ListLocksStub = func(state string) ([]string, error) {
+				if fakeLockHandler.LeaseLockCallCount() == 0 {
+					return nil, nil
+				}
+
+				return nil, errors.New("disaster")
+			}
+
+			_, _, err := lockPool.AcquireLock()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(output).Should(gbytes.Say("failed to count the locks in pool: my-pool! \\(err: disaster\\)"))
+			for _, pair := range lockPool.Metadata() {
+				Ω(pair.Name).ShouldNot(Equal("claimed_count"))
+			}
+		})
+
+		Context("when the pool has fewer unclaimed locks than the threshold", func() {
+			BeforeEach(func() {
+				lockPool.Source.MinUnclaimedWarning = 2
+			})
+
+			It("warns in the output and the metadata", func() {
+				_, _, err := lockPool.AcquireLock()
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakeLockHandler.ListLocksArgsForCall(fakeLockHandler.ListLocksCallCount() - 1)).Should(Equal("unclaimed"))
+
+				Ω(output).Should(gbytes.Say("WARNING: only 1 unclaimed lock\\(s\\) left in pool my-pool"))
+				Ω(lockPool.Metadata()).Should(ContainElement(out.MetadataPair{
+					Name:  "low_pool_warning",
+					Value: "only 1 unclaimed lock(s) left in pool my-pool (warning below 2)",
+				}))
+			})
+		})
+
+		Context("when the pool has enough unclaimed locks", func() {
+			BeforeEach(func() {
+				lockPool.Source.MinUnclaimedWarning = 1
+			})
+
+			It("does not warn", func() {
+				_, _, err := lockPool.AcquireLock()
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(output).ShouldNot(gbytes.Say("WARNING"))
+				Ω(lockPool.Metadata()).Should(HaveLen(4))
+			})
+		})
+	})
+
 	Context("Removing a lock", func() {
 		var lockDir string
 
@@ -59,20 +855,55 @@ var _ = Describe("Lock Pool", func() {
 			})
 		})
 
+		Context("when the name file contains an invalid lock name", func() {
+			for _, name := range []string{"../../other-pool/foo", "nested/lock", ".gitkeep", ".."} {
+				name := name
+
+				It("rejects "+name+" without touching the pool", func() {
+					err := ioutil.WriteFile(filepath.Join(lockDir, "name"), []byte(name), 0755)
+					Ω(err).ShouldNot(HaveOccurred())
+
+					_, _, err = lockPool.RemoveLock(lockDir)
+					Ω(err).Should(MatchError(ContainSubstring("invalid lock name")))
+
+					Ω(fakeLockHandler.SetupCallCount()).Should(Equal(0))
+				})
+			}
+		})
+
 		Context("when a name file does exist", func() {
 			BeforeEach(func() {
 				err := ioutil.WriteFile(filepath.Join(lockDir, "name"), []byte("some-remove-lock"), 0755)
 				Ω(err).ShouldNot(HaveOccurred())
 			})
 
-			Context("when setup fails", func() {
+			Context("when setup fails", func() {
+				BeforeEach(func() {
+					fakeLockHandler.SetupReturns(errors.New("some-error"))
+				})
+
+				It("returns an error", func() {
+					_, _, err := lockPool.RemoveLock(lockDir)
+					Ω(err).Should(HaveOccurred())
+				})
+
+				It("cleans up what setup left behind", func() {
+					lockPool.RemoveLock(lockDir)
+					Ω(fakeLockHandler.CleanupCallCount()).Should(Equal(1))
+				})
+			})
+
+			Context("when the lock is not claimed", func() {
 				BeforeEach(func() {
-					fakeLockHandler.SetupReturns(errors.New("some-error"))
+					fakeLockHandler.ReadLockReturns(nil, os.ErrNotExist)
+					fakeLockHandler.ListLocksReturns([]string{"lock-a", "lock-b"}, nil)
 				})
 
-				It("returns an error", func() {
+				It("lists the locks that are claimed and unclaimed", func() {
 					_, _, err := lockPool.RemoveLock(lockDir)
-					Ω(err).Should(HaveOccurred())
+					Ω(err).Should(MatchError("lock some-remove-lock is not claimed in pool my-pool (claimed: lock-a, lock-b; unclaimed: lock-a, lock-b)"))
+
+					Ω(fakeLockHandler.RemoveLockCallCount()).Should(Equal(0))
 				})
 			})
 
@@ -93,6 +924,11 @@ var _ = Describe("Lock Pool", func() {
 						_, _, err := lockPool.RemoveLock(lockDir)
 						Ω(err).Should(HaveOccurred())
 					})
+
+					It("still cleans up after itself", func() {
+						lockPool.RemoveLock(lockDir)
+						Ω(fakeLockHandler.CleanupCallCount()).Should(Equal(1))
+					})
 				})
 
 				Context("when resetting the lock state succeeds", func() {
@@ -186,13 +1022,21 @@ var _ = Describe("Lock Pool", func() {
 						})
 
 						Context("when broadcasting succeeds", func() {
+							It("cleans up after itself", func() {
+								_, _, err := lockPool.RemoveLock(lockDir)
+								Ω(err).ShouldNot(HaveOccurred())
+
+								Ω(fakeLockHandler.CleanupCallCount()).Should(Equal(1))
+							})
+
 							It("returns the lockname, and a version", func() {
 								lockName, version, err := lockPool.RemoveLock(lockDir)
 
 								Ω(err).ShouldNot(HaveOccurred())
 								Ω(lockName).Should(Equal("some-remove-lock"))
 								Ω(version).Should(Equal(out.Version{
-									Ref: "some-ref",
+									Ref:  "some-ref",
+									Lock: "some-remove-lock",
 								}))
 							})
 						})
@@ -202,6 +1046,248 @@ var _ = Describe("Lock Pool", func() {
 		})
 	})
 
+	Context("Releasing the locks matching a pattern", func() {
+		var claimed []string
+
+		BeforeEach(func() {
+			claimed = []string{"perf-1", "perf-2", "smoke-1"}
+
+			fakeLockHandler.ListLocksStub = func(state string) ([]string, error) {
+				if state == "claimed" {
+					return claimed, nil
+				}
+
+				return nil, nil
+			}
+
+			fakeLockHandler.UnclaimLocksReturns("some-ref", nil)
+		})
+
+		It("unclaims every matching claimed lock in one change", func() {
+			lock, version, err := lockPool.ReleaseMatching("perf-*")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(lock).Should(BeEmpty())
+			Ω(version).Should(Equal(out.Version{Ref: "some-ref"}))
+
+			Ω(fakeLockHandler.UnclaimLocksCallCount()).Should(Equal(1))
+			Ω(fakeLockHandler.UnclaimLocksArgsForCall(0)).Should(Equal([]string{"perf-1", "perf-2"}))
+			Ω(fakeLockHandler.UnclaimLockCallCount()).Should(BeZero())
+
+			Ω(output).Should(gbytes.Say(`released 2 lock\(s\): perf-1, perf-2`))
+			Ω(lockPool.Metadata()).Should(ContainElement(out.MetadataPair{Name: "released_locks", Value: "perf-1, perf-2"}))
+		})
+
+		It("matches the locks again after a conflicting change", func() {
+			fakeLockHandler.BroadcastLockPoolStub = func() error {
+				if fakeLockHandler.BroadcastLockPoolCallCount() == 1 {
+					claimed = []string{"perf-2", "smoke-1"}
+					return out.ErrLockConflict
+				}
+
+				return nil
+			}
+
+			_, _, err := lockPool.ReleaseMatching("perf-*")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(fakeLockHandler.UnclaimLocksCallCount()).Should(Equal(2))
+			Ω(fakeLockHandler.UnclaimLocksArgsForCall(1)).Should(Equal([]string{"perf-2"}))
+		})
+
+		It("fails when no claimed lock matches", func() {
+			_, _, err := lockPool.ReleaseMatching("load-*")
+			Ω(err).Should(MatchError("no claimed locks in pool my-pool match load-*"))
+
+			Ω(fakeLockHandler.UnclaimLocksCallCount()).Should(BeZero())
+		})
+	})
+
+	Context("Releasing the locks the pipeline holds", func() {
+		var (
+			claimed   []string
+			pipelines map[string]string
+		)
+
+		BeforeEach(func() {
+			os.Setenv("BUILD_TEAM_NAME", "main")
+			os.Setenv("BUILD_PIPELINE_NAME", "deploy")
+
+			claimed = []string{"lock-a", "lock-b", "lock-c"}
+			pipelines = map[string]string{
+				"lock-a": "main/deploy",
+				"lock-b": "main/smoke",
+				"lock-c": "main/deploy",
+			}
+
+			fakeLockHandler.ListLocksStub = func(state string) ([]string, error) {
+				if state == "claimed" {
+					return claimed, nil
+				}
+
+				return nil, nil
+			}
+
+			fakeLockHandler.ClaimPipelineStub = func(lock string) (string, error) {
+				return pipelines[lock], nil
+			}
+
+			fakeLockHandler.UnclaimLocksReturns("some-ref", nil)
+			fakeLockHandler.HeadReturns("head-ref\n", nil)
+		})
+
+		AfterEach(func() {
+			os.Unsetenv("BUILD_TEAM_NAME")
+			os.Unsetenv("BUILD_PIPELINE_NAME")
+		})
+
+		It("unclaims every lock the pipeline holds in one change", func() {
+			lock, version, err := lockPool.ReleaseAllMine()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(lock).Should(BeEmpty())
+			Ω(version).Should(Equal(out.Version{Ref: "some-ref"}))
+
+			Ω(fakeLockHandler.UnclaimLocksCallCount()).Should(Equal(1))
+			Ω(fakeLockHandler.UnclaimLocksArgsForCall(0)).Should(Equal([]string{"lock-a", "lock-c"}))
+
+			Ω(output).Should(gbytes.Say(`released 2 lock\(s\): lock-a, lock-c`))
+		})
+
+		It("succeeds with the pool's version when the pipeline holds nothing", func() {
+			pipelines = map[string]string{"lock-b": "main/smoke"}
+
+			lock, version, err := lockPool.ReleaseAllMine()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(lock).Should(BeEmpty())
+			Ω(version).Should(Equal(out.Version{Ref: "head-ref"}))
+
+			Ω(fakeLockHandler.UnclaimLocksCallCount()).Should(BeZero())
+			Ω(fakeLockHandler.BroadcastLockPoolCallCount()).Should(BeZero())
+			Ω(fakeLockHandler.CleanupCallCount()).Should(Equal(1))
+
+			Ω(output).Should(gbytes.Say("no claimed locks to release"))
+		})
+
+		It("finds the pipeline's locks again after a conflicting change", func() {
+			fakeLockHandler.BroadcastLockPoolStub = func() error {
+				if fakeLockHandler.BroadcastLockPoolCallCount() == 1 {
+					claimed = []string{"lock-b", "lock-c"}
+					return out.ErrLockConflict
+				}
+
+				return nil
+			}
+
+			_, version, err := lockPool.ReleaseAllMine()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(version).Should(Equal(out.Version{Ref: "some-ref"}))
+
+			Ω(fakeLockHandler.UnclaimLocksCallCount()).Should(Equal(2))
+			Ω(fakeLockHandler.UnclaimLocksArgsForCall(1)).Should(Equal([]string{"lock-c"}))
+		})
+
+		It("fails outside of a pipeline", func() {
+			os.Unsetenv("BUILD_PIPELINE_NAME")
+
+			_, _, err := lockPool.ReleaseAllMine()
+			Ω(err).Should(HaveOccurred())
+
+			Ω(fakeLockHandler.SetupCallCount()).Should(BeZero())
+		})
+	})
+
+	Context("Removing several locks at once", func() {
+		var locks map[string][]string
+
+		BeforeEach(func() {
+			locks = map[string][]string{
+				"claimed":   {"perf-1", "smoke-1"},
+				"unclaimed": {"perf-2", "smoke-2"},
+			}
+
+			fakeLockHandler.ListLocksStub = func(state string) ([]string, error) {
+				return locks[state], nil
+			}
+
+			fakeLockHandler.ReadLockStub = func(state string, lock string) ([]byte, error) {
+				for _, listed := range locks[state] {
+					if listed == lock {
+						return []byte("contents"), nil
+					}
+				}
+
+				return nil, os.ErrNotExist
+			}
+
+			fakeLockHandler.RemoveLocksReturns("some-ref", nil)
+		})
+
+		It("removes every claimed or unclaimed lock matching a pattern in one change", func() {
+			lock, version, err := lockPool.RemoveMatching("perf-*")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(lock).Should(BeEmpty())
+			Ω(version).Should(Equal(out.Version{Ref: "some-ref"}))
+
+			Ω(fakeLockHandler.RemoveLocksCallCount()).Should(Equal(1))
+			Ω(fakeLockHandler.RemoveLocksArgsForCall(0)).Should(Equal(map[string]string{
+				"perf-1": "claimed",
+				"perf-2": "unclaimed",
+			}))
+
+			Ω(output).Should(gbytes.Say(`removed 2 lock\(s\): perf-1, perf-2`))
+			Ω(lockPool.Metadata()).Should(ContainElement(out.MetadataPair{Name: "removed_locks", Value: "perf-1, perf-2"}))
+		})
+
+		It("finds the locks again after a conflicting change", func() {
+			fakeLockHandler.BroadcastLockPoolStub = func() error {
+				if fakeLockHandler.BroadcastLockPoolCallCount() == 1 {
+					locks["claimed"] = []string{"smoke-1"}
+					locks["unclaimed"] = []string{"perf-1", "perf-2", "smoke-2"}
+					return out.ErrLockConflict
+				}
+
+				return nil
+			}
+
+			_, _, err := lockPool.RemoveList([]string{"perf-1", "smoke-2"})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(fakeLockHandler.RemoveLocksCallCount()).Should(Equal(2))
+			Ω(fakeLockHandler.RemoveLocksArgsForCall(0)).Should(Equal(map[string]string{
+				"perf-1":  "claimed",
+				"smoke-2": "unclaimed",
+			}))
+			Ω(fakeLockHandler.RemoveLocksArgsForCall(1)).Should(Equal(map[string]string{
+				"perf-1":  "unclaimed",
+				"smoke-2": "unclaimed",
+			}))
+		})
+
+		It("fails when no lock matches", func() {
+			_, _, err := lockPool.RemoveMatching("load-*")
+			Ω(err).Should(MatchError("no claimed or unclaimed locks in pool my-pool match load-*"))
+
+			Ω(fakeLockHandler.RemoveLocksCallCount()).Should(BeZero())
+		})
+
+		It("removes none of the listed locks when any is missing", func() {
+			_, _, err := lockPool.RemoveList([]string{"perf-1", "load-1", "load-2"})
+			Ω(err).Should(MatchError("locks are neither claimed nor unclaimed in pool my-pool: load-1, load-2"))
+
+			Ω(fakeLockHandler.RemoveLocksCallCount()).Should(BeZero())
+		})
+
+		It("rejects an invalid lock name without touching the pool", func() {
+			_, _, err := lockPool.RemoveList([]string{"perf-1", "../other-pool/perf-1"})
+			Ω(err).Should(MatchError(ContainSubstring("invalid lock name")))
+
+			Ω(fakeLockHandler.SetupCallCount()).Should(BeZero())
+		})
+	})
+
 	Context("Releasing a lock", func() {
 		var lockDir string
 
@@ -224,6 +1310,22 @@ var _ = Describe("Lock Pool", func() {
 			})
 		})
 
+		Context("when the name file contains an invalid lock name", func() {
+			for _, name := range []string{"../../other-pool/foo", "nested/lock", ".gitkeep", ".."} {
+				name := name
+
+				It("rejects "+name+" without touching the pool", func() {
+					err := ioutil.WriteFile(filepath.Join(lockDir, "name"), []byte(name), 0755)
+					Ω(err).ShouldNot(HaveOccurred())
+
+					_, _, err = lockPool.ReleaseLock(lockDir)
+					Ω(err).Should(MatchError(ContainSubstring("invalid lock name")))
+
+					Ω(fakeLockHandler.SetupCallCount()).Should(Equal(0))
+				})
+			}
+		})
+
 		Context("when a name file does exist", func() {
 			BeforeEach(func() {
 				err := ioutil.WriteFile(filepath.Join(lockDir, "name"), []byte("some-lock"), 0755)
@@ -241,6 +1343,60 @@ var _ = Describe("Lock Pool", func() {
 				})
 			})
 
+			Context("when the lock is not claimed", func() {
+				BeforeEach(func() {
+					fakeLockHandler.ReadLockReturns(nil, os.ErrNotExist)
+					fakeLockHandler.ListLocksStub = func(state string) ([]string, error) {
+						if state == "claimed" {
+							return []string{"other-lock"}, nil
+						}
+
+						return nil, nil
+					}
+				})
+
+				It("lists the locks that are claimed and unclaimed", func() {
+					_, _, err := lockPool.ReleaseLock(lockDir)
+					Ω(err).Should(MatchError("lock some-lock is not claimed in pool my-pool (claimed: other-lock; unclaimed: none)"))
+
+					Ω(fakeLockHandler.UnclaimLockCallCount()).Should(Equal(0))
+				})
+
+				It("doesn't run the pre-release hook", func() {
+					lockPool.Source.Hooks.PreRelease = "/bin/false"
+
+					_, _, err := lockPool.ReleaseLock(lockDir)
+					Ω(err).Should(MatchError(ContainSubstring("lock some-lock is not claimed")))
+					Ω(err).ShouldNot(MatchError(ContainSubstring("hook /bin/false failed")))
+				})
+
+				Context("when a missing claim is allowed", func() {
+					BeforeEach(func() {
+						fakeLockHandler.HeadReturns("current-ref\n", nil)
+					})
+
+					It("does nothing, returning the current version", func() {
+						lock, version, err := lockPool.ReleaseLockIfClaimed(lockDir)
+						Ω(err).ShouldNot(HaveOccurred())
+						Ω(lock).Should(Equal("some-lock"))
+						Ω(version).Should(Equal(out.Version{Ref: "current-ref", Lock: "some-lock"}))
+
+						Ω(output).Should(gbytes.Say("lock some-lock is not claimed, so there is nothing to release"))
+						Ω(lockPool.Metadata()).Should(ContainElement(out.MetadataPair{Name: "already_released", Value: "true"}))
+
+						Ω(fakeLockHandler.UnclaimLockCallCount()).Should(Equal(0))
+						Ω(fakeLockHandler.BroadcastLockPoolCallCount()).Should(Equal(0))
+					})
+
+					It("doesn't run the pre-release hook", func() {
+						lockPool.Source.Hooks.PreRelease = "/bin/false"
+
+						_, _, err := lockPool.ReleaseLockIfClaimed(lockDir)
+						Ω(err).ShouldNot(HaveOccurred())
+					})
+				})
+			})
+
 			Context("when setup succeeds", func() {
 				It("tries to unclaim the lock it found in the name file", func() {
 					_, _, err := lockPool.ReleaseLock(lockDir)
@@ -251,6 +1407,46 @@ var _ = Describe("Lock Pool", func() {
 					Ω(lockName).Should(Equal("some-lock"))
 				})
 
+				It("releases a claimed lock even if a missing claim is allowed", func() {
+					_, _, err := lockPool.ReleaseLockIfClaimed(lockDir)
+					Ω(err).ShouldNot(HaveOccurred())
+
+					Ω(fakeLockHandler.UnclaimLockCallCount()).Should(Equal(1))
+					Ω(fakeLockHandler.HeadCallCount()).Should(Equal(0))
+				})
+
+				Context("when the pre-release hook fails", func() {
+					BeforeEach(func() {
+						lockPool.Source.Hooks.PreRelease = "/bin/false"
+					})
+
+					It("leaves the lock claimed", func() {
+						_, _, err := lockPool.ReleaseLock(lockDir)
+						Ω(err).Should(MatchError(ContainSubstring("hook /bin/false failed")))
+						Ω(fakeLockHandler.UnclaimLockCallCount()).Should(Equal(0))
+					})
+				})
+
+				Context("when the lock's metadata can't be decrypted", func() {
+					BeforeEach(func() {
+						lockPool.Source.Encryption = out.Encryption{
+							Type:       out.EncryptionGPG,
+							PrivateKey: "not-a-key",
+						}
+						lockPool.Source.Hooks.PreRelease = "/bin/true"
+
+						fakeLockHandler.ReadLockReturns([]byte("-----BEGIN PGP MESSAGE-----\n\nnonsense\n-----END PGP MESSAGE-----\n"), nil)
+					})
+
+					It("says so, and runs the pre-release hook and releases the lock all the same", func() {
+						_, _, err := lockPool.ReleaseLock(lockDir)
+						Ω(err).ShouldNot(HaveOccurred())
+
+						Ω(output).Should(gbytes.Say("failed to read the metadata of lock: some-lock!"))
+						Ω(fakeLockHandler.UnclaimLockCallCount()).Should(Equal(1))
+					})
+				})
+
 				Context("when unclaiming the lock fails", func() {
 					BeforeEach(func() {
 						fakeLockHandler.UnclaimLockReturns("", errors.New("disaster"))
@@ -303,6 +1499,23 @@ var _ = Describe("Lock Pool", func() {
 							})
 						})
 
+						Context("for a reason that retrying won't fix", func() {
+							BeforeEach(func() {
+								fakeLockHandler.BroadcastLockPoolReturns(&out.GitError{
+									Class:   out.ErrorClassAuth,
+									Command: "git push",
+									Output:  "Permission denied (publickey).",
+								})
+							})
+
+							It("fails immediately", func() {
+								_, _, err := lockPool.ReleaseLock(lockDir)
+								Ω(err).Should(MatchError(ContainSubstring("authentication failed")))
+
+								Ω(fakeLockHandler.BroadcastLockPoolCallCount()).Should(Equal(1))
+							})
+						})
+
 						Context("for an expected reason", func() {
 							BeforeEach(func() {
 								called := false
@@ -332,13 +1545,21 @@ var _ = Describe("Lock Pool", func() {
 					})
 
 					Context("when broadcasting succeeds", func() {
+						It("cleans up after itself", func() {
+							_, _, err := lockPool.ReleaseLock(lockDir)
+							Ω(err).ShouldNot(HaveOccurred())
+
+							Ω(fakeLockHandler.CleanupCallCount()).Should(Equal(1))
+						})
+
 						It("returns the lockname, and a version", func() {
 							lockName, version, err := lockPool.ReleaseLock(lockDir)
 
 							Ω(err).ShouldNot(HaveOccurred())
 							Ω(lockName).Should(Equal("some-lock"))
 							Ω(version).Should(Equal(out.Version{
-								Ref: "some-ref",
+								Ref:  "some-ref",
+								Lock: "some-lock",
 							}))
 						})
 					})
@@ -361,10 +1582,192 @@ var _ = Describe("Lock Pool", func() {
 			Ω(err).ShouldNot(HaveOccurred())
 		})
 
-		Context("when a no files file doesn't exist", func() {
-			It("returns an error", func() {
-				_, _, err := lockPool.AddLock(lockDir)
-				Ω(err).Should(HaveOccurred())
+		Context("when a no files file doesn't exist", func() {
+			It("returns an error", func() {
+				_, _, err := lockPool.AddLock(lockDir)
+				Ω(err).Should(HaveOccurred())
+			})
+		})
+
+		Context("when the name file contains an invalid lock name", func() {
+			for _, name := range []string{"../../other-pool/foo", "nested/lock", ".gitkeep", ".."} {
+				name := name
+
+				It("rejects "+name+" without touching the pool", func() {
+					err := ioutil.WriteFile(filepath.Join(lockDir, "name"), []byte(name), 0755)
+					Ω(err).ShouldNot(HaveOccurred())
+
+					err = ioutil.WriteFile(filepath.Join(lockDir, "metadata"), []byte("lock-contents"), 0755)
+					Ω(err).ShouldNot(HaveOccurred())
+
+					_, _, err = lockPool.AddLock(lockDir)
+					Ω(err).Should(MatchError(ContainSubstring("invalid lock name")))
+
+					Ω(fakeLockHandler.SetupCallCount()).Should(Equal(0))
+				})
+			}
+		})
+
+		Context("when the lock is already in the pool", func() {
+			BeforeEach(func() {
+				err := ioutil.WriteFile(filepath.Join(lockDir, "name"), []byte("some-lock"), 0755)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				err = ioutil.WriteFile(filepath.Join(lockDir, "metadata"), []byte("new-contents"), 0755)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				fakeLockHandler.AddLockReturns("some-ref", nil)
+			})
+
+			inState := func(lockState string) {
+				fakeLockHandler.ListLocksStub = func(state string) ([]string, error) {
+					if state == lockState {
+						return []string{"other-lock", "some-lock"}, nil
+					}
+
+					return nil, nil
+				}
+			}
+
+			It("refuses to replace an unclaimed lock's metadata", func() {
+				inState("unclaimed")
+
+				_, _, err := lockPool.AddLock(lockDir)
+				Ω(err).Should(MatchError("lock some-lock is already in pool my-pool; set params.overwrite to replace its metadata"))
+
+				Ω(fakeLockHandler.AddLockCallCount()).Should(Equal(0))
+			})
+
+			It("replaces an unclaimed lock's metadata when asked to", func() {
+				inState("unclaimed")
+
+				_, _, err := lockPool.ReplaceLock(lockDir, "")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakeLockHandler.AddLockCallCount()).Should(Equal(1))
+				lock, contents := fakeLockHandler.AddLockArgsForCall(0)
+				Ω(lock).Should(Equal("some-lock"))
+				Ω(string(contents)).Should(Equal("new-contents"))
+			})
+
+			It("refuses to add a lock that is in any other state, even when asked to replace it", func() {
+				inState("claimed")
+
+				_, _, err := lockPool.ReplaceLock(lockDir, "")
+				Ω(err).Should(MatchError("lock some-lock is already in pool my-pool, in claimed, and can't be overwritten"))
+
+				Ω(fakeLockHandler.AddLockCallCount()).Should(Equal(0))
+			})
+		})
+
+		Context("when there is no name file but several lock files", func() {
+			BeforeEach(func() {
+				err := ioutil.WriteFile(filepath.Join(lockDir, "lock-b"), []byte("b-contents"), 0755)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				err = ioutil.WriteFile(filepath.Join(lockDir, "lock-a"), []byte("a-contents"), 0755)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				err = ioutil.WriteFile(filepath.Join(lockDir, ".gitkeep"), []byte{}, 0755)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				fakeLockHandler.AddLocksReturns("some-ref", nil)
+			})
+
+			It("adds every lock in a single change", func() {
+				lock, version, err := lockPool.AddLock(lockDir)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(lock).Should(BeEmpty())
+				Ω(version).Should(Equal(out.Version{Ref: "some-ref"}))
+
+				Ω(fakeLockHandler.AddLockCallCount()).Should(Equal(0))
+				Ω(fakeLockHandler.AddLocksCallCount()).Should(Equal(1))
+				Ω(fakeLockHandler.AddLocksArgsForCall(0)).Should(Equal(map[string][]byte{
+					"lock-a": []byte("a-contents"),
+					"lock-b": []byte("b-contents"),
+				}))
+
+				Ω(lockPool.Metadata()).Should(ContainElement(out.MetadataPair{Name: "added_locks", Value: "lock-a, lock-b"}))
+			})
+
+			It("renders each lock's metadata from a template, if given", func() {
+				_, _, err := lockPool.AddTemplatedLock(lockDir, "{{.Name}}: {{.Metadata}}")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				locks := fakeLockHandler.AddLocksArgsForCall(0)
+				Ω(string(locks["lock-a"])).Should(Equal("lock-a: a-contents"))
+				Ω(string(locks["lock-b"])).Should(Equal("lock-b: b-contents"))
+			})
+
+			It("retries the whole change on a conflict", func() {
+				called := false
+
+				fakeLockHandler.BroadcastLockPoolStub = func() error {
+					if !called {
+						called = true
+						return out.ErrLockConflict
+					}
+
+					return nil
+				}
+
+				_, _, err := lockPool.AddLock(lockDir)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakeLockHandler.AddLocksCallCount()).Should(Equal(2))
+				Ω(fakeLockHandler.BroadcastLockPoolCallCount()).Should(Equal(2))
+			})
+
+			It("rejects the lot without touching the pool when any name is invalid", func() {
+				err := ioutil.WriteFile(filepath.Join(lockDir, "bad name"), []byte("contents"), 0755)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				_, _, err = lockPool.AddLock(lockDir)
+				Ω(err).Should(MatchError(ContainSubstring("invalid lock name")))
+
+				Ω(fakeLockHandler.SetupCallCount()).Should(Equal(0))
+			})
+
+			Context("when a manifest lists the locks", func() {
+				BeforeEach(func() {
+					err := ioutil.WriteFile(filepath.Join(lockDir, out.LockManifest), []byte(`{"env-1": "plain", "env-2": {"ip": "10.0.0.2"}}`), 0755)
+					Ω(err).ShouldNot(HaveOccurred())
+				})
+
+				It("adds the manifest's locks instead of the files", func() {
+					_, _, err := lockPool.AddLock(lockDir)
+					Ω(err).ShouldNot(HaveOccurred())
+
+					Ω(fakeLockHandler.AddLocksArgsForCall(0)).Should(Equal(map[string][]byte{
+						"env-1": []byte("plain"),
+						"env-2": []byte(`{"ip":"10.0.0.2"}`),
+					}))
+				})
+			})
+
+			Context("when a manifest is not valid JSON", func() {
+				BeforeEach(func() {
+					err := ioutil.WriteFile(filepath.Join(lockDir, out.LockManifest), []byte(`["env-1"]`), 0755)
+					Ω(err).ShouldNot(HaveOccurred())
+				})
+
+				It("returns an error without touching the pool", func() {
+					_, _, err := lockPool.AddLock(lockDir)
+					Ω(err).Should(MatchError(ContainSubstring("could not parse locks.json")))
+
+					Ω(fakeLockHandler.SetupCallCount()).Should(Equal(0))
+				})
+			})
+		})
+
+		Context("when there is only a metadata file", func() {
+			It("still asks for the name file", func() {
+				err := ioutil.WriteFile(filepath.Join(lockDir, "metadata"), []byte("lock-contents"), 0755)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				_, _, err = lockPool.AddLock(lockDir)
+				Ω(err).Should(MatchError(ContainSubstring("could not read the name file")))
 			})
 		})
 
@@ -399,6 +1802,27 @@ var _ = Describe("Lock Pool", func() {
 					Ω(string(lockContents)).Should(Equal("lock-contents"))
 				})
 
+				It("renders the metadata from a template, if given", func() {
+					lockPool.Now = func() time.Time { return time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC) }
+
+					_, _, err := lockPool.AddTemplatedLock(lockDir, `{"name":{{json .Name}},"file":{{json .Metadata}},"added_at":"{{.Timestamp}}"}`)
+					Ω(err).ShouldNot(HaveOccurred())
+
+					_, lockContents := fakeLockHandler.AddLockArgsForCall(0)
+					Ω(string(lockContents)).Should(Equal(`{"name":"some-lock","file":"lock-contents","added_at":"2026-01-02T03:04:05Z"}`))
+				})
+
+				It("does not need a metadata file when given a template", func() {
+					err := os.Remove(filepath.Join(lockDir, "metadata"))
+					Ω(err).ShouldNot(HaveOccurred())
+
+					_, _, err = lockPool.AddTemplatedLock(lockDir, "added by {{.Name}}")
+					Ω(err).ShouldNot(HaveOccurred())
+
+					_, lockContents := fakeLockHandler.AddLockArgsForCall(0)
+					Ω(string(lockContents)).Should(Equal("added by some-lock"))
+				})
+
 				Context("when adding the lock fails", func() {
 					BeforeEach(func() {
 						called := false
@@ -497,12 +1921,616 @@ var _ = Describe("Lock Pool", func() {
 							Ω(err).ShouldNot(HaveOccurred())
 							Ω(lockName).Should(Equal("some-lock"))
 							Ω(version).Should(Equal(out.Version{
-								Ref: "some-ref",
+								Ref:  "some-ref",
+								Lock: "some-lock",
 							}))
 						})
 					})
 				})
 			})
 		})
+
+		Context("when the pool has a metadata schema", func() {
+			BeforeEach(func() {
+				err := ioutil.WriteFile(filepath.Join(lockDir, "name"), []byte("some-lock"), 0755)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				err = ioutil.WriteFile(filepath.Join(lockDir, "metadata"), []byte(`{"size":"large"}`), 0755)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				fakeLockHandler.ReadSchemaReturns([]byte(`{"required": ["size"], "properties": {"size": {"enum": ["small", "large"]}}}`), nil)
+				fakeLockHandler.AddLockReturns("some-ref", nil)
+			})
+
+			It("adds a lock whose metadata matches it", func() {
+				_, _, err := lockPool.AddLock(lockDir)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakeLockHandler.AddLockCallCount()).Should(Equal(1))
+			})
+
+			It("rejects a lock whose metadata doesn't match it without touching the pool", func() {
+				err := ioutil.WriteFile(filepath.Join(lockDir, "metadata"), []byte(`{"size":"huge"}`), 0755)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				_, _, err = lockPool.AddLock(lockDir)
+				Ω(err).Should(MatchError(`metadata of lock some-lock does not match the schema of pool my-pool: metadata.size must be one of ["small","large"]`))
+
+				Ω(fakeLockHandler.AddLockCallCount()).Should(BeZero())
+				Ω(fakeLockHandler.BroadcastLockPoolCallCount()).Should(BeZero())
+			})
+
+			It("reads the schema again after a conflicting change", func() {
+				fakeLockHandler.BroadcastLockPoolStub = func() error {
+					if fakeLockHandler.BroadcastLockPoolCallCount() == 1 {
+						fakeLockHandler.ReadSchemaReturns([]byte(`{"properties": {"size": {"const": "small"}}}`), nil)
+						return out.ErrLockConflict
+					}
+
+					return nil
+				}
+
+				_, _, err := lockPool.AddLock(lockDir)
+				Ω(err).Should(MatchError(ContainSubstring("does not match the schema of pool my-pool")))
+
+				Ω(fakeLockHandler.ReadSchemaCallCount()).Should(Equal(2))
+				Ω(fakeLockHandler.AddLockCallCount()).Should(Equal(1))
+			})
+		})
+	})
+
+	Context("changing the state of a lock", func() {
+		var lockDir string
+
+		BeforeEach(func() {
+			var err error
+			lockDir, err = ioutil.TempDir("", "lock-dir")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = ioutil.WriteFile(filepath.Join(lockDir, "name"), []byte("some-lock"), 0755)
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			err := os.RemoveAll(lockDir)
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("disables the lock found in the name file", func() {
+			fakeLockHandler.DisableLockReturns("some-ref", nil)
+
+			lockName, version, err := lockPool.DisableLock(lockDir)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(fakeLockHandler.DisableLockCallCount()).Should(Equal(1))
+			Ω(fakeLockHandler.DisableLockArgsForCall(0)).Should(Equal("some-lock"))
+			Ω(fakeLockHandler.BroadcastLockPoolCallCount()).Should(Equal(1))
+
+			Ω(lockName).Should(Equal("some-lock"))
+			Ω(version).Should(Equal(out.Version{Ref: "some-ref", Lock: "some-lock"}))
+		})
+
+		It("enables the lock found in the name file", func() {
+			fakeLockHandler.EnableLockReturns("some-ref", nil)
+
+			lockName, version, err := lockPool.EnableLock(lockDir)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(fakeLockHandler.EnableLockCallCount()).Should(Equal(1))
+			Ω(fakeLockHandler.EnableLockArgsForCall(0)).Should(Equal("some-lock"))
+
+			Ω(lockName).Should(Equal("some-lock"))
+			Ω(version).Should(Equal(out.Version{Ref: "some-ref", Lock: "some-lock"}))
+		})
+
+		It("quarantines the lock found in the name file with the given reason", func() {
+			fakeLockHandler.QuarantineLockReturns("some-ref", nil)
+
+			lockName, version, err := lockPool.QuarantineLock(lockDir, "disk full")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(fakeLockHandler.QuarantineLockCallCount()).Should(Equal(1))
+			quarantinedLock, reason := fakeLockHandler.QuarantineLockArgsForCall(0)
+			Ω(quarantinedLock).Should(Equal("some-lock"))
+			Ω(reason).Should(Equal("disk full"))
+
+			Ω(output).Should(gbytes.Say("disk full"))
+
+			Ω(lockName).Should(Equal("some-lock"))
+			Ω(version).Should(Equal(out.Version{Ref: "some-ref", Lock: "some-lock"}))
+		})
+
+		It("force unclaims the lock found in the name file from whichever state it is in", func() {
+			lockPool.Source.Paths.Maintenance = "maintenance"
+			lockPool.Source.Paths.Broken = "broken"
+
+			fakeLockHandler.ReadLockStub = func(state string, lock string) ([]byte, error) {
+				if state == "broken" {
+					return []byte("some-metadata"), nil
+				}
+
+				return nil, os.ErrNotExist
+			}
+			fakeLockHandler.ForceUnclaimLockReturns("some-ref", nil)
+
+			lockName, version, err := lockPool.ForceUnclaimLock(lockDir)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(fakeLockHandler.ForceUnclaimLockCallCount()).Should(Equal(1))
+			unclaimedLock, state := fakeLockHandler.ForceUnclaimLockArgsForCall(0)
+			Ω(unclaimedLock).Should(Equal("some-lock"))
+			Ω(state).Should(Equal("broken"))
+
+			Ω(lockName).Should(Equal("some-lock"))
+			Ω(version).Should(Equal(out.Version{Ref: "some-ref", Lock: "some-lock"}))
+		})
+
+		It("fails to force unclaim a lock that is already unclaimed", func() {
+			fakeLockHandler.ReadLockReturns(nil, os.ErrNotExist)
+
+			_, _, err := lockPool.ForceUnclaimLock(lockDir)
+			Ω(err).Should(MatchError("lock some-lock is not claimed, reserved, disabled, or quarantined"))
+
+			Ω(fakeLockHandler.ForceUnclaimLockCallCount()).Should(Equal(0))
+			Ω(fakeLockHandler.BroadcastLockPoolCallCount()).Should(Equal(0))
+		})
+
+		Context("confirming a reservation", func() {
+			var now time.Time
+
+			BeforeEach(func() {
+				now = time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+				lockPool.Now = func() time.Time { return now }
+				fakeLockHandler.ConfirmLockReturns("some-ref", nil)
+			})
+
+			It("claims the reserved lock found in the name file", func() {
+				fakeLockHandler.ReservationExpiryReturns(now.Add(time.Minute), nil)
+
+				lockName, version, err := lockPool.ConfirmLock(lockDir)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakeLockHandler.ConfirmLockCallCount()).Should(Equal(1))
+				Ω(fakeLockHandler.ConfirmLockArgsForCall(0)).Should(Equal("some-lock"))
+
+				Ω(lockName).Should(Equal("some-lock"))
+				Ω(version).Should(Equal(out.Version{Ref: "some-ref", Lock: "some-lock"}))
+			})
+
+			It("refuses a reservation that has lapsed", func() {
+				fakeLockHandler.ReservationExpiryReturns(now.Add(-time.Minute), nil)
+
+				_, _, err := lockPool.ConfirmLock(lockDir)
+				Ω(err).Should(MatchError("the reservation of lock some-lock lapsed at 2026-01-02T03:03:05Z"))
+
+				Ω(fakeLockHandler.ConfirmLockCallCount()).Should(Equal(0))
+				Ω(fakeLockHandler.BroadcastLockPoolCallCount()).Should(Equal(0))
+			})
+
+			It("refuses a lock that is not reserved", func() {
+				fakeLockHandler.ReservationExpiryReturns(time.Time{}, os.ErrNotExist)
+
+				_, _, err := lockPool.ConfirmLock(lockDir)
+				Ω(err).Should(MatchError("lock some-lock is not reserved; its reservation may have lapsed"))
+
+				Ω(fakeLockHandler.ConfirmLockCallCount()).Should(Equal(0))
+			})
+		})
+
+		Context("renewing a lease", func() {
+			var now time.Time
+
+			BeforeEach(func() {
+				now = time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+				lockPool.Source.LeaseDuration = 5 * time.Minute
+				lockPool.Now = func() time.Time { return now }
+
+				fakeLockHandler.RenewLeaseReturns("some-ref", nil)
+			})
+
+			It("extends the lease of the claimed lock found in the name file", func() {
+				lockName, version, err := lockPool.RenewLease(lockDir)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakeLockHandler.RenewLeaseCallCount()).Should(Equal(1))
+				renewedLock, until := fakeLockHandler.RenewLeaseArgsForCall(0)
+				Ω(renewedLock).Should(Equal("some-lock"))
+				Ω(until).Should(Equal(now.Add(5 * time.Minute)))
+
+				Ω(lockName).Should(Equal("some-lock"))
+				Ω(version).Should(Equal(out.Version{Ref: "some-ref", Lock: "some-lock"}))
+				Ω(lockPool.Metadata()).Should(ContainElement(out.MetadataPair{Name: "lease_expires", Value: "2026-01-02T03:09:05Z"}))
+			})
+
+			It("refuses a lock that is no longer claimed", func() {
+				fakeLockHandler.ReadLockReturns(nil, os.ErrNotExist)
+
+				_, _, err := lockPool.RenewLease(lockDir)
+				Ω(err).Should(MatchError("lock some-lock is not claimed; its lease may have been reaped"))
+
+				Ω(fakeLockHandler.RenewLeaseCallCount()).Should(Equal(0))
+			})
+
+			It("extends the lease by the max_claim_duration in the lock's metadata", func() {
+				lockPool.Source.LeaseDuration = 0
+				fakeLockHandler.ReadLockReturns([]byte(`{"max_claim_duration":"1h"}`), nil)
+
+				_, _, err := lockPool.RenewLease(lockDir)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				_, until := fakeLockHandler.RenewLeaseArgsForCall(0)
+				Ω(until).Should(Equal(now.Add(time.Hour)))
+			})
+
+			It("requires a lease duration", func() {
+				lockPool.Source.LeaseDuration = 0
+
+				_, _, err := lockPool.RenewLease(lockDir)
+				Ω(err).Should(MatchError("lock some-lock has no lease to renew: set source.lease_duration, or max_claim_duration in its metadata"))
+
+				Ω(fakeLockHandler.RenewLeaseCallCount()).Should(Equal(0))
+			})
+		})
+
+		Context("transferring a lock", func() {
+			var now time.Time
+
+			BeforeEach(func() {
+				now = time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+				lockPool.Now = func() time.Time { return now }
+
+				fakeLockHandler.TransferLockReturns("some-ref", nil)
+				fakeLockHandler.FencingTokenReturns(4, nil)
+			})
+
+			It("hands the claimed lock found in the name file over in one commit", func() {
+				lockName, version, err := lockPool.TransferLock(lockDir)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fakeLockHandler.TransferLockCallCount()).Should(Equal(1))
+				transferredLock, until := fakeLockHandler.TransferLockArgsForCall(0)
+				Ω(transferredLock).Should(Equal("some-lock"))
+				Ω(until).Should(BeZero())
+
+				Ω(fakeLockHandler.BroadcastLockPoolCallCount()).Should(Equal(1))
+				Ω(fakeLockHandler.UnclaimLockCallCount()).Should(Equal(0))
+
+				Ω(lockName).Should(Equal("some-lock"))
+				Ω(version).Should(Equal(out.Version{Ref: "some-ref", Lock: "some-lock"}))
+				Ω(lockPool.Metadata()).Should(ContainElement(out.MetadataPair{Name: "fencing_token", Value: "4"}))
+			})
+
+			It("restarts the lease for the new claimer", func() {
+				lockPool.Source.LeaseDuration = 5 * time.Minute
+
+				_, _, err := lockPool.TransferLock(lockDir)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				_, until := fakeLockHandler.TransferLockArgsForCall(0)
+				Ω(until).Should(Equal(now.Add(5 * time.Minute)))
+				Ω(lockPool.Metadata()).Should(ContainElement(out.MetadataPair{Name: "lease_expires", Value: "2026-01-02T03:09:05Z"}))
+			})
+
+			It("refuses a lock that is not claimed", func() {
+				fakeLockHandler.ReadLockReturns(nil, os.ErrNotExist)
+
+				_, _, err := lockPool.TransferLock(lockDir)
+				Ω(err).Should(MatchError("lock some-lock is not claimed, so there is nothing to transfer"))
+
+				Ω(fakeLockHandler.TransferLockCallCount()).Should(Equal(0))
+			})
+		})
+
+		Context("when disabling the lock fails", func() {
+			BeforeEach(func() {
+				fakeLockHandler.DisableLockReturns("", errors.New("disaster"))
+			})
+
+			It("returns an error without retrying", func() {
+				_, _, err := lockPool.DisableLock(lockDir)
+				Ω(err).Should(HaveOccurred())
+
+				Ω(fakeLockHandler.DisableLockCallCount()).Should(Equal(1))
+				Ω(fakeLockHandler.BroadcastLockPoolCallCount()).Should(Equal(0))
+			})
+		})
+
+		Context("when broadcasting conflicts", func() {
+			BeforeEach(func() {
+				called := false
+
+				fakeLockHandler.BroadcastLockPoolStub = func() error {
+					// succeed on second call
+					if !called {
+						called = true
+						return out.ErrLockConflict
+					} else {
+						return nil
+					}
+				}
+			})
+
+			It("resets and retries without logging an error", func() {
+				_, _, err := lockPool.DisableLock(lockDir)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(output).ShouldNot(gbytes.Say("err"))
+
+				Ω(fakeLockHandler.ResetLockCallCount()).Should(Equal(2))
+				Ω(fakeLockHandler.DisableLockCallCount()).Should(Equal(2))
+			})
+
+			It("reports how many times it retried after conflicting changes", func() {
+				_, _, err := lockPool.DisableLock(lockDir)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(output).Should(gbytes.Say(`retried 1 time\(s\) after conflicting changes to the pool`))
+				Ω(lockPool.Metadata()).Should(ContainElement(out.MetadataPair{Name: "conflict_retries", Value: "1"}))
+			})
+
+			It("streams the operation's events as JSON", func() {
+				events := gbytes.NewBuffer()
+				lockPool.Events = events
+				lockPool.Now = func() time.Time { return time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC) }
+				fakeLockHandler.DisableLockReturns("some-ref", nil)
+
+				_, _, err := lockPool.DisableLock(lockDir)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				var lines []out.Event
+				decoder := json.NewDecoder(bytes.NewReader(events.Contents()))
+				for decoder.More() {
+					var event out.Event
+					Ω(decoder.Decode(&event)).Should(Succeed())
+					lines = append(lines, event)
+				}
+
+				base := out.Event{Time: "2026-01-02T03:04:05Z", Operation: "disable", Pool: "my-pool"}
+				with := func(change func(*out.Event)) out.Event {
+					event := base
+					change(&event)
+					return event
+				}
+
+				finished := &lines[len(lines)-1]
+				Ω(finished.TimingsMS).Should(HaveKey("clone"))
+				Ω(finished.TimingsMS).Should(HaveKey("select"))
+				Ω(finished.TimingsMS).Should(HaveKey("commit"))
+				Ω(finished.TimingsMS).Should(HaveKey("push"))
+				finished.TimingsMS = nil
+
+				Ω(lines).Should(Equal([]out.Event{
+					with(func(e *out.Event) { e.Event = out.EventStarted }),
+					with(func(e *out.Event) { e.Event = out.EventConflict; e.Attempt = 1 }),
+					with(func(e *out.Event) { e.Event = out.EventRetry; e.Attempt = 1; e.Reason = out.ErrLockConflict.Error() }),
+					with(func(e *out.Event) {
+						e.Event = out.EventSucceeded
+						e.Lock = "some-lock"
+						e.Ref = "some-ref"
+						e.Retries = 1
+						e.Conflicts = 1
+					}),
+				}))
+			})
+		})
+	})
+
+	Context("Renaming a lock", func() {
+		var states map[string]string
+
+		BeforeEach(func() {
+			states = map[string]string{"old-name": "claimed", "other-lock": "unclaimed"}
+
+			fakeLockHandler.ReadLockStub = func(state string, lock string) ([]byte, error) {
+				if states[lock] == state {
+					return []byte("some-metadata"), nil
+				}
+
+				return nil, os.ErrNotExist
+			}
+		})
+
+		It("renames the lock in the state it is in", func() {
+			fakeLockHandler.RenameLockReturns("some-ref\n", nil)
+
+			lockName, version, err := lockPool.RenameLock("old-name", "new-name")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(fakeLockHandler.RenameLockCallCount()).Should(Equal(1))
+			from, to, state := fakeLockHandler.RenameLockArgsForCall(0)
+			Ω(from).Should(Equal("old-name"))
+			Ω(to).Should(Equal("new-name"))
+			Ω(state).Should(Equal("claimed"))
+
+			Ω(lockName).Should(Equal("new-name"))
+			Ω(version).Should(Equal(out.Version{Ref: "some-ref", Lock: "new-name"}))
+			Ω(output).Should(gbytes.Say("renamed lock: old-name to: new-name"))
+		})
+
+		It("refuses to rename a lock onto one the pool already has", func() {
+			_, _, err := lockPool.RenameLock("old-name", "other-lock")
+			Ω(err).Should(MatchError("lock other-lock is already in pool my-pool, in unclaimed"))
+
+			Ω(fakeLockHandler.RenameLockCallCount()).Should(BeZero())
+		})
+
+		It("refuses to rename a lock the pool doesn't have", func() {
+			_, _, err := lockPool.RenameLock("missing-lock", "new-name")
+			Ω(err).Should(MatchError("lock missing-lock is not in pool my-pool"))
+
+			Ω(fakeLockHandler.RenameLockCallCount()).Should(BeZero())
+		})
+
+		It("rejects an invalid lock name without touching the pool", func() {
+			_, _, err := lockPool.RenameLock("old-name", "../other-pool/new-name")
+			Ω(err).Should(MatchError(ContainSubstring("invalid lock name")))
+
+			Ω(fakeLockHandler.SetupCallCount()).Should(BeZero())
+		})
+	})
+
+	Context("Squashing history", func() {
+		var now time.Time
+
+		BeforeEach(func() {
+			now = time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+			lockPool.Now = func() time.Time { return now }
+		})
+
+		It("squashes the history older than it is told to keep", func() {
+			fakeLockHandler.SquashHistoryReturns("some-ref\n", 42, nil)
+
+			_, version, err := lockPool.SquashHistory(30 * 24 * time.Hour)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(version).Should(Equal(out.Version{Ref: "some-ref"}))
+
+			Ω(fakeLockHandler.SquashHistoryArgsForCall(0)).Should(Equal(now.Add(-30 * 24 * time.Hour)))
+			Ω(fakeLockHandler.BroadcastLockPoolCallCount()).Should(Equal(1))
+			Ω(lockPool.Metadata()).Should(ContainElement(out.MetadataPair{Name: "squashed_commits", Value: "42"}))
+		})
+
+		It("pushes nothing when there is nothing to squash", func() {
+			fakeLockHandler.SquashHistoryReturns("some-ref\n", 0, nil)
+
+			_, version, err := lockPool.SquashHistory(30 * 24 * time.Hour)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(version).Should(Equal(out.Version{Ref: "some-ref"}))
+
+			Ω(fakeLockHandler.BroadcastLockPoolCallCount()).Should(BeZero())
+			Ω(output).Should(gbytes.Say("nothing to squash"))
+		})
+
+		It("squashes again on top of changes made meanwhile", func() {
+			fakeLockHandler.SquashHistoryReturns("some-ref", 42, nil)
+			fakeLockHandler.BroadcastLockPoolStub = func() error {
+				if fakeLockHandler.BroadcastLockPoolCallCount() == 1 {
+					return out.ErrLockConflict
+				}
+
+				return nil
+			}
+
+			_, _, err := lockPool.SquashHistory(30 * 24 * time.Hour)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(fakeLockHandler.ResetLockCallCount()).Should(Equal(2))
+			Ω(fakeLockHandler.SquashHistoryCallCount()).Should(Equal(2))
+		})
+
+		It("gives up when squashing fails", func() {
+			fakeLockHandler.SquashHistoryReturns("", 0, errors.New("disaster"))
+
+			_, _, err := lockPool.SquashHistory(30 * 24 * time.Hour)
+			Ω(err).Should(MatchError("disaster"))
+			Ω(fakeLockHandler.BroadcastLockPoolCallCount()).Should(BeZero())
+		})
+	})
+
+	Context("Reverting a commit", func() {
+		It("reverts the commit, recording which it was", func() {
+			fakeLockHandler.RevertCommitReturns("some-ref\n", "bad-commit", nil)
+
+			_, version, err := lockPool.RevertCommit("bad")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(version).Should(Equal(out.Version{Ref: "some-ref"}))
+
+			Ω(fakeLockHandler.RevertCommitArgsForCall(0)).Should(Equal("bad"))
+			Ω(output).Should(gbytes.Say("reverted commit: bad-commit"))
+			Ω(lockPool.Metadata()).Should(ContainElement(out.MetadataPair{Name: "reverted_commit", Value: "bad-commit"}))
+		})
+
+		It("reverts again on top of changes made meanwhile", func() {
+			fakeLockHandler.RevertCommitReturns("some-ref", "bad-commit", nil)
+			fakeLockHandler.BroadcastLockPoolStub = func() error {
+				if fakeLockHandler.BroadcastLockPoolCallCount() == 1 {
+					return out.ErrLockConflict
+				}
+
+				return nil
+			}
+
+			_, _, err := lockPool.RevertCommit("bad")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(fakeLockHandler.ResetLockCallCount()).Should(Equal(2))
+			Ω(fakeLockHandler.RevertCommitCallCount()).Should(Equal(2))
+		})
+
+		It("gives up when the commit can't be reverted", func() {
+			fakeLockHandler.RevertCommitReturns("", "", errors.New("commit bad can't be reverted cleanly"))
+
+			_, _, err := lockPool.RevertCommit("bad")
+			Ω(err).Should(MatchError("commit bad can't be reverted cleanly"))
+			Ω(fakeLockHandler.BroadcastLockPoolCallCount()).Should(BeZero())
+		})
+	})
+
+	Context("Destroying the pool", func() {
+		It("destroys the pool when it is confirmed by name", func() {
+			fakeLockHandler.DestroyPoolReturns("some-ref\n", nil)
+
+			_, version, err := lockPool.DestroyPool("my-pool")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(version).Should(Equal(out.Version{Ref: "some-ref"}))
+
+			Ω(fakeLockHandler.DestroyPoolCallCount()).Should(Equal(1))
+			Ω(fakeLockHandler.BroadcastLockPoolCallCount()).Should(Equal(1))
+		})
+
+		It("refuses to destroy the pool when the confirmation names another", func() {
+			_, _, err := lockPool.DestroyPool("other-pool")
+			Ω(err).Should(MatchError(`destroying pool my-pool must be confirmed with its name, not "other-pool"`))
+
+			Ω(fakeLockHandler.SetupCallCount()).Should(BeZero())
+			Ω(fakeLockHandler.DestroyPoolCallCount()).Should(BeZero())
+		})
+	})
+
+	It("replaces its log with JSON events when asked to", func() {
+		pool := out.NewLockPool(out.Source{JSONLogs: true}, output)
+		Ω(pool.Events).Should(Equal(output))
+		Ω(pool.Output).Should(Equal(ioutil.Discard))
+
+		pool = out.NewLockPool(out.Source{}, output)
+		Ω(pool.Events).Should(BeNil())
+		Ω(pool.Output).Should(Equal(output))
 	})
 })
+
+// negotiatingHandler is a fake LockHandler that tells which git protocol
+// version the remote spoke.
+type negotiatingHandler struct {
+	*fakes.FakeLockHandler
+	protocol int
+}
+
+func (handler negotiatingHandler) NegotiatedProtocol() int {
+	return handler.protocol
+}
+
+// mirroringHandler is a fake LockHandler that counts its pushes to the
+// mirror, failing them with err.
+type mirroringHandler struct {
+	*fakes.FakeLockHandler
+	pushes int
+	err    error
+}
+
+func (handler *mirroringHandler) PushMirror() error {
+	handler.pushes++
+	return handler.err
+}
+
+// commitTimingHandler is a fake LockHandler that tells how long it has spent
+// committing.
+type commitTimingHandler struct {
+	*fakes.FakeLockHandler
+	committing time.Duration
+}
+
+func (handler *commitTimingHandler) CommitDuration() time.Duration {
+	return handler.committing
+}
@@ -0,0 +1,97 @@
+package out
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// MetadataQuery matches the locks whose metadata is a JSON object holding
+// each of its keys with the same value.
+type MetadataQuery map[string]interface{}
+
+// Matches tells whether the metadata holds every key of the query with the
+// same value. Metadata that isn't a JSON object matches no query.
+func (query MetadataQuery) Matches(contents []byte) bool {
+	var fields map[string]interface{}
+	if json.Unmarshal(contents, &fields) != nil {
+		return false
+	}
+
+	for key, value := range query {
+		field, found := fields[key]
+		if !found || !reflect.DeepEqual(field, value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (query MetadataQuery) String() string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	terms := make([]string, 0, len(keys))
+	for _, key := range keys {
+		value, _ := json.Marshal(query[key])
+		terms = append(terms, fmt.Sprintf("%s: %s", key, value))
+	}
+
+	return strings.Join(terms, ", ")
+}
+
+// FilteredClaimer is implemented by LockHandlers that can be limited to
+// claiming the available locks that allow accepts, choosing among them as
+// they otherwise would. Claiming where nil allows lifts the limit.
+type FilteredClaimer interface {
+	ClaimWhere(allow func(lock string) bool)
+}
+
+// ClaimWhere limits claims to the available locks that allow accepts, before
+// the source's affinity and selection strategy choose among them.
+func (glh *GitLockHandler) ClaimWhere(allow func(lock string) bool) {
+	glh.allow = allow
+}
+
+// allowedLocks returns the locks that allow accepts.
+func allowedLocks(locks []string, allow func(lock string) bool) []string {
+	allowed := []string{}
+	for _, lock := range locks {
+		if allow(lock) {
+			allowed = append(allowed, lock)
+		}
+	}
+
+	return allowed
+}
+
+// AcquireMatching claims one of the available locks whose metadata matches
+// the query, waiting as AcquireLock does while none of them is available.
+// Encrypted metadata is matched once decrypted, if it can be.
+func (lp *LockPool) AcquireMatching(query MetadataQuery) (string, Version, error) {
+	claimer, ok := lp.LockHandler.(FilteredClaimer)
+	if !ok {
+		return "", Version{}, errors.New("the pool's lock handler cannot claim locks by their metadata")
+	}
+
+	fmt.Fprintf(lp.Output, "claiming a lock with metadata: %s\n", query)
+
+	claimer.ClaimWhere(func(lock string) bool {
+		contents, err := lp.LockHandler.ReadLock(lp.Source.Paths.Unclaimed, lock)
+		if err != nil {
+			return false
+		}
+
+		return query.Matches(lp.readable(lock, contents))
+	})
+	defer claimer.ClaimWhere(nil)
+
+	return lp.AcquireLock()
+}
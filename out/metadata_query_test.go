@@ -0,0 +1,41 @@
+package out_test
+
+import (
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/concourse/pool-resource/out"
+)
+
+var _ = Describe("Querying lock metadata", func() {
+	query := func(raw string) out.MetadataQuery {
+		var query out.MetadataQuery
+		Ω(json.Unmarshal([]byte(raw), &query)).Should(Succeed())
+		return query
+	}
+
+	contents := []byte(`{"cloud":"aws","size":"large","gpus":2,"spot":false}` + "\n")
+
+	It("matches metadata holding every key of the query with the same value", func() {
+		Ω(query(`{"cloud":"aws","size":"large"}`).Matches(contents)).Should(BeTrue())
+		Ω(query(`{"gpus":2,"spot":false}`).Matches(contents)).Should(BeTrue())
+		Ω(query(`{}`).Matches(contents)).Should(BeTrue())
+	})
+
+	It("doesn't match metadata with a different or missing value", func() {
+		Ω(query(`{"cloud":"aws","size":"small"}`).Matches(contents)).Should(BeFalse())
+		Ω(query(`{"gpus":"2"}`).Matches(contents)).Should(BeFalse())
+		Ω(query(`{"region":"us-east-1"}`).Matches(contents)).Should(BeFalse())
+	})
+
+	It("doesn't match metadata that isn't a JSON object", func() {
+		Ω(query(`{"cloud":"aws"}`).Matches([]byte("cloud: aws\n"))).Should(BeFalse())
+		Ω(query(`{}`).Matches([]byte(`["aws"]`))).Should(BeFalse())
+	})
+
+	It("describes itself by its keys, in order", func() {
+		Ω(query(`{"size":"large","cloud":"aws","gpus":2}`).String()).Should(Equal(`cloud: "aws", gpus: 2, size: "large"`))
+	})
+})
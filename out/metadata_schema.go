@@ -0,0 +1,394 @@
+package out
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// SchemaFile is the file in a pool's directory holding the JSON Schema that
+// the metadata of the locks added to the pool must match. Like the pool's
+// other hidden files, it is not a lock itself.
+const SchemaFile = ".schema.json"
+
+// MetadataSchema is a JSON Schema for lock metadata. It supports the
+// keywords that describe the shape of a document: type, enum, const,
+// properties, required, additionalProperties, items, the numeric, string and
+// array bounds, pattern, and allOf, anyOf, oneOf and not. Annotations such as
+// title and description are ignored, as is any other keyword, except $ref,
+// which is refused rather than silently passing everything.
+type MetadataSchema struct {
+	schema interface{}
+}
+
+// ParseMetadataSchema reads a JSON Schema.
+func ParseMetadataSchema(contents []byte) (*MetadataSchema, error) {
+	var schema interface{}
+	err := json.Unmarshal(contents, &schema)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkSchema(schema)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MetadataSchema{schema: schema}, nil
+}
+
+// checkSchema makes sure that the schema, and each schema within it, is one
+// that can be validated against.
+func checkSchema(schema interface{}) error {
+	switch schema := schema.(type) {
+	case bool:
+		return nil
+	case map[string]interface{}:
+		if _, found := schema["$ref"]; found {
+			return errors.New("$ref is not supported")
+		}
+
+		if pattern, ok := schema["pattern"].(string); ok {
+			_, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf("pattern %q: %s", pattern, err)
+			}
+		}
+
+		for _, subschema := range subschemas(schema) {
+			err := checkSchema(subschema)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	default:
+		return errors.New("a schema must be an object or a boolean")
+	}
+}
+
+// subschemas lists the schemas within a schema.
+func subschemas(schema map[string]interface{}) []interface{} {
+	var found []interface{}
+
+	for _, keyword := range []string{"items", "additionalProperties", "not"} {
+		if subschema, ok := schema[keyword]; ok {
+			found = append(found, subschema)
+		}
+	}
+
+	if properties, ok := schema["properties"].(map[string]interface{}); ok {
+		for _, subschema := range properties {
+			found = append(found, subschema)
+		}
+	}
+
+	for _, keyword := range []string{"allOf", "anyOf", "oneOf"} {
+		if list, ok := schema[keyword].([]interface{}); ok {
+			found = append(found, list...)
+		}
+	}
+
+	return found
+}
+
+// Validate checks that metadata is JSON matching the schema, returning an
+// error naming each problem found.
+func (schema *MetadataSchema) Validate(metadata []byte) error {
+	var value interface{}
+	err := json.Unmarshal(metadata, &value)
+	if err != nil {
+		return fmt.Errorf("metadata is not JSON: %s", err)
+	}
+
+	problems := validateSchema(schema.schema, value, "metadata")
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// validateSchema lists the ways the value at path fails to match the schema.
+func validateSchema(schema interface{}, value interface{}, path string) []string {
+	switch schema := schema.(type) {
+	case bool:
+		if !schema {
+			return []string{path + " is not allowed"}
+		}
+		return nil
+	case map[string]interface{}:
+		var problems []string
+		for _, check := range []func(map[string]interface{}, interface{}, string) []string{
+			validateType, validateValue, validateNumber, validateString, validateArray, validateObject, validateCombinations,
+		} {
+			problems = append(problems, check(schema, value, path)...)
+		}
+		return problems
+	default:
+		return nil
+	}
+}
+
+func validateType(schema map[string]interface{}, value interface{}, path string) []string {
+	var types []string
+	switch allowed := schema["type"].(type) {
+	case string:
+		types = []string{allowed}
+	case []interface{}:
+		for _, each := range allowed {
+			if name, ok := each.(string); ok {
+				types = append(types, name)
+			}
+		}
+	default:
+		return nil
+	}
+
+	actual := jsonType(value)
+	for _, name := range types {
+		if name == actual || (name == "number" && actual == "integer") {
+			return nil
+		}
+	}
+
+	return []string{fmt.Sprintf("%s must be %s, not %s", path, strings.Join(types, " or "), actual)}
+}
+
+// jsonType names the JSON type of a decoded value, telling integers apart
+// from other numbers.
+func jsonType(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if value == math.Trunc(value) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+func validateValue(schema map[string]interface{}, value interface{}, path string) []string {
+	var problems []string
+
+	if constant, ok := schema["const"]; ok && !reflect.DeepEqual(value, constant) {
+		encoded, _ := json.Marshal(constant)
+		problems = append(problems, fmt.Sprintf("%s must be %s", path, encoded))
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range enum {
+			if reflect.DeepEqual(value, allowed) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			encoded, _ := json.Marshal(enum)
+			problems = append(problems, fmt.Sprintf("%s must be one of %s", path, encoded))
+		}
+	}
+
+	return problems
+}
+
+func validateNumber(schema map[string]interface{}, value interface{}, path string) []string {
+	number, ok := value.(float64)
+	if !ok {
+		return nil
+	}
+
+	var problems []string
+	for _, bound := range []struct {
+		keyword  string
+		fails    func(limit float64) bool
+		relation string
+	}{
+		{"minimum", func(limit float64) bool { return number < limit }, "at least"},
+		{"maximum", func(limit float64) bool { return number > limit }, "at most"},
+		{"exclusiveMinimum", func(limit float64) bool { return number <= limit }, "more than"},
+		{"exclusiveMaximum", func(limit float64) bool { return number >= limit }, "less than"},
+	} {
+		if limit, ok := schema[bound.keyword].(float64); ok && bound.fails(limit) {
+			problems = append(problems, fmt.Sprintf("%s must be %s %v", path, bound.relation, limit))
+		}
+	}
+
+	return problems
+}
+
+func validateString(schema map[string]interface{}, value interface{}, path string) []string {
+	text, ok := value.(string)
+	if !ok {
+		return nil
+	}
+
+	var problems []string
+	length := float64(utf8.RuneCountInString(text))
+
+	if limit, ok := schema["minLength"].(float64); ok && length < limit {
+		problems = append(problems, fmt.Sprintf("%s must be at least %v characters long", path, limit))
+	}
+
+	if limit, ok := schema["maxLength"].(float64); ok && length > limit {
+		problems = append(problems, fmt.Sprintf("%s must be at most %v characters long", path, limit))
+	}
+
+	if pattern, ok := schema["pattern"].(string); ok && !regexp.MustCompile(pattern).MatchString(text) {
+		problems = append(problems, fmt.Sprintf("%s must match %q", path, pattern))
+	}
+
+	return problems
+}
+
+func validateArray(schema map[string]interface{}, value interface{}, path string) []string {
+	items, ok := value.([]interface{})
+	if !ok {
+		return nil
+	}
+
+	var problems []string
+	count := float64(len(items))
+
+	if limit, ok := schema["minItems"].(float64); ok && count < limit {
+		problems = append(problems, fmt.Sprintf("%s must have at least %v items", path, limit))
+	}
+
+	if limit, ok := schema["maxItems"].(float64); ok && count > limit {
+		problems = append(problems, fmt.Sprintf("%s must have at most %v items", path, limit))
+	}
+
+	if itemSchema, ok := schema["items"]; ok {
+		for i, item := range items {
+			problems = append(problems, validateSchema(itemSchema, item, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	}
+
+	return problems
+}
+
+func validateObject(schema map[string]interface{}, value interface{}, path string) []string {
+	fields, ok := value.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	var problems []string
+
+	if required, ok := schema["required"].([]interface{}); ok {
+		for _, key := range required {
+			if name, ok := key.(string); ok {
+				if _, found := fields[name]; !found {
+					problems = append(problems, fmt.Sprintf("%s.%s is required", path, name))
+				}
+			}
+		}
+	}
+
+	properties, _ := schema["properties"].(map[string]interface{})
+	additional, restricted := schema["additionalProperties"]
+
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if propertySchema, ok := properties[key]; ok {
+			problems = append(problems, validateSchema(propertySchema, fields[key], path+"."+key)...)
+		} else if restricted {
+			problems = append(problems, validateSchema(additional, fields[key], path+"."+key)...)
+		}
+	}
+
+	return problems
+}
+
+func validateCombinations(schema map[string]interface{}, value interface{}, path string) []string {
+	var problems []string
+
+	if all, ok := schema["allOf"].([]interface{}); ok {
+		for _, subschema := range all {
+			problems = append(problems, validateSchema(subschema, value, path)...)
+		}
+	}
+
+	matches := func(subschemas []interface{}) int {
+		count := 0
+		for _, subschema := range subschemas {
+			if len(validateSchema(subschema, value, path)) == 0 {
+				count++
+			}
+		}
+		return count
+	}
+
+	if anyOf, ok := schema["anyOf"].([]interface{}); ok && matches(anyOf) == 0 {
+		problems = append(problems, fmt.Sprintf("%s must match at least one of the schemas of anyOf", path))
+	}
+
+	if oneOf, ok := schema["oneOf"].([]interface{}); ok && matches(oneOf) != 1 {
+		problems = append(problems, fmt.Sprintf("%s must match exactly one of the schemas of oneOf", path))
+	}
+
+	if not, ok := schema["not"]; ok && len(validateSchema(not, value, path)) == 0 {
+		problems = append(problems, fmt.Sprintf("%s must not match the schema of not", path))
+	}
+
+	return problems
+}
+
+// ReadSchema reads the pool's schema as staged, or nil if it has none.
+func (glh *GitLockHandler) ReadSchema() ([]byte, error) {
+	contents, err := glh.readFile(filepath.Join(glh.poolDir(), SchemaFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	return contents, err
+}
+
+// validateMetadata checks the metadata of the locks being added against the
+// pool's schema, if it has one, before they are committed. It is read afresh
+// on each attempt, as the schema may change along with the pool.
+func (lp *LockPool) validateMetadata(locks map[string][]byte) error {
+	contents, err := lp.LockHandler.ReadSchema()
+	if err != nil || contents == nil {
+		return err
+	}
+
+	schema, err := ParseMetadataSchema(contents)
+	if err != nil {
+		return fmt.Errorf("pool %s has an invalid %s: %s", lp.Source.Pool, SchemaFile, err)
+	}
+
+	for _, name := range sortedLockNames(locks) {
+		err = schema.Validate(locks[name])
+		if err != nil {
+			return fmt.Errorf("metadata of lock %s does not match the schema of pool %s: %s", name, lp.Source.Pool, err)
+		}
+	}
+
+	return nil
+}
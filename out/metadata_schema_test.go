@@ -0,0 +1,73 @@
+package out_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/concourse/pool-resource/out"
+)
+
+var _ = Describe("Validating lock metadata against a schema", func() {
+	schema := func(raw string) *out.MetadataSchema {
+		schema, err := out.ParseMetadataSchema([]byte(raw))
+		Ω(err).ShouldNot(HaveOccurred())
+		return schema
+	}
+
+	var environment *out.MetadataSchema
+
+	BeforeEach(func() {
+		environment = schema(`{
+			"$schema": "http://json-schema.org/draft-07/schema#",
+			"title": "environment",
+			"type": "object",
+			"required": ["region", "size"],
+			"properties": {
+				"region": {"type": "string", "pattern": "^[a-z]+-[a-z]+-[0-9]$"},
+				"size": {"enum": ["small", "large"]},
+				"gpus": {"type": "integer", "minimum": 0, "maximum": 8},
+				"tags": {"type": "array", "items": {"type": "string", "minLength": 1}, "maxItems": 3}
+			},
+			"additionalProperties": false
+		}`)
+	})
+
+	It("accepts metadata matching the schema", func() {
+		Ω(environment.Validate([]byte(`{"region":"us-east-1","size":"large","gpus":2,"tags":["ci"]}` + "\n"))).Should(Succeed())
+		Ω(environment.Validate([]byte(`{"region":"eu-west-2","size":"small"}`))).Should(Succeed())
+	})
+
+	It("names each way the metadata fails to match", func() {
+		err := environment.Validate([]byte(`{"region":"Mars","gpus":2.5,"tags":["ci",""],"owner":"me"}`))
+		Ω(err).Should(MatchError(`metadata.size is required; ` +
+			`metadata.gpus must be integer, not number; ` +
+			`metadata.owner is not allowed; ` +
+			`metadata.region must match "^[a-z]+-[a-z]+-[0-9]$"; ` +
+			`metadata.tags[1] must be at least 1 characters long`))
+	})
+
+	It("rejects metadata that isn't JSON", func() {
+		Ω(environment.Validate([]byte("region: us-east-1\n"))).Should(MatchError(ContainSubstring("metadata is not JSON")))
+	})
+
+	It("combines schemas", func() {
+		either := schema(`{"oneOf": [{"type": "string"}, {"type": "integer", "exclusiveMinimum": 0}], "not": {"const": "none"}}`)
+
+		Ω(either.Validate([]byte(`"us-east-1"`))).Should(Succeed())
+		Ω(either.Validate([]byte(`3`))).Should(Succeed())
+		Ω(either.Validate([]byte(`0`))).Should(MatchError("metadata must match exactly one of the schemas of oneOf"))
+		Ω(either.Validate([]byte(`"none"`))).Should(MatchError("metadata must not match the schema of not"))
+	})
+
+	It("refuses schemas it can't validate against", func() {
+		for _, raw := range []string{
+			`not json`,
+			`"object"`,
+			`{"properties": {"region": {"$ref": "#/definitions/region"}}}`,
+			`{"pattern": "("}`,
+		} {
+			_, err := out.ParseMetadataSchema([]byte(raw))
+			Ω(err).Should(HaveOccurred(), raw)
+		}
+	})
+})
@@ -0,0 +1,77 @@
+package out
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// MetadataTemplateData is what a metadata template is rendered with.
+type MetadataTemplateData struct {
+	// Name is the name of the lock being added.
+	Name string
+
+	// Metadata is the contents of the lock's metadata file, if it has one.
+	Metadata string
+
+	// Env holds the build's BUILD_* variables and ATC_EXTERNAL_URL, as
+	// Concourse sets them for the step.
+	Env map[string]string
+
+	// Now is when the lock is added, and Timestamp the same in RFC3339.
+	Now       time.Time
+	Timestamp string
+}
+
+var metadataTemplateFuncs = template.FuncMap{
+	// json quotes a value for use within a JSON document
+	"json": func(value interface{}) (string, error) {
+		encoded, err := json.Marshal(value)
+		return string(encoded), err
+	},
+}
+
+// ParseMetadataTemplate parses a template for the metadata of added locks.
+// Variables the build does not set render as empty strings.
+func ParseMetadataTemplate(text string) (*template.Template, error) {
+	return template.New("metadata_template").Funcs(metadataTemplateFuncs).Option("missingkey=zero").Parse(text)
+}
+
+// RenderMetadataTemplate renders a template for the metadata of an added lock.
+func RenderMetadataTemplate(text string, name string, metadata []byte, now time.Time) ([]byte, error) {
+	tmpl, err := ParseMetadataTemplate(text)
+	if err != nil {
+		return nil, err
+	}
+
+	var rendered bytes.Buffer
+	err = tmpl.Execute(&rendered, MetadataTemplateData{
+		Name:      name,
+		Metadata:  string(metadata),
+		Env:       buildEnv(),
+		Now:       now.UTC(),
+		Timestamp: now.UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return rendered.Bytes(), nil
+}
+
+// buildEnv collects the build's BUILD_* variables and ATC_EXTERNAL_URL for
+// templates to use.
+func buildEnv() map[string]string {
+	env := map[string]string{}
+	for _, variable := range os.Environ() {
+		parts := strings.SplitN(variable, "=", 2)
+		if strings.HasPrefix(parts[0], "BUILD_") || parts[0] == "ATC_EXTERNAL_URL" {
+			env[parts[0]] = parts[1]
+		}
+	}
+
+	return env
+}
@@ -0,0 +1,54 @@
+package out_test
+
+import (
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/concourse/pool-resource/out"
+)
+
+var _ = Describe("Metadata templates", func() {
+	var now time.Time
+
+	BeforeEach(func() {
+		now = time.Date(2026, 1, 2, 3, 4, 5, 0, time.FixedZone("CET", 3600))
+
+		os.Setenv("BUILD_PIPELINE_NAME", "some-pipeline")
+		os.Setenv("ATC_EXTERNAL_URL", "https://ci.example.com")
+	})
+
+	AfterEach(func() {
+		os.Unsetenv("BUILD_PIPELINE_NAME")
+		os.Unsetenv("ATC_EXTERNAL_URL")
+	})
+
+	It("renders the build's variables and the time in UTC", func() {
+		rendered, err := out.RenderMetadataTemplate(
+			`{{.Env.BUILD_PIPELINE_NAME}} at {{.Env.ATC_EXTERNAL_URL}} on {{.Timestamp}} ({{.Now.Year}})`,
+			"some-lock", nil, now,
+		)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(rendered)).Should(Equal("some-pipeline at https://ci.example.com on 2026-01-02T02:04:05Z (2026)"))
+	})
+
+	It("leaves out variables other than the build's", func() {
+		rendered, err := out.RenderMetadataTemplate(`[{{.Env.PATH}}]`, "some-lock", nil, now)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(rendered)).Should(Equal("[]"))
+	})
+
+	It("renders unset build variables as empty", func() {
+		rendered, err := out.RenderMetadataTemplate(`[{{.Env.BUILD_TEAM_NAME}}]`, "some-lock", nil, now)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(rendered)).Should(Equal("[]"))
+	})
+
+	It("quotes values for JSON documents", func() {
+		rendered, err := out.RenderMetadataTemplate(`{"metadata": {{json .Metadata}}}`, "some-lock", []byte("say \"hi\"\n"), now)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(rendered)).Should(Equal(`{"metadata": "say \"hi\"\n"}`))
+	})
+})
@@ -0,0 +1,295 @@
+package out
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"time"
+)
+
+// MigrationStates are the states whose locks are migrated, in the order they
+// are reported: every state a snapshot includes.
+var MigrationStates = SnapshotStates
+
+// StateCount compares how many locks a state held in the pool migrated from
+// and in the pool migrated to.
+type StateCount struct {
+	State       string
+	Source      int
+	Destination int
+}
+
+// MigrationReport describes a finished migration.
+type MigrationReport struct {
+	Counts []StateCount
+
+	// Commits is how many commits of history were replayed, if any.
+	Commits int
+}
+
+// Verified reports whether every state ended up with as many locks in the
+// destination as it had in the source.
+func (report MigrationReport) Verified() bool {
+	for _, count := range report.Counts {
+		if count.Source != count.Destination {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Migration copies every lock of one pool, with its state, metadata, fencing
+// token and expiry, to another pool, which may be in another repository or backend. The
+// destination must not already hold any of the locks being copied.
+type Migration struct {
+	From       LockHandler
+	FromSource Source
+
+	To       LockHandler
+	ToSource Source
+
+	Output io.Writer
+}
+
+func (migration Migration) Run() (MigrationReport, error) {
+	return migration.run(func() error {
+		return migration.copyLocks()
+	})
+}
+
+func statePaths(source Source) map[string]string {
+	return map[string]string{
+		"unclaimed":   source.Paths.Unclaimed,
+		"claimed":     source.Paths.Claimed,
+		"maintenance": source.Paths.Maintenance,
+		"broken":      source.Paths.Broken,
+	}
+}
+
+// run sets up both pools, applies the migration to the destination until it is
+// broadcast without conflicting with another change, and then checks the
+// destination against the source.
+func (migration Migration) run(apply func() error) (MigrationReport, error) {
+	err := migration.From.Setup()
+	if err != nil {
+		return MigrationReport{}, fmt.Errorf("setting up %s: %s", migration.FromSource.Pool, err)
+	}
+
+	defer migration.From.Cleanup()
+
+	err = migration.To.Setup()
+	if err != nil {
+		return MigrationReport{}, fmt.Errorf("setting up %s: %s", migration.ToSource.Pool, err)
+	}
+
+	defer migration.To.Cleanup()
+
+	for {
+		err = migration.To.ResetLock()
+		if err != nil {
+			return MigrationReport{}, err
+		}
+
+		err = apply()
+		if err != nil {
+			return MigrationReport{}, err
+		}
+
+		err = migration.To.BroadcastLockPool()
+		if err == nil {
+			break
+		}
+
+		if !IsRetryable(err) {
+			return MigrationReport{}, err
+		}
+
+		fmt.Fprintf(migration.Output, "failed to broadcast the migrated locks! (err: %s) retrying...\n", err)
+		time.Sleep(migration.ToSource.RetryDelay)
+	}
+
+	err = migration.To.ResetLock()
+	if err != nil {
+		return MigrationReport{}, err
+	}
+
+	return migration.report()
+}
+
+func (migration Migration) copyLocks() error {
+	fromPaths := snapshotPaths(migration.FromSource)
+	toPaths := snapshotPaths(migration.ToSource)
+
+	existing := map[string]bool{}
+	for _, state := range MigrationStates {
+		locks, err := migration.To.ListLocks(toPaths[state])
+		if err != nil {
+			return err
+		}
+
+		for _, lock := range locks {
+			existing[lock] = true
+		}
+	}
+
+	for _, state := range MigrationStates {
+		locks, err := migration.From.ListLocks(fromPaths[state])
+		if err != nil {
+			return err
+		}
+
+		for _, lock := range locks {
+			if existing[lock] {
+				return fmt.Errorf("lock %s is already in %s", lock, migration.ToSource.Pool)
+			}
+
+			contents, err := migration.From.ReadLock(fromPaths[state], lock)
+			if err != nil {
+				return err
+			}
+
+			token, expires, err := readRecords(migration.From, state, lock)
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintf(migration.Output, "copying %s lock: %s\n", state, lock)
+
+			// carrying the token over keeps it from starting again at 1, so
+			// the lock's holders can still be told apart
+			err = writeRecords(migration.To, toPaths[state], lock, token, expires)
+			if err != nil {
+				return err
+			}
+
+			_, err = migration.To.ImportLock(toPaths[state], lock, contents)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (migration Migration) report() (MigrationReport, error) {
+	fromPaths := snapshotPaths(migration.FromSource)
+	toPaths := snapshotPaths(migration.ToSource)
+
+	var report MigrationReport
+	for _, state := range MigrationStates {
+		from, err := migration.From.ListLocks(fromPaths[state])
+		if err != nil {
+			return report, err
+		}
+
+		to, err := migration.To.ListLocks(toPaths[state])
+		if err != nil {
+			return report, err
+		}
+
+		report.Counts = append(report.Counts, StateCount{State: state, Source: len(from), Destination: len(to)})
+	}
+
+	return report, nil
+}
+
+// HistoryMigration is a Migration between git pools that replays every commit
+// that changed the source pool onto the destination, so that the history of
+// claims comes along with the locks. Both pools must lay out their states the
+// same way, and the destination pool must be empty.
+type HistoryMigration struct {
+	Migration
+
+	fromGit *GitLockHandler
+	toGit   *GitLockHandler
+}
+
+// patchHeader starts each commit in the output of git format-patch.
+var patchHeader = regexp.MustCompile(`(?m)^From [0-9a-f]{40} `)
+
+func NewHistoryMigration(from Source, to Source, output io.Writer) HistoryMigration {
+	fromHandler := NewGitLockHandler(from)
+	toHandler := NewGitLockHandler(to)
+
+	return HistoryMigration{
+		Migration: Migration{
+			From:       fromHandler,
+			FromSource: from,
+			To:         toHandler,
+			ToSource:   to,
+			Output:     output,
+		},
+		fromGit: fromHandler,
+		toGit:   toHandler,
+	}
+}
+
+func (migration HistoryMigration) Run() (MigrationReport, error) {
+	if migration.FromSource.Paths != migration.ToSource.Paths {
+		return MigrationReport{}, errors.New("history can only be migrated between pools with the same paths")
+	}
+
+	var commits int
+	report, err := migration.run(func() error {
+		var err error
+		commits, err = migration.replayHistory()
+		return err
+	})
+
+	report.Commits = commits
+
+	return report, err
+}
+
+func (migration HistoryMigration) replayHistory() (int, error) {
+	for _, state := range MigrationStates {
+		existing, err := migration.To.ListLocks(snapshotPaths(migration.ToSource)[state])
+		if err != nil {
+			return 0, err
+		}
+
+		if len(existing) > 0 {
+			return 0, fmt.Errorf("history can only be migrated to an empty pool, but %s has locks", migration.ToSource.Pool)
+		}
+	}
+
+	// the patches are made relative to the source pool, and applied within
+	// the destination pool
+	patches, err := migration.fromGit.git("format-patch", "--root", "--binary", "--stdout", "--relative="+migration.fromGit.pool, "HEAD", "--", migration.fromGit.pool)
+	if err != nil {
+		return 0, err
+	}
+
+	commits := len(patchHeader.FindAll(patches, -1))
+	if commits == 0 {
+		return 0, nil
+	}
+
+	patchFile, err := ioutil.TempFile("", TempDirPrefix+"-history")
+	if err != nil {
+		return 0, err
+	}
+
+	defer os.Remove(patchFile.Name())
+
+	_, err = patchFile.Write(patches)
+	patchFile.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = migration.toGit.git("am", "--committer-date-is-author-date", "--directory="+migration.toGit.pool, patchFile.Name())
+	if err != nil {
+		migration.toGit.git("am", "--abort")
+		return 0, err
+	}
+
+	fmt.Fprintf(migration.Output, "replayed %d commits of history\n", commits)
+
+	return commits, nil
+}
@@ -0,0 +1,130 @@
+package out_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+
+	"github.com/concourse/pool-resource/out"
+	"github.com/concourse/pool-resource/out/poolfakes"
+)
+
+var _ = Describe("Migration", func() {
+	var (
+		fromPool   *poolfakes.Pool
+		toPool     *poolfakes.Pool
+		fromSource out.Source
+		toSource   out.Source
+		output     *gbytes.Buffer
+	)
+
+	BeforeEach(func() {
+		fromPool = poolfakes.NewPool()
+		fromPool.Put(out.FencingDir, "lock-b", []byte("7"))
+		fromPool.Put("unclaimed", "lock-a", []byte("metadata-a"))
+		fromPool.Put("claimed", "lock-b", []byte("metadata-b"))
+		fromPool.Put("broken", "lock-c", []byte("metadata-c"))
+		fromPool.Put("reserved", "lock-d", []byte("metadata-d"))
+
+		toPool = poolfakes.NewPool()
+
+		fromSource = out.Source{Pool: "old-pool", RetryDelay: time.Millisecond}
+		toSource = out.Source{Pool: "new-pool", RetryDelay: time.Millisecond}
+
+		output = gbytes.NewBuffer()
+	})
+
+	migration := func() out.Migration {
+		return out.Migration{
+			From:       poolfakes.NewMemoryLockHandler(fromPool, fromSource),
+			FromSource: fromSource.WithDefaults(),
+			To:         poolfakes.NewMemoryLockHandler(toPool, toSource),
+			ToSource:   toSource.WithDefaults(),
+			Output:     output,
+		}
+	}
+
+	It("copies every lock to the same state with its metadata", func() {
+		_, err := migration().Run()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(toPool.Locks("unclaimed")).Should(Equal([]string{"lock-a"}))
+		Ω(toPool.Locks("claimed")).Should(Equal([]string{"lock-b"}))
+		Ω(toPool.Locks("broken")).Should(Equal([]string{"lock-c"}))
+		Ω(toPool.Locks("reserved")).Should(Equal([]string{"lock-d"}))
+
+		contents, found := toPool.Contents("claimed", "lock-b")
+		Ω(found).Should(BeTrue())
+		Ω(string(contents)).Should(Equal("metadata-b"))
+
+		Ω(output).Should(gbytes.Say("copying claimed lock: lock-b"))
+	})
+
+	It("carries each lock's fencing token over, rather than starting it again", func() {
+		_, err := migration().Run()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		token, found := toPool.Contents(out.FencingDir, "lock-b")
+		Ω(found).Should(BeTrue())
+		Ω(string(token)).Should(Equal("7"))
+
+		_, found = toPool.Contents(out.FencingDir, "lock-a")
+		Ω(found).Should(BeFalse())
+	})
+
+	It("leaves the source pool alone", func() {
+		head := fromPool.Head()
+
+		_, err := migration().Run()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(fromPool.Head()).Should(Equal(head))
+		Ω(fromPool.Locks("unclaimed")).Should(Equal([]string{"lock-a"}))
+	})
+
+	It("maps states onto the destination's paths", func() {
+		toSource.Paths = out.Paths{Claimed: "in-use"}
+
+		_, err := migration().Run()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(toPool.Locks("in-use")).Should(Equal([]string{"lock-b"}))
+		Ω(toPool.Locks("claimed")).Should(BeEmpty())
+	})
+
+	It("reports how many locks each state holds in both pools", func() {
+		report, err := migration().Run()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(report.Counts).Should(Equal([]out.StateCount{
+			{State: "unclaimed", Source: 1, Destination: 1},
+			{State: "claimed", Source: 1, Destination: 1},
+			{State: "reserved", Source: 1, Destination: 1},
+			{State: "maintenance", Source: 0, Destination: 0},
+			{State: "broken", Source: 1, Destination: 1},
+		}))
+		Ω(report.Verified()).Should(BeTrue())
+	})
+
+	It("keeps the locks already in the destination", func() {
+		toPool.Put("unclaimed", "lock-z", nil)
+
+		report, err := migration().Run()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(toPool.Locks("unclaimed")).Should(Equal([]string{"lock-a", "lock-z"}))
+		Ω(report.Verified()).Should(BeFalse())
+	})
+
+	It("refuses to overwrite a lock the destination already has", func() {
+		toPool.Put("maintenance", "lock-a", []byte("other-metadata"))
+		head := toPool.Head()
+
+		_, err := migration().Run()
+		Ω(err).Should(MatchError("lock lock-a is already in new-pool"))
+
+		Ω(toPool.Head()).Should(Equal(head))
+	})
+})
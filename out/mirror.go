@@ -0,0 +1,68 @@
+package out
+
+import "fmt"
+
+// Mirrorer is implemented by LockHandlers that can copy the pool, as last
+// broadcast, to source.mirror_uri.
+type Mirrorer interface {
+	PushMirror() error
+}
+
+// PushMirror pushes the pool's branch, with any claim tags on it, to
+// source.mirror_uri. It never rolls the mirror back: a mirror that another
+// build has already given a later change is left as it is. Only the history
+// that squashing the pool's history rewrote is replaced on the mirror, and
+// only if the mirror still holds it.
+func (glh *GitLockHandler) PushMirror() error {
+	if glh.Source.MirrorURI == "" {
+		return nil
+	}
+
+	args := []string{"push", "--porcelain", "--follow-tags", glh.Source.MirrorURI, "HEAD:refs/heads/" + glh.branch}
+	if glh.mirrorLease != "" {
+		args = append(args, "--force-with-lease=refs/heads/"+glh.branch+":"+glh.mirrorLease)
+	}
+
+	output, err := glh.git(args...)
+	if status, _ := ParsePushOutput(string(output)); status != PushConflicted || glh.mirrorLease != "" {
+		return err
+	}
+
+	// a push that arrives after a later one has nothing to add
+	if glh.mirrorAhead() {
+		return nil
+	}
+
+	return err
+}
+
+// mirrorAhead reports whether the mirror's branch already holds the pool's
+// head, with later changes on top of it.
+func (glh *GitLockHandler) mirrorAhead() bool {
+	_, err := glh.git("fetch", "--no-tags", glh.Source.MirrorURI, "refs/heads/"+glh.branch)
+	if err != nil {
+		return false
+	}
+
+	_, err = glh.git("merge-base", "--is-ancestor", "HEAD", "FETCH_HEAD")
+	return err == nil
+}
+
+// mirror copies the change just broadcast to the source's mirror. The mirror
+// is a best-effort standby: failing to update it is reported, but doesn't
+// fail the operation, which the pool itself has already seen.
+func (lp *LockPool) mirror() {
+	mirrorer, ok := lp.LockHandler.(Mirrorer)
+	if !ok || lp.Source.MirrorURI == "" {
+		return
+	}
+
+	span := lp.span.StartChild("mirror")
+	err := mirrorer.PushMirror()
+	span.EndWithError(err)
+
+	if err != nil {
+		fmt.Fprintf(lp.Output, "\nfailed to mirror pool: %s to %s! (err: %s)\n", lp.Source.Pool, lp.Source.MirrorURI, err)
+		lp.addMetadata("mirror_error", err.Error())
+	}
+}
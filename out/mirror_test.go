@@ -0,0 +1,158 @@
+package out_test
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/concourse/pool-resource/out"
+)
+
+var _ = Describe("Pushing a pool to its mirror", func() {
+	var (
+		origin string
+		mirror string
+		source out.Source
+	)
+
+	git := func(dir string, script string) string {
+		command := exec.Command("bash", "-e", "-c", script)
+		command.Dir = dir
+
+		output, err := command.CombinedOutput()
+		Ω(err).ShouldNot(HaveOccurred(), string(output))
+
+		return strings.TrimSpace(string(output))
+	}
+
+	BeforeEach(func() {
+		var err error
+		origin, err = ioutil.TempDir("", "mirror-origin")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		git(origin, `
+			git init -q --bare origin.git
+			git init -q --bare mirror.git
+			git init -q work
+			cd work
+
+			git config user.email "ginkgo@localhost"
+			git config user.name "Ginkgo Local"
+
+			mkdir -p lock-pool/unclaimed lock-pool/claimed
+			touch lock-pool/claimed/.gitkeep
+			echo '{}' > lock-pool/unclaimed/some-lock
+
+			git add .
+			git commit -q -m 'setup'
+			git branch -M master
+			git push -q ../origin.git master
+		`)
+
+		mirror = filepath.Join(origin, "mirror.git")
+
+		source = out.Source{
+			URI:               filepath.Join(origin, "origin.git"),
+			MirrorURI:         mirror,
+			Branch:            "master",
+			Pool:              "lock-pool",
+			SelectionStrategy: out.SelectionDeterministic,
+		}.WithDefaults()
+	})
+
+	AfterEach(func() {
+		err := os.RemoveAll(origin)
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	setup := func() *out.GitLockHandler {
+		handler := out.NewGitLockHandler(source)
+
+		err := handler.Setup()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		return handler
+	}
+
+	head := func(repo string) string {
+		return git(repo, "git rev-parse master")
+	}
+
+	It("leaves a mirror that a later change has already reached alone", func() {
+		late := setup()
+		defer late.Cleanup()
+
+		early := setup()
+		defer early.Cleanup()
+
+		Ω(early.ResetLock()).Should(Succeed())
+
+		_, _, err := early.LeaseLock(func(string) time.Time { return time.Time{} })
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(early.BroadcastLockPool()).Should(Succeed())
+		Ω(early.PushMirror()).Should(Succeed())
+
+		claimed := head(mirror)
+
+		Ω(late.PushMirror()).Should(Succeed())
+		Ω(head(mirror)).Should(Equal(claimed))
+	})
+
+	It("refuses to roll back a mirror that has gone its own way", func() {
+		handler := setup()
+		defer handler.Cleanup()
+
+		git(origin, `
+			cd work
+			git commit -q --allow-empty -m 'made on the mirror'
+			git push -q ../mirror.git master
+		`)
+
+		diverged := head(mirror)
+
+		Ω(handler.ResetLock()).Should(Succeed())
+
+		_, _, err := handler.LeaseLock(func(string) time.Time { return time.Time{} })
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(handler.BroadcastLockPool()).Should(Succeed())
+		Ω(handler.PushMirror()).ShouldNot(Succeed())
+		Ω(head(mirror)).Should(Equal(diverged))
+	})
+
+	It("replaces the mirror's history once the pool's has been squashed", func() {
+		handler := setup()
+		defer handler.Cleanup()
+
+		for i := 0; i < 2; i++ {
+			Ω(handler.ResetLock()).Should(Succeed())
+
+			lock, _, err := handler.LeaseLock(func(string) time.Time { return time.Time{} })
+			Ω(err).ShouldNot(HaveOccurred())
+
+			_, err = handler.UnclaimLock(lock)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(handler.BroadcastLockPool()).Should(Succeed())
+			Ω(handler.PushMirror()).Should(Succeed())
+		}
+
+		Ω(handler.ResetLock()).Should(Succeed())
+
+		_, squashed, err := handler.SquashHistory(time.Now().Add(time.Minute))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(squashed).Should(BeNumerically(">", 1))
+
+		Ω(handler.BroadcastLockPool()).Should(Succeed())
+		Ω(handler.PushMirror()).Should(Succeed())
+
+		Ω(head(mirror)).Should(Equal(head(filepath.Join(origin, "origin.git"))))
+	})
+})
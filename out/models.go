@@ -1,24 +1,479 @@
 package out
 
-import "time"
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
 
 type Source struct {
-	URI        string        `json:"uri"`
-	Branch     string        `json:"branch"`
-	PrivateKey string        `json:"private_key"`
-	Pool       string        `json:"pool"`
-	RetryDelay time.Duration `json:"retry_delay"`
+	URI               string        `json:"uri"`
+	MirrorURI         string        `json:"mirror_uri"`
+	Branch            string        `json:"branch"`
+	PrivateKey        string        `json:"private_key"`
+	CredentialHelper  string        `json:"credential_helper"`
+	InheritGitConfig  bool          `json:"inherit_git_config"`
+	Askpass           string        `json:"askpass"`
+	Vault             Vault         `json:"vault"`
+	GitHubApp         GitHubApp     `json:"github_app"`
+	Pool              string        `json:"pool"`
+	RetryDelay        time.Duration `json:"retry_delay"`
+	RetryJitter       float64       `json:"retry_jitter"`
+	HeartbeatInterval time.Duration `json:"heartbeat_interval"`
+	ProtocolVersion   int           `json:"protocol_version"`
+	CircuitBreaker    int           `json:"circuit_breaker"`
+	RetryBackoffMax   time.Duration `json:"retry_backoff_max"`
+	OperationTimeout  time.Duration `json:"operation_timeout"`
+	LeaseDuration     time.Duration `json:"lease_duration"`
+	StaleTempDirAge   time.Duration `json:"stale_temp_dir_age"`
+	CloneSince        time.Duration `json:"clone_since"`
+	MinRemoteInterval time.Duration `json:"min_remote_interval"`
+	Submodules        Submodules    `json:"submodules"`
+	CacheDir          string        `json:"cache_dir"`
+	Bare              bool          `json:"bare"`
+	LockIndex         bool          `json:"lock_index"`
+	ContentDigest     bool          `json:"content_digest"`
+	CreateBranch      bool          `json:"create_branch"`
+	Paths             Paths         `json:"paths"`
+	Affinity          string        `json:"affinity"`
+	SelectionStrategy string        `json:"selection_strategy"`
+
+	CommitMessageTemplate string `json:"commit_message_template"`
+
+	// Port is the port that SSH remotes are reached on, for scp-like uris
+	// such as git@host:org/repo.git that have no way to give one.
+	Port int `json:"port"`
+
+	// KnownHosts are the host keys, in known_hosts format, that SSH remotes
+	// must present, rather than whichever the image knows.
+	KnownHosts string `json:"known_hosts"`
+
+	// StrictHostKeyChecking is ssh's StrictHostKeyChecking for the remotes:
+	// yes, no, or accept-new. It defaults to yes when KnownHosts is given.
+	StrictHostKeyChecking string `json:"strict_host_key_checking"`
+
+	// CACert is the PEM encoded certificate authorities that HTTPS remotes'
+	// certificates are verified against, for servers with a private CA.
+	CACert string `json:"ca_cert"`
+
+	MinUnclaimedWarning int `json:"min_unclaimed_warning"`
+
+	// ReserveMinimum is how many unclaimed locks acquire and reserve leave
+	// for steps that set params.bypass_reserve_minimum.
+	ReserveMinimum int `json:"reserve_minimum"`
+
+	// NetworkRetries is how many times in a row an operation retries after
+	// blips in the network, such as DNS failures, connection resets, and
+	// timeouts, before giving up; DefaultNetworkRetries when zero.
+	NetworkRetries int `json:"network_retries"`
+
+	// RetryBackoffReset, when false, keeps backing off from a failing remote
+	// until the operation ends, rather than starting afresh each time the
+	// remote answers with a conflict or an empty pool. It defaults to true.
+	RetryBackoffReset *bool `json:"retry_backoff_reset"`
+
+	// FailWhenPaused fails acquire and reserve on a paused pool, rather than
+	// waiting for it to be unpaused.
+	FailWhenPaused bool `json:"fail_when_paused"`
+
+	// LockFileMode is the octal mode, such as "0644", that lock files are
+	// written with.
+	LockFileMode string `json:"lock_file_mode"`
+
+	// States are the lock states that check reports changes to; only used
+	// by check.
+	States []string `json:"states"`
+
+	// LockName is the one lock whose changes check reports; only used by
+	// check.
+	LockName string `json:"lock_name"`
+
+	// Pools are the pools that check reports changes to, each version naming
+	// the pool it changed, in place of Pool; only used by check and get.
+	Pools []string `json:"pools"`
+
+	// CheckURI is a read-only mirror of the repository that check polls
+	// instead of URI; only used by check.
+	CheckURI string `json:"check_uri"`
+
+	ShowMetadata     bool     `json:"show_metadata"`
+	ShowMetadataKeys []string `json:"show_metadata_keys"`
+
+	// ShowTimings adds how long each phase of an operation took to the
+	// step's metadata.
+	ShowTimings bool `json:"show_timings"`
+
+	Hooks Hooks `json:"hooks"`
+
+	Encryption Encryption `json:"encryption"`
+
+	ClaimTags ClaimTags `json:"claim_tags"`
+
+	// AuditNotes records each claim and release as a git note on its commit,
+	// pushed to AuditNotesRef.
+	AuditNotes bool `json:"audit_notes"`
+
+	Tracing TracingConfig `json:"tracing"`
+
+	// JSONLogs replaces the step's log with a stream of JSON events.
+	JSONLogs bool `json:"json_logs"`
+}
+
+// UnmarshalJSON reads durations either as strings such as "30s" or "2m", or
+// as a number of nanoseconds.
+func (source *Source) UnmarshalJSON(data []byte) error {
+	type plainSource Source
+
+	var raw struct {
+		plainSource
+		RetryDelay       jsonDuration `json:"retry_delay"`
+		RetryBackoffMax  jsonDuration `json:"retry_backoff_max"`
+		OperationTimeout jsonDuration `json:"operation_timeout"`
+		LeaseDuration    jsonDuration `json:"lease_duration"`
+		StaleTempDirAge  jsonDuration `json:"stale_temp_dir_age"`
+		CloneSince       jsonDuration `json:"clone_since"`
+
+		MinRemoteInterval jsonDuration `json:"min_remote_interval"`
+
+		HeartbeatInterval jsonDuration `json:"heartbeat_interval"`
+	}
+
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+
+	*source = Source(raw.plainSource)
+	source.RetryDelay = time.Duration(raw.RetryDelay)
+	source.RetryBackoffMax = time.Duration(raw.RetryBackoffMax)
+	source.OperationTimeout = time.Duration(raw.OperationTimeout)
+	source.LeaseDuration = time.Duration(raw.LeaseDuration)
+	source.StaleTempDirAge = time.Duration(raw.StaleTempDirAge)
+	source.CloneSince = time.Duration(raw.CloneSince)
+	source.MinRemoteInterval = time.Duration(raw.MinRemoteInterval)
+	source.HeartbeatInterval = time.Duration(raw.HeartbeatInterval)
+
+	return nil
+}
+
+type jsonDuration time.Duration
+
+func (d *jsonDuration) UnmarshalJSON(data []byte) error {
+	var nanoseconds int64
+	if err := json.Unmarshal(data, &nanoseconds); err == nil {
+		*d = jsonDuration(nanoseconds)
+		return nil
+	}
+
+	var duration string
+	if err := json.Unmarshal(data, &duration); err != nil {
+		return fmt.Errorf("invalid duration %s (expected e.g. \"30s\" or \"2m\")", data)
+	}
+
+	parsed, err := time.ParseDuration(duration)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q (expected e.g. \"30s\" or \"2m\")", duration)
+	}
+
+	*d = jsonDuration(parsed)
+
+	return nil
+}
+
+// DefaultRetryDelay is how long to wait before retrying when the source
+// doesn't say.
+const DefaultRetryDelay = 10 * time.Second
+
+// DefaultHeartbeatInterval is how often a build waiting on an empty pool says
+// it is still waiting when the source doesn't say.
+const DefaultHeartbeatInterval = time.Minute
+
+// WithDefaults fills in the state directories, retry delay, heartbeat
+// interval, and git protocol version the source leaves unset.
+func (source Source) WithDefaults() Source {
+	if source.Paths.Unclaimed == "" {
+		source.Paths.Unclaimed = "unclaimed"
+	}
+
+	if source.Paths.Claimed == "" {
+		source.Paths.Claimed = "claimed"
+	}
+
+	if source.Paths.Maintenance == "" {
+		source.Paths.Maintenance = "maintenance"
+	}
+
+	if source.Paths.Broken == "" {
+		source.Paths.Broken = "broken"
+	}
+
+	if source.Paths.Reserved == "" {
+		source.Paths.Reserved = "reserved"
+	}
+
+	if source.RetryDelay == 0 {
+		source.RetryDelay = DefaultRetryDelay
+	}
+
+	if source.HeartbeatInterval == 0 {
+		source.HeartbeatInterval = DefaultHeartbeatInterval
+	}
+
+	if source.ProtocolVersion == 0 {
+		source.ProtocolVersion = DefaultProtocolVersion
+	}
+
+	return source
+}
+
+// DefaultNetworkRetries is how many times in a row blips in the network are
+// retried when source.network_retries doesn't say.
+const DefaultNetworkRetries = 10
+
+// NetworkRetryLimit is how many times in a row blips in the network are
+// retried.
+func (source Source) NetworkRetryLimit() int {
+	if source.NetworkRetries <= 0 {
+		return DefaultNetworkRetries
+	}
+
+	return source.NetworkRetries
+}
+
+// ResetsBackOff tells whether backing off from a failing remote starts afresh
+// each time the remote answers, as it does unless retry_backoff_reset is
+// false.
+func (source Source) ResetsBackOff() bool {
+	return source.RetryBackoffReset == nil || *source.RetryBackoffReset
 }
 
+// HostKeyChecking is the StrictHostKeyChecking ssh is run with: the source's
+// strict_host_key_checking, or yes when it pins known_hosts without saying.
+// It is empty when the source leaves host keys to the image.
+func (source Source) HostKeyChecking() string {
+	if source.StrictHostKeyChecking == "" && source.KnownHosts != "" {
+		return "yes"
+	}
+
+	return source.StrictHostKeyChecking
+}
+
+// DefaultLockFileMode is the mode lock files are written with when the
+// source doesn't say.
+const DefaultLockFileMode os.FileMode = 0555
+
+// LockFilePerm parses the source's lock_file_mode.
+func (source Source) LockFilePerm() (os.FileMode, error) {
+	if source.LockFileMode == "" {
+		return DefaultLockFileMode, nil
+	}
+
+	mode, err := strconv.ParseUint(source.LockFileMode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("source.lock_file_mode %q must be an octal file mode such as \"0644\"", source.LockFileMode)
+	}
+
+	return os.FileMode(mode), nil
+}
+
+// Paths names the directories holding each state's locks within a pool.
+type Paths struct {
+	Unclaimed   string `json:"unclaimed"`
+	Claimed     string `json:"claimed"`
+	Maintenance string `json:"maintenance"`
+	Broken      string `json:"broken"`
+	Reserved    string `json:"reserved"`
+}
+
+// Vault locates the git credentials to read from Vault when the pool is used;
+// only used by the shell scripts, which do the reading.
+type Vault struct {
+	Address   string `json:"address"`
+	Path      string `json:"path"`
+	Role      string `json:"role"`
+	AuthMount string `json:"auth_mount"`
+}
+
+// Submodules is configured as either "all", "none", or a list of submodule
+// paths to initialize.
+type Submodules struct {
+	All   bool
+	Paths []string
+}
+
+func (s Submodules) None() bool {
+	return !s.All && len(s.Paths) == 0
+}
+
+func (s *Submodules) UnmarshalJSON(data []byte) error {
+	var mode string
+	if err := json.Unmarshal(data, &mode); err == nil {
+		switch mode {
+		case "all":
+			*s = Submodules{All: true}
+		case "none", "":
+			*s = Submodules{}
+		default:
+			return fmt.Errorf("invalid submodules %q (expected all, none, or a list of paths)", mode)
+		}
+
+		return nil
+	}
+
+	var paths []string
+	if err := json.Unmarshal(data, &paths); err != nil {
+		return fmt.Errorf("invalid submodules (expected all, none, or a list of paths)")
+	}
+
+	*s = Submodules{Paths: paths}
+
+	return nil
+}
+
+func (s Submodules) MarshalJSON() ([]byte, error) {
+	switch {
+	case s.All:
+		return json.Marshal("all")
+	case len(s.Paths) > 0:
+		return json.Marshal(s.Paths)
+	default:
+		return json.Marshal("none")
+	}
+}
+
+// Version identifies a commit to the pool and the lock it changed. Versions
+// emitted before the lock was recorded only carry a ref.
 type Version struct {
-	Ref string `json:"ref"`
+	Ref  string `json:"ref"`
+	Lock string `json:"lock,omitempty"`
+
+	// Pool is the pool the lock is in, with source.pools, which get fetches
+	// it from.
+	Pool string `json:"pool,omitempty"`
+
+	// Digest is the digest of the lock's contents as of Ref, with
+	// source.content_digest, which get verifies what it fetches against.
+	Digest string `json:"digest,omitempty"`
 }
 
 type OutParams struct {
 	Release string `json:"release"`
 	Acquire bool   `json:"acquire"`
+
+	// AllowMissing makes releasing a lock that is not claimed do nothing,
+	// rather than fail.
+	AllowMissing bool `json:"allow_missing"`
+
+	// ClaimAnyOf limits acquire to these locks, claiming the first of them
+	// that is available.
+	ClaimAnyOf []string `json:"claim_any_of"`
+
+	// MetadataQuery limits acquire to the locks whose metadata matches it.
+	MetadataQuery MetadataQuery `json:"metadata_query"`
+
+	// ReleaseMatching releases every claimed lock whose name matches the
+	// glob.
+	ReleaseMatching string `json:"release_matching"`
+
+	// ReleaseAllMine releases every claimed lock held by the pipeline running
+	// the step.
+	ReleaseAllMine bool `json:"release_all_mine"`
+
 	Add     string `json:"add"`
 	Remove  string `json:"remove"`
+	Disable string `json:"disable"`
+	Enable  string `json:"enable"`
+
+	// RemoveMatching and RemoveList remove several claimed or unclaimed
+	// locks at once: those matching the glob, or those named.
+	RemoveMatching string   `json:"remove_matching"`
+	RemoveList     []string `json:"remove_list"`
+
+	Quarantine string `json:"quarantine"`
+	Reason     string `json:"reason"`
+
+	// Reserve acquires a lock as a reservation, which lapses back to
+	// unclaimed after ReserveFor unless Confirm claims it first.
+	Reserve    bool          `json:"reserve"`
+	ReserveFor time.Duration `json:"reserve_for"`
+	Confirm    string        `json:"confirm"`
+
+	// MetadataTemplate renders the metadata of the lock being added.
+	MetadataTemplate string `json:"metadata_template"`
+
+	// Overwrite lets add replace the metadata of a lock already unclaimed in
+	// the pool.
+	Overwrite bool `json:"overwrite"`
+
+	// Heartbeat renews the lease of a claimed lock.
+	Heartbeat string `json:"heartbeat"`
+
+	// Transfer takes over a lock another build claimed, without releasing
+	// it.
+	Transfer string `json:"transfer"`
+
+	// Rename renames a lock, in whichever state it is in.
+	Rename *RenameParams `json:"rename"`
+
+	// PausePool and UnpausePool pause the pool, with Reason, so that no locks
+	// are claimed from it, and unpause it again.
+	PausePool   bool `json:"pause_pool"`
+	UnpausePool bool `json:"unpause_pool"`
+
+	// Revert reverts the changes that the commit it names made to the pool.
+	Revert string `json:"revert"`
+
+	// DestroyPool removes the whole pool, as long as ConfirmDestroy names
+	// it.
+	DestroyPool    bool   `json:"destroy_pool"`
+	ConfirmDestroy string `json:"confirm_destroy"`
+
+	// SquashHistory squashes the history of the pool's branch made more than
+	// SquashOlderThanDays ago into a single commit.
+	SquashHistory       bool `json:"squash_history"`
+	SquashOlderThanDays int  `json:"squash_older_than_days"`
+
+	// BypassReserveMinimum lets acquire and reserve take the unclaimed locks
+	// the source's reserve_minimum keeps back.
+	BypassReserveMinimum bool `json:"bypass_reserve_minimum"`
+
+	// Branch overrides the source's branch for this step.
+	Branch string `json:"branch"`
+
+	// Pool overrides the source's pool for this step.
+	Pool string `json:"pool"`
+}
+
+// RenameParams names the lock to rename, and what to rename it to.
+type RenameParams struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// DefaultReserveFor is how long a reservation lasts when the params don't say.
+const DefaultReserveFor = 10 * time.Minute
+
+// UnmarshalJSON reads reserve_for as either a string such as "10m", or a
+// number of nanoseconds.
+func (params *OutParams) UnmarshalJSON(data []byte) error {
+	type plainParams OutParams
+
+	var raw struct {
+		plainParams
+		ReserveFor jsonDuration `json:"reserve_for"`
+	}
+
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+
+	*params = OutParams(raw.plainParams)
+	params.ReserveFor = time.Duration(raw.ReserveFor)
+
+	return nil
 }
 
 type OutRequest struct {
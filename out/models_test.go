@@ -0,0 +1,95 @@
+package out_test
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/concourse/pool-resource/out"
+)
+
+var _ = Describe("Source", func() {
+	It("reads durations written as strings", func() {
+		var source out.Source
+		err := json.Unmarshal([]byte(`{"uri": "some-uri", "retry_delay": "30s", "heartbeat_interval": "15s", "operation_timeout": "5m", "stale_temp_dir_age": "2h30m", "retry_backoff_max": "1m", "clone_since": "720h", "min_remote_interval": "2s"}`), &source)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(source.URI).Should(Equal("some-uri"))
+		Ω(source.RetryDelay).Should(Equal(30 * time.Second))
+		Ω(source.HeartbeatInterval).Should(Equal(15 * time.Second))
+		Ω(source.OperationTimeout).Should(Equal(5 * time.Minute))
+		Ω(source.StaleTempDirAge).Should(Equal(150 * time.Minute))
+		Ω(source.RetryBackoffMax).Should(Equal(time.Minute))
+		Ω(source.CloneSince).Should(Equal(30 * 24 * time.Hour))
+		Ω(source.MinRemoteInterval).Should(Equal(2 * time.Second))
+	})
+
+	It("reads durations written as nanoseconds", func() {
+		var source out.Source
+		err := json.Unmarshal([]byte(`{"retry_delay": 100000000}`), &source)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(source.RetryDelay).Should(Equal(100 * time.Millisecond))
+	})
+
+	It("leaves unset durations zero", func() {
+		var source out.Source
+		err := json.Unmarshal([]byte(`{"pool": "some-pool"}`), &source)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(source.RetryDelay).Should(BeZero())
+	})
+
+	It("rejects durations it cannot parse", func() {
+		var source out.Source
+		err := json.Unmarshal([]byte(`{"retry_delay": "soon"}`), &source)
+		Ω(err).Should(MatchError(`invalid duration "soon" (expected e.g. "30s" or "2m")`))
+	})
+
+	It("round trips through JSON", func() {
+		source := out.Source{URI: "some-uri", RetryDelay: time.Minute, Submodules: out.Submodules{All: true}}
+
+		data, err := json.Marshal(source)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		var decoded out.Source
+		Ω(json.Unmarshal(data, &decoded)).Should(Succeed())
+		Ω(decoded.URI).Should(Equal("some-uri"))
+		Ω(decoded.RetryDelay).Should(Equal(time.Minute))
+		Ω(decoded.Submodules.All).Should(BeTrue())
+	})
+
+	It("writes lock files read-only and executable unless told otherwise", func() {
+		Ω(out.Source{}.LockFilePerm()).Should(Equal(os.FileMode(0555)))
+		Ω(out.Source{LockFileMode: "0644"}.LockFilePerm()).Should(Equal(os.FileMode(0644)))
+		Ω(out.Source{LockFileMode: "755"}.LockFilePerm()).Should(Equal(os.FileMode(0755)))
+	})
+
+	It("checks host keys strictly once they are pinned, unless told otherwise", func() {
+		Ω(out.Source{}.HostKeyChecking()).Should(BeEmpty())
+		Ω(out.Source{KnownHosts: "some-host ssh-ed25519 AAAA"}.HostKeyChecking()).Should(Equal("yes"))
+		Ω(out.Source{KnownHosts: "some-host ssh-ed25519 AAAA", StrictHostKeyChecking: "accept-new"}.HostKeyChecking()).Should(Equal("accept-new"))
+		Ω(out.Source{StrictHostKeyChecking: "no"}.HostKeyChecking()).Should(Equal("no"))
+	})
+
+	It("rejects lock file modes that aren't octal permissions", func() {
+		for _, mode := range []string{"rw-r--r--", "0888", "01777", "-1"} {
+			_, err := out.Source{LockFileMode: mode}.LockFilePerm()
+			Ω(err).Should(MatchError(ContainSubstring("must be an octal file mode")), mode)
+		}
+	})
+})
+
+var _ = Describe("OutParams", func() {
+	It("reads the reservation length written as a string", func() {
+		var params out.OutParams
+		err := json.Unmarshal([]byte(`{"reserve": true, "reserve_for": "15m"}`), &params)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(params.Reserve).Should(BeTrue())
+		Ω(params.ReserveFor).Should(Equal(15 * time.Minute))
+	})
+})
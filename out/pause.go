@@ -0,0 +1,115 @@
+package out
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// PausedMarker is the file whose presence in a pool pauses it: no locks are
+// claimed from a paused pool, even if some are unclaimed, until it is
+// unpaused again.
+const PausedMarker = ".paused"
+
+// ErrPoolPaused is returned by acquire on a paused pool when
+// source.fail_when_paused is set.
+var ErrPoolPaused = errors.New("pool is paused")
+
+// PausePool pauses the pool, recording why in its marker and commit.
+func (glh *GitLockHandler) PausePool(reason string) (string, error) {
+	paused, err := glh.PoolPaused()
+	if err != nil {
+		return "", err
+	}
+
+	if paused {
+		return "", fmt.Errorf("pool %s is already paused", glh.Source.Pool)
+	}
+
+	contents := reason
+	if buildURL := BuildURL(); buildURL != "" {
+		contents = strings.TrimSpace(contents + "\n" + buildURL)
+	}
+
+	err = glh.stageFile(glh.pausedPath(), []byte(contents+"\n"), 0644)
+	if err != nil {
+		return "", err
+	}
+
+	return glh.commit("pausing", glh.Source.Pool, reason)
+}
+
+func (glh *GitLockHandler) UnpausePool() (string, error) {
+	err := glh.removeFile(glh.pausedPath(), false)
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("pool %s is not paused", glh.Source.Pool)
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	return glh.commit("unpausing", glh.Source.Pool, "")
+}
+
+// PoolPaused tells whether the pool holds a PausedMarker.
+func (glh *GitLockHandler) PoolPaused() (bool, error) {
+	_, err := glh.readFile(glh.pausedPath())
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+func (glh *GitLockHandler) pausedPath() string {
+	return filepath.Join(glh.poolDir(), PausedMarker)
+}
+
+// PausePool pauses the pool for a maintenance window: until UnpausePool,
+// acquire and reserve wait, or fail with source.fail_when_paused, even if
+// there are unclaimed locks. The version it returns names no lock.
+func (lp *LockPool) PausePool(reason string) (string, Version, error) {
+	return lp.traced("pause", func() (string, Version, error) {
+		return lp.changePool("pausing", func() (string, error) {
+			return lp.LockHandler.PausePool(reason)
+		})
+	})
+}
+
+// UnpausePool lets builds claim locks from a paused pool again. The version
+// it returns names no lock.
+func (lp *LockPool) UnpausePool() (string, Version, error) {
+	return lp.traced("unpause", func() (string, Version, error) {
+		return lp.changePool("unpausing", lp.LockHandler.UnpausePool)
+	})
+}
+
+// changePool makes a change to the pool as a whole, rather than to one of its
+// locks, retrying if it conflicts with another change.
+func (lp *LockPool) changePool(verb string, change func() (string, error)) (string, Version, error) {
+	fmt.Fprintf(lp.Output, "%s pool: %s\n", verb, lp.Source.Pool)
+
+	err := lp.setup()
+	if err != nil {
+		return "", Version{}, err
+	}
+
+	defer lp.LockHandler.Cleanup()
+
+	ref, err := lp.commitChange("the pool", func() (string, error) {
+		ref, err := change()
+		if err != nil {
+			fmt.Fprintf(lp.Output, "\nfailed %s the pool: %s! (err: %s)\n", verb, lp.Source.Pool, err)
+		}
+
+		return ref, err
+	})
+	if err != nil {
+		return "", Version{}, err
+	}
+
+	return "", Version{Ref: strings.TrimSpace(ref)}, nil
+}
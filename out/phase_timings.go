@@ -0,0 +1,96 @@
+package out
+
+import (
+	"fmt"
+	"time"
+)
+
+// CommitTimer is implemented by LockHandlers that can tell how long they have
+// spent committing changes to the pool, in total.
+type CommitTimer interface {
+	CommitDuration() time.Duration
+}
+
+// PhaseTimings is how long an operation spent in each phase of changing the
+// pool, summed over its retries: cloning the pool and bringing it up to date,
+// selecting what to change, committing the change, and pushing it. Time spent
+// waiting between retries is in none of them.
+type PhaseTimings struct {
+	Clone  time.Duration
+	Select time.Duration
+	Commit time.Duration
+	Push   time.Duration
+}
+
+func (timings PhaseTimings) String() string {
+	return fmt.Sprintf(
+		"clone %s, select %s, commit %s, push %s",
+		timings.Clone.Round(time.Millisecond),
+		timings.Select.Round(time.Millisecond),
+		timings.Commit.Round(time.Millisecond),
+		timings.Push.Round(time.Millisecond),
+	)
+}
+
+// milliseconds lists the timings by phase for the event stream.
+func (timings PhaseTimings) milliseconds() map[string]int64 {
+	return map[string]int64{
+		"clone":  timings.Clone.Milliseconds(),
+		"select": timings.Select.Milliseconds(),
+		"commit": timings.Commit.Milliseconds(),
+		"push":   timings.Push.Milliseconds(),
+	}
+}
+
+// CommitDuration is how long the handler has spent committing changes since
+// it was made.
+func (glh *GitLockHandler) CommitDuration() time.Duration {
+	return glh.committing
+}
+
+// Timings is how long the last operation spent in each phase.
+func (lp *LockPool) Timings() PhaseTimings {
+	return lp.timings
+}
+
+func (lp *LockPool) commitDuration() time.Duration {
+	timer, ok := lp.LockHandler.(CommitTimer)
+	if !ok {
+		return 0
+	}
+
+	return timer.CommitDuration()
+}
+
+// startTimings begins timing the phases of an operation.
+func (lp *LockPool) startTimings() {
+	lp.timings = PhaseTimings{}
+	lp.resetAt = time.Time{}
+	lp.changing = 0
+	lp.committedBefore = lp.commitDuration()
+}
+
+// finishTimings works out the time spent selecting what to change, which is
+// the time between bringing the pool up to date and pushing the change that
+// wasn't spent committing it, then reports the timings of every phase.
+func (lp *LockPool) finishTimings() {
+	lp.timings.Commit = lp.commitDuration() - lp.committedBefore
+
+	lp.timings.Select = lp.changing - lp.timings.Commit
+	if lp.timings.Select < 0 {
+		lp.timings.Select = 0
+	}
+
+	if lp.timings == (PhaseTimings{}) {
+		return
+	}
+
+	fmt.Fprintf(lp.Output, "\ntimings: %s\n", lp.timings)
+
+	if lp.Source.ShowTimings {
+		lp.addMetadata("clone_duration", lp.timings.Clone.Round(time.Millisecond).String())
+		lp.addMetadata("select_duration", lp.timings.Select.Round(time.Millisecond).String())
+		lp.addMetadata("commit_duration", lp.timings.Commit.Round(time.Millisecond).String())
+		lp.addMetadata("push_duration", lp.timings.Push.Round(time.Millisecond).String())
+	}
+}
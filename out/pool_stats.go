@@ -0,0 +1,30 @@
+package out
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// reportPoolStats counts the pool's claimed and unclaimed locks after the
+// operation that was just broadcast, giving every build a running gauge of
+// the pool's depth in its output and metadata. The clone already holds the
+// pool, so counting costs nothing more than listing two directories.
+func (lp *LockPool) reportPoolStats() {
+	claimed, err := lp.LockHandler.ListLocks(lp.Source.Paths.Claimed)
+	if err != nil {
+		fmt.Fprintf(lp.Output, "failed to count the locks in pool: %s! (err: %s)\n", lp.Source.Pool, err)
+		return
+	}
+
+	unclaimed, err := lp.LockHandler.ListLocks(lp.Source.Paths.Unclaimed)
+	if err != nil {
+		fmt.Fprintf(lp.Output, "failed to count the locks in pool: %s! (err: %s)\n", lp.Source.Pool, err)
+		return
+	}
+
+	fmt.Fprintf(lp.Output, "pool: %s has %d claimed and %d unclaimed lock(s)\n", lp.Source.Pool, len(claimed), len(unclaimed))
+	lp.addMetadata("claimed_count", strconv.Itoa(len(claimed)))
+	lp.addMetadata("unclaimed_count", strconv.Itoa(len(unclaimed)))
+
+	lp.warnIfPoolIsLow(len(unclaimed))
+}
@@ -0,0 +1,805 @@
+// Package poolfakes provides a working, in-memory LockHandler, so that tools
+// embedding a LockPool can test against it end to end without a git server.
+//
+// Claims pick locks as the git pool does, by the source's selection strategy,
+// the weights the locks' metadata declares and the source's affinity. What
+// depends on the git pool's history or its remote is not modelled:
+//
+//   - SquashHistory and RevertCommit fail with ErrUnsupported, as the pool
+//     keeps no history.
+//   - BroadcastLockPool succeeds without publishing anything if nothing was
+//     changed, where pushing an unchanged git pool is reported as a conflict.
+//   - Claim tags and mirrors are never written.
+package poolfakes
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/concourse/pool-resource/out"
+)
+
+// Pool is the shared state of an in-memory pool, standing in for the remote
+// repository. Several MemoryLockHandlers sharing a Pool conflict with each
+// other the way concurrent pushes to a repository do.
+type Pool struct {
+	mutex sync.Mutex
+
+	locks map[string]map[string][]byte
+	notes []out.AuditNote
+	head  string
+	refs  int
+}
+
+func NewPool() *Pool {
+	return &Pool{locks: map[string]map[string][]byte{}}
+}
+
+// Put puts a lock in the given state, e.g. to seed the pool before a test,
+// as if someone had pushed it.
+func (pool *Pool) Put(state string, lock string, contents []byte) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	for state, locks := range pool.locks {
+		if state != out.FencingDir {
+			delete(locks, lock)
+		}
+	}
+
+	putLock(pool.locks, state, lock, contents)
+	pool.head = pool.nextRef("put: " + lock)
+}
+
+// PutSchema gives the pool a metadata schema, as if someone had pushed its
+// out.SchemaFile, or takes it away if schema is nil.
+func (pool *Pool) PutSchema(schema []byte) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	if schema == nil {
+		delete(pool.locks[schemaDir], out.SchemaFile)
+	} else {
+		putLock(pool.locks, schemaDir, out.SchemaFile, schema)
+	}
+
+	pool.head = pool.nextRef("put: " + out.SchemaFile)
+}
+
+// Locks lists the locks in the given state, in order.
+func (pool *Pool) Locks(state string) []string {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	return sortedLocks(pool.locks[state])
+}
+
+// Contents returns the contents of a lock in the given state, and whether
+// the lock is in that state.
+func (pool *Pool) Contents(state string, lock string) ([]byte, bool) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	contents, found := pool.locks[state][lock]
+	return contents, found
+}
+
+// Head is the ref of the last change made to the pool.
+func (pool *Pool) Head() string {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	return pool.head
+}
+
+// nextRef makes up a ref that looks like a commit's and is unique to the
+// pool; the caller must hold the mutex.
+func (pool *Pool) nextRef(message string) string {
+	pool.refs++
+	return fmt.Sprintf("%x", sha1.Sum([]byte(fmt.Sprintf("%d\x00%s", pool.refs, message))))
+}
+
+// MemoryLockHandler is an out.LockHandler over a Pool. Like GitLockHandler,
+// it changes a working copy of the pool and only publishes the changes when
+// they are broadcast, failing with out.ErrLockConflict if the pool changed
+// in the meantime.
+type MemoryLockHandler struct {
+	Pool   *Pool
+	Source out.Source
+
+	// Selector picks which available lock to claim.
+	Selector out.Selector
+
+	// candidates, if any, are the only locks that may be claimed, in order of
+	// preference.
+	candidates []string
+
+	// allow, if set, accepts the only locks that may be claimed.
+	allow func(lock string) bool
+
+	locks   map[string]map[string][]byte
+	notes   []out.AuditNote
+	base    string
+	head    string
+	changed bool
+}
+
+var _ out.LockHandler = &MemoryLockHandler{}
+var _ out.CandidateClaimer = &MemoryLockHandler{}
+var _ out.FilteredClaimer = &MemoryLockHandler{}
+
+// NewLockPool returns a LockPool whose locks are kept in pool, with the
+// source's unset settings defaulted as the out resource does.
+func NewLockPool(pool *Pool, source out.Source, output io.Writer) out.LockPool {
+	handler := NewMemoryLockHandler(pool, source)
+
+	return out.LockPool{
+		Source:      handler.Source,
+		Output:      output,
+		LockHandler: handler,
+	}
+}
+
+func NewMemoryLockHandler(pool *Pool, source out.Source) *MemoryLockHandler {
+	source = source.WithDefaults()
+
+	return &MemoryLockHandler{
+		Pool:     pool,
+		Source:   source,
+		Selector: out.SelectorFor(source.SelectionStrategy),
+	}
+}
+
+func (handler *MemoryLockHandler) Setup() error {
+	return handler.ResetLock()
+}
+
+func (handler *MemoryLockHandler) ResetLock() error {
+	handler.Pool.mutex.Lock()
+	defer handler.Pool.mutex.Unlock()
+
+	handler.locks = map[string]map[string][]byte{}
+	for state, locks := range handler.Pool.locks {
+		for lock, contents := range locks {
+			putLock(handler.locks, state, lock, contents)
+		}
+	}
+
+	handler.notes = append([]out.AuditNote(nil), handler.Pool.notes...)
+
+	handler.base = handler.Pool.head
+	handler.head = handler.Pool.head
+	handler.changed = false
+
+	return nil
+}
+
+func (handler *MemoryLockHandler) Cleanup() error {
+	handler.locks = nil
+	handler.notes = nil
+	handler.changed = false
+
+	return nil
+}
+
+func (handler *MemoryLockHandler) BroadcastLockPool() error {
+	handler.Pool.mutex.Lock()
+	defer handler.Pool.mutex.Unlock()
+
+	if !handler.changed {
+		return nil
+	}
+
+	if handler.Pool.head != handler.base {
+		return out.ErrLockConflict
+	}
+
+	handler.Pool.locks = map[string]map[string][]byte{}
+	for state, locks := range handler.locks {
+		for lock, contents := range locks {
+			putLock(handler.Pool.locks, state, lock, contents)
+		}
+	}
+
+	handler.Pool.notes = append([]out.AuditNote(nil), handler.notes...)
+
+	handler.Pool.head = handler.head
+	handler.base = handler.head
+	handler.changed = false
+
+	return nil
+}
+
+func (handler *MemoryLockHandler) ListLocks(state string) ([]string, error) {
+	return sortedLocks(handler.locks[state]), nil
+}
+
+func (handler *MemoryLockHandler) ReadLock(state string, lock string) ([]byte, error) {
+	contents, found := handler.locks[state][lock]
+	if !found {
+		return nil, &os.PathError{Op: "open", Path: filepath.Join(handler.Source.Pool, state, lock), Err: os.ErrNotExist}
+	}
+
+	return contents, nil
+}
+
+func (handler *MemoryLockHandler) ReadSchema() ([]byte, error) {
+	return handler.locks[schemaDir][out.SchemaFile], nil
+}
+
+func (handler *MemoryLockHandler) ClaimPipeline(lock string) (string, error) {
+	if _, found := handler.locks[handler.Source.Paths.Claimed][lock]; !found {
+		return "", nil
+	}
+
+	return string(handler.locks[pipelinesDir][lock]), nil
+}
+
+// AuditLog lists the audit notes of the lock, or of every lock if lock is "",
+// oldest first, as recorded if the source asks for them.
+func (handler *MemoryLockHandler) AuditLog(lock string) ([]out.AuditNote, error) {
+	var notes []out.AuditNote
+	for _, note := range handler.notes {
+		if lock == "" || note.Lock == lock {
+			notes = append(notes, note)
+		}
+	}
+
+	return notes, nil
+}
+
+func (handler *MemoryLockHandler) GrabAvailableLock() (string, string, error) {
+	lock, ref, err := handler.grabLock(handler.Source.Paths.Claimed, "claiming: ")
+	if err != nil {
+		return "", "", err
+	}
+
+	handler.incrementFencingToken(lock)
+	handler.noteAudit(out.AuditClaimed, ref, lock)
+
+	return lock, ref, nil
+}
+
+func (handler *MemoryLockHandler) ReserveLock(until time.Time) (string, string, error) {
+	lock, ref, err := handler.grabLock(handler.Source.Paths.Reserved, "reserving: ")
+	if err != nil {
+		return "", "", err
+	}
+
+	handler.WriteExpiry(handler.Source.Paths.Reserved, lock, until)
+
+	return lock, ref, nil
+}
+
+func (handler *MemoryLockHandler) ConfirmLock(lock string) (string, error) {
+	ref, err := handler.moveLock(lock, handler.Source.Paths.Reserved, handler.Source.Paths.Claimed, "confirming: "+lock)
+	if err != nil {
+		return "", err
+	}
+
+	handler.incrementFencingToken(lock)
+	handler.noteAudit(out.AuditClaimed, ref, lock)
+
+	return ref, nil
+}
+
+func (handler *MemoryLockHandler) LapseReservation(lock string) (string, error) {
+	return handler.moveLock(lock, handler.Source.Paths.Reserved, handler.Source.Paths.Unclaimed, "lapsing reservation: "+lock)
+}
+
+func (handler *MemoryLockHandler) ReservationExpiry(lock string) (time.Time, error) {
+	return handler.readExpiry(handler.Source.Paths.Reserved, lock)
+}
+
+func (handler *MemoryLockHandler) LeaseLock(until func(lock string) time.Time) (string, string, error) {
+	lock, ref, err := handler.GrabAvailableLock()
+	if err != nil {
+		return "", "", err
+	}
+
+	if expiry := until(lock); !expiry.IsZero() {
+		handler.WriteExpiry(handler.Source.Paths.Claimed, lock, expiry)
+	}
+
+	return lock, ref, nil
+}
+
+func (handler *MemoryLockHandler) RenewLease(lock string, until time.Time) (string, error) {
+	if _, found := handler.locks[handler.Source.Paths.Claimed][lock]; !found {
+		return "", fmt.Errorf("lock %s is not in %s", lock, handler.Source.Paths.Claimed)
+	}
+
+	handler.WriteExpiry(handler.Source.Paths.Claimed, lock, until)
+
+	return handler.commit("renewing lease: " + lock), nil
+}
+
+func (handler *MemoryLockHandler) TransferLock(lock string, until time.Time) (string, error) {
+	if _, found := handler.locks[handler.Source.Paths.Claimed][lock]; !found {
+		return "", fmt.Errorf("lock %s is not in %s", lock, handler.Source.Paths.Claimed)
+	}
+
+	handler.incrementFencingToken(lock)
+	handler.recordPipeline(lock)
+
+	delete(handler.locks[handler.Source.Paths.Claimed], expiryName(lock))
+	if !until.IsZero() {
+		handler.WriteExpiry(handler.Source.Paths.Claimed, lock, until)
+	}
+
+	ref := handler.commit("transferring: " + lock)
+	handler.noteAudit(out.AuditTransferred, ref, lock)
+
+	return ref, nil
+}
+
+func (handler *MemoryLockHandler) RenameLock(from string, to string, state string) (string, error) {
+	contents, found := handler.locks[state][from]
+	if !found {
+		return "", fmt.Errorf("lock %s is not in %s", from, state)
+	}
+
+	delete(handler.locks[state], from)
+	putLock(handler.locks, state, to, contents)
+
+	if expiry, found := handler.locks[state][expiryName(from)]; found {
+		delete(handler.locks[state], expiryName(from))
+		putLock(handler.locks, state, expiryName(to), expiry)
+	}
+
+	// the pipeline that claimed the lock still holds it by its new name
+	for _, dir := range []string{out.FencingDir, pipelinesDir} {
+		if record, found := handler.locks[dir][from]; found {
+			delete(handler.locks[dir], from)
+			putLock(handler.locks, dir, to, record)
+		}
+	}
+
+	return handler.commit("renaming: " + from), nil
+}
+
+func (handler *MemoryLockHandler) PausePool(reason string) (string, error) {
+	if handler.paused() {
+		return "", fmt.Errorf("pool %s is already paused", handler.Source.Pool)
+	}
+
+	putLock(handler.locks, "", out.PausedMarker, []byte(reason+"\n"))
+
+	return handler.commit("pausing: " + handler.Source.Pool), nil
+}
+
+func (handler *MemoryLockHandler) UnpausePool() (string, error) {
+	if !handler.paused() {
+		return "", fmt.Errorf("pool %s is not paused", handler.Source.Pool)
+	}
+
+	delete(handler.locks[""], out.PausedMarker)
+
+	return handler.commit("unpausing: " + handler.Source.Pool), nil
+}
+
+func (handler *MemoryLockHandler) DestroyPool() (string, error) {
+	empty := true
+	for _, locks := range handler.locks {
+		if len(locks) > 0 {
+			empty = false
+		}
+	}
+
+	if empty {
+		return "", fmt.Errorf("pool %s does not exist", handler.Source.Pool)
+	}
+
+	handler.locks = map[string]map[string][]byte{}
+
+	return handler.commit("destroying: " + handler.Source.Pool), nil
+}
+
+func (handler *MemoryLockHandler) PoolPaused() (bool, error) {
+	return handler.paused(), nil
+}
+
+func (handler *MemoryLockHandler) Head() (string, error) {
+	return handler.head, nil
+}
+
+// ErrUnsupported is returned by the operations that need a history of the
+// pool, which an in-memory pool doesn't keep.
+var ErrUnsupported = errors.New("not supported by an in-memory pool, which keeps no history")
+
+func (handler *MemoryLockHandler) SquashHistory(before time.Time) (string, int, error) {
+	return "", 0, ErrUnsupported
+}
+
+func (handler *MemoryLockHandler) RevertCommit(ref string) (string, string, error) {
+	return "", "", ErrUnsupported
+}
+
+func (handler *MemoryLockHandler) paused() bool {
+	_, found := handler.locks[""][out.PausedMarker]
+	return found
+}
+
+func (handler *MemoryLockHandler) ReapLease(lock string) (string, error) {
+	ref, err := handler.moveLock(lock, handler.Source.Paths.Claimed, handler.Source.Paths.Unclaimed, "reaping: "+lock)
+	if err != nil {
+		return "", err
+	}
+
+	handler.noteAudit(out.AuditReaped, ref, lock)
+
+	return ref, nil
+}
+
+func (handler *MemoryLockHandler) LeaseExpiry(lock string) (time.Time, error) {
+	return handler.readExpiry(handler.Source.Paths.Claimed, lock)
+}
+
+func (handler *MemoryLockHandler) WriteExpiry(state string, lock string, until time.Time) error {
+	putLock(handler.locks, state, expiryName(lock), []byte(until.UTC().Format(time.RFC3339)))
+	return nil
+}
+
+func (handler *MemoryLockHandler) readExpiry(state string, lock string) (time.Time, error) {
+	if _, found := handler.locks[state][lock]; !found {
+		return time.Time{}, fmt.Errorf("lock %s is not in %s", lock, state)
+	}
+
+	expiry, found := handler.locks[state][expiryName(lock)]
+	if !found {
+		return time.Time{}, nil
+	}
+
+	return time.Parse(time.RFC3339, string(expiry))
+}
+
+func (handler *MemoryLockHandler) FencingToken(lock string) (int, error) {
+	token, found := handler.locks[out.FencingDir][lock]
+	if !found {
+		return 0, nil
+	}
+
+	return strconv.Atoi(string(token))
+}
+
+func (handler *MemoryLockHandler) incrementFencingToken(lock string) {
+	token, _ := handler.FencingToken(lock)
+	handler.WriteFencingToken(lock, token+1)
+}
+
+func (handler *MemoryLockHandler) WriteFencingToken(lock string, token int) error {
+	putLock(handler.locks, out.FencingDir, lock, []byte(strconv.Itoa(token)))
+	return nil
+}
+
+func (handler *MemoryLockHandler) grabLock(to string, verb string) (string, string, error) {
+	locks := sortedLocks(handler.locks[handler.Source.Paths.Unclaimed])
+	if handler.allow != nil {
+		allowed := []string{}
+		for _, lock := range locks {
+			if handler.allow(lock) {
+				allowed = append(allowed, lock)
+			}
+		}
+
+		locks = allowed
+	}
+
+	if len(locks) == 0 {
+		return "", "", out.ErrNoLocksAvailable
+	}
+
+	var lock string
+	if len(handler.candidates) > 0 {
+		lock = out.FirstAvailable(handler.candidates, locks)
+	} else {
+		if handler.Source.Affinity == out.AffinityPipeline {
+			lock = handler.preferredLock(out.BuildPipeline(), locks)
+		}
+
+		if lock == "" {
+			lock = handler.Selector.Select(locks, handler.lockWeights(locks))
+		}
+	}
+
+	if lock == "" {
+		return "", "", out.ErrNoLocksAvailable
+	}
+
+	ref, err := handler.moveLock(lock, handler.Source.Paths.Unclaimed, to, verb+lock)
+	if err != nil {
+		return "", "", err
+	}
+
+	handler.recordPipeline(lock)
+
+	if to == handler.Source.Paths.Claimed {
+		handler.recordClaim(lock)
+	}
+
+	return lock, ref, nil
+}
+
+// lockWeights reads the weight each lock's metadata declares, as the git
+// pool does.
+func (handler *MemoryLockHandler) lockWeights(locks []string) map[string]float64 {
+	weights := map[string]float64{}
+	for _, lock := range locks {
+		contents, err := handler.Source.Encryption.Readable(handler.locks[handler.Source.Paths.Unclaimed][lock])
+		if err != nil {
+			continue
+		}
+
+		if weight, ok := out.MetadataWeight(contents); ok {
+			weights[lock] = weight
+		}
+	}
+
+	return weights
+}
+
+// preferredLock returns the available lock that pipeline claimed most
+// recently, or "" if it has claimed none of them.
+func (handler *MemoryLockHandler) preferredLock(pipeline string, available []string) string {
+	if pipeline == "" {
+		return ""
+	}
+
+	isAvailable := map[string]bool{}
+	for _, lock := range available {
+		isAvailable[lock] = true
+	}
+
+	for _, lock := range strings.Fields(string(handler.locks[claimsDir][pipeline])) {
+		if isAvailable[lock] {
+			return lock
+		}
+	}
+
+	return ""
+}
+
+// ClaimFrom limits claims to the first available of candidates, instead of
+// the lock the Selector picks.
+func (handler *MemoryLockHandler) ClaimFrom(candidates []string) {
+	handler.candidates = candidates
+}
+
+// ClaimWhere limits claims to the available locks that allow accepts.
+func (handler *MemoryLockHandler) ClaimWhere(allow func(lock string) bool) {
+	handler.allow = allow
+}
+
+func (handler *MemoryLockHandler) UnclaimLock(lock string) (string, error) {
+	ref, err := handler.moveLock(lock, handler.Source.Paths.Claimed, handler.Source.Paths.Unclaimed, "unclaiming: "+lock)
+	if err != nil {
+		return "", err
+	}
+
+	handler.noteAudit(out.AuditReleased, ref, lock)
+
+	return ref, nil
+}
+
+func (handler *MemoryLockHandler) UnclaimLocks(locks []string) (string, error) {
+	for _, lock := range locks {
+		contents, found := handler.locks[handler.Source.Paths.Claimed][lock]
+		if !found {
+			return "", fmt.Errorf("lock %s is not in %s", lock, handler.Source.Paths.Claimed)
+		}
+
+		delete(handler.locks[handler.Source.Paths.Claimed], lock)
+		delete(handler.locks[handler.Source.Paths.Claimed], expiryName(lock))
+		putLock(handler.locks, handler.Source.Paths.Unclaimed, lock, contents)
+	}
+
+	ref := handler.commit("unclaiming: " + strings.Join(locks, ", "))
+	handler.noteAudit(out.AuditReleased, ref, locks...)
+
+	return ref, nil
+}
+
+func (handler *MemoryLockHandler) DisableLock(lock string) (string, error) {
+	return handler.moveLock(lock, handler.Source.Paths.Claimed, handler.Source.Paths.Maintenance, "disabling: "+lock)
+}
+
+func (handler *MemoryLockHandler) EnableLock(lock string) (string, error) {
+	return handler.moveLock(lock, handler.Source.Paths.Maintenance, handler.Source.Paths.Unclaimed, "enabling: "+lock)
+}
+
+func (handler *MemoryLockHandler) QuarantineLock(lock string, reason string) (string, error) {
+	return handler.moveLock(lock, handler.Source.Paths.Claimed, handler.Source.Paths.Broken, "quarantining: "+lock)
+}
+
+func (handler *MemoryLockHandler) ForceUnclaimLock(lock string, state string) (string, error) {
+	return handler.moveLock(lock, state, handler.Source.Paths.Unclaimed, "force unclaiming: "+lock)
+}
+
+func (handler *MemoryLockHandler) ImportLock(state string, lock string, contents []byte) (string, error) {
+	putLock(handler.locks, state, lock, contents)
+
+	return handler.commit("importing: " + lock), nil
+}
+
+func (handler *MemoryLockHandler) AddLock(lock string, contents []byte) (string, error) {
+	putLock(handler.locks, handler.Source.Paths.Unclaimed, lock, contents)
+
+	return handler.commit("adding: " + lock), nil
+}
+
+func (handler *MemoryLockHandler) AddLocks(locks map[string][]byte) (string, error) {
+	names := []string{}
+	for lock, contents := range locks {
+		putLock(handler.locks, handler.Source.Paths.Unclaimed, lock, contents)
+		names = append(names, lock)
+	}
+
+	sort.Strings(names)
+
+	return handler.commit("adding: " + strings.Join(names, ", ")), nil
+}
+
+func (handler *MemoryLockHandler) RemoveLock(lock string) (string, error) {
+	if _, found := handler.locks[handler.Source.Paths.Claimed][lock]; !found {
+		return "", fmt.Errorf("lock %s is not in %s", lock, handler.Source.Paths.Claimed)
+	}
+
+	delete(handler.locks[handler.Source.Paths.Claimed], lock)
+	delete(handler.locks[handler.Source.Paths.Claimed], expiryName(lock))
+
+	return handler.commit("removing: " + lock), nil
+}
+
+func (handler *MemoryLockHandler) RemoveLocks(locks map[string]string) (string, error) {
+	names := []string{}
+	for lock, state := range locks {
+		if _, found := handler.locks[state][lock]; !found {
+			return "", fmt.Errorf("lock %s is not in %s", lock, state)
+		}
+
+		names = append(names, lock)
+	}
+
+	for lock, state := range locks {
+		delete(handler.locks[state], lock)
+		delete(handler.locks[state], expiryName(lock))
+	}
+
+	sort.Strings(names)
+
+	return handler.commit("removing: " + strings.Join(names, ", ")), nil
+}
+
+func (handler *MemoryLockHandler) moveLock(lock string, from string, to string, message string) (string, error) {
+	contents, found := handler.locks[from][lock]
+	if !found {
+		return "", fmt.Errorf("lock %s is not in %s", lock, from)
+	}
+
+	delete(handler.locks[from], lock)
+	delete(handler.locks[from], expiryName(lock))
+	putLock(handler.locks, to, lock, contents)
+
+	return handler.commit(message), nil
+}
+
+func (handler *MemoryLockHandler) commit(message string) string {
+	handler.Pool.mutex.Lock()
+	defer handler.Pool.mutex.Unlock()
+
+	handler.head = handler.Pool.nextRef(message)
+	handler.changed = true
+
+	return handler.head
+}
+
+// noteAudit records the action on each of the locks, with how long they had
+// been held since the notes last saw them claimed, to be published with the
+// change.
+func (handler *MemoryLockHandler) noteAudit(action string, ref string, locks ...string) {
+	if !handler.Source.AuditNotes {
+		return
+	}
+
+	at := time.Now().UTC()
+	for _, lock := range locks {
+		note := out.AuditNote{
+			Action:   action,
+			Lock:     lock,
+			Pool:     handler.Source.Pool,
+			At:       at,
+			BuildURL: out.BuildURL(),
+			Pipeline: out.BuildPipeline(),
+			Commit:   ref,
+		}
+
+		if action != out.AuditClaimed {
+			for i := len(handler.notes) - 1; i >= 0; i-- {
+				last := handler.notes[i]
+				if last.Lock != lock {
+					continue
+				}
+
+				if last.Action == out.AuditClaimed || last.Action == out.AuditTransferred {
+					note.HeldSeconds = int64(at.Sub(last.At) / time.Second)
+				}
+
+				break
+			}
+		}
+
+		handler.notes = append(handler.notes, note)
+	}
+}
+
+// recordPipeline notes which pipeline the lock went to, as the git pool's
+// commits do, or that it went to none.
+func (handler *MemoryLockHandler) recordPipeline(lock string) {
+	putLock(handler.locks, pipelinesDir, lock, []byte(out.BuildPipeline()))
+}
+
+// recordClaim puts the lock first among those the pipeline claimed, as the
+// git pool's history of claims has it.
+func (handler *MemoryLockHandler) recordClaim(lock string) {
+	pipeline := out.BuildPipeline()
+	if pipeline == "" {
+		return
+	}
+
+	claims := []string{lock}
+	for _, claimed := range strings.Fields(string(handler.locks[claimsDir][pipeline])) {
+		if claimed != lock {
+			claims = append(claims, claimed)
+		}
+	}
+
+	putLock(handler.locks, claimsDir, pipeline, []byte(strings.Join(claims, "\n")))
+}
+
+func putLock(locks map[string]map[string][]byte, state string, lock string, contents []byte) {
+	if locks[state] == nil {
+		locks[state] = map[string][]byte{}
+	}
+
+	locks[state][lock] = append([]byte(nil), contents...)
+}
+
+// schemaDir is where the pool's schema is kept, in the pool's own directory
+// rather than any of its states.
+const schemaDir = ""
+
+// pipelinesDir is where the pipeline each lock last went to is kept, outside
+// of the states as fencing tokens are.
+const pipelinesDir = ".pipelines"
+
+// claimsDir is where the locks each pipeline claimed are kept, most recent
+// first, standing in for the git pool's history of claims.
+const claimsDir = ".claims"
+
+// expiryName is where the expiry of a reservation or lease is kept, hidden
+// from the locks of the state as the git pool's dotfile is.
+func expiryName(lock string) string {
+	return "." + lock + ".expires"
+}
+
+func sortedLocks(locks map[string][]byte) []string {
+	var names []string
+	for name := range locks {
+		if !strings.HasPrefix(name, ".") {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	return names
+}
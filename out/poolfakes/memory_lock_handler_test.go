@@ -0,0 +1,434 @@
+package poolfakes_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+
+	"github.com/concourse/pool-resource/out"
+	"github.com/concourse/pool-resource/out/poolfakes"
+)
+
+var _ = Describe("MemoryLockHandler", func() {
+	var (
+		pool    *poolfakes.Pool
+		source  out.Source
+		output  *gbytes.Buffer
+		lockDir string
+	)
+
+	BeforeEach(func() {
+		pool = poolfakes.NewPool()
+		pool.Put("unclaimed", "some-lock", []byte("some-metadata"))
+
+		source = out.Source{
+			Pool:       "some-pool",
+			RetryDelay: time.Millisecond,
+		}
+
+		output = gbytes.NewBuffer()
+
+		var err error
+		lockDir, err = ioutil.TempDir("", "lock-dir")
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(lockDir)
+	})
+
+	writeLock := func(name string, metadata string) {
+		err := ioutil.WriteFile(filepath.Join(lockDir, "name"), []byte(name), 0644)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		err = ioutil.WriteFile(filepath.Join(lockDir, "metadata"), []byte(metadata), 0644)
+		Ω(err).ShouldNot(HaveOccurred())
+	}
+
+	It("acquires and releases locks through a LockPool", func() {
+		lockPool := poolfakes.NewLockPool(pool, source, output)
+
+		lock, version, err := lockPool.AcquireLock()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(lock).Should(Equal("some-lock"))
+		Ω(version.Ref).Should(Equal(pool.Head()))
+		Ω(pool.Locks("claimed")).Should(Equal([]string{"some-lock"}))
+		Ω(pool.Locks("unclaimed")).Should(BeEmpty())
+
+		writeLock("some-lock", "")
+
+		_, version, err = lockPool.ReleaseLock(lockDir)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(version.Ref).Should(Equal(pool.Head()))
+		Ω(pool.Locks("unclaimed")).Should(Equal([]string{"some-lock"}))
+
+		contents, found := pool.Contents("unclaimed", "some-lock")
+		Ω(found).Should(BeTrue())
+		Ω(string(contents)).Should(Equal("some-metadata"))
+	})
+
+	It("claims whichever lock its selector picks", func() {
+		pool.Put("unclaimed", "other-lock", []byte("other-metadata"))
+
+		handler := poolfakes.NewMemoryLockHandler(pool, source)
+		handler.Selector = out.FilteredSelector{Allow: func(lock string) bool { return lock == "other-lock" }}
+		Ω(handler.Setup()).Should(Succeed())
+
+		lock, _, err := handler.GrabAvailableLock()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(lock).Should(Equal("other-lock"))
+
+		_, _, err = handler.GrabAvailableLock()
+		Ω(err).Should(Equal(out.ErrNoLocksAvailable))
+	})
+
+	It("gives its selector the weights the locks' metadata declares", func() {
+		pool.Put("unclaimed", "heavy-lock", []byte(`{"weight": 3}`))
+
+		var weighed map[string]float64
+
+		handler := poolfakes.NewMemoryLockHandler(pool, source)
+		handler.Selector = out.SelectionFunc(func(available []string, weights map[string]float64) string {
+			weighed = weights
+			return available[0]
+		})
+		Ω(handler.Setup()).Should(Succeed())
+
+		_, _, err := handler.GrabAvailableLock()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(weighed).Should(Equal(map[string]float64{"heavy-lock": 3}))
+	})
+
+	It("prefers the lock its pipeline claimed last, with pipeline affinity", func() {
+		pool.Put("unclaimed", "other-lock", nil)
+
+		os.Setenv("BUILD_PIPELINE_NAME", "some-pipeline")
+		defer os.Unsetenv("BUILD_PIPELINE_NAME")
+
+		source.Affinity = out.AffinityPipeline
+		source.SelectionStrategy = out.SelectionDeterministic
+
+		lockPool := poolfakes.NewLockPool(pool, source, output)
+
+		_, _, err := lockPool.AcquireAnyOf([]string{"some-lock"})
+		Ω(err).ShouldNot(HaveOccurred())
+
+		writeLock("some-lock", "some-metadata")
+		_, _, err = lockPool.ReleaseLock(lockDir)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		lock, _, err := lockPool.AcquireLock()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(lock).Should(Equal("some-lock"))
+	})
+
+	It("can't squash or revert the history it doesn't keep", func() {
+		handler := poolfakes.NewMemoryLockHandler(pool, source)
+		Ω(handler.Setup()).Should(Succeed())
+
+		_, _, err := handler.SquashHistory(time.Now())
+		Ω(err).Should(Equal(poolfakes.ErrUnsupported))
+
+		_, _, err = handler.RevertCommit(pool.Head())
+		Ω(err).Should(Equal(poolfakes.ErrUnsupported))
+	})
+
+	It("claims the first available of a list of candidates", func() {
+		pool.Put("unclaimed", "lock-a", []byte("a"))
+		pool.Put("unclaimed", "lock-b", []byte("b"))
+		pool.Put("claimed", "lock-c", []byte("c"))
+
+		lockPool := poolfakes.NewLockPool(pool, source, output)
+
+		lock, _, err := lockPool.AcquireAnyOf([]string{"lock-c", "lock-b", "lock-a"})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(lock).Should(Equal("lock-b"))
+
+		lock, _, err = lockPool.AcquireAnyOf([]string{"lock-c", "lock-b", "lock-a"})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(lock).Should(Equal("lock-a"))
+
+		Ω(pool.Locks("unclaimed")).Should(Equal([]string{"some-lock"}))
+
+		lock, _, err = lockPool.AcquireLock()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(lock).Should(Equal("some-lock"))
+	})
+
+	It("claims only locks whose metadata matches a query", func() {
+		pool.Put("unclaimed", "lock-a", []byte(`{"cloud":"gcp","size":"large"}`))
+		pool.Put("unclaimed", "lock-b", []byte(`{"cloud":"aws","size":"large"}`))
+		pool.Put("unclaimed", "lock-c", []byte(`{"cloud":"aws","size":"small"}`))
+
+		lockPool := poolfakes.NewLockPool(pool, source, output)
+
+		lock, _, err := lockPool.AcquireMatching(out.MetadataQuery{"cloud": "aws", "size": "large"})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(lock).Should(Equal("lock-b"))
+		Ω(output).Should(gbytes.Say(`claiming a lock with metadata: cloud: "aws", size: "large"`))
+
+		Ω(pool.Locks("unclaimed")).Should(Equal([]string{"lock-a", "lock-c", "some-lock"}))
+	})
+
+	It("adds, disables, enables, and removes locks", func() {
+		lockPool := poolfakes.NewLockPool(pool, source, output)
+
+		writeLock("new-lock", "new-metadata")
+
+		_, _, err := lockPool.AddLock(lockDir)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pool.Locks("unclaimed")).Should(Equal([]string{"new-lock", "some-lock"}))
+
+		pool.Put("claimed", "new-lock", []byte("new-metadata"))
+
+		_, _, err = lockPool.DisableLock(lockDir)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pool.Locks("maintenance")).Should(Equal([]string{"new-lock"}))
+
+		_, _, err = lockPool.EnableLock(lockDir)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pool.Locks("unclaimed")).Should(Equal([]string{"new-lock", "some-lock"}))
+
+		pool.Put("claimed", "new-lock", []byte("new-metadata"))
+
+		_, _, err = lockPool.RemoveLock(lockDir)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pool.Locks("claimed")).Should(BeEmpty())
+		Ω(pool.Locks("unclaimed")).Should(Equal([]string{"some-lock"}))
+	})
+
+	It("releases the locks claimed by the pipeline it runs in", func() {
+		pool.Put("unclaimed", "other-lock", nil)
+
+		os.Setenv("BUILD_PIPELINE_NAME", "some-pipeline")
+		defer os.Unsetenv("BUILD_PIPELINE_NAME")
+
+		lockPool := poolfakes.NewLockPool(pool, source, output)
+
+		_, _, err := lockPool.AcquireLock()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		pool.Put("claimed", "seeded-lock", nil)
+
+		_, version, err := lockPool.ReleaseAllMine()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(version.Ref).Should(Equal(pool.Head()))
+
+		Ω(pool.Locks("claimed")).Should(Equal([]string{"seeded-lock"}))
+	})
+
+	It("checks added locks against the pool's schema", func() {
+		pool.PutSchema([]byte(`{"required": ["size"]}`))
+
+		lockPool := poolfakes.NewLockPool(pool, source, output)
+
+		writeLock("new-lock", `{"cloud":"aws"}`)
+
+		_, _, err := lockPool.AddLock(lockDir)
+		Ω(err).Should(MatchError(ContainSubstring("metadata.size is required")))
+		Ω(pool.Locks("unclaimed")).Should(Equal([]string{"some-lock"}))
+
+		pool.PutSchema(nil)
+
+		_, _, err = lockPool.AddLock(lockDir)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pool.Locks("unclaimed")).Should(Equal([]string{"new-lock", "some-lock"}))
+	})
+
+	It("keeps audit notes of claims and releases when the source asks for them", func() {
+		source.AuditNotes = true
+
+		handler := poolfakes.NewMemoryLockHandler(pool, source)
+		Ω(handler.Setup()).Should(Succeed())
+
+		lock, claimRef, err := handler.GrabAvailableLock()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		releaseRef, err := handler.UnclaimLock(lock)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(handler.BroadcastLockPool()).Should(Succeed())
+
+		reader := poolfakes.NewMemoryLockHandler(pool, source)
+		Ω(reader.Setup()).Should(Succeed())
+
+		notes, err := reader.AuditLog("some-lock")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(notes).Should(HaveLen(2))
+
+		Ω(notes[0].Action).Should(Equal(out.AuditClaimed))
+		Ω(notes[0].Commit).Should(Equal(claimRef))
+		Ω(notes[1].Action).Should(Equal(out.AuditReleased))
+		Ω(notes[1].Commit).Should(Equal(releaseRef))
+	})
+
+	It("fails to broadcast changes made to a pool that has since moved on", func() {
+		first := poolfakes.NewMemoryLockHandler(pool, source)
+		second := poolfakes.NewMemoryLockHandler(pool, source)
+
+		Ω(first.Setup()).Should(Succeed())
+		Ω(second.Setup()).Should(Succeed())
+
+		_, _, err := first.GrabAvailableLock()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		_, _, err = second.GrabAvailableLock()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(first.BroadcastLockPool()).Should(Succeed())
+		Ω(second.BroadcastLockPool()).Should(Equal(out.ErrLockConflict))
+
+		Ω(second.ResetLock()).Should(Succeed())
+
+		_, _, err = second.GrabAvailableLock()
+		Ω(err).Should(Equal(out.ErrNoLocksAvailable))
+	})
+
+	It("hands each lock to only one of several concurrent acquirers", func() {
+		pool.Put("unclaimed", "some-other-lock", nil)
+
+		acquired := make(chan string, 3)
+		for i := 0; i < 3; i++ {
+			go func() {
+				defer GinkgoRecover()
+
+				lockPool := poolfakes.NewLockPool(pool, source, output)
+				lock, _, err := lockPool.AcquireLock()
+				Ω(err).ShouldNot(HaveOccurred())
+
+				acquired <- lock
+			}()
+		}
+
+		Eventually(acquired).Should(Receive())
+		Eventually(acquired).Should(Receive())
+		Consistently(acquired, 50*time.Millisecond).ShouldNot(Receive())
+
+		Ω(pool.Locks("claimed")).Should(Equal([]string{"some-lock", "some-other-lock"}))
+	})
+
+	It("reserves locks, which lapse unless they are confirmed", func() {
+		pool.Put("unclaimed", "some-other-lock", nil)
+
+		now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+		lockPool := poolfakes.NewLockPool(pool, source, output)
+		lockPool.Now = func() time.Time { return now }
+
+		lapsing, _, err := lockPool.ReserveLock(time.Minute)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		confirmed, _, err := lockPool.ReserveLock(time.Hour)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(pool.Locks("reserved")).Should(ConsistOf(lapsing, confirmed))
+
+		writeLock(confirmed, "")
+		_, _, err = lockPool.ConfirmLock(lockDir)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(pool.Locks("claimed")).Should(Equal([]string{confirmed}))
+
+		now = now.Add(2 * time.Minute)
+
+		writeLock(lapsing, "")
+		_, _, err = lockPool.ConfirmLock(lockDir)
+		Ω(err).Should(MatchError(ContainSubstring("lapsed")))
+
+		acquired, _, err := lockPool.AcquireLock()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(acquired).Should(Equal(lapsing))
+
+		Ω(pool.Locks("reserved")).Should(BeEmpty())
+		Ω(pool.Locks("claimed")).Should(ConsistOf(lapsing, confirmed))
+	})
+
+	It("counts the claims of each lock with a fencing token", func() {
+		lockPool := poolfakes.NewLockPool(pool, source, output)
+
+		for claim := 1; claim <= 2; claim++ {
+			lock, _, err := lockPool.AcquireLock()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(lockPool.Metadata()).Should(ContainElement(out.MetadataPair{Name: "fencing_token", Value: strconv.Itoa(claim)}))
+
+			writeLock(lock, "")
+			_, _, err = lockPool.ReleaseLock(lockDir)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			lockPool = poolfakes.NewLockPool(pool, source, output)
+		}
+	})
+
+	It("reaps claims unless their leases are renewed", func() {
+		pool.Put("unclaimed", "some-other-lock", nil)
+
+		now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+		source.LeaseDuration = time.Minute
+
+		lockPool := poolfakes.NewLockPool(pool, source, output)
+		lockPool.Now = func() time.Time { return now }
+
+		renewed, _, err := lockPool.AcquireLock()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		abandoned, _, err := lockPool.AcquireLock()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		now = now.Add(45 * time.Second)
+
+		writeLock(renewed, "")
+		_, _, err = lockPool.RenewLease(lockDir)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		now = now.Add(45 * time.Second)
+
+		reclaimed, _, err := lockPool.AcquireLock()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(reclaimed).Should(Equal(abandoned))
+
+		Ω(pool.Locks("claimed")).Should(ConsistOf(renewed, reclaimed))
+		Ω(output).Should(gbytes.Say("lease of lock: %s expired", abandoned))
+	})
+
+	It("claims nothing from a paused pool until it is unpaused", func() {
+		lockPool := poolfakes.NewLockPool(pool, source, output)
+
+		_, _, err := lockPool.PausePool("upgrading the hosts")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		_, _, err = lockPool.PausePool("again")
+		Ω(err).Should(MatchError("pool some-pool is already paused"))
+
+		failFast := source
+		failFast.FailWhenPaused = true
+
+		failingPool := poolfakes.NewLockPool(pool, failFast, output)
+		_, _, err = failingPool.AcquireLock()
+		Ω(err).Should(Equal(out.ErrPoolPaused))
+
+		go func() {
+			defer GinkgoRecover()
+
+			time.Sleep(20 * time.Millisecond)
+
+			unpauser := poolfakes.NewLockPool(pool, source, gbytes.NewBuffer())
+			_, _, err := unpauser.UnpausePool()
+			Ω(err).ShouldNot(HaveOccurred())
+		}()
+
+		lock, _, err := lockPool.AcquireLock()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(lock).Should(Equal("some-lock"))
+		Ω(output).Should(gbytes.Say("pool: some-pool is paused; waiting for it to be unpaused"))
+
+		_, _, err = lockPool.UnpausePool()
+		Ω(err).Should(MatchError("pool some-pool is not paused"))
+	})
+})
@@ -0,0 +1,13 @@
+package poolfakes_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestPoolfakes(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Poolfakes Suite")
+}
@@ -0,0 +1,114 @@
+package out
+
+import (
+	"strings"
+)
+
+type PushStatus int
+
+const (
+	// PushAccepted means the remote took the update, or the output held no
+	// ref status at all, e.g. because the push never reached the remote.
+	PushAccepted PushStatus = iota
+
+	// PushUpToDate means the remote already had the commit, so another
+	// process made the identical change first.
+	PushUpToDate
+
+	// PushConflicted means the remote branch moved on since it was fetched.
+	PushConflicted
+
+	// PushRefused means the remote rejected the update for some other
+	// reason, such as a protected branch or a declined hook.
+	PushRefused
+)
+
+// atomicPushFailed is the reason given for refs an atomic push left alone
+// because another of its refs was rejected; git servers word it
+// atomicPushFailure.
+const (
+	atomicPushFailed  = "atomic push failed"
+	atomicPushFailure = "atomic push failure"
+)
+
+// conflictReasons are the reasons servers give for rejecting an update
+// because the branch changed underneath it.
+var conflictReasons = []string{
+	// git and GitHub
+	"fetch first",
+	"non-fast-forward",
+	"stale info",
+	"incorrect old value",
+
+	// GitLab and other servers built on git itself
+	"cannot lock ref",
+	"failed to update ref",
+	"atomic transaction failed",
+
+	// Gerrit and other servers built on JGit
+	"failed to lock",
+	"lock failure",
+
+	// Azure DevOps
+	"tf401028",
+	"already been updated by another client",
+}
+
+// ParsePushOutput reads the status of the push from the output of
+// `git push --porcelain`, along with the reason the server gave for
+// rejecting it, if any. When an atomic push fails, refs rejected only
+// because another ref was are passed over in favour of the ref that failed.
+//
+// Each ref is reported on a line of the form
+//
+//	<flag> TAB <from>:<to> TAB <summary> (<reason>)
+//
+// which is the same whatever the server is, unlike the human readable
+// messages servers print alongside it.
+func ParsePushOutput(output string) (PushStatus, string) {
+	atomicFailure := false
+
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 3 || len(fields[0]) != 1 {
+			continue
+		}
+
+		summary := fields[2]
+
+		reason := ""
+		if start := strings.Index(summary, "("); start != -1 {
+			reason = strings.TrimSuffix(summary[start+1:], ")")
+		}
+
+		if fields[0] == "!" && (reason == atomicPushFailed || reason == atomicPushFailure) {
+			atomicFailure = true
+			continue
+		}
+
+		switch fields[0] {
+		case "=":
+			return PushUpToDate, ""
+
+		case "!":
+			if strings.HasPrefix(summary, "[rejected]") {
+				return PushConflicted, reason
+			}
+
+			lowerReason := strings.ToLower(reason)
+			for _, conflictReason := range conflictReasons {
+				if strings.Contains(lowerReason, conflictReason) {
+					return PushConflicted, reason
+				}
+			}
+
+			return PushRefused, reason
+		}
+	}
+
+	if atomicFailure {
+		return PushRefused, atomicPushFailed
+	}
+
+	return PushAccepted, ""
+}
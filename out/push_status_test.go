@@ -0,0 +1,91 @@
+package out_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/concourse/pool-resource/out"
+)
+
+var _ = Describe("Parsing push output", func() {
+	for _, example := range []struct {
+		description string
+		output      string
+		status      out.PushStatus
+		reason      string
+	}{
+		{
+			"an accepted push",
+			"To /tmp/locks\n \tHEAD:refs/heads/master\t1a2b3c4..5d6e7f8\nDone\n",
+			out.PushAccepted, "",
+		},
+		{
+			"a push that changed nothing",
+			"To /tmp/locks\n=\tHEAD:refs/heads/master\t[up to date]\nDone\n",
+			out.PushUpToDate, "",
+		},
+		{
+			"a push that never reached the remote",
+			"ssh: Could not resolve hostname example.invalid: Name or service not known\nfatal: Could not read from remote repository.\n",
+			out.PushAccepted, "",
+		},
+		{
+			"a GitHub rejection",
+			"To github.com:example/locks.git\n!\tHEAD:refs/heads/master\t[rejected] (fetch first)\nDone\nerror: failed to push some refs to 'github.com:example/locks.git'\n",
+			out.PushConflicted, "fetch first",
+		},
+		{
+			"a GitLab rejection",
+			"To gitlab.com:example/locks.git\n!\tHEAD:refs/heads/master\t[remote rejected] (cannot lock ref 'refs/heads/master': is at 1a2b3c4 but expected 5d6e7f8)\nDone\n",
+			out.PushConflicted, "cannot lock ref 'refs/heads/master': is at 1a2b3c4 but expected 5d6e7f8",
+		},
+		{
+			"a Gerrit rejection",
+			"To ssh://gerrit.example.com:29418/locks\n!\tHEAD:refs/heads/master\t[remote rejected] (failed to lock)\nDone\n",
+			out.PushConflicted, "failed to lock",
+		},
+		{
+			"an Azure DevOps rejection",
+			"To https://dev.azure.com/example/_git/locks\n!\tHEAD:refs/heads/master\t[remote rejected] (TF401028: The reference 'refs/heads/master' has already been updated by another client, so you cannot update it. Please try again.)\nDone\n",
+			out.PushConflicted, "TF401028: The reference 'refs/heads/master' has already been updated by another client, so you cannot update it. Please try again.",
+		},
+		{
+			"a Bitbucket rejection",
+			"To bitbucket.example.com:example/locks.git\n!\tHEAD:refs/heads/master\t[remote rejected] (failed to update ref)\nDone\n",
+			out.PushConflicted, "failed to update ref",
+		},
+		{
+			"an atomic push rejected because of another ref",
+			"To github.com:example/locks.git\n!\trefs/tags/claim/some-pool/some-lock/1:refs/tags/claim/some-pool/some-lock/1\t[rejected] (atomic push failed)\n!\tHEAD:refs/heads/master\t[remote rejected] (protected branch hook declined)\nDone\n",
+			out.PushRefused, "protected branch hook declined",
+		},
+		{
+			"an atomic push that lost a race for the branch",
+			"To /tmp/locks\n!\tHEAD:refs/heads/master\t[remote rejected] (atomic transaction failed)\nDone\n",
+			out.PushConflicted, "atomic transaction failed",
+		},
+		{
+			"an atomic push that conflicted",
+			"To /tmp/locks\n!\tHEAD:refs/heads/master\t[rejected] (fetch first)\n!\trefs/tags/claim/some-pool/some-lock/1:refs/tags/claim/some-pool/some-lock/1\t[rejected] (atomic push failed)\nDone\n",
+			out.PushConflicted, "fetch first",
+		},
+		{
+			"a protected branch",
+			"To github.com:example/locks.git\n!\tHEAD:refs/heads/master\t[remote rejected] (protected branch hook declined)\nDone\n",
+			out.PushRefused, "protected branch hook declined",
+		},
+		{
+			"a Gerrit permission denial",
+			"To ssh://gerrit.example.com:29418/locks\n!\tHEAD:refs/heads/master\t[remote rejected] (prohibited by Gerrit: not permitted: update)\nDone\n",
+			out.PushRefused, "prohibited by Gerrit: not permitted: update",
+		},
+	} {
+		example := example
+
+		It("recognizes "+example.description, func() {
+			status, reason := out.ParsePushOutput(example.output)
+			Ω(status).Should(Equal(example.status))
+			Ω(reason).Should(Equal(example.reason))
+		})
+	}
+})
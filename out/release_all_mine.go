@@ -0,0 +1,69 @@
+package out
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// errNothingHeld stops the release of a pipeline's locks when it holds none.
+var errNothingHeld = errors.New("the pipeline holds no locks")
+
+// ReleaseAllMine releases every claimed lock held by the pipeline running
+// this step, in a single commit, as a safety net for pipelines whose builds
+// fan out claims and are sometimes aborted before releasing them. Having no
+// locks to release is not a failure. The version it returns names no lock.
+func (lp *LockPool) ReleaseAllMine() (string, Version, error) {
+	return lp.traced("release_all_mine", func() (string, Version, error) {
+		pipeline := BuildPipeline()
+		if pipeline == "" {
+			return "", Version{}, errors.New("releasing a pipeline's locks must be done within the pipeline, as BUILD_PIPELINE_NAME is not set")
+		}
+
+		fmt.Fprintf(lp.Output, "releasing locks held by pipeline: %s on pool: %s\n", pipeline, lp.Source.Pool)
+
+		// with nothing to release, the pool's version as it stands is
+		// returned, read while the pool is still set up
+		var head string
+
+		lock, version, err := lp.releaseLocks(func() ([]string, error) {
+			locks, err := lp.claimedByPipeline(pipeline)
+			if err == nil && len(locks) == 0 {
+				head, err = lp.LockHandler.Head()
+				if err == nil {
+					err = errNothingHeld
+				}
+			}
+
+			return locks, err
+		})
+		if err == errNothingHeld {
+			fmt.Fprintf(lp.Output, "no claimed locks to release\n")
+			return "", Version{Ref: strings.TrimSpace(head)}, nil
+		}
+
+		return lock, version, err
+	})
+}
+
+// claimedByPipeline lists the claimed locks that the pipeline holds.
+func (lp *LockPool) claimedByPipeline(pipeline string) ([]string, error) {
+	claimed, err := lp.LockHandler.ListLocks(lp.Source.Paths.Claimed)
+	if err != nil {
+		return nil, err
+	}
+
+	var held []string
+	for _, lock := range claimed {
+		holder, err := lp.LockHandler.ClaimPipeline(lock)
+		if err != nil {
+			return nil, err
+		}
+
+		if holder == pipeline {
+			held = append(held, lock)
+		}
+	}
+
+	return held, nil
+}
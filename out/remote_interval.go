@@ -0,0 +1,118 @@
+package out
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// remoteCommands are the git subcommands that talk to the remote.
+var remoteCommands = map[string]bool{
+	"clone":     true,
+	"fetch":     true,
+	"push":      true,
+	"ls-remote": true,
+}
+
+// Dozens of pipelines polling and retrying against the same small, self
+// hosted git server can overwhelm it. With source.min_remote_interval set,
+// remote git commands for the same repository are spaced at least that far
+// apart: each takes a turn by locking a file kept beside the clones, either
+// in source.cache_dir, so that every container mounting the volume takes
+// turns together, or else in the temp directory. The file records when the
+// last command started, and the next waits out the rest of the interval,
+// holding the lock so that those after it queue behind it in turn.
+
+// throttleRemote waits until a remote git command for the repository may
+// start, if args is one.
+func (glh *GitLockHandler) throttleRemote(args []string) error {
+	if glh.Source.MinRemoteInterval <= 0 || !remoteCommands[subcommand(args)] {
+		return nil
+	}
+
+	return Throttle(glh.throttlePath(), glh.Source.MinRemoteInterval, time.Now, time.Sleep)
+}
+
+// throttlePath is the file that the repository's remote commands take turns
+// by.
+func (glh *GitLockHandler) throttlePath() string {
+	dir := glh.Source.CacheDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+
+	return filepath.Join(dir, fmt.Sprintf("%s-%x.throttle", TempDirPrefix, sha1.Sum([]byte(glh.Source.URI))))
+}
+
+// Throttle waits until interval has passed since the time recorded in the
+// file, then records the current time in it. A time recorded in the future,
+// by a clock that has since been set back, is waited on for no longer than
+// interval.
+func Throttle(path string, interval time.Duration, now func() time.Time, sleep func(time.Duration)) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	err = lockFile(file, true)
+	if err != nil {
+		return err
+	}
+
+	defer unlockFile(file)
+
+	contents, err := ioutil.ReadAll(file)
+	if err != nil {
+		return err
+	}
+
+	// a file that can't be read, such as one left half written, doesn't hold
+	// anyone up
+	last, err := strconv.ParseInt(strings.TrimSpace(string(contents)), 10, 64)
+	if err == nil {
+		wait := time.Unix(0, last).Add(interval).Sub(now())
+		if wait > interval {
+			wait = interval
+		}
+
+		if wait > 0 {
+			sleep(wait)
+		}
+	}
+
+	err = file.Truncate(0)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.WriteAt([]byte(strconv.FormatInt(now().UnixNano(), 10)+"\n"), 0)
+	return err
+}
+
+// subcommand finds the git subcommand among args, after any options given
+// to git itself.
+func subcommand(args []string) string {
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "-c" || args[i] == "-C":
+			i++
+		case strings.HasPrefix(args[i], "-"):
+		default:
+			return args[i]
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,80 @@
+package out_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/concourse/pool-resource/out"
+)
+
+var _ = Describe("Throttling remote git commands", func() {
+	var (
+		dir    string
+		path   string
+		now    time.Time
+		slept  []time.Duration
+		waited func(time.Duration)
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "throttle")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		path = filepath.Join(dir, "some-repo.throttle")
+		now = time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+		slept = nil
+
+		waited = func(duration time.Duration) {
+			slept = append(slept, duration)
+			now = now.Add(duration)
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	clock := func() time.Time { return now }
+
+	It("lets the first command through straight away", func() {
+		Ω(out.Throttle(path, time.Minute, clock, waited)).Should(Succeed())
+		Ω(slept).Should(BeEmpty())
+	})
+
+	It("spaces commands at least the interval apart", func() {
+		Ω(out.Throttle(path, time.Minute, clock, waited)).Should(Succeed())
+
+		now = now.Add(20 * time.Second)
+		Ω(out.Throttle(path, time.Minute, clock, waited)).Should(Succeed())
+		Ω(slept).Should(Equal([]time.Duration{40 * time.Second}))
+
+		now = now.Add(2 * time.Minute)
+		Ω(out.Throttle(path, time.Minute, clock, waited)).Should(Succeed())
+		Ω(slept).Should(HaveLen(1))
+	})
+
+	It("waits no longer than the interval after the clock is set back", func() {
+		Ω(out.Throttle(path, time.Minute, clock, waited)).Should(Succeed())
+
+		now = now.Add(-time.Hour)
+		Ω(out.Throttle(path, time.Minute, clock, waited)).Should(Succeed())
+		Ω(slept).Should(Equal([]time.Duration{time.Minute}))
+	})
+
+	It("doesn't hold anyone up over a file it can't read", func() {
+		Ω(ioutil.WriteFile(path, []byte("garbage"), 0644)).Should(Succeed())
+
+		Ω(out.Throttle(path, time.Minute, clock, waited)).Should(Succeed())
+		Ω(slept).Should(BeEmpty())
+
+		now = now.Add(time.Second)
+		Ω(out.Throttle(path, time.Minute, clock, waited)).Should(Succeed())
+		Ω(slept).Should(Equal([]time.Duration{59 * time.Second}))
+	})
+})
@@ -0,0 +1,133 @@
+package out
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// renamedTrailer marks the commits that renamed a lock, with its new name.
+const renamedTrailer = "Renamed-To: "
+
+// RenameLock renames a lock in the given state, along with what is recorded
+// alongside it: its expiry, the build that claimed it, and its fencing token.
+func (glh *GitLockHandler) RenameLock(from string, to string, state string) (string, error) {
+	pool := glh.poolDir()
+
+	err := glh.moveFile(filepath.Join(pool, state, from), filepath.Join(pool, state, to))
+	if err != nil {
+		return "", err
+	}
+
+	records := [][2]string{
+		{glh.expiryPath(state, from), glh.expiryPath(state, to)},
+		{glh.fencingTokenPath(from), glh.fencingTokenPath(to)},
+	}
+
+	if state == glh.Source.Paths.Claimed {
+		records = append(records, [2]string{glh.buildURLPath(from), glh.buildURLPath(to)})
+	}
+
+	for _, record := range records {
+		err = glh.moveRecord(record[0], record[1])
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// the index keeps the lock as it was, only under its new name
+	glh.renamed = map[string]string{to: from}
+
+	return glh.commit("renaming", from, renamedTrailer+to)
+}
+
+// moveRecord moves a file recorded alongside a lock, if there is one.
+func (glh *GitLockHandler) moveRecord(from string, to string) error {
+	_, err := glh.readFile(from)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return glh.moveFile(from, to)
+}
+
+// RenameLock renames a lock, keeping it in the state it is in with its
+// metadata, in a single commit, so that a claimed lock stays claimed
+// throughout. The version it returns names the lock by its new name.
+func (lp *LockPool) RenameLock(from string, to string) (string, Version, error) {
+	return lp.traced("rename", func() (string, Version, error) {
+		for _, name := range []string{from, to} {
+			err := ValidateLockName(name)
+			if err != nil {
+				return "", Version{}, err
+			}
+		}
+
+		if from == to {
+			return "", Version{}, fmt.Errorf("lock %s is already called %s", from, to)
+		}
+
+		var (
+			digest  string
+			renamed *Claim
+		)
+
+		_, version, err := lp.changeLock(from, "renaming", func(lock string) (string, error) {
+			if state := lp.lockState(to); state != "" {
+				return "", fmt.Errorf("lock %s is already in pool %s, in %s", to, lp.Source.Pool, state)
+			}
+
+			state := lp.lockState(from)
+			if state == "" {
+				return "", fmt.Errorf("lock %s is not in pool %s", from, lp.Source.Pool)
+			}
+
+			ref, err := lp.LockHandler.RenameLock(from, to, state)
+			if err != nil {
+				return "", err
+			}
+
+			digest = lp.lockDigest(to)
+
+			lp.recordClaim(ref, to)
+			renamed = lp.claim
+
+			return ref, nil
+		})
+		if err != nil {
+			return "", Version{}, err
+		}
+
+		fmt.Fprintf(lp.Output, "renamed lock: %s to: %s\n", from, to)
+
+		version.Lock = to
+		version.Digest = digest
+
+		// the claim is of the lock by its new name, as the version is
+		renamed.Ref = version.Ref
+		lp.claim = renamed
+
+		return to, version, nil
+	})
+}
+
+// lockState finds the state the lock is in, or "" if the pool doesn't hold
+// it.
+func (lp *LockPool) lockState(lock string) string {
+	states := []string{lp.Source.Paths.Unclaimed, lp.Source.Paths.Claimed, lp.Source.Paths.Maintenance, lp.Source.Paths.Broken}
+	if lp.Source.Paths.Reserved != "" {
+		states = append(states, lp.Source.Paths.Reserved)
+	}
+
+	for _, state := range states {
+		if _, err := lp.LockHandler.ReadLock(state, lock); err == nil {
+			return state
+		}
+	}
+
+	return ""
+}
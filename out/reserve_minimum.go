@@ -0,0 +1,23 @@
+package out
+
+import "errors"
+
+// ErrReserveMinimum is why acquire waits while the pool has no more than
+// source.reserve_minimum unclaimed locks.
+var ErrReserveMinimum = errors.New("only the reserved minimum of unclaimed locks is left")
+
+// atReserveMinimum tells whether claiming another lock would dip into the
+// source's reserve_minimum, the unclaimed locks kept back for pipelines that
+// bypass it.
+func (lp *LockPool) atReserveMinimum() (bool, error) {
+	if lp.Source.ReserveMinimum <= 0 {
+		return false, nil
+	}
+
+	unclaimed, err := lp.LockHandler.ListLocks(lp.Source.Paths.Unclaimed)
+	if err != nil {
+		return false, err
+	}
+
+	return len(unclaimed) <= lp.Source.ReserveMinimum, nil
+}
@@ -0,0 +1,167 @@
+package out
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// RevertCommit undoes the pool's changes made by a commit of its branch, as
+// `git revert` would, on top of everything committed since. Only the pool is
+// reverted, and not all of it: fencing tokens and the lock index only ever
+// move forward, so they are left as they are, and the index is updated from
+// the locks that the revert moves. A commit whose changes were since changed
+// again can't be reverted cleanly, and isn't. It returns the full name of the
+// commit reverted.
+func (glh *GitLockHandler) RevertCommit(ref string) (string, string, error) {
+	commit, err := glh.resolveCommit(ref)
+	if err != nil {
+		return "", "", err
+	}
+
+	_, err = glh.git("rev-parse", "--verify", "--quiet", commit+"^")
+	if err != nil {
+		return "", "", fmt.Errorf("commit %s has no parent to revert to", ref)
+	}
+
+	pool := glh.treePath(glh.poolDir())
+	pathspecs := []string{
+		pool,
+		":(exclude)" + glh.treePath(filepath.Join(glh.poolDir(), FencingDir)),
+		":(exclude)" + glh.treePath(glh.lockIndexPath()),
+	}
+
+	patch, err := glh.git(append([]string{"diff", "--binary", "--full-index", commit, commit + "^", "--"}, pathspecs...)...)
+	if err != nil {
+		return "", "", err
+	}
+
+	if len(patch) == 0 {
+		return "", "", fmt.Errorf("commit %s changes nothing in pool %s", ref, glh.Source.Pool)
+	}
+
+	if glh.Source.Bare {
+		err = glh.applyBarePatch(patch)
+	} else {
+		err = glh.applyPatch(patch)
+	}
+
+	if err != nil {
+		return "", "", fmt.Errorf("commit %s can't be reverted cleanly, as the pool has changed since: %s", ref, err)
+	}
+
+	output, err := glh.git("log", "-1", "--format=%s", commit)
+	if err != nil {
+		return "", "", err
+	}
+
+	body := fmt.Sprintf("This reverts commit %s, %q.", commit, strings.TrimSpace(string(output)))
+
+	version, err := glh.commit("reverting", commit, body)
+	if err != nil {
+		return "", "", err
+	}
+
+	return version, commit, nil
+}
+
+// resolveCommit finds the commit ref names in the history of the branch,
+// fetching what clone_since left out of the clone if need be.
+func (glh *GitLockHandler) resolveCommit(ref string) (string, error) {
+	output, err := glh.git("rev-parse", "--verify", "--quiet", ref+"^{commit}")
+	if err != nil {
+		err = glh.unshallow()
+		if err != nil {
+			return "", err
+		}
+
+		output, err = glh.git("rev-parse", "--verify", "--quiet", ref+"^{commit}")
+	}
+
+	commit := strings.TrimSpace(string(output))
+
+	if err == nil {
+		_, err = glh.git("merge-base", "--is-ancestor", commit, "HEAD")
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("commit %s is not in the history of branch %s", ref, glh.branch)
+	}
+
+	return commit, nil
+}
+
+// applyPatch applies the patch to the index and the working tree.
+func (glh *GitLockHandler) applyPatch(patch []byte) error {
+	// merging the patch in writes objects into the store shared with the
+	// clone's other worktrees
+	unlock, err := glh.lockSharedClone()
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	_, err = glh.runWithInput(glh.repoDir, patch, []string{"apply", "--index", "--3way"})
+	return err
+}
+
+// applyBarePatch applies the patch to the staged tree, by way of an index of
+// its own, as a bare clone has none.
+func (glh *GitLockHandler) applyBarePatch(patch []byte) error {
+	index, err := ioutil.TempFile("", TempDirPrefix+"-index")
+	if err != nil {
+		return err
+	}
+
+	index.Close()
+	os.Remove(index.Name())
+
+	defer os.Remove(index.Name())
+
+	env := "GIT_INDEX_FILE=" + index.Name()
+
+	_, err = glh.run(glh.repoDir, []string{"read-tree", glh.tree}, env)
+	if err != nil {
+		return err
+	}
+
+	_, err = glh.runWithInput(glh.repoDir, patch, []string{"apply", "--cached", "--3way"}, env)
+	if err != nil {
+		return err
+	}
+
+	output, err := glh.run(glh.repoDir, []string{"write-tree"}, env)
+	if err != nil {
+		return err
+	}
+
+	glh.tree = strings.TrimSpace(string(output))
+
+	return nil
+}
+
+// RevertCommit reverts the changes a commit of the pool's branch made to the
+// pool, in a new commit, for undoing a mistake such as a bad bulk change. The
+// version it returns names no lock.
+func (lp *LockPool) RevertCommit(ref string) (string, Version, error) {
+	return lp.traced("revert", func() (string, Version, error) {
+		var reverted string
+
+		lock, version, err := lp.changePool("reverting", func() (string, error) {
+			version, commit, err := lp.LockHandler.RevertCommit(ref)
+			reverted = commit
+			return version, err
+		})
+		if err != nil {
+			return "", Version{}, err
+		}
+
+		fmt.Fprintf(lp.Output, "reverted commit: %s\n", reverted)
+		lp.addMetadata("reverted_commit", reverted)
+
+		return lock, version, nil
+	})
+}
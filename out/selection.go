@@ -0,0 +1,172 @@
+package out
+
+import (
+	"encoding/json"
+	"math/rand"
+	"sort"
+)
+
+const (
+	SelectionRandom               = "random"
+	SelectionDeterministic        = "deterministic"
+	SelectionLeastRecentlyClaimed = "least_recently_claimed"
+)
+
+// Selector picks the lock to claim from the available ones. It is only
+// asked when at least one lock is available, and weights holds the weight
+// each lock's metadata declares, if any do. Returning "" claims nothing, as
+// if no lock were available.
+type Selector interface {
+	Select(available []string, weights map[string]float64) string
+}
+
+// MetadataWeight reads the weight a lock's metadata declares, if the metadata
+// is a JSON object with a numeric "weight".
+func MetadataWeight(metadata []byte) (float64, bool) {
+	var fields struct {
+		Weight *float64 `json:"weight"`
+	}
+
+	if json.Unmarshal(metadata, &fields) != nil || fields.Weight == nil {
+		return 0, false
+	}
+
+	return *fields.Weight, true
+}
+
+// SelectionFunc adapts a plain function to a Selector.
+type SelectionFunc func(available []string, weights map[string]float64) string
+
+func (f SelectionFunc) Select(available []string, weights map[string]float64) string {
+	return f(available, weights)
+}
+
+// RandomSelector picks evenly among the available locks, whatever they weigh.
+type RandomSelector struct{}
+
+func (RandomSelector) Select(available []string, weights map[string]float64) string {
+	return available[rand.Intn(len(available))]
+}
+
+// WeightedSelector picks randomly in proportion to the locks' weights; see
+// SelectRandomly.
+type WeightedSelector struct{}
+
+func (WeightedSelector) Select(available []string, weights map[string]float64) string {
+	return SelectRandomly(available, weights)
+}
+
+// FIFOSelector hands out the lock released longest ago first; see
+// SelectLeastRecentlyReleased. ReleasedAt is asked afresh for each selection.
+type FIFOSelector struct {
+	ReleasedAt func() map[string]int64
+}
+
+func (s FIFOSelector) Select(available []string, weights map[string]float64) string {
+	return SelectLeastRecentlyReleased(s.ReleasedAt())(available, weights)
+}
+
+// FilteredSelector only lets Next pick among the locks Allow accepts,
+// claiming nothing if it accepts none of them. Next defaults to a
+// WeightedSelector.
+type FilteredSelector struct {
+	Allow func(lock string) bool
+	Next  Selector
+}
+
+func (s FilteredSelector) Select(available []string, weights map[string]float64) string {
+	allowed := []string{}
+	for _, lock := range available {
+		if s.Allow(lock) {
+			allowed = append(allowed, lock)
+		}
+	}
+
+	if len(allowed) == 0 {
+		return ""
+	}
+
+	next := s.Next
+	if next == nil {
+		next = WeightedSelector{}
+	}
+
+	return next.Select(allowed, weights)
+}
+
+// SelectRandomly spreads claims across the pool in proportion to the locks'
+// weights. Locks without a weight count as 1, and if every lock weighs
+// nothing they are picked from evenly.
+func SelectRandomly(available []string, weights map[string]float64) string {
+	total := 0.0
+	for _, lock := range available {
+		total += weightOf(weights, lock)
+	}
+
+	if total <= 0 {
+		return available[rand.Intn(len(available))]
+	}
+
+	target := rand.Float64() * total
+	for _, lock := range available {
+		target -= weightOf(weights, lock)
+		if target < 0 {
+			return lock
+		}
+	}
+
+	return available[len(available)-1]
+}
+
+func weightOf(weights map[string]float64, lock string) float64 {
+	weight, found := weights[lock]
+	if !found {
+		return 1
+	}
+
+	if weight < 0 {
+		return 0
+	}
+
+	return weight
+}
+
+// SelectDeterministically always picks the lexically first lock, so that
+// claims are reproducible.
+func SelectDeterministically(available []string, weights map[string]float64) string {
+	sorted := append([]string{}, available...)
+	sort.Strings(sorted)
+
+	return sorted[0]
+}
+
+// SelectLeastRecentlyReleased picks the lock released longest ago, given when
+// each was last released. Locks that have never been released go first, and
+// ties go to the lexically first lock.
+func SelectLeastRecentlyReleased(releasedAt map[string]int64) SelectionFunc {
+	return func(available []string, weights map[string]float64) string {
+		sorted := append([]string{}, available...)
+		sort.Strings(sorted)
+
+		selected := sorted[0]
+		for _, lock := range sorted[1:] {
+			if releasedAt[lock] < releasedAt[selected] {
+				selected = lock
+			}
+		}
+
+		return selected
+	}
+}
+
+// SelectorFor returns the selector for a source.selection_strategy; anything
+// unrecognized selects randomly. Selecting the least recently claimed lock
+// needs the pool's history, so GitLockHandler provides that itself.
+func SelectorFor(strategy string) Selector {
+	switch strategy {
+	case SelectionDeterministic:
+		return SelectionFunc(SelectDeterministically)
+	default:
+		return WeightedSelector{}
+	}
+}
@@ -0,0 +1,109 @@
+package out_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/concourse/pool-resource/out"
+)
+
+var _ = Describe("Selecting a lock", func() {
+	available := []string{"lock-c", "lock-a", "lock-b"}
+
+	It("selects the lexically first lock deterministically", func() {
+		Ω(out.SelectDeterministically(available, nil)).Should(Equal("lock-a"))
+		Ω(available).Should(Equal([]string{"lock-c", "lock-a", "lock-b"}))
+	})
+
+	It("selects any of the locks randomly", func() {
+		selected := map[string]bool{}
+		for i := 0; i < 100; i++ {
+			selected[out.SelectRandomly(available, nil)] = true
+		}
+
+		Ω(selected).Should(HaveLen(3))
+	})
+
+	It("selects randomly in proportion to the locks' weights", func() {
+		weights := map[string]float64{"lock-a": 8, "lock-b": 0}
+
+		selected := map[string]int{}
+		for i := 0; i < 1000; i++ {
+			selected[out.SelectRandomly(available, weights)]++
+		}
+
+		Ω(selected["lock-b"]).Should(BeZero())
+		Ω(selected["lock-a"]).Should(BeNumerically(">", 4*selected["lock-c"]))
+	})
+
+	It("selects evenly when no lock weighs anything", func() {
+		weights := map[string]float64{"lock-a": 0, "lock-b": 0, "lock-c": -1}
+
+		selected := map[string]bool{}
+		for i := 0; i < 100; i++ {
+			selected[out.SelectRandomly(available, weights)] = true
+		}
+
+		Ω(selected).Should(HaveLen(3))
+	})
+
+	It("selects the lock released longest ago", func() {
+		selectLock := out.SelectLeastRecentlyReleased(map[string]int64{"lock-a": 300, "lock-b": 100, "lock-c": 200})
+		Ω(selectLock(available, nil)).Should(Equal("lock-b"))
+	})
+
+	It("selects locks that were never released first", func() {
+		selectLock := out.SelectLeastRecentlyReleased(map[string]int64{"lock-a": 300})
+		Ω(selectLock(available, nil)).Should(Equal("lock-b"))
+	})
+
+	It("chooses the selector for a strategy", func() {
+		Ω(out.SelectorFor(out.SelectionDeterministic).Select(available, nil)).Should(Equal("lock-a"))
+		Ω(out.SelectorFor("")).Should(Equal(out.WeightedSelector{}))
+	})
+
+	It("selects evenly whatever the locks weigh", func() {
+		weights := map[string]float64{"lock-a": 0, "lock-b": 0}
+
+		selected := map[string]bool{}
+		for i := 0; i < 100; i++ {
+			selected[out.RandomSelector{}.Select(available, weights)] = true
+		}
+
+		Ω(selected).Should(HaveLen(3))
+	})
+
+	It("selects by weight", func() {
+		weights := map[string]float64{"lock-a": 1, "lock-b": 0, "lock-c": 0}
+		Ω(out.WeightedSelector{}.Select(available, weights)).Should(Equal("lock-a"))
+	})
+
+	It("asks for the release times on every selection first in, first out", func() {
+		releasedAt := map[string]int64{"lock-a": 300, "lock-b": 100, "lock-c": 200}
+		selector := out.FIFOSelector{ReleasedAt: func() map[string]int64 { return releasedAt }}
+
+		Ω(selector.Select(available, nil)).Should(Equal("lock-b"))
+
+		releasedAt["lock-b"] = 400
+		Ω(selector.Select(available, nil)).Should(Equal("lock-c"))
+	})
+
+	Context("filtering the locks", func() {
+		notA := func(lock string) bool { return lock != "lock-a" }
+
+		It("only lets the next selector pick among the allowed locks", func() {
+			selector := out.FilteredSelector{Allow: notA, Next: out.SelectionFunc(out.SelectDeterministically)}
+			Ω(selector.Select(available, nil)).Should(Equal("lock-b"))
+		})
+
+		It("selects by weight when given no next selector", func() {
+			weights := map[string]float64{"lock-c": 0}
+			Ω(out.FilteredSelector{Allow: notA}.Select(available, weights)).Should(Equal("lock-b"))
+		})
+
+		It("selects nothing when no lock is allowed", func() {
+			selector := out.FilteredSelector{Allow: func(string) bool { return false }}
+			Ω(selector.Select(available, nil)).Should(BeEmpty())
+		})
+	})
+})
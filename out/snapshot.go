@@ -0,0 +1,257 @@
+package out
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// SnapshotStates are the states whose locks are included in a snapshot, in
+// the order they are exported.
+var SnapshotStates = []string{"unclaimed", "claimed", "reserved", "maintenance", "broken"}
+
+// ClaimInfo describes the last claim of a lock.
+type ClaimInfo struct {
+	At time.Time
+	By string
+}
+
+// ClaimInfoReader is implemented by LockHandlers that can tell when, and by
+// whom, a lock was claimed, which is then included in snapshots.
+type ClaimInfoReader interface {
+	ClaimInfo(lock string) (ClaimInfo, error)
+}
+
+// Snapshot is every lock of a pool, as a single document that can be
+// restored into a pool in another repository or backend.
+type Snapshot struct {
+	Pool    string         `json:"pool"`
+	TakenAt time.Time      `json:"taken_at"`
+	Locks   []SnapshotLock `json:"locks"`
+}
+
+// SnapshotLock is a lock in a Snapshot. State is one of SnapshotStates,
+// rather than the path the pool keeps it in.
+type SnapshotLock struct {
+	Name         string     `json:"name"`
+	State        string     `json:"state"`
+	Metadata     []byte     `json:"metadata"`
+	FencingToken int        `json:"fencing_token,omitempty"`
+	Expires      *time.Time `json:"expires,omitempty"`
+	ClaimedAt    *time.Time `json:"claimed_at,omitempty"`
+	ClaimedBy    string     `json:"claimed_by,omitempty"`
+}
+
+func snapshotPaths(source Source) map[string]string {
+	paths := statePaths(source)
+	paths["reserved"] = source.Paths.Reserved
+	return paths
+}
+
+// ExportSnapshot reads every lock of the pool the handler manages.
+func ExportSnapshot(handler LockHandler, source Source) (Snapshot, error) {
+	snapshot := Snapshot{Pool: source.Pool, TakenAt: time.Now().UTC(), Locks: []SnapshotLock{}}
+
+	err := handler.Setup()
+	if err != nil {
+		return snapshot, fmt.Errorf("setting up %s: %s", source.Pool, err)
+	}
+
+	defer handler.Cleanup()
+
+	// the index, if the pool keeps one, saves walking the history for each
+	// claim
+	var index LockIndex
+	if reader, ok := handler.(LockIndexReader); ok {
+		index, _, err = reader.ReadLockIndex()
+		if err != nil {
+			return snapshot, err
+		}
+	}
+
+	paths := snapshotPaths(source)
+	for _, state := range SnapshotStates {
+		locks, err := handler.ListLocks(paths[state])
+		if err != nil {
+			return snapshot, err
+		}
+
+		for _, name := range locks {
+			lock, err := exportLock(handler, index, paths[state], state, name)
+			if err != nil {
+				return snapshot, err
+			}
+
+			snapshot.Locks = append(snapshot.Locks, lock)
+		}
+	}
+
+	return snapshot, nil
+}
+
+func exportLock(handler LockHandler, index LockIndex, path string, state string, name string) (SnapshotLock, error) {
+	lock := SnapshotLock{Name: name, State: state}
+
+	var err error
+	lock.Metadata, err = handler.ReadLock(path, name)
+	if err != nil {
+		return lock, err
+	}
+
+	var expires time.Time
+	lock.FencingToken, expires, err = readRecords(handler, state, name)
+	if err != nil {
+		return lock, err
+	}
+
+	if !expires.IsZero() {
+		lock.Expires = &expires
+	}
+
+	if entry, found := index.Locks[name]; found && entry.State == "claimed" && state == "claimed" {
+		if entry.Since != nil {
+			lock.ClaimedAt = entry.Since
+			lock.ClaimedBy = entry.Claimer
+		}
+	} else if reader, ok := handler.(ClaimInfoReader); ok && state == "claimed" {
+		info, err := reader.ClaimInfo(name)
+		if err != nil {
+			return lock, err
+		}
+
+		if !info.At.IsZero() {
+			lock.ClaimedAt = &info.At
+			lock.ClaimedBy = info.By
+		}
+	}
+
+	return lock, nil
+}
+
+// readRecords reads what is recorded alongside a lock in the given state: its
+// fencing token, and when its lease or reservation expires.
+func readRecords(handler LockHandler, state string, name string) (int, time.Time, error) {
+	token, err := handler.FencingToken(name)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	var expires time.Time
+	switch state {
+	case "claimed":
+		expires, err = handler.LeaseExpiry(name)
+	case "reserved":
+		expires, err = handler.ReservationExpiry(name)
+	}
+
+	return token, expires, err
+}
+
+// writeRecords stages what is recorded alongside a lock, to be committed
+// along with it.
+func writeRecords(handler LockHandler, path string, name string, token int, expires time.Time) error {
+	if token > 0 {
+		err := handler.WriteFencingToken(name, token)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !expires.IsZero() {
+		err := handler.WriteExpiry(path, name, expires)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ImportSnapshot restores every lock of the snapshot, in its state, into the
+// pool the handler manages, retrying if it conflicts with another change. The
+// pool must not already hold any of the locks being restored.
+func ImportSnapshot(handler LockHandler, source Source, snapshot Snapshot, output io.Writer) error {
+	paths := snapshotPaths(source)
+	for _, lock := range snapshot.Locks {
+		if _, found := paths[lock.State]; !found {
+			return fmt.Errorf("lock %s has an unknown state: %s", lock.Name, lock.State)
+		}
+
+		err := ValidateLockName(lock.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := handler.Setup()
+	if err != nil {
+		return fmt.Errorf("setting up %s: %s", source.Pool, err)
+	}
+
+	defer handler.Cleanup()
+
+	for {
+		err = handler.ResetLock()
+		if err != nil {
+			return err
+		}
+
+		err = importLocks(handler, source, snapshot, output)
+		if err != nil {
+			return err
+		}
+
+		err = handler.BroadcastLockPool()
+		if err == nil {
+			return nil
+		}
+
+		if !IsRetryable(err) {
+			return err
+		}
+
+		fmt.Fprintf(output, "failed to broadcast the imported locks! (err: %s) retrying...\n", err)
+		time.Sleep(source.RetryDelay)
+	}
+}
+
+func importLocks(handler LockHandler, source Source, snapshot Snapshot, output io.Writer) error {
+	paths := snapshotPaths(source)
+
+	existing := map[string]bool{}
+	for _, state := range SnapshotStates {
+		locks, err := handler.ListLocks(paths[state])
+		if err != nil {
+			return err
+		}
+
+		for _, lock := range locks {
+			existing[lock] = true
+		}
+	}
+
+	for _, lock := range snapshot.Locks {
+		if existing[lock.Name] {
+			return fmt.Errorf("lock %s is already in %s", lock.Name, source.Pool)
+		}
+
+		fmt.Fprintf(output, "importing %s lock: %s\n", lock.State, lock.Name)
+
+		var expires time.Time
+		if lock.Expires != nil {
+			expires = *lock.Expires
+		}
+
+		err := writeRecords(handler, paths[lock.State], lock.Name, lock.FencingToken, expires)
+		if err != nil {
+			return err
+		}
+
+		_, err = handler.ImportLock(paths[lock.State], lock.Name, lock.Metadata)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
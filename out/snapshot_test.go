@@ -0,0 +1,117 @@
+package out_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+
+	"github.com/concourse/pool-resource/out"
+	"github.com/concourse/pool-resource/out/poolfakes"
+)
+
+var _ = Describe("Snapshots", func() {
+	var (
+		fromPool   *poolfakes.Pool
+		toPool     *poolfakes.Pool
+		fromSource out.Source
+		toSource   out.Source
+		output     *gbytes.Buffer
+		expires    time.Time
+	)
+
+	BeforeEach(func() {
+		expires = time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+
+		fromPool = poolfakes.NewPool()
+		fromPool.Put("unclaimed", "lock-a", []byte("metadata-a"))
+		fromPool.Put("broken", "lock-c", []byte("metadata-c"))
+		fromPool.Put("reserved", "lock-r", []byte("metadata-r"))
+		fromPool.Put("reserved", ".lock-r.expires", []byte(expires.Format(time.RFC3339)))
+		fromPool.Put(out.FencingDir, "lock-b", []byte("3"))
+		fromPool.Put("claimed", "lock-b", []byte("metadata-b"))
+
+		toPool = poolfakes.NewPool()
+
+		fromSource = out.Source{Pool: "old-pool", RetryDelay: time.Millisecond}.WithDefaults()
+		toSource = out.Source{Pool: "new-pool", RetryDelay: time.Millisecond}.WithDefaults()
+
+		output = gbytes.NewBuffer()
+	})
+
+	export := func() out.Snapshot {
+		snapshot, err := out.ExportSnapshot(poolfakes.NewMemoryLockHandler(fromPool, fromSource), fromSource)
+		Ω(err).ShouldNot(HaveOccurred())
+		return snapshot
+	}
+
+	restore := func(snapshot out.Snapshot) error {
+		return out.ImportSnapshot(poolfakes.NewMemoryLockHandler(toPool, toSource), toSource, snapshot, output)
+	}
+
+	It("exports every lock with its state, metadata, fencing token and expiry", func() {
+		snapshot := export()
+
+		Ω(snapshot.Pool).Should(Equal("old-pool"))
+		Ω(snapshot.Locks).Should(Equal([]out.SnapshotLock{
+			{Name: "lock-a", State: "unclaimed", Metadata: []byte("metadata-a")},
+			{Name: "lock-b", State: "claimed", Metadata: []byte("metadata-b"), FencingToken: 3},
+			{Name: "lock-r", State: "reserved", Metadata: []byte("metadata-r"), Expires: &expires},
+			{Name: "lock-c", State: "broken", Metadata: []byte("metadata-c")},
+		}))
+	})
+
+	It("imports a snapshot into another pool", func() {
+		err := restore(export())
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(toPool.Locks("unclaimed")).Should(Equal([]string{"lock-a"}))
+		Ω(toPool.Locks("claimed")).Should(Equal([]string{"lock-b"}))
+		Ω(toPool.Locks("reserved")).Should(Equal([]string{"lock-r"}))
+		Ω(toPool.Locks("broken")).Should(Equal([]string{"lock-c"}))
+
+		contents, found := toPool.Contents("claimed", "lock-b")
+		Ω(found).Should(BeTrue())
+		Ω(string(contents)).Should(Equal("metadata-b"))
+
+		Ω(output).Should(gbytes.Say("importing claimed lock: lock-b"))
+	})
+
+	It("restores fencing tokens and expiries, so that they round trip", func() {
+		snapshot := export()
+
+		err := restore(snapshot)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		restored, err := out.ExportSnapshot(poolfakes.NewMemoryLockHandler(toPool, toSource), toSource)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(restored.Locks).Should(Equal(snapshot.Locks))
+	})
+
+	It("maps states onto the destination's paths", func() {
+		toSource.Paths.Claimed = "in-use"
+
+		err := restore(export())
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(toPool.Locks("in-use")).Should(Equal([]string{"lock-b"}))
+		Ω(toPool.Locks("claimed")).Should(BeEmpty())
+	})
+
+	It("refuses to overwrite a lock the destination already has", func() {
+		toPool.Put("maintenance", "lock-a", []byte("other-metadata"))
+		head := toPool.Head()
+
+		err := restore(export())
+		Ω(err).Should(MatchError("lock lock-a is already in new-pool"))
+
+		Ω(toPool.Head()).Should(Equal(head))
+	})
+
+	It("refuses a lock in an unknown state", func() {
+		err := restore(out.Snapshot{Locks: []out.SnapshotLock{{Name: "lock-a", State: "lost"}}})
+		Ω(err).Should(MatchError("lock lock-a has an unknown state: lost"))
+	})
+})
@@ -0,0 +1,125 @@
+package out
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// sshEnv points git at ssh with the source's port and host key settings,
+// keeping any ssh command the environment already gives, such as one the
+// image configures. Options given to ssh itself take precedence over its
+// config files, so pinned host keys can't be undone by the image's.
+func (glh *GitLockHandler) sshEnv() []string {
+	var options []string
+
+	if glh.knownHosts != "" {
+		options = append(options, "-o UserKnownHostsFile="+glh.knownHosts)
+	}
+
+	if checking := glh.Source.HostKeyChecking(); checking != "" {
+		// a rejected host key is otherwise failed silently
+		options = append(options, "-o StrictHostKeyChecking="+checking, "-o LogLevel=ERROR")
+	}
+
+	if glh.Source.Port != 0 {
+		options = append(options, fmt.Sprintf("-p %d", glh.Source.Port))
+	}
+
+	if len(options) == 0 {
+		return nil
+	}
+
+	command := os.Getenv("GIT_SSH_COMMAND")
+	if command == "" {
+		command = "ssh"
+	}
+
+	return []string{"GIT_SSH_COMMAND=" + command + " " + strings.Join(options, " ")}
+}
+
+// setupKnownHosts writes source.known_hosts to a file for ssh to verify the
+// remotes' host keys against.
+func (glh *GitLockHandler) setupKnownHosts() error {
+	if glh.Source.KnownHosts == "" {
+		return nil
+	}
+
+	file, err := ioutil.TempFile("", TempDirPrefix+"-known-hosts")
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	glh.knownHosts = file.Name()
+
+	_, err = file.WriteString(strings.TrimRight(glh.Source.KnownHosts, "\n") + "\n")
+	return err
+}
+
+// uriPort returns the port a URL-style uri such as
+// ssh://git@host:7999/org/repo.git names, and whether it is an SSH uri. A
+// scp-like uri, git@host:org/repo.git, is SSH but cannot name a port; a local
+// path is neither.
+func uriPort(uri string) (port string, ssh bool) {
+	if !strings.Contains(uri, "://") {
+		return "", !strings.HasPrefix(uri, "/") && strings.Contains(strings.SplitN(uri, "/", 2)[0], ":")
+	}
+
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return "", false
+	}
+
+	switch parsed.Scheme {
+	case "ssh", "git+ssh", "ssh+git":
+		return parsed.Port(), true
+	}
+
+	return "", false
+}
+
+// validateHostKeyChecking checks that source.strict_host_key_checking is a
+// setting that doesn't need someone to answer ssh's questions.
+func (source Source) validateHostKeyChecking() []string {
+	switch source.StrictHostKeyChecking {
+	case "", "yes", "no", "accept-new":
+		return nil
+	}
+
+	return []string{fmt.Sprintf("source.strict_host_key_checking %q must be yes, no, or accept-new", source.StrictHostKeyChecking)}
+}
+
+// validatePort checks that source.port is a port, that it is only given for
+// SSH remotes, and that it agrees with any port the remotes' uris name, which
+// ssh would otherwise quietly ignore in favour of source.port.
+func (source Source) validatePort() []string {
+	if source.Port == 0 {
+		return nil
+	}
+
+	if source.Port < 0 || source.Port > 65535 {
+		return []string{"source.port must be between 1 and 65535"}
+	}
+
+	var problems []string
+
+	remotes := [][2]string{{"source.uri", source.URI}, {"source.mirror_uri", source.MirrorURI}, {"source.check_uri", source.CheckURI}}
+	for _, remote := range remotes {
+		if remote[1] == "" {
+			continue
+		}
+
+		port, ssh := uriPort(remote[1])
+		if !ssh {
+			problems = append(problems, fmt.Sprintf("source.port only applies to SSH remotes, which %s is not", remote[0]))
+		} else if port != "" && port != fmt.Sprint(source.Port) {
+			problems = append(problems, fmt.Sprintf("source.port %d conflicts with port %s in %s", source.Port, port, remote[0]))
+		}
+	}
+
+	return problems
+}
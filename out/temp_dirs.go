@@ -0,0 +1,97 @@
+package out
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const TempDirPrefix = "pool-resource"
+
+const DefaultStaleTempDirAge = 24 * time.Hour
+
+// SweepStaleTempDirs removes clones left behind in dir by previous runs that
+// were killed before they could clean up after themselves. Only directories
+// whose name starts with TempDirPrefix, that have not been modified for at
+// least maxAge, and that no running process holds with HoldTempDir are
+// removed, so every directory made with the prefix must be held while it is
+// in use. Temp files are never swept.
+func SweepStaleTempDirs(dir string, maxAge time.Duration) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	cutoff := time.Now().Add(-maxAge)
+
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), TempDirPrefix) {
+			continue
+		}
+
+		if entry.ModTime().After(cutoff) {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+
+		swept, err := sweepTempDir(path)
+		if err != nil {
+			return removed, err
+		}
+
+		if swept {
+			removed = append(removed, path)
+		}
+	}
+
+	return removed, nil
+}
+
+// sweepTempDir removes the directory unless it is held. It is locked while
+// it is removed, so that it can't be taken up again halfway through.
+func sweepTempDir(path string) (bool, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	defer file.Close()
+
+	locked, err := tryLockFile(file)
+	if !locked || err != nil {
+		return false, err
+	}
+
+	return true, os.RemoveAll(path)
+}
+
+// HoldTempDir marks a temp dir as in use until the returned function is
+// called, so that SweepStaleTempDirs leaves it alone however long it goes
+// unmodified, e.g. while an operation waits its turn on a contended pool. The
+// mark is a lock on the directory itself, which the sweep of any process, in
+// this container or in others sharing the temp dir, sees, and which goes away
+// with the process holding it.
+func HoldTempDir(dir string) (func(), error) {
+	file, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	err = lockFile(file, false)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return func() {
+		unlockFile(file)
+		file.Close()
+	}, nil
+}
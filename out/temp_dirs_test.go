@@ -0,0 +1,73 @@
+package out_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/concourse/pool-resource/out"
+)
+
+var _ = Describe("Sweeping stale temp dirs", func() {
+	var tmpDir string
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "sweep-root")
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		err := os.RemoveAll(tmpDir)
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	makeDir := func(name string, age time.Duration) string {
+		path := filepath.Join(tmpDir, name)
+
+		err := os.Mkdir(path, 0755)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		modTime := time.Now().Add(-age)
+		err = os.Chtimes(path, modTime, modTime)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		return path
+	}
+
+	It("removes only old pool-resource dirs", func() {
+		stale := makeDir("pool-resource123", 2*time.Hour)
+		fresh := makeDir("pool-resource456", time.Minute)
+		unrelated := makeDir("something-else", 2*time.Hour)
+
+		removed, err := out.SweepStaleTempDirs(tmpDir, time.Hour)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(removed).Should(Equal([]string{stale}))
+
+		Ω(stale).ShouldNot(BeADirectory())
+		Ω(fresh).Should(BeADirectory())
+		Ω(unrelated).Should(BeADirectory())
+	})
+
+	It("leaves old dirs that are still in use", func() {
+		inUse := makeDir("pool-resource789", 2*time.Hour)
+
+		release, err := out.HoldTempDir(inUse)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		removed, err := out.SweepStaleTempDirs(tmpDir, time.Hour)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(removed).Should(BeEmpty())
+		Ω(inUse).Should(BeADirectory())
+
+		release()
+
+		removed, err = out.SweepStaleTempDirs(tmpDir, time.Hour)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(removed).Should(Equal([]string{inUse}))
+	})
+})
@@ -0,0 +1,361 @@
+package out
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TracingConfig configures exporting spans for lock operations over OTLP/HTTP.
+// Anything left unset falls back to the standard OTEL_* environment variables.
+type TracingConfig struct {
+	Endpoint    string            `json:"endpoint"`
+	Headers     map[string]string `json:"headers"`
+	ServiceName string            `json:"service_name"`
+}
+
+// Tracer records spans in memory and exports them in one request on Flush.
+// A nil *Tracer is valid and records nothing.
+type Tracer struct {
+	endpoint    string
+	headers     map[string]string
+	serviceName string
+
+	traceID      string
+	parentSpanID string
+
+	lock  sync.Mutex
+	spans []*Span
+}
+
+// NewTracer returns nil, disabling tracing, when no endpoint is configured.
+func NewTracer(config TracingConfig) *Tracer {
+	endpoint := config.Endpoint
+	if endpoint == "" {
+		endpoint = os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	}
+
+	if endpoint == "" && os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" {
+		endpoint = strings.TrimSuffix(os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "/") + "/v1/traces"
+	}
+
+	if endpoint == "" {
+		return nil
+	}
+
+	headers := parseOTLPHeaders(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"))
+	for name, value := range config.Headers {
+		headers[name] = value
+	}
+
+	serviceName := config.ServiceName
+	if serviceName == "" {
+		serviceName = os.Getenv("OTEL_SERVICE_NAME")
+	}
+
+	if serviceName == "" {
+		serviceName = "pool-resource"
+	}
+
+	tracer := &Tracer{
+		endpoint:    endpoint,
+		headers:     headers,
+		serviceName: serviceName,
+		traceID:     randomHex(16),
+	}
+
+	// join the pipeline's trace when the caller propagates one
+	traceParent := strings.Split(os.Getenv("TRACEPARENT"), "-")
+	if len(traceParent) == 4 && len(traceParent[1]) == 32 && len(traceParent[2]) == 16 {
+		tracer.traceID = traceParent[1]
+		tracer.parentSpanID = traceParent[2]
+	}
+
+	return tracer
+}
+
+func parseOTLPHeaders(value string) map[string]string {
+	headers := map[string]string{}
+
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) == 2 {
+			headers[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+	}
+
+	return headers
+}
+
+func (t *Tracer) StartSpan(name string) *Span {
+	if t == nil {
+		return nil
+	}
+
+	return t.start(name, t.parentSpanID)
+}
+
+func (t *Tracer) start(name string, parentSpanID string) *Span {
+	span := &Span{
+		tracer:       t,
+		name:         name,
+		spanID:       randomHex(8),
+		parentSpanID: parentSpanID,
+		start:        time.Now(),
+		attributes:   map[string]interface{}{},
+	}
+
+	t.lock.Lock()
+	t.spans = append(t.spans, span)
+	t.lock.Unlock()
+
+	return span
+}
+
+// Flush sends every ended span to the collector.
+func (t *Tracer) Flush() error {
+	if t == nil {
+		return nil
+	}
+
+	t.lock.Lock()
+	var spans []otlpSpan
+	for _, span := range t.spans {
+		if !span.end.IsZero() {
+			spans = append(spans, span.otlp(t.traceID))
+		}
+	}
+	t.spans = nil
+	t.lock.Unlock()
+
+	if len(spans) == 0 {
+		return nil
+	}
+
+	payload, err := json.Marshal(otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: []otlpAttribute{otlpAttributeFor("service.name", t.serviceName)},
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "github.com/concourse/pool-resource"},
+				Spans: spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest("POST", t.endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+	for name, value := range t.headers {
+		request.Header.Set(name, value)
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("exporting traces to %s failed: %s", t.endpoint, response.Status)
+	}
+
+	return nil
+}
+
+// Span is a single timed operation. A nil *Span is valid and records nothing.
+type Span struct {
+	tracer       *Tracer
+	name         string
+	spanID       string
+	parentSpanID string
+	start        time.Time
+	end          time.Time
+	attributes   map[string]interface{}
+	events       []spanEvent
+	err          error
+}
+
+type spanEvent struct {
+	name       string
+	time       time.Time
+	attributes map[string]interface{}
+}
+
+func (s *Span) StartChild(name string) *Span {
+	if s == nil {
+		return nil
+	}
+
+	return s.tracer.start(name, s.spanID)
+}
+
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+
+	s.tracer.lock.Lock()
+	s.attributes[key] = value
+	s.tracer.lock.Unlock()
+}
+
+func (s *Span) AddEvent(name string, attributes map[string]interface{}) {
+	if s == nil {
+		return
+	}
+
+	s.tracer.lock.Lock()
+	s.events = append(s.events, spanEvent{name: name, time: time.Now(), attributes: attributes})
+	s.tracer.lock.Unlock()
+}
+
+func (s *Span) End() {
+	s.EndWithError(nil)
+}
+
+// EndWithError ends the span, marking it as failed if err is not nil.
+func (s *Span) EndWithError(err error) {
+	if s == nil {
+		return
+	}
+
+	s.tracer.lock.Lock()
+	s.end = time.Now()
+	s.err = err
+	s.tracer.lock.Unlock()
+}
+
+func (s *Span) otlp(traceID string) otlpSpan {
+	span := otlpSpan{
+		TraceID:           traceID,
+		SpanID:            s.spanID,
+		ParentSpanID:      s.parentSpanID,
+		Name:              s.name,
+		Kind:              1,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Attributes:        otlpAttributes(s.attributes),
+	}
+
+	for _, event := range s.events {
+		span.Events = append(span.Events, otlpEvent{
+			TimeUnixNano: strconv.FormatInt(event.time.UnixNano(), 10),
+			Name:         event.name,
+			Attributes:   otlpAttributes(event.attributes),
+		})
+	}
+
+	if s.err != nil {
+		span.Status = &otlpStatus{Code: 2, Message: s.err.Error()}
+	}
+
+	return span
+}
+
+func randomHex(bytes int) string {
+	id := make([]byte, bytes)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Events            []otlpEvent     `json:"events,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string          `json:"timeUnixNano"`
+	Name         string          `json:"name"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+func otlpAttributes(attributes map[string]interface{}) []otlpAttribute {
+	var result []otlpAttribute
+	for key, value := range attributes {
+		result = append(result, otlpAttributeFor(key, value))
+	}
+
+	return result
+}
+
+func otlpAttributeFor(key string, value interface{}) otlpAttribute {
+	var converted otlpValue
+
+	switch v := value.(type) {
+	case int:
+		intValue := strconv.Itoa(v)
+		converted.IntValue = &intValue
+	case bool:
+		converted.BoolValue = &v
+	default:
+		stringValue := fmt.Sprint(v)
+		converted.StringValue = &stringValue
+	}
+
+	return otlpAttribute{Key: key, Value: converted}
+}
@@ -0,0 +1,163 @@
+package out_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+
+	"github.com/concourse/pool-resource/out"
+	fakes "github.com/concourse/pool-resource/out/fakes"
+)
+
+type exportedSpan struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+	Events       []struct {
+		Name string `json:"name"`
+	} `json:"events"`
+	Status *struct {
+		Code int `json:"code"`
+	} `json:"status"`
+}
+
+type exportRequest struct {
+	ResourceSpans []struct {
+		ScopeSpans []struct {
+			Spans []exportedSpan `json:"spans"`
+		} `json:"scopeSpans"`
+	} `json:"resourceSpans"`
+}
+
+var _ = Describe("Tracing", func() {
+	var server *httptest.Server
+	var exported chan exportRequest
+	var headers chan http.Header
+
+	BeforeEach(func() {
+		exported = make(chan exportRequest, 1)
+		headers = make(chan http.Header, 1)
+
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, err := ioutil.ReadAll(r.Body)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			var request exportRequest
+			err = json.Unmarshal(body, &request)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			headers <- r.Header
+			exported <- request
+		}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	spansIn := func(request exportRequest) map[string]exportedSpan {
+		spans := map[string]exportedSpan{}
+		for _, resourceSpans := range request.ResourceSpans {
+			for _, scopeSpans := range resourceSpans.ScopeSpans {
+				for _, span := range scopeSpans.Spans {
+					spans[span.Name] = span
+				}
+			}
+		}
+
+		return spans
+	}
+
+	It("is disabled without an endpoint", func() {
+		Ω(out.NewTracer(out.TracingConfig{})).Should(BeNil())
+
+		var tracer *out.Tracer
+		tracer.StartSpan("ignored").End()
+		Ω(tracer.Flush()).Should(Succeed())
+	})
+
+	It("exports the spans of an acquire, including conflicts", func() {
+		fakeLockHandler := new(fakes.FakeLockHandler)
+		fakeLockHandler.LeaseLockReturns("some-lock", "some-ref", nil)
+
+		conflicted := false
+		fakeLockHandler.BroadcastLockPoolStub = func() error {
+			if !conflicted {
+				conflicted = true
+				return out.ErrLockConflict
+			}
+
+			return nil
+		}
+
+		lockPool := out.LockPool{
+			Source: out.Source{
+				Pool:       "my-pool",
+				RetryDelay: time.Millisecond,
+			},
+			Output:      gbytes.NewBuffer(),
+			LockHandler: fakeLockHandler,
+			Tracer: out.NewTracer(out.TracingConfig{
+				Endpoint: server.URL,
+				Headers:  map[string]string{"X-Api-Key": "some-key"},
+			}),
+		}
+
+		_, _, err := lockPool.AcquireLock()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(lockPool.Tracer.Flush()).Should(Succeed())
+
+		Ω((<-headers).Get("X-Api-Key")).Should(Equal("some-key"))
+
+		spans := spansIn(<-exported)
+		Ω(spans).Should(HaveKey("pool.acquire"))
+		Ω(spans).Should(HaveKey("setup"))
+		Ω(spans).Should(HaveKey("claim"))
+		Ω(spans).Should(HaveKey("broadcast"))
+
+		acquire := spans["pool.acquire"]
+		Ω(acquire.Status).Should(BeNil())
+		Ω(acquire.Events).Should(HaveLen(1))
+		Ω(acquire.Events[0].Name).Should(Equal("conflict"))
+
+		Ω(spans["claim"].ParentSpanID).Should(Equal(acquire.SpanID))
+		Ω(spans["claim"].TraceID).Should(Equal(acquire.TraceID))
+	})
+
+	It("marks failed operations and joins a propagated trace", func() {
+		os.Setenv("TRACEPARENT", "00-0123456789abcdef0123456789abcdef-0123456789abcdef-01")
+		defer os.Unsetenv("TRACEPARENT")
+
+		tracer := out.NewTracer(out.TracingConfig{Endpoint: server.URL})
+
+		fakeLockHandler := new(fakes.FakeLockHandler)
+		fakeLockHandler.SetupReturns(out.ErrNoLocksAvailable)
+
+		lockPool := out.LockPool{
+			Source:      out.Source{Pool: "my-pool"},
+			Output:      gbytes.NewBuffer(),
+			LockHandler: fakeLockHandler,
+			Tracer:      tracer,
+		}
+
+		_, _, err := lockPool.AcquireLock()
+		Ω(err).Should(HaveOccurred())
+
+		Ω(tracer.Flush()).Should(Succeed())
+
+		acquire := spansIn(<-exported)["pool.acquire"]
+		Ω(acquire.TraceID).Should(Equal("0123456789abcdef0123456789abcdef"))
+		Ω(acquire.ParentSpanID).Should(Equal("0123456789abcdef"))
+		Ω(acquire.Status).ShouldNot(BeNil())
+		Ω(acquire.Status.Code).Should(Equal(2))
+	})
+})
@@ -0,0 +1,183 @@
+package out
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// UnknownFields checks JSON that is to be decoded into v for fields that v has
+// no place for, such as a misspelt source.brnch, which decoding would
+// otherwise silently ignore. It returns a message for each one, naming it by
+// its path from prefix and suggesting the known field it was probably meant
+// to be. Fields are matched the way encoding/json matches them, ignoring
+// case.
+func UnknownFields(prefix string, data []byte, v interface{}) []string {
+	var raw interface{}
+	if json.Unmarshal(data, &raw) != nil {
+		return nil
+	}
+
+	var problems []string
+	unknownFields(prefix, raw, reflect.TypeOf(v), &problems)
+
+	return problems
+}
+
+func unknownFields(path string, raw interface{}, t reflect.Type, problems *[]string) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		object, ok := raw.(map[string]interface{})
+		if !ok {
+			return
+		}
+
+		fields := jsonFields(t)
+
+		keys := make([]string, 0, len(object))
+		for key := range object {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			field, found := lookupField(fields, key)
+			if !found {
+				*problems = append(*problems, unknownField(path, key, fields))
+				continue
+			}
+
+			unknownFields(join(path, key), object[key], field.Type, problems)
+		}
+
+	case reflect.Slice, reflect.Array:
+		list, ok := raw.([]interface{})
+		if !ok {
+			return
+		}
+
+		for i, element := range list {
+			unknownFields(fmt.Sprintf("%s[%d]", path, i), element, t.Elem(), problems)
+		}
+	}
+}
+
+// jsonFields maps the JSON names of a struct's fields to the fields, including
+// those of embedded structs, as encoding/json names them.
+func jsonFields(t reflect.Type) map[string]reflect.StructField {
+	fields := map[string]reflect.StructField{}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+
+		name := strings.Split(tag, ",")[0]
+
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			for embeddedName, embedded := range jsonFields(field.Type) {
+				if _, shadowed := fields[embeddedName]; !shadowed {
+					fields[embeddedName] = embedded
+				}
+			}
+			continue
+		}
+
+		if field.PkgPath != "" {
+			continue
+		}
+
+		if name == "" {
+			name = field.Name
+		}
+
+		fields[name] = field
+	}
+
+	return fields
+}
+
+func lookupField(fields map[string]reflect.StructField, key string) (reflect.StructField, bool) {
+	if field, found := fields[key]; found {
+		return field, true
+	}
+
+	for name, field := range fields {
+		if strings.EqualFold(name, key) {
+			return field, true
+		}
+	}
+
+	return reflect.StructField{}, false
+}
+
+// unknownField describes an unknown field, suggesting the known field closest
+// to it if it is only a couple of typos away.
+func unknownField(parent string, key string, fields map[string]reflect.StructField) string {
+	closest := ""
+	closestDistance := 3
+
+	for name := range fields {
+		distance := editDistance(strings.ToLower(key), strings.ToLower(name))
+		if distance < closestDistance || (distance == closestDistance && name < closest) {
+			closest = name
+			closestDistance = distance
+		}
+	}
+
+	if closest == "" {
+		return fmt.Sprintf("%s is not a known field", join(parent, key))
+	}
+
+	return fmt.Sprintf("%s is not a known field (did you mean %s?)", join(parent, key), join(parent, closest))
+}
+
+func join(path string, key string) string {
+	if path == "" {
+		return key
+	}
+
+	return path + "." + key
+}
+
+// editDistance counts the single character insertions, deletions, and
+// substitutions that turn a into b.
+func editDistance(a string, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+
+			current[j] = previous[j-1] + cost
+			if previous[j]+1 < current[j] {
+				current[j] = previous[j] + 1
+			}
+			if current[j-1]+1 < current[j] {
+				current[j] = current[j-1] + 1
+			}
+		}
+
+		previous = current
+	}
+
+	return previous[len(b)]
+}
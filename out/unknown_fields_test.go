@@ -0,0 +1,47 @@
+package out_test
+
+import (
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/concourse/pool-resource/out"
+)
+
+var _ = Describe("Finding unknown fields", func() {
+	It("accepts every field of a request", func() {
+		payload, err := json.Marshal(out.OutRequest{
+			Source: out.Source{URI: "some-uri", Branch: "some-branch", Pool: "some-pool"},
+			Params: out.OutParams{Acquire: true},
+		})
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(out.UnknownFields("", payload, out.OutRequest{})).Should(BeEmpty())
+	})
+
+	It("names each unknown field by its path, suggesting the field it was meant to be", func() {
+		payload := []byte(`{
+			"source": {"uri": "some-uri", "brnch": "some-branch", "pool": "some-pool", "paths": {"claimd": "taken"}},
+			"params": {"acquire": true, "frobnicate": true}
+		}`)
+
+		Ω(out.UnknownFields("", payload, out.OutRequest{})).Should(Equal([]string{
+			"params.frobnicate is not a known field",
+			"source.brnch is not a known field (did you mean source.branch?)",
+			"source.paths.claimd is not a known field (did you mean source.paths.claimed?)",
+		}))
+	})
+
+	It("matches fields ignoring case, as decoding does", func() {
+		payload := []byte(`{"URI": "some-uri", "Branch": "some-branch", "pool": "some-pool"}`)
+
+		Ω(out.UnknownFields("source", payload, out.Source{})).Should(BeEmpty())
+	})
+
+	It("leaves fields that take more than one shape to decoding", func() {
+		payload := []byte(`{"submodules": ["some/path"], "tracing": {"headers": {"x-anything": "goes"}}}`)
+
+		Ω(out.UnknownFields("source", payload, out.Source{})).Should(BeEmpty())
+	})
+})
@@ -0,0 +1,360 @@
+package out
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Validate checks the source for mistakes that would otherwise surface as
+// confusing git failures, returning a message for each problem found.
+func (source Source) Validate() []string {
+	var problems []string
+
+	if source.URI == "" {
+		problems = append(problems, "source.uri is required")
+	}
+
+	if source.MirrorURI != "" && source.MirrorURI == source.URI {
+		problems = append(problems, "source.mirror_uri must differ from source.uri")
+	}
+
+	problems = append(problems, source.validatePort()...)
+	problems = append(problems, source.validateHostKeyChecking()...)
+	problems = append(problems, source.validateCACert()...)
+
+	if source.Branch == "" {
+		problems = append(problems, "source.branch is required")
+	} else if !validBranchName(source.Branch) {
+		problems = append(problems, fmt.Sprintf("source.branch %q is not a valid branch name", source.Branch))
+	}
+
+	if source.Pool == "" && len(source.Pools) == 0 {
+		problems = append(problems, "source.pool is required")
+	} else if filepath.IsAbs(source.Pool) || containsDotDot(source.Pool) {
+		problems = append(problems, fmt.Sprintf("source.pool %q must be a path within the repository", source.Pool))
+	}
+
+	for _, pool := range source.Pools {
+		if filepath.IsAbs(pool) || containsDotDot(pool) {
+			problems = append(problems, fmt.Sprintf("source.pools %q must be a path within the repository", pool))
+		}
+	}
+
+	if source.Vault.Address != "" && source.Vault.Path == "" {
+		problems = append(problems, "source.vault.path is required to read credentials from Vault")
+	} else if source.Vault.Address == "" && source.Vault.Path != "" {
+		problems = append(problems, "source.vault.address is required to read credentials from Vault")
+	}
+
+	if source.GitHubApp.Enabled() {
+		for _, field := range []struct{ name, value string }{
+			{"app_id", source.GitHubApp.AppID},
+			{"installation_id", source.GitHubApp.InstallationID},
+			{"private_key", source.GitHubApp.PrivateKey},
+		} {
+			if field.value == "" {
+				problems = append(problems, fmt.Sprintf("source.github_app.%s is required to authenticate as a GitHub App", field.name))
+			}
+		}
+	}
+
+	if source.RetryDelay < 0 {
+		problems = append(problems, "source.retry_delay must not be negative")
+	}
+
+	if source.ProtocolVersion < 0 || source.ProtocolVersion > 2 {
+		problems = append(problems, "source.protocol_version must be 1 or 2")
+	}
+
+	if source.HeartbeatInterval < 0 {
+		problems = append(problems, "source.heartbeat_interval must not be negative")
+	}
+
+	if source.OperationTimeout < 0 {
+		problems = append(problems, "source.operation_timeout must not be negative")
+	}
+
+	if source.CloneSince < 0 {
+		problems = append(problems, "source.clone_since must not be negative")
+	}
+
+	if source.MinRemoteInterval < 0 {
+		problems = append(problems, "source.min_remote_interval must not be negative")
+	}
+
+	if source.LeaseDuration < 0 {
+		problems = append(problems, "source.lease_duration must not be negative")
+	}
+
+	if source.CacheDir != "" {
+		if !filepath.IsAbs(source.CacheDir) {
+			problems = append(problems, fmt.Sprintf("source.cache_dir %q must be an absolute path", source.CacheDir))
+		}
+
+		if !source.Submodules.None() {
+			problems = append(problems, "source.cache_dir cannot be used with source.submodules")
+		}
+	}
+
+	if source.Bare {
+		if source.CacheDir != "" {
+			problems = append(problems, "source.bare cannot be used with source.cache_dir")
+		}
+
+		if !source.Submodules.None() {
+			problems = append(problems, "source.bare cannot be used with source.submodules")
+		}
+	}
+
+	if source.CommitMessageTemplate != "" {
+		_, err := ParseCommitMessageTemplate(source.CommitMessageTemplate)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("source.commit_message_template is not a valid template: %s", err))
+		}
+	}
+
+	if source.ClaimTags.SigningKey != "" && !source.ClaimTags.Enabled {
+		problems = append(problems, "source.claim_tags.signing_key only applies with source.claim_tags.enabled")
+	}
+
+	if source.RetryJitter < 0 || source.RetryJitter > 1 {
+		problems = append(problems, "source.retry_jitter must be between 0 and 1")
+	}
+
+	if source.CircuitBreaker < 0 {
+		problems = append(problems, "source.circuit_breaker must not be negative")
+	}
+
+	if source.NetworkRetries < 0 {
+		problems = append(problems, "source.network_retries must not be negative")
+	}
+
+	if source.RetryBackoffMax < 0 {
+		problems = append(problems, "source.retry_backoff_max must not be negative")
+	} else if source.RetryBackoffMax > 0 && source.RetryBackoffMax < source.RetryDelay {
+		problems = append(problems, "source.retry_backoff_max must not be less than source.retry_delay")
+	}
+
+	if _, err := source.LockFilePerm(); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	if source.Affinity != "" && source.Affinity != AffinityPipeline {
+		problems = append(problems, fmt.Sprintf("source.affinity %q must be %q", source.Affinity, AffinityPipeline))
+	}
+
+	switch source.SelectionStrategy {
+	case "", SelectionRandom, SelectionDeterministic, SelectionLeastRecentlyClaimed:
+	default:
+		problems = append(problems, fmt.Sprintf("source.selection_strategy %q must be %q, %q, or %q", source.SelectionStrategy, SelectionRandom, SelectionDeterministic, SelectionLeastRecentlyClaimed))
+	}
+
+	if source.MinUnclaimedWarning < 0 {
+		problems = append(problems, "source.min_unclaimed_warning must not be negative")
+	}
+
+	if source.ReserveMinimum < 0 {
+		problems = append(problems, "source.reserve_minimum must not be negative")
+	}
+
+	switch source.Encryption.Type {
+	case "":
+	case EncryptionAge, EncryptionGPG:
+		if len(source.Encryption.Recipients) == 0 {
+			problems = append(problems, "source.encryption.recipients is required to encrypt metadata")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("source.encryption.type %q must be %q or %q", source.Encryption.Type, EncryptionAge, EncryptionGPG))
+	}
+
+	for _, state := range source.States {
+		switch state {
+		case "unclaimed", "claimed", "maintenance", "broken":
+		default:
+			problems = append(problems, fmt.Sprintf("source.states may only contain unclaimed, claimed, maintenance, and broken, not %q", state))
+		}
+	}
+
+	if source.LockName != "" {
+		err := ValidateLockName(source.LockName)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("source.lock_name: %s", err))
+		}
+	}
+
+	stateDirs := map[string]string{}
+	for _, dir := range []struct{ field, name string }{
+		{"paths.unclaimed", source.Paths.Unclaimed},
+		{"paths.claimed", source.Paths.Claimed},
+		{"paths.maintenance", source.Paths.Maintenance},
+		{"paths.broken", source.Paths.Broken},
+		{"paths.reserved", source.Paths.Reserved},
+	} {
+		if dir.name == "" {
+			continue
+		}
+
+		if other, found := stateDirs[dir.name]; found {
+			problems = append(problems, fmt.Sprintf("source.%s and source.%s must differ", other, dir.field))
+		}
+
+		stateDirs[dir.name] = dir.field
+	}
+
+	return problems
+}
+
+// Validate checks the params for mistakes, returning a message for each
+// problem found.
+func (params OutParams) Validate() []string {
+	var problems []string
+
+	if params.Branch != "" && !validBranchName(params.Branch) {
+		problems = append(problems, fmt.Sprintf("params.branch %q is not a valid branch name", params.Branch))
+	}
+
+	if params.Pool != "" && (filepath.IsAbs(params.Pool) || containsDotDot(params.Pool)) {
+		problems = append(problems, fmt.Sprintf("params.pool %q must be a path within the repository", params.Pool))
+	}
+
+	if params.ReserveFor < 0 {
+		problems = append(problems, "params.reserve_for must not be negative")
+	}
+
+	if params.ReserveFor != 0 && !params.Reserve {
+		problems = append(problems, "params.reserve_for only applies with params.reserve")
+	}
+
+	if params.Reserve && params.Acquire {
+		problems = append(problems, "params.reserve and params.acquire cannot be used together")
+	}
+
+	if params.BypassReserveMinimum && !params.Acquire && !params.Reserve {
+		problems = append(problems, "params.bypass_reserve_minimum only applies with params.acquire or params.reserve")
+	}
+
+	if params.AllowMissing && params.Release == "" {
+		problems = append(problems, "params.allow_missing only applies with params.release")
+	}
+
+	if params.Rename != nil {
+		for _, name := range []struct{ field, lock string }{{"from", params.Rename.From}, {"to", params.Rename.To}} {
+			if name.lock == "" {
+				problems = append(problems, fmt.Sprintf("params.rename.%s must be given", name.field))
+				continue
+			}
+
+			err := ValidateLockName(name.lock)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("params.rename.%s: %s", name.field, err))
+			}
+		}
+	}
+
+	if params.PausePool && params.UnpausePool {
+		problems = append(problems, "params.pause_pool and params.unpause_pool cannot be used together")
+	}
+
+	if strings.HasPrefix(params.Revert, "-") || strings.ContainsAny(params.Revert, " \t\n") {
+		problems = append(problems, fmt.Sprintf("params.revert %q must name a commit", params.Revert))
+	}
+
+	if params.DestroyPool && params.ConfirmDestroy == "" {
+		problems = append(problems, "params.destroy_pool must be confirmed by naming the pool in params.confirm_destroy")
+	}
+
+	if params.ConfirmDestroy != "" && !params.DestroyPool {
+		problems = append(problems, "params.confirm_destroy only applies with params.destroy_pool")
+	}
+
+	// the builds that just changed the pool still need their versions, so
+	// the most recent day of history is always kept
+	if params.SquashOlderThanDays < 0 {
+		problems = append(problems, "params.squash_older_than_days must be at least 1")
+	}
+
+	if params.SquashOlderThanDays != 0 && !params.SquashHistory {
+		problems = append(problems, "params.squash_older_than_days only applies with params.squash_history")
+	}
+
+	if len(params.MetadataQuery) > 0 && !params.Acquire {
+		problems = append(problems, "params.metadata_query only applies with params.acquire")
+	}
+
+	if len(params.MetadataQuery) > 0 && len(params.ClaimAnyOf) > 0 {
+		problems = append(problems, "params.metadata_query and params.claim_any_of cannot be used together")
+	}
+
+	if len(params.ClaimAnyOf) > 0 && !params.Acquire {
+		problems = append(problems, "params.claim_any_of only applies with params.acquire")
+	}
+
+	for _, lock := range params.ClaimAnyOf {
+		err := ValidateLockName(lock)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("params.claim_any_of: %s", err))
+		}
+	}
+
+	if params.ReleaseMatching != "" {
+		_, err := path.Match(params.ReleaseMatching, "")
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("params.release_matching %q is not a valid pattern", params.ReleaseMatching))
+		}
+	}
+
+	if params.RemoveMatching != "" {
+		_, err := path.Match(params.RemoveMatching, "")
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("params.remove_matching %q is not a valid pattern", params.RemoveMatching))
+		}
+	}
+
+	for _, lock := range params.RemoveList {
+		err := ValidateLockName(lock)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("params.remove_list: %s", err))
+		}
+	}
+
+	if params.MetadataTemplate != "" {
+		if params.Add == "" {
+			problems = append(problems, "params.metadata_template only applies with params.add")
+		}
+
+		_, err := ParseMetadataTemplate(params.MetadataTemplate)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("params.metadata_template is not a valid template: %s", err))
+		}
+	}
+
+	if params.Overwrite && params.Add == "" {
+		problems = append(problems, "params.overwrite only applies with params.add")
+	}
+
+	return problems
+}
+
+func validBranchName(branch string) bool {
+	if strings.HasPrefix(branch, "-") || strings.HasPrefix(branch, "/") || strings.HasSuffix(branch, "/") {
+		return false
+	}
+
+	if strings.HasSuffix(branch, ".lock") || strings.Contains(branch, "..") || strings.Contains(branch, "@{") {
+		return false
+	}
+
+	return !strings.ContainsAny(branch, " \t~^:?*[\\")
+}
+
+func containsDotDot(path string) bool {
+	for _, part := range strings.Split(filepath.ToSlash(path), "/") {
+		if part == ".." {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,115 @@
+// Package pool drives a pool of locks kept in a git repository, with the same
+// semantics as the resource's out step: claims are pushed atomically, changes
+// that conflict with other builds are retried, and leases, reservations and
+// fencing tokens work the same way.
+//
+// It is the entry point meant for Go tools outside of this repository. Its
+// types are the out package's, under names that don't depend on how the
+// resource is laid out, so they change as the resource does: in particular,
+// LockHandler gains a method with most new operations, so a handler made
+// outside of this repository will need to keep up with it.
+//
+// A LockPool is made with New from a Source, as configured in a pipeline, and
+// each of its operations clones the pool afresh, makes its change, and pushes
+// it:
+//
+//	lockPool, err := pool.New(pool.Source{
+//		URI:    "git@github.com:example/locks.git",
+//		Branch: "main",
+//		Pool:   "aws",
+//	}, os.Stderr)
+//	if err != nil {
+//		return err
+//	}
+//
+//	lock, version, err := lockPool.AcquireLock()
+//
+// Operations that act on a lock the caller already holds, such as ReleaseLock
+// or RenewLease, take a directory holding a file called name with the lock's
+// name, as the resource's get and put steps leave behind.
+package pool
+
+import (
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/concourse/pool-resource/out"
+)
+
+type (
+	// LockPool performs operations on a pool, retrying them until they are
+	// pushed.
+	LockPool = out.LockPool
+
+	// LockHandler makes the changes a LockPool asks for to a copy of the pool,
+	// and pushes them.
+	LockHandler = out.LockHandler
+
+	// Source configures where a pool is kept and how it is operated on.
+	Source = out.Source
+
+	// Paths names the directories holding each state's locks within a pool.
+	Paths = out.Paths
+
+	// Version identifies a commit to the pool and the lock it changed.
+	Version = out.Version
+
+	// MetadataPair is an entry of the metadata an operation reports.
+	MetadataPair = out.MetadataPair
+
+	// PhaseTimings is how long an operation spent cloning, selecting,
+	// committing and pushing.
+	PhaseTimings = out.PhaseTimings
+)
+
+// Errors that operations may fail with, which callers can compare against.
+var (
+	ErrNoLocksAvailable = out.ErrNoLocksAvailable
+	ErrLockConflict     = out.ErrLockConflict
+	ErrPoolPaused       = out.ErrPoolPaused
+)
+
+// New makes a LockPool operating on the pool the source describes through
+// git, logging what it does to output. The source's defaults are filled in,
+// and it fails if the source is invalid.
+func New(source Source, output io.Writer) (*LockPool, error) {
+	source, err := validSource(source)
+	if err != nil {
+		return nil, err
+	}
+
+	lockPool := out.NewLockPool(source, output)
+
+	return &lockPool, nil
+}
+
+// NewWithHandler makes a LockPool operating on the pool through the given
+// handler, such as a fake for tests, rather than through git.
+func NewWithHandler(source Source, handler LockHandler, output io.Writer) (*LockPool, error) {
+	source, err := validSource(source)
+	if err != nil {
+		return nil, err
+	}
+
+	lockPool := out.NewLockPool(source, output)
+	lockPool.LockHandler = handler
+
+	return &lockPool, nil
+}
+
+// NewGitLockHandler makes the LockHandler that New operates on a pool with.
+func NewGitLockHandler(source Source) LockHandler {
+	return out.NewGitLockHandler(source.WithDefaults())
+}
+
+func validSource(source Source) (Source, error) {
+	source = source.WithDefaults()
+
+	problems := source.Validate()
+	if len(problems) > 0 {
+		return source, errors.New("invalid source: " + strings.Join(problems, "; "))
+	}
+
+	return source, nil
+}
@@ -0,0 +1,59 @@
+package pool_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+
+	"github.com/concourse/pool-resource/out/poolfakes"
+	"github.com/concourse/pool-resource/pool"
+)
+
+var _ = Describe("Pool", func() {
+	var source pool.Source
+
+	BeforeEach(func() {
+		source = pool.Source{
+			URI:        "some-uri",
+			Branch:     "main",
+			Pool:       "some-pool",
+			RetryDelay: time.Millisecond,
+		}
+	})
+
+	It("fills in the source's defaults", func() {
+		source.RetryDelay = 0
+
+		lockPool, err := pool.New(source, gbytes.NewBuffer())
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(lockPool.Source.RetryDelay).Should(Equal(10 * time.Second))
+		Ω(lockPool.Source.Paths.Unclaimed).Should(Equal("unclaimed"))
+	})
+
+	It("rejects an invalid source", func() {
+		source.URI = ""
+		source.CircuitBreaker = -1
+
+		_, err := pool.New(source, gbytes.NewBuffer())
+		Ω(err).Should(MatchError("invalid source: source.uri is required; source.circuit_breaker must not be negative"))
+	})
+
+	It("operates on the pool through the handler given", func() {
+		locks := poolfakes.NewPool()
+		locks.Put("unclaimed", "some-lock", nil)
+
+		output := gbytes.NewBuffer()
+		lockPool, err := pool.NewWithHandler(source, poolfakes.NewMemoryLockHandler(locks, source), output)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		lock, version, err := lockPool.AcquireLock()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(lock).Should(Equal("some-lock"))
+		Ω(version).Should(Equal(pool.Version{Ref: locks.Head(), Lock: "some-lock"}))
+		Ω(locks.Locks("claimed")).Should(Equal([]string{"some-lock"}))
+		Ω(output).Should(gbytes.Say("acquired lock: some-lock"))
+	})
+})
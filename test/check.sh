@@ -9,7 +9,7 @@ it_can_check_from_head() {
   local ref=$(make_commit_to_file $repo my_pool/unclaimed/file-a)
 
   check_uri $repo | jq -e "
-    . == [{ref: $(echo $ref | jq -R .)}]
+    . == [{ref: $(echo $ref | jq -R .), lock: \"file-a\"}]
   "
 }
 
@@ -21,8 +21,8 @@ it_can_check_from_a_ref() {
 
   check_uri_from $repo $ref1 | jq -e "
     . == [
-      {ref: $(echo $ref2 | jq -R .)},
-      {ref: $(echo $ref3 | jq -R .)}
+      {ref: $(echo $ref2 | jq -R .), lock: \"file-b\"},
+      {ref: $(echo $ref3 | jq -R .), lock: \"file-c\"}
     ]
   "
 }
@@ -33,7 +33,7 @@ it_can_check_from_a_bogus_sha() {
   local ref2=$(make_commit_to_file $repo my_pool/unclaimed/file-b)
 
   check_uri_from $repo "bogus-ref" | jq -e "
-    . == [{ref: $(echo $ref2 | jq -R .)}]
+    . == [{ref: $(echo $ref2 | jq -R .), lock: \"file-b\"}]
   "
 }
 
@@ -44,24 +44,24 @@ it_checks_given_pool() {
   local ref3=$(make_commit_to_file $repo my_pool/unclaimed/file-c)
 
   check_uri_paths $repo "my_other_pool" | jq -e "
-    . == [{ref: $(echo $ref2 | jq -R .)}]
+    . == [{ref: $(echo $ref2 | jq -R .), lock: \"file-b\"}]
   "
 
   check_uri_paths $repo "my_pool" | jq -e "
-    . == [{ref: $(echo $ref3 | jq -R .)}]
+    . == [{ref: $(echo $ref3 | jq -R .), lock: \"file-c\"}]
   "
 
   local ref4=$(make_commit_to_file $repo my_other_pool/unclaimed/file-d)
 
   check_uri_from_paths $repo $ref1 "my_pool" | jq -e "
-    . == [{ref: $(echo $ref3 | jq -R .)}]
+    . == [{ref: $(echo $ref3 | jq -R .), lock: \"file-c\"}]
   "
 
   local ref5=$(make_commit_to_file $repo my_pool/claimed/file-e)
 
   check_uri_from_paths $repo $ref1 "my_pool" | jq -e "
     . == [
-      {ref: $(echo $ref3 | jq -R .)}
+      {ref: $(echo $ref3 | jq -R .), lock: \"file-c\"}
     ]
   "
 }
@@ -123,10 +123,364 @@ it_can_check_when_not_ff() {
   git branch -u origin/master HEAD
 
   check_uri $other_repo | jq -e "
-    . == [{ref: $(echo $ref2 | jq -R .)}]
+    . == [{ref: $(echo $ref2 | jq -R .), lock: \"file-a\"}]
   "
 }
 
+it_checks_custom_unclaimed_dir() {
+  local repo=$(init_repo)
+  mkdir $repo/my_pool/available
+
+  local ref1=$(make_commit_to_file $repo my_pool/available/file-a)
+  local ref2=$(make_commit_to_file $repo my_pool/unclaimed/file-b)
+
+  check_uri_with_unclaimed_dir $repo "available" | jq -e "
+    . == [{ref: $(echo $ref1 | jq -R .), lock: \"file-a\"}]
+  "
+}
+
+it_can_check_with_credentials() {
+  local repo=$(init_repo)
+  local ref=$(make_commit_to_file $repo my_pool/unclaimed/file-a)
+
+  local askpass=$TMPDIR/askpass
+  printf '#!/bin/sh\necho secret\n' > $askpass
+  chmod +x $askpass
+
+  check_uri_with_credentials $repo "cache --timeout=60" $askpass | jq -e "
+    . == [{ref: $(echo $ref | jq -R .), lock: \"file-a\"}]
+  "
+}
+
+it_rejects_an_askpass_that_is_not_executable() {
+  local repo=$(init_repo)
+
+  if check_uri_with_credentials $repo "" $TMPDIR/missing-askpass; then
+    echo "expected check to fail"
+    exit 1
+  fi
+}
+
+it_checks_locks_becoming_claimed() {
+  local repo=$(init_repo)
+  local ref1=$(make_commit_to_file $repo my_pool/claimed/file-a)
+  local ref2=$(make_commit_to_file $repo my_pool/unclaimed/file-b)
+  local ref3=$(make_commit_to_file $repo my_pool/claimed/file-a)
+  local ref4=$(make_commit_to_file $repo my_pool/claimed/file-c)
+
+  check_uri_from_with_states $repo "" '["claimed"]' | jq -e "
+    . == [{ref: $(echo $ref4 | jq -R .), lock: \"file-c\"}]
+  "
+
+  check_uri_from_with_states $repo $ref1 '["claimed"]' | jq -e "
+    . == [{ref: $(echo $ref4 | jq -R .), lock: \"file-c\"}]
+  "
+}
+
+it_rejects_unknown_states() {
+  local repo=$(init_repo)
+
+  if check_uri_from_with_states $repo "" '["taken"]'; then
+    echo "expected check to fail"
+    exit 1
+  fi
+}
+
+it_checks_the_changes_of_one_lock() {
+  local repo=$(init_repo)
+  local ref1=$(make_commit_to_file $repo my_pool/unclaimed/file-a)
+  local ref2=$(make_commit_to_file $repo my_pool/unclaimed/file-b)
+  local ref3=$(make_commit_to_file $repo my_pool/claimed/file-a)
+  local ref4=$(make_commit_to_file $repo my_pool/unclaimed/file-b)
+
+  check_uri_from_with_lock_name $repo "" file-a | jq -e "
+    . == [{ref: $(echo $ref3 | jq -R .), lock: \"file-a\"}]
+  "
+
+  check_uri_from_with_lock_name $repo $ref1 file-a | jq -e "
+    . == [{ref: $(echo $ref3 | jq -R .), lock: \"file-a\"}]
+  "
+
+  # only when it moves into one of the states
+  check_uri_from_with_lock_name $repo "" file-a '["unclaimed"]' | jq -e "
+    . == [{ref: $(echo $ref1 | jq -R .), lock: \"file-a\"}]
+  "
+}
+
+it_rejects_an_invalid_lock_name() {
+  local repo=$(init_repo)
+
+  if check_uri_from_with_lock_name $repo "" ../file-a; then
+    echo "expected check to fail"
+    exit 1
+  fi
+}
+
+it_checks_several_pools() {
+  local repo=$(init_repo)
+  mkdir -p $repo/pool-a/unclaimed $repo/pool-b/unclaimed $repo/pool-c/unclaimed $repo/nested/pool-d/unclaimed
+  local ref1=$(make_commit_to_file $repo pool-a/unclaimed/file-a)
+  local ref2=$(make_commit_to_file $repo pool-b/unclaimed/file-b)
+  local ref3=$(make_commit_to_file $repo pool-c/unclaimed/file-c)
+  local ref4=$(make_commit_to_file $repo nested/pool-d/unclaimed/file-d)
+
+  check_uri_from_pools $repo $ref1 '["pool-a", "pool-b", "nested/pool-d"]' | jq -e "
+    . == [
+      {ref: $(echo $ref2 | jq -R .), lock: \"file-b\", pool: \"pool-b\"},
+      {ref: $(echo $ref4 | jq -R .), lock: \"file-d\", pool: \"nested/pool-d\"}
+    ]
+  "
+
+  if check_uri_from_pools $repo "" '["pool-a", "pool-e"]'; then
+    echo "expected check to fail for a missing pool"
+    exit 1
+  fi
+}
+
+it_can_check_with_either_protocol_version() {
+  local repo=$(init_repo)
+  local ref=$(make_commit_to_file $repo my_pool/unclaimed/file-a)
+
+  for version in 1 2; do
+    check_uri_with_protocol_version $repo $version | jq -e "
+      . == [{ref: $(echo $ref | jq -R .), lock: \"file-a\"}]
+    "
+  done
+}
+
+it_rejects_an_unknown_protocol_version() {
+  local repo=$(init_repo)
+
+  if check_uri_with_protocol_version $repo 3; then
+    echo "expected check to fail"
+    exit 1
+  fi
+}
+
+it_can_check_a_read_only_mirror() {
+  local repo=$(init_repo)
+  local ref=$(make_commit_to_file $repo my_pool/unclaimed/file-a)
+
+  local mirror=$(mktemp -d $TMPDIR/mirror.XXXXXX)
+  git clone -q --mirror $repo $mirror
+
+  check_uri_with_check_uri $TMPDIR/no-such-repo $mirror | jq -e "
+    . == [{ref: $(echo $ref | jq -R .), lock: \"file-a\"}]
+  "
+}
+
+it_can_check_with_vault_credentials() {
+  local repo=$(init_repo)
+  local ref=$(make_commit_to_file $repo my_pool/unclaimed/file-a)
+
+  fake_vault '{"data": {"data": {"username": "ci", "password": "secret"}, "metadata": {"version": 1}}}'
+
+  VAULT_TOKEN=vault-token check_uri_with_vault $repo http://vault.example.com secret/data/locks | jq -e "
+    . == [{ref: $(echo $ref | jq -R .), lock: \"file-a\"}]
+  "
+
+  grep -q 'X-Vault-Token: vault-token' $TMPDIR/wget.log
+  grep -q 'http://vault.example.com/v1/secret/data/locks' $TMPDIR/wget.log
+}
+
+it_gives_https_credentials_only_to_the_pools_host() {
+  (
+    source ${resource_dir}/common.sh
+
+    jq -n '{source: {uri: "https://git.example.com/org/pool.git"}}' > $TMPDIR/payload.json
+    use_https_credentials $TMPDIR/payload.json $TMPDIR/credentials ci secret
+
+    echo url=https://git.example.com/org/other.git | git credential fill | grep -q '^password=secret$'
+
+    if git config --get-urlmatch credential.helper https://mirror.example.com/org/pool.git; then
+      echo "expected no credentials for another host"
+      exit 1
+    fi
+  )
+}
+
+it_fails_when_vault_has_no_credentials() {
+  local repo=$(init_repo)
+
+  fake_vault ''
+
+  if VAULT_TOKEN=vault-token check_uri_with_vault $repo http://vault.example.com secret/data/missing; then
+    echo "expected check to fail"
+    exit 1
+  fi
+}
+
+it_explains_a_missing_repository() {
+  local output
+
+  if output=$(check_uri $TMPDIR/missing-repo 2>&1); then
+    echo "expected check to fail"
+    exit 1
+  fi
+
+  echo "$output" | grep -q "error: repository $TMPDIR/missing-repo does not exist"
+}
+
+it_explains_a_missing_branch() {
+  local repo=$(init_repo)
+  local output
+
+  if output=$(check_uri_on_branch $repo missing-branch 2>&1); then
+    echo "expected check to fail"
+    exit 1
+  fi
+
+  echo "$output" | grep -q "error: branch missing-branch does not exist in $repo"
+}
+
+it_explains_a_missing_pool() {
+  local repo=$(init_repo)
+  local output
+
+  if output=$(check_uri_paths $repo missing_pool 2>&1); then
+    echo "expected check to fail"
+    exit 1
+  fi
+
+  echo "$output" | grep -q "error: pool missing_pool does not exist on branch master"
+}
+
+it_can_check_concurrently_from_a_shared_cache() {
+  local repo=$(init_repo)
+  local ref=$(make_commit_to_file $repo my_pool/unclaimed/file-a)
+
+  local pids=""
+  for i in 1 2 3 4; do
+    check_uri $repo > $TMPDIR/check-$i.json 2>/dev/null &
+    pids="$pids $!"
+  done
+
+  for pid in $pids; do
+    wait $pid
+  done
+
+  for i in 1 2 3 4; do
+    jq -e "
+      . == [{ref: $(echo $ref | jq -R .), lock: \"file-a\"}]
+    " < $TMPDIR/check-$i.json
+  done
+}
+
+it_can_check_on_an_ssh_port() {
+  local repo=$(init_repo)
+  local ref=$(make_commit_to_file $repo my_pool/unclaimed/file-a)
+
+  # stands in for ssh, noting how it was run and running the command meant
+  # for the remote locally
+  cat > $TMPDIR/ssh <<EOF
+#!/bin/sh
+echo "\$@" >> $TMPDIR/ssh.log
+for command; do :; done
+exec sh -c "\$command"
+EOF
+  chmod +x $TMPDIR/ssh
+
+  jq -n "{
+    source: {
+      uri: $(echo "localhost:$repo" | jq -R .),
+      branch: \"master\",
+      pool: \"my_pool\",
+      port: 7999
+    }
+  }" | GIT_SSH_COMMAND=$TMPDIR/ssh ${resource_dir}/check | jq -e "
+    . == [{ref: $(echo $ref | jq -R .), lock: \"file-a\"}]
+  "
+
+  ! grep -v '^-p 7999 ' $TMPDIR/ssh.log
+}
+
+it_pins_the_known_hosts_given() {
+  local repo=$(init_repo)
+  local ref=$(make_commit_to_file $repo my_pool/unclaimed/file-a)
+  local key="localhost ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl"
+
+  # stands in for ssh, noting how it was run and the known hosts it was
+  # given, and running the command meant for the remote locally
+  cat > $TMPDIR/ssh <<EOF
+#!/bin/sh
+echo "\$@" >> $TMPDIR/ssh.log
+for arg; do
+  case "\$arg" in
+    UserKnownHostsFile=*) cat "\${arg#UserKnownHostsFile=}" >> $TMPDIR/known_hosts.log ;;
+  esac
+done
+for command; do :; done
+exec sh -c "\$command"
+EOF
+  chmod +x $TMPDIR/ssh
+
+  jq -n "{
+    source: {
+      uri: $(echo "localhost:$repo" | jq -R .),
+      branch: \"master\",
+      pool: \"my_pool\",
+      known_hosts: $(echo "$key" | jq -R .)
+    }
+  }" | GIT_SSH_COMMAND=$TMPDIR/ssh ${resource_dir}/check | jq -e "
+    . == [{ref: $(echo $ref | jq -R .), lock: \"file-a\"}]
+  "
+
+  ! grep -v -- '-o StrictHostKeyChecking=yes -o LogLevel=ERROR ' $TMPDIR/ssh.log
+  grep -qx "$key" $TMPDIR/known_hosts.log
+}
+
+it_can_check_with_clone_since() {
+  local old=2020-01-01T00:00:00Z
+  local repo=$(GIT_COMMITTER_DATE=$old init_repo)
+  local ref1=$(GIT_COMMITTER_DATE=$old make_commit_to_file $repo my_pool/unclaimed/file-a)
+
+  # shallow clones are only made over a transport, not from a local path
+  local request="{
+    source: {
+      uri: $(echo "file://$repo" | jq -R .),
+      branch: \"master\",
+      pool: \"my_pool\",
+      clone_since: \"720h\"
+    }
+  }"
+
+  # nothing has changed since, so just the last commits are cloned
+  jq -n "$request" | ${resource_dir}/check | jq -e "
+    . == [{ref: $(echo $ref1 | jq -R .), lock: \"file-a\"}]
+  "
+
+  local ref2=$(make_commit_to_file $repo my_pool/unclaimed/file-b)
+
+  jq -n "$request + {version: {ref: $(echo $ref1 | jq -R .)}}" | ${resource_dir}/check | jq -e "
+    . == [{ref: $(echo $ref2 | jq -R .), lock: \"file-b\"}]
+  "
+
+  test "$(git -C $TMPDIR/git-resource-repo-cache rev-list --count HEAD)" = 2
+}
+
+it_can_check_with_content_digest() {
+  local repo=$(init_repo)
+  local ref1=$(make_commit_to_file $repo my_pool/unclaimed/file-a)
+
+  # a fencing token is named after its lock, but isn't the lock
+  mkdir -p $repo/my_pool/.fencing
+  echo 1 > $repo/my_pool/.fencing/file-a
+  local ref2=$(make_commit_to_file $repo my_pool/unclaimed/file-a)
+
+  local digest="sha256:$(printf 'x\nx\n' | sha256sum | cut -d' ' -f1)"
+
+  jq -n "{
+    source: {
+      uri: $(echo $repo | jq -R .),
+      branch: \"master\",
+      pool: \"my_pool\",
+      content_digest: true
+    },
+    version: {ref: $(echo $ref1 | jq -R .)}
+  }" | ${resource_dir}/check | jq -e "
+    . == [{ref: $(echo $ref2 | jq -R .), lock: \"file-a\", digest: $(echo $digest | jq -R .)}]
+  "
+}
 
 run it_can_check_from_head
 run it_can_check_from_a_ref
@@ -134,3 +488,25 @@ run it_can_check_from_a_bogus_sha
 run it_checks_given_pool
 run it_can_check_when_not_ff
 run it_checks_given_pool_only_claimed
+run it_checks_custom_unclaimed_dir
+run it_can_check_with_credentials
+run it_rejects_an_askpass_that_is_not_executable
+run it_checks_locks_becoming_claimed
+run it_rejects_unknown_states
+run it_checks_the_changes_of_one_lock
+run it_rejects_an_invalid_lock_name
+run it_checks_several_pools
+run it_can_check_with_either_protocol_version
+run it_rejects_an_unknown_protocol_version
+run it_can_check_a_read_only_mirror
+run it_can_check_with_vault_credentials
+run it_gives_https_credentials_only_to_the_pools_host
+run it_fails_when_vault_has_no_credentials
+run it_explains_a_missing_repository
+run it_explains_a_missing_branch
+run it_explains_a_missing_pool
+run it_can_check_concurrently_from_a_shared_cache
+run it_can_check_on_an_ssh_port
+run it_pins_the_known_hosts_given
+run it_can_check_with_clone_since
+run it_can_check_with_content_digest
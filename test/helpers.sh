@@ -132,6 +132,16 @@ check_uri_paths() {
   }" | ${resource_dir}/check | tee /dev/stderr
 }
 
+check_uri_on_branch() {
+  jq -n "{
+    source: {
+      uri: $(echo $1 | jq -R .),
+      branch: $(echo $2 | jq -R .),
+      pool: \"my_pool\"
+    }
+  }" | ${resource_dir}/check | tee /dev/stderr
+}
+
 check_uri_from() {
   jq -n "{
     source: {
@@ -162,3 +172,152 @@ check_uri_from_paths() {
     }
   }" | ${resource_dir}/check | tee /dev/stderr
 }
+
+check_uri_with_unclaimed_dir() {
+  local uri=$1
+  local unclaimed_dir=$2
+
+  jq -n "{
+    source: {
+      uri: $(echo $uri | jq -R .),
+      branch: \"master\",
+      pool: \"my_pool\",
+      paths: {
+        unclaimed: $(echo $unclaimed_dir | jq -R .)
+      }
+    }
+  }" | ${resource_dir}/check | tee /dev/stderr
+}
+
+check_uri_with_protocol_version() {
+  local uri=$1
+  local protocol_version=$2
+
+  jq -n "{
+    source: {
+      uri: $(echo $uri | jq -R .),
+      branch: \"master\",
+      pool: \"my_pool\",
+      protocol_version: $protocol_version
+    }
+  }" | ${resource_dir}/check | tee /dev/stderr
+}
+
+check_uri_with_check_uri() {
+  local uri=$1
+  local check_uri=$2
+
+  jq -n "{
+    source: {
+      uri: $(echo $uri | jq -R .),
+      check_uri: $(echo $check_uri | jq -R .),
+      branch: \"master\",
+      pool: \"my_pool\"
+    }
+  }" | ${resource_dir}/check | tee /dev/stderr
+}
+
+check_uri_with_credentials() {
+  local uri=$1
+  local credential_helper=$2
+  local askpass=$3
+
+  jq -n "{
+    source: {
+      uri: $(echo $uri | jq -R .),
+      branch: \"master\",
+      pool: \"my_pool\",
+      credential_helper: $(echo $credential_helper | jq -R .),
+      askpass: $(echo $askpass | jq -R .)
+    }
+  }" | ${resource_dir}/check | tee /dev/stderr
+}
+
+check_uri_with_vault() {
+  local uri=$1
+  local address=$2
+  local path=$3
+
+  jq -n "{
+    source: {
+      uri: $(echo $uri | jq -R .),
+      branch: \"master\",
+      pool: \"my_pool\",
+      vault: {
+        address: $(echo $address | jq -R .),
+        path: $(echo $path | jq -R .)
+      }
+    }
+  }" | ${resource_dir}/check | tee /dev/stderr
+}
+
+# puts a wget on the PATH that logs its arguments and answers every request
+# with the given response
+fake_vault() {
+  local response=$1
+
+  mkdir -p $TMPDIR/bin
+  cat > $TMPDIR/bin/wget <<EOF
+#!/bin/sh
+echo "\$@" >> $TMPDIR/wget.log
+echo '$response'
+EOF
+  chmod +x $TMPDIR/bin/wget
+
+  export PATH=$TMPDIR/bin:$PATH
+}
+
+check_uri_from_with_states() {
+  local uri=$1
+  local ref=$2
+  local states=$3
+
+  jq -n "{
+    source: {
+      uri: $(echo $uri | jq -R .),
+      branch: \"master\",
+      pool: \"my_pool\",
+      states: $states
+    },
+    version: {
+      ref: $(echo $ref | jq -R .)
+    }
+  }" | ${resource_dir}/check | tee /dev/stderr
+}
+
+check_uri_from_pools() {
+  local uri=$1
+  local ref=$2
+  local pools=$3
+
+  jq -n "{
+    source: {
+      uri: $(echo $uri | jq -R .),
+      branch: \"master\",
+      pools: $pools
+    },
+    version: {
+      ref: $(echo $ref | jq -R .)
+    }
+  }" | ${resource_dir}/check | tee /dev/stderr
+}
+
+check_uri_from_with_lock_name() {
+  local uri=$1
+  local ref=$2
+  local lock_name=$3
+  local states=${4:-null}
+
+  jq -n "{
+    source: {
+      uri: $(echo $uri | jq -R .),
+      branch: \"master\",
+      pool: \"my_pool\",
+      lock_name: $(echo $lock_name | jq -R .),
+      states: $states
+    },
+    version: {
+      ref: $(echo $ref | jq -R .)
+    }
+  }" | ${resource_dir}/check | tee /dev/stderr
+}